@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// aliasArg matches a positional argument in an alias, $1 to $9
+var aliasArg = regexp.MustCompile(`\$([1-9])`)
+
+// checkAlias reports why name can't be an alias for target among aliases,
+// or nil if it can: built-in commands can't be redefined, and following
+// target through the other aliases mustn't lead back to name
+func checkAlias(aliases map[string]string, name string, target string) error {
+	if _, ok := findCommand(name); ok {
+		return fmt.Errorf("/%s is a built-in command", name)
+	}
+	next, _, ok := parseCommand(target)
+	if !ok {
+		return fmt.Errorf("an alias has to stand for a /command")
+	}
+	for seen := 0; seen <= len(aliases); seen++ {
+		if next == name {
+			return fmt.Errorf("/%s would end up running itself", name)
+		}
+		target, ok := aliases[next]
+		if !ok {
+			return nil
+		}
+		next, _, _ = parseCommand(target)
+	}
+	return fmt.Errorf("/%s would end up running itself", name)
+}
+
+// loadAliases checks the config's aliases, leaving out any that redefine a
+// built-in or loop; /alias list only shows the rest
+func loadAliases(configured map[string]string) map[string]string {
+	names := make([]string, 0, len(configured))
+	for name := range configured {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	aliases := make(map[string]string, len(configured))
+	for _, name := range names {
+		name, target := strings.ToLower(name), configured[name]
+		if checkAlias(aliases, name, target) == nil {
+			aliases[name] = target
+		}
+	}
+	return aliases
+}
+
+// expandAlias turns an alias and its arguments into the command it stands
+// for. $1 to $9 are the arguments, the last one used taking the rest of the
+// line; an alias without any gets the arguments after it.
+func expandAlias(target string, args string) string {
+	fields := strings.Fields(args)
+	last := 0
+	for _, match := range aliasArg.FindAllStringSubmatch(target, -1) {
+		n, _ := strconv.Atoi(match[1])
+		last = max(last, n)
+	}
+	if last == 0 {
+		return strings.TrimSpace(target + " " + args)
+	}
+	return aliasArg.ReplaceAllStringFunc(target, func(arg string) string {
+		n, _ := strconv.Atoi(arg[1:])
+		switch {
+		case n > len(fields):
+			return ""
+		case n == last:
+			return strings.Join(fields[n-1:], " ")
+		}
+		return fields[n-1]
+	})
+}
+
+// resolveAlias follows name through the aliases to the built-in command
+// it runs, and the arguments it gets
+func (m mainModel) resolveAlias(name string, args string) (string, string) {
+	for range len(m.aliases) {
+		target, ok := m.aliases[name]
+		if !ok {
+			break
+		}
+		name, args, _ = parseCommand(expandAlias(target, args))
+	}
+	return name, args
+}
+
+func aliasCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	action, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	name, target, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	name = strings.ToLower(strings.TrimPrefix(name, "/"))
+	target = strings.TrimSpace(target)
+	switch {
+	case action == "list":
+		m.listAliases()
+	case action == "add" && name != "" && target != "":
+		m.addAlias(name, target)
+	case action == "remove" && name != "":
+		m.removeAlias(name)
+	case action == "save":
+		m.saveAliases()
+	default:
+		m.addSystemMessage("Usage: /alias add <name> <command> | list | remove <name> | save")
+	}
+	return m, nil
+}
+
+func (m *mainModel) listAliases() {
+	if len(m.aliases) == 0 {
+		m.addSystemMessage("No aliases - /alias add <name> <command> to make one")
+		return
+	}
+	names := make([]string, 0, len(m.aliases))
+	width := 0
+	for name := range m.aliases {
+		names = append(names, name)
+		width = max(width, len(name)+1)
+	}
+	sort.Strings(names)
+
+	lines := []string{"Aliases:"}
+	for _, name := range names {
+		line := fmt.Sprintf("    %-*s  %s", width, "/"+name, m.aliases[name])
+		if m.config.Aliases[name] != m.aliases[name] {
+			line += " (until you quit - /alias save keeps it)"
+		}
+		lines = append(lines, line)
+	}
+	m.addSystemMessage(strings.Join(lines, "\n"))
+}
+
+// addAlias makes an alias for this session; /alias save keeps it
+func (m *mainModel) addAlias(name string, target string) {
+	if !strings.HasPrefix(target, "/") {
+		target = "/" + target
+	}
+	others := make(map[string]string, len(m.aliases))
+	for other, t := range m.aliases {
+		if other != name {
+			others[other] = t
+		}
+	}
+	if err := checkAlias(others, name, target); err != nil {
+		m.addOutcomeMessage(fmt.Sprintf("Can't make /%s an alias: %v", name, err), outcomeError)
+		return
+	}
+	m.aliases[name] = target
+	m.addOutcomeMessage(fmt.Sprintf("/%s now runs %s", name, target), outcomeSuccess)
+}
+
+func (m *mainModel) removeAlias(name string) {
+	if _, ok := m.aliases[name]; !ok {
+		m.addSystemMessage("No alias /" + name + " - /alias list shows them")
+		return
+	}
+	delete(m.aliases, name)
+	m.addOutcomeMessage("Removed /"+name+" - /alias save to forget it for good", outcomeSuccess)
+}
+
+// saveAliases writes the aliases as they are now to the config
+func (m *mainModel) saveAliases() {
+	if err := writeAliases(configPath(), m.aliases); err != nil {
+		m.addOutcomeMessage("Couldn't save the aliases: "+err.Error(), outcomeError)
+		return
+	}
+	m.config.Aliases = make(map[string]string, len(m.aliases))
+	for name, target := range m.aliases {
+		m.config.Aliases[name] = target
+	}
+	m.addOutcomeMessage(fmt.Sprintf("Saved %d aliases to %s", len(m.aliases), configPath()), outcomeSuccess)
+}
+
+// writeAliases replaces the config file's [aliases] table, or adds one at
+// the end, leaving the rest of the file and its comments as they are
+func writeAliases(path string, aliases map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+
+	start, end := -1, len(lines)
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if start == -1 {
+			if line == "[aliases]" {
+				start = i
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			end = i
+			break
+		}
+	}
+	if start != -1 {
+		// Comments just above the next table are about that one
+		for end > start+1 && (strings.TrimSpace(lines[end-1]) == "" || strings.HasPrefix(strings.TrimSpace(lines[end-1]), "#")) {
+			end--
+		}
+		lines = append(lines[:start], lines[end:]...)
+	}
+	text := strings.TrimRight(strings.Join(lines, "\n"), "\n") + "\n"
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil || len(aliases) == 0 {
+		return err
+	}
+	return appendConfig(path, struct {
+		Aliases map[string]string `toml:"aliases"`
+	}{aliases})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Animation speeds, for animation_speed in the config and /animation
+const (
+	animationNormal = "normal"
+	animationFast   = "fast"
+	animationSlow   = "slow"
+	animationNone   = "none" // Nothing moves, for reduced motion
+)
+
+// animationIntervals is how often each speed moves the animations on
+var animationIntervals = map[string]time.Duration{
+	animationNormal: 150 * time.Millisecond,
+	animationFast:   75 * time.Millisecond,
+	animationSlow:   300 * time.Millisecond,
+}
+
+// stillInterval is how often the animation tick still comes with
+// animations off, for what else it does, like expiring typing notices,
+// paging in history and ending border flashes
+const stillInterval = 500 * time.Millisecond
+
+// Shown in place of animations when they're off
+const (
+	stillSpinner = "…"
+	stillPulse   = "●"
+	stillConnect = "[====]"
+)
+
+func validAnimationSpeed(speed string) error {
+	switch speed {
+	case "", animationNormal, animationFast, animationSlow, animationNone:
+		return nil
+	}
+	return fmt.Errorf("unknown animation speed %q, want normal, fast, slow or none", speed)
+}
+
+// reduceMotion reports whether REDUCE_MOTION=1 in the environment asks for
+// animations off, whatever the config says
+func reduceMotion() bool {
+	return os.Getenv("REDUCE_MOTION") == "1"
+}
+
+// animated reports whether animations are on
+func (m mainModel) animated() bool {
+	return m.config.AnimationSpeed != animationNone
+}
+
+// animTick schedules the next animation tick, as often as the animation
+// speed says
+func (m mainModel) animTick() tea.Cmd {
+	interval, ok := animationIntervals[m.config.AnimationSpeed]
+	if !ok {
+		interval = animationIntervals[animationNormal]
+	}
+	if !m.animated() {
+		interval = stillInterval
+	}
+	return tea.Tick(interval, func(t time.Time) tea.Msg {
+		return animTickMsg(t)
+	})
+}
+
+func (m mainModel) spinnerView() string {
+	if !m.animated() {
+		return stillSpinner
+	}
+	return m.spinner.View()
+}
+
+func (m mainModel) pulseDot() string {
+	if !m.animated() {
+		return stillPulse
+	}
+	return pulseFrames[m.pulseFrame]
+}
+
+func (m mainModel) connectFrame() string {
+	if !m.animated() {
+		return stillConnect
+	}
+	return connectFrames[m.animFrame]
+}
+
+// animationCommand shows or changes the animation speed until the client
+// quits; animation_speed in the config sets it for good
+func animationCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	speed := strings.ToLower(strings.TrimSpace(args))
+	if speed == "" {
+		m.addSystemMessage("Animation speed is " + m.config.AnimationSpeed + " - usage: /animation none|slow|normal|fast")
+		return m, nil
+	}
+	if validAnimationSpeed(speed) != nil {
+		m.addSystemMessage("Usage: /animation none|slow|normal|fast")
+		return m, nil
+	}
+
+	var cmd tea.Cmd
+	if !m.animated() && speed != animationNone {
+		cmd = m.spinner.Tick // It stopped with the animations
+	}
+	m.config.AnimationSpeed = speed
+	if !m.animated() {
+		m.animFrame, m.pulseFrame = 0, 0
+	}
+	m.addSystemMessage("Animation speed set to " + speed)
+	return m, cmd
+}
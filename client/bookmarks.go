@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// bookmarksFile holds the messages bookmarked with Ctrl+B in vim normal
+// mode, on every server
+const bookmarksFile = "bookmarks.json"
+
+// bookmarkSnippetLength is how much of a message its bookmark keeps
+const bookmarkSnippetLength = 80
+
+// bookmark is a message saved to come back to with /bookmarks
+type bookmark struct {
+	Server    string `json:"server"`
+	Channel   string `json:"channel"`
+	MsgID     string `json:"msgID"`
+	Timestamp string `json:"timestamp"` // When the message was sent, RFC 3339
+	Sender    string `json:"sender"`
+	Snippet   string `json:"snippet"`
+	Gone      bool   `json:"gone,omitempty"` // The message was deleted since
+}
+
+func loadBookmarks() []bookmark {
+	dir, err := echoDir()
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, bookmarksFile))
+	if err != nil {
+		return nil
+	}
+	var bookmarks []bookmark
+	if err := json.Unmarshal(data, &bookmarks); err != nil {
+		return nil
+	}
+	return bookmarks
+}
+
+func saveBookmarks(bookmarks []bookmark) error {
+	dir, err := echoDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(bookmarks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, bookmarksFile), data, 0600)
+}
+
+// bookmarkBottom bookmarks the bottom message in view, the one r replies
+// to in vim normal mode
+func (m *mainModel) bookmarkBottom() {
+	m.statusUntil = time.Now().Add(vimStatusDuration)
+	msg, ok := m.bottomMessage()
+	if !ok {
+		m.statusMsg = "No message to bookmark"
+		return
+	}
+	for _, b := range m.bookmarks {
+		if b.Server == m.serverAddr && b.MsgID == msg.ID {
+			m.statusMsg = "Already bookmarked"
+			return
+		}
+	}
+
+	var sent string
+	if !msg.Time.IsZero() {
+		sent = msg.Time.UTC().Format(time.RFC3339)
+	}
+	m.bookmarks = append(m.bookmarks, bookmark{
+		Server:    m.serverAddr,
+		Channel:   m.currentChannel,
+		MsgID:     msg.ID,
+		Timestamp: sent,
+		Sender:    msg.User,
+		Snippet:   ansi.Truncate(strings.Join(strings.Fields(msg.Content), " "), bookmarkSnippetLength, "…"),
+	})
+	if err := saveBookmarks(m.bookmarks); err != nil {
+		m.statusMsg = "Couldn't save the bookmark: " + err.Error()
+		return
+	}
+	m.statusMsg = "Bookmarked - /bookmarks lists them"
+}
+
+func bookmarksCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	m.state = bookmarkView
+	m.bookmarkIndex = 0
+	m.msgInput.Blur()
+	content, _ := m.renderBookmarks()
+	m.viewport.SetContent(content)
+	m.viewport.GotoTop()
+	return m, nil
+}
+
+// closeBookmarks goes back to the chat, scrolled to the bottom
+func (m *mainModel) closeBookmarks() tea.Cmd {
+	m.state = chatView
+	m.viewport.SetContent(m.renderMessages())
+	m.viewport.GotoBottom()
+	return m.msgInput.Focus()
+}
+
+// moveBookmarkSelection moves the highlighted bookmark, keeping it in view
+func (m *mainModel) moveBookmarkSelection(delta int) {
+	if len(m.bookmarks) == 0 {
+		return
+	}
+	m.bookmarkIndex = max(0, min(len(m.bookmarks)-1, m.bookmarkIndex+delta))
+	content, starts := m.renderBookmarks()
+	m.viewport.SetContent(content)
+
+	// Bookmarks are separated by a blank line
+	top, bottom := starts[m.bookmarkIndex], starts[m.bookmarkIndex+1]-2
+	if top < m.viewport.YOffset || m.bookmarkIndex == 0 {
+		m.viewport.SetYOffset(top - 1) // With the blank line above
+	} else if bottom >= m.viewport.YOffset+m.viewport.Height {
+		m.viewport.SetYOffset(bottom - m.viewport.Height + 1)
+	}
+}
+
+// deleteSelectedBookmark removes the highlighted bookmark, from the file too
+func (m *mainModel) deleteSelectedBookmark() {
+	if len(m.bookmarks) == 0 {
+		return
+	}
+	m.bookmarks = append(m.bookmarks[:m.bookmarkIndex:m.bookmarkIndex], m.bookmarks[m.bookmarkIndex+1:]...)
+	if err := saveBookmarks(m.bookmarks); err != nil {
+		m.statusMsg = "Couldn't save the bookmarks: " + err.Error()
+		m.statusUntil = time.Now().Add(vimStatusDuration)
+	}
+	m.bookmarkIndex = max(0, min(len(m.bookmarks)-1, m.bookmarkIndex))
+	offset := m.viewport.YOffset
+	content, _ := m.renderBookmarks()
+	m.viewport.SetContent(content)
+	m.viewport.SetYOffset(offset)
+}
+
+// openSelectedBookmark goes back to the chat at the highlighted bookmark,
+// joining its channel first if need be
+func (m *mainModel) openSelectedBookmark() tea.Cmd {
+	if len(m.bookmarks) == 0 {
+		return m.closeBookmarks()
+	}
+	b := m.bookmarks[m.bookmarkIndex]
+	if b.Server != m.serverAddr {
+		m.statusMsg = "That bookmark is on " + b.Server
+		m.statusUntil = time.Now().Add(vimStatusDuration)
+		return nil
+	}
+	cmd := m.closeBookmarks()
+	if b.Channel == m.currentChannel {
+		m.jumpToBookmark(b)
+		return cmd
+	}
+
+	// Scrolled to once the channel's history arrives, see resumeBookmark
+	next, join := joinCommand(*m, b.Channel)
+	*m = next
+	m.pendingBookmark = &b
+	return tea.Batch(cmd, join)
+}
+
+// resumeBookmark scrolls to the bookmark being opened when the history of
+// its channel arrives
+func (m *mainModel) resumeBookmark(channel string) {
+	if b := m.pendingBookmark; b != nil && b.Channel == channel {
+		m.pendingBookmark = nil
+		m.jumpToBookmark(*b)
+	}
+}
+
+// jumpToBookmark scrolls the chat to b's message. One missing from history
+// that reaches back past it was deleted.
+func (m *mainModel) jumpToBookmark(b bookmark) {
+	if i := m.messageIndex(b.MsgID); i != -1 {
+		if m.messages[i].Deleted {
+			m.markBookmarkGone(b.Server, b.MsgID)
+		}
+		m.scrollToMessage(i)
+		return
+	}
+
+	sent, _ := time.Parse(time.RFC3339, b.Timestamp)
+	if m.historyReaches(sent) {
+		m.markBookmarkGone(b.Server, b.MsgID)
+		m.addSystemMessage("That bookmarked message was deleted")
+	} else {
+		m.addSystemMessage("That message is older than the loaded history")
+	}
+	m.viewport.SetContent(m.renderMessages())
+	m.jumpToBottom()
+}
+
+// messageIndex is the index of the message with server ID id, or -1
+func (m mainModel) messageIndex(id string) int {
+	for i := range m.messages {
+		if m.messages[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// historyReaches reports whether the loaded messages go back to t
+func (m mainModel) historyReaches(t time.Time) bool {
+	if t.IsZero() {
+		return false
+	}
+	for _, msg := range m.messages {
+		if msg.ID != "" && !msg.Time.IsZero() {
+			return !msg.Time.After(t)
+		}
+	}
+	return false
+}
+
+// markBookmarkGone notes that a bookmarked message was deleted
+func (m *mainModel) markBookmarkGone(server string, id string) {
+	for i := range m.bookmarks {
+		if m.bookmarks[i].Server == server && m.bookmarks[i].MsgID == id && !m.bookmarks[i].Gone {
+			m.bookmarks[i].Gone = true
+			saveBookmarks(m.bookmarks)
+		}
+	}
+}
+
+// pruneBookmarks drops the bookmarks in channels server no longer has
+func (m *mainModel) pruneBookmarks(server string, exists func(channel string) bool) {
+	kept := m.bookmarks[:0:0]
+	for _, b := range m.bookmarks {
+		if b.Server != server || b.Channel == defaultChannel || exists(b.Channel) {
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) == len(m.bookmarks) {
+		return
+	}
+	m.bookmarks = kept
+	saveBookmarks(m.bookmarks)
+}
+
+// renderBookmarks lays out every bookmark, along with the line each starts
+// on and, last, the line after them all
+func (m mainModel) renderBookmarks() (string, []int) {
+	width := m.viewport.Width
+	if width == 0 {
+		width = 80
+	}
+	indent := lipgloss.NewStyle().PaddingLeft(4).Width(max(width-2, 20))
+
+	count := fmt.Sprintf("%d bookmarks", len(m.bookmarks))
+	if len(m.bookmarks) == 1 {
+		count = "1 bookmark"
+	}
+	var lines []string
+	add := func(blocks ...string) {
+		for _, block := range blocks {
+			lines = append(lines, strings.Split(block, "\n")...)
+		}
+	}
+	add(m.styles.Subtitle.Render("🔖 " + count))
+	if len(m.bookmarks) == 0 {
+		add("", m.styles.InlineHint("In vim normal mode, Ctrl+B bookmarks the bottom message"))
+	}
+
+	starts := make([]int, 0, len(m.bookmarks)+1)
+	for i, b := range m.bookmarks {
+		add("")
+		starts = append(starts, len(lines))
+
+		marker := "  "
+		if i == m.bookmarkIndex {
+			marker = lipgloss.NewStyle().Foreground(m.styles.PrimaryColor).Bold(true).Render("▸ ")
+		}
+		where := "#" + b.Channel
+		if b.Server != m.serverAddr {
+			where = b.Server + " " + where
+		}
+		body := m.styles.Msg.Render(b.Snippet)
+		if b.Gone {
+			body = m.styles.InlineHint("[message no longer available]")
+		}
+		add(marker+m.styles.DateTime.Render("["+pinTime(b.Timestamp)+"]")+" "+m.styles.InlineHint(where)+" "+m.userStyle(b.Sender).Render(b.Sender+":"),
+			indent.Render(body))
+	}
+	starts = append(starts, len(lines)+1)
+	return strings.Join(lines, "\n"), starts
+}
+
+// exportBookmarks writes every bookmark to ~/echo-export-bookmarks-<date>
+// as JSON or Markdown, for /export --bookmarks
+func (m *mainModel) exportBookmarks(format string) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		m.addSystemMessage("Couldn't find your home directory: " + err.Error())
+		return
+	}
+	path := filepath.Join(home, fmt.Sprintf("echo-export-bookmarks-%s.%s", time.Now().Format(exportDateLayout), format))
+
+	var data []byte
+	if format == "json" {
+		data, err = json.MarshalIndent(m.bookmarks, "", "  ")
+		data = append(data, '\n')
+	} else {
+		var b strings.Builder
+		b.WriteString("# Bookmarks\n\n")
+		for _, bm := range m.bookmarks {
+			snippet := bm.Snippet
+			if bm.Gone {
+				snippet = "[message no longer available]"
+			}
+			fmt.Fprintf(&b, "- **%s %s #%s %s**: %s\n", pinTime(bm.Timestamp), bm.Server, bm.Channel, bm.Sender, snippet)
+		}
+		data = []byte(b.String())
+	}
+	if err == nil {
+		err = os.WriteFile(path, data, 0600)
+	}
+	if err != nil {
+		m.addSystemMessage("Export failed: " + err.Error())
+		return
+	}
+	m.addSystemMessage(fmt.Sprintf("Exported %d bookmarks to %s", len(m.bookmarks), path))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// otherCategory is the sidebar section for channels in no category
+const otherCategory = "Other"
+
+// sidebarRow is one line of the sidebar's channel list: a category header,
+// or a channel
+type sidebarRow struct {
+	category string // Set on header rows only
+	channel  channelInfo
+}
+
+// setCategory handles CHANNELCATEGORY:<category>:<channels_csv>
+func (m *mainModel) setCategory(payload string) {
+	name, csv, ok := strings.Cut(payload, ":")
+	if !ok || name == "" {
+		return
+	}
+	var channels []string
+	for _, channel := range strings.Split(csv, ",") {
+		if channel = strings.TrimSpace(channel); channel != "" {
+			channels = append(channels, channel)
+		}
+	}
+	m.channelCategories[name] = channels
+}
+
+// categoryNames lists the categories in the order they're shown
+func (m mainModel) categoryNames() []string {
+	names := make([]string, 0, len(m.channelCategories))
+	for name := range m.channelCategories {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i]) < strings.ToLower(names[j])
+	})
+	return names
+}
+
+// sidebarRows lays out the channel list: each category's header followed
+// by its channels, unless collapsed, and the rest under "Other". Without
+// any categories it's just the channels.
+func (m mainModel) sidebarRows() []sidebarRow {
+	channels := m.sidebarChannels()
+	var rows []sidebarRow
+	if len(m.channelCategories) == 0 {
+		for _, c := range channels {
+			rows = append(rows, sidebarRow{channel: c})
+		}
+		return rows
+	}
+
+	for _, name := range append(m.categoryNames(), otherCategory) {
+		var members []channelInfo
+		for _, c := range channels {
+			if m.categoryOf(c.Name) == name {
+				members = append(members, c)
+			}
+		}
+		if name == otherCategory && len(members) == 0 {
+			continue
+		}
+		rows = append(rows, sidebarRow{category: name})
+		if m.collapsedCategories[name] {
+			continue
+		}
+		for _, c := range members {
+			rows = append(rows, sidebarRow{channel: c})
+		}
+	}
+	return rows
+}
+
+// categoryOf is the sidebar section channel is listed under
+func (m mainModel) categoryOf(channel string) string {
+	for name, members := range m.channelCategories {
+		for _, member := range members {
+			if member == channel {
+				return name
+			}
+		}
+	}
+	return otherCategory
+}
+
+// visibleChannels are the channels the sidebar shows, in order, leaving
+// out those in collapsed categories
+func (m mainModel) visibleChannels() []channelInfo {
+	var channels []channelInfo
+	for _, row := range m.sidebarRows() {
+		if row.category == "" {
+			channels = append(channels, row.channel)
+		}
+	}
+	return channels
+}
+
+// categoryUnread totals the unread messages in a category's channels, for
+// its header while collapsed
+func (m mainModel) categoryUnread(name string) int {
+	total := 0
+	for _, c := range m.channels {
+		if m.categoryOf(c.Name) == name {
+			total += m.unreadCounts[c.Name]
+		}
+	}
+	return total
+}
+
+func (m *mainModel) toggleCategory(name string) {
+	m.collapsedCategories[name] = !m.collapsedCategories[name]
+}
+
+// toggleSidebarFocus moves the keyboard between the input and the
+// sidebar's channel list, where ↑/↓ pick a row and Enter opens it
+func (m *mainModel) toggleSidebarFocus() tea.Cmd {
+	if m.sidebarFocused {
+		m.sidebarFocused = false
+		return m.msgInput.Focus()
+	}
+	if m.thread != nil || m.sidebarWidth() == 0 {
+		m.statusMsg = "The sidebar is hidden"
+		m.statusUntil = time.Now().Add(vimStatusDuration)
+		return nil
+	}
+	m.sidebarFocused = true
+	m.sidebarCursor = 0
+	for i, row := range m.sidebarRows() {
+		if row.category == "" && row.channel.Name == m.currentChannel {
+			m.sidebarCursor = i
+		}
+	}
+	m.msgInput.Blur()
+	return nil
+}
+
+// isSidebarKey reports whether key is handled by sidebarKey
+func isSidebarKey(key string) bool {
+	switch key {
+	case "up", "down", "k", "j", "enter", "esc":
+		return true
+	}
+	return false
+}
+
+// sidebarKey moves through the sidebar's rows, collapsing or expanding a
+// category or joining a channel on Enter
+func (m mainModel) sidebarKey(key string) (mainModel, tea.Cmd) {
+	rows := m.sidebarRows()
+	if len(rows) == 0 || key == "esc" {
+		return m, m.toggleSidebarFocus()
+	}
+	m.sidebarCursor = min(m.sidebarCursor, len(rows)-1)
+
+	switch key {
+	case "up", "k":
+		m.sidebarCursor = max(m.sidebarCursor-1, 0)
+	case "down", "j":
+		m.sidebarCursor = min(m.sidebarCursor+1, len(rows)-1)
+	case "enter":
+		row := rows[m.sidebarCursor]
+		if row.category != "" {
+			m.toggleCategory(row.category)
+			return m, nil
+		}
+		cmd := m.toggleSidebarFocus()
+		if row.channel.Name == m.currentChannel {
+			return m, cmd
+		}
+		m, join := m.handleCommand("join", row.channel.Name)
+		return m, tea.Batch(cmd, join)
+	}
+	return m, nil
+}
+
+func categoryCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	action, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	rest = strings.TrimSpace(rest)
+	switch strings.ToLower(action) {
+	case "create":
+		if rest != "" {
+			return m, m.sendMessageCmd("CATEGORY:create:" + rest)
+		}
+	case "add":
+		channel, name, _ := strings.Cut(rest, " ")
+		if name = strings.TrimSpace(name); name != "" {
+			return m, m.sendMessageCmd(fmt.Sprintf("CATEGORY:add:%s:%s", strings.TrimPrefix(channel, "#"), name))
+		}
+	case "remove":
+		if rest != "" {
+			return m, m.sendMessageCmd("CATEGORY:remove:" + strings.TrimPrefix(rest, "#"))
+		}
+	}
+	m.addSystemMessage("Usage: /category create <name> | add <channel> <name> | remove <channel>")
+	return m, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// defaultChannel is where every session starts
+const defaultChannel = "general"
+
+// topicWidth is how much of a topic the header shows; longer ones scroll
+const topicWidth = 60
+
+// topicMarquee is the part of topic to show in width columns now, scrolling
+// one character every other animation tick when it doesn't fit
+func (m mainModel) topicMarquee(topic string, width int) string {
+	runes := []rune(topic)
+	if len(runes) <= width {
+		return topic
+	}
+	loop := append(runes, []rune("   ")...)
+	start := (m.animTicks / 2) % len(loop)
+	window := make([]rune, width)
+	for i := range window {
+		window[i] = loop[(start+i)%len(loop)]
+	}
+	return string(window)
+}
+
+// channelCacheLimit caps how many messages are kept per inactive channel
+const channelCacheLimit = 500
+
+// channelInfo is one entry of a CHANNELLIST or CHANNELADD frame
+type channelInfo struct {
+	Name        string `json:"name"`
+	Topic       string `json:"topic"`
+	MemberCount int    `json:"memberCount"`
+	Permissions string `json:"permissions"` // public, invite-only or read-only
+	IsPrivate   bool   `json:"isPrivate"`   // From servers without permissions
+	Pins        int    `json:"pins"`        // Pinned messages, kept current by PINNED/UNPINNED frames
+}
+
+var channelNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,32}$`)
+
+// validateChannelName checks a name without its leading "#"
+func validateChannelName(name string) error {
+	if !channelNamePattern.MatchString(name) {
+		return fmt.Errorf("channel names are letters, digits and hyphens, at most 32 characters")
+	}
+	return nil
+}
+
+func parseChannelList(payload string) ([]channelInfo, bool) {
+	var channels []channelInfo
+	if err := json.Unmarshal([]byte(payload), &channels); err != nil {
+		return nil, false
+	}
+	return channels, true
+}
+
+// addChannel adds or replaces a channel announced by CHANNELADD
+func (m *mainModel) addChannel(payload string) {
+	var channel channelInfo
+	if err := json.Unmarshal([]byte(payload), &channel); err != nil {
+		return
+	}
+	m.channelTopics[channel.Name] = channel.Topic
+	for i := range m.channels {
+		if m.channels[i].Name == channel.Name {
+			m.channels[i] = channel
+			return
+		}
+	}
+	m.channels = append(m.channels, channel)
+}
+
+// removeChannel drops a channel announced by CHANNELDEL
+func (m *mainModel) removeChannel(name string) {
+	for i := range m.channels {
+		if m.channels[i].Name == name {
+			m.channels = append(m.channels[:i], m.channels[i+1:]...)
+			break
+		}
+	}
+	delete(m.messageCache, name)
+	delete(m.scrollPositions, name)
+	if m.currentChannel == name {
+		m.currentChannel = defaultChannel
+		m.addSystemMessage("#" + name + " was deleted")
+	}
+}
+
+// sidebarChannels is the channel list in sidebar order: as the server sent
+// it, or with unread channels first when the config asks for that
+func (m mainModel) sidebarChannels() []channelInfo {
+	if !m.config.SortByUnread {
+		return m.channels
+	}
+	channels := append([]channelInfo(nil), m.channels...)
+	sort.SliceStable(channels, func(i, j int) bool {
+		return m.unreadCounts[channels[i].Name] > 0 && m.unreadCounts[channels[j].Name] == 0
+	})
+	return channels
+}
+
+// nextChannel is the channel after the current one in the sidebar,
+// wrapping and skipping collapsed categories
+func (m mainModel) nextChannel() (string, bool) {
+	channels := m.visibleChannels()
+	if len(channels) < 2 {
+		return "", false
+	}
+	for i, c := range channels {
+		if c.Name == m.currentChannel {
+			return channels[(i+1)%len(channels)].Name, true
+		}
+	}
+	return channels[0].Name, true
+}
+
+func (m mainModel) listChannelsCmd() tea.Cmd {
+	return m.sendMessageCmd("LISTCHANNELS")
+}
+
+func joinCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	name := strings.TrimPrefix(strings.TrimSpace(args), "#")
+	if name == "" {
+		m.addSystemMessage("Usage: /join <channel>")
+		return m, nil
+	}
+	if err := validateChannelName(name); err != nil {
+		m.addSystemMessage("Can't join #" + name + ": " + err.Error())
+		return m, nil
+	}
+	if name == m.currentChannel {
+		m.addSystemMessage("You are already in #" + name)
+		return m, nil
+	}
+
+	// Keep what was being typed for when we come back
+	m.setDraft(m.currentChannel, m.msgInput.Value())
+	m.msgInput.Reset()
+	m.msgInput.SetHeight(1)
+	if draft := m.drafts[name]; draft != "" {
+		m.msgInput.SetValue(draft)
+		m.msgInput.CursorEnd()
+	}
+
+	slog.Info("switching channel", "from", m.currentChannel, "to", name, "tab", m.id)
+	m.dropStreams()
+	m.cacheChannel()
+	m.previousChannel = m.currentChannel
+	m.currentChannel = name
+	delete(m.mentionCounts, name)
+	delete(m.unreadCounts, name)
+	m.editingID = ""
+	m.replyToID = ""
+	m.thread = nil // The server closes it on JOIN too
+	m.resize()
+	m.typingUsers = map[string]time.Time{}
+	m.expandedBlocks = map[string]bool{}
+
+	// The server replays history on every JOIN; messages we already have
+	// are skipped and anything newer lands below the cached ones
+	if cached, ok := m.messageCache[name]; ok {
+		m.messages = cached
+		m.connectedMsgIndex = len(m.messages)
+		m.viewport.SetContent(m.renderMessages())
+		if offset := m.scrollPositions[name]; offset >= 0 {
+			m.viewport.SetYOffset(offset)
+		} else {
+			m.viewport.GotoBottom()
+		}
+		m.followScroll()
+	} else {
+		m.messages = nil
+		m.connectedMsgIndex = 0
+		m.addSystemMessage("Joined #" + name)
+		m.jumpToBottom()
+	}
+	m.resetHistoryPaging()
+	return m, tea.Sequence(m.sendMessageCmd("JOIN:"+name), m.sendMessageCmd("READ:"+name))
+}
+
+// cacheChannel keeps the current channel's messages and reading position
+// for switching back to it. A position of -1 means following the bottom.
+func (m *mainModel) cacheChannel() {
+	messages := m.messages
+	if len(messages) > channelCacheLimit {
+		messages = messages[len(messages)-channelCacheLimit:]
+	}
+	m.messageCache[m.currentChannel] = messages
+
+	m.scrollPositions[m.currentChannel] = -1
+	if !m.viewport.AtBottom() {
+		m.scrollPositions[m.currentChannel] = m.viewport.YOffset
+	}
+}
+
+func topicCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	topic := strings.TrimSpace(args)
+	if topic == "" {
+		if current := m.channelTopics[m.currentChannel]; current != "" {
+			m.addSystemMessage("Topic of #" + m.currentChannel + ": " + current)
+		} else {
+			m.addSystemMessage("Usage: /topic <text>")
+		}
+		return m, nil
+	}
+	return m, m.sendMessageCmd("TOPIC:" + m.currentChannel + ":" + topic)
+}
+
+func createCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	name := strings.TrimPrefix(strings.TrimSpace(args), "#")
+	if name == "" {
+		m.addSystemMessage("Usage: /create <name>")
+		return m, nil
+	}
+	if err := validateChannelName(name); err != nil {
+		m.addSystemMessage("Can't create #" + name + ": " + err.Error())
+		return m, nil
+	}
+	return m, m.sendMessageCmd("CREATECHANNEL:" + name)
+}
+
+// renderChannels renders the bordered "Channels" panel
+func (m mainModel) renderChannels() string {
+	innerWidth := sidebarWidth - 4 // Border and padding
+
+	var b strings.Builder
+	b.WriteString(m.styles.User.Render("Channels"))
+	for i, r := range m.sidebarRows() {
+		row := m.renderSidebarRow(r)
+		if r.category == "" && len(m.channelCategories) > 0 {
+			row = "  " + row // Under its category's header
+		}
+		if m.sidebarFocused && i == m.sidebarCursor {
+			row = lipgloss.NewStyle().Reverse(true).Render(ansi.Strip(row))
+		}
+		b.WriteString("\n" + lipgloss.NewStyle().MaxWidth(innerWidth).Render(row))
+	}
+
+	return lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(lipgloss.Color("#3B4252")).
+		Width(sidebarWidth-2).
+		Padding(0, 1).
+		Render(b.String())
+}
+
+// renderSidebarRow renders a channel with its member count and badges, or
+// a category header with ▼ when expanded and ▶ when collapsed
+func (m mainModel) renderSidebarRow(r sidebarRow) string {
+	if r.category != "" {
+		header := "▼ " + r.category
+		if m.collapsedCategories[r.category] {
+			header = "▶ " + r.category
+			if n := m.categoryUnread(r.category); n > 0 {
+				return m.styles.InlineHint(header) + " " + m.styles.Error.UnsetPadding().Render(fmt.Sprintf("(%d)", n))
+			}
+		}
+		return m.styles.InlineHint(header)
+	}
+
+	c := r.channel
+	name := channelLabel(c)
+	if c.Name == m.currentChannel {
+		name = lipgloss.NewStyle().Foreground(m.styles.PrimaryColor).Bold(true).Render(name)
+	}
+	row := name + " " + m.styles.InlineHint(fmt.Sprintf("(%d)", c.MemberCount))
+	if n := m.unreadCounts[c.Name]; n > 0 {
+		row += " " + m.styles.Error.UnsetPadding().Render(fmt.Sprintf("(%d)", n))
+	}
+	if m.mentionCounts[c.Name] > 0 {
+		row += " " + m.styles.ButtonFocus.UnsetPadding().UnsetMargins().Render("●")
+	}
+	if c.Pins > 0 {
+		row += " " + m.styles.InlineHint(fmt.Sprintf("%s %d", IconPin, c.Pins))
+	}
+	if m.drafts[c.Name] != "" && c.Name != m.currentChannel {
+		row += " " + m.styles.InlineHint("[draft]")
+	}
+	return row
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"net/url"
 	"strings"
 	"time"
@@ -10,53 +16,401 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// ErrTimeout is returned when connecting takes longer than the caller allows
+var ErrTimeout = errors.New("connection timed out")
+
+// ErrConnect wraps failures to reach the server at all, which are worth retrying
+var ErrConnect = errors.New("failed to connect")
+
+// ErrTOTPRequired is returned when the password was accepted but the account
+// also needs a two-factor code
+var ErrTOTPRequired = errors.New("two-factor code required")
+
+// ErrNotConnected is returned when sending with no connection open
+var ErrNotConnected = errors.New("not connected")
+
+// ErrServerRestarting is reported while reconnecting after the server went away
+var ErrServerRestarting = errors.New("server restarting")
+
+// ErrMaintenance is returned when the server turns connections away while
+// it's down for maintenance
+var ErrMaintenance = errors.New("server under maintenance")
+
+// protocolVersions are the websocket subprotocols naming the versions of
+// the frames this client speaks, most preferred first. echo-v2 announces
+// joins and leaves as JOINED:<user> and LEFT:<user> frames. Servers from
+// before versioning don't negotiate one, and speak echo-v1.
+var protocolVersions = []string{"echo-v2", "echo-v1"}
+
+// Reconnect backoff: the delay starts small and doubles after each failed attempt
+const (
+	defaultMaxRetries = 5
+	retryBaseDelay    = 500 * time.Millisecond
+	retryMaxDelay     = 30 * time.Second
+)
+
+// retryDelay returns how long to wait before retry number attempt (starting at 0)
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 0; i < attempt && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay
+}
+
+// isRetryable reports whether a connect error may go away by trying again
+func isRetryable(err error) bool {
+	return errors.Is(err, ErrConnect) || errors.Is(err, ErrTimeout)
+}
+
+// friendlyErrors puts connection errors in words someone who isn't a
+// programmer can act on, matched by substring, first match wins
+var friendlyErrors = []struct{ substr, message string }{
+	{"connection refused", "Server is offline or the address is wrong"},
+	{"under maintenance", "The server is down for maintenance, try again later"},
+	{"no such host", "Hostname could not be resolved — check the address"},
+	{"authentication failed", "Wrong username or password"},
+	{"context deadline exceeded", "Connection timed out"},
+	{"i/o timeout", "Connection timed out"},
+	{"connection timed out", "Connection timed out"},
+	{"network is unreachable", "No network connection - check that you're online"},
+	{"connection reset", "The server closed the connection"},
+	{"does not look like a tls handshake", "The server doesn't use TLS - turn off tls in your config"},
+	{"certificate", "The server's certificate isn't trusted - check the address"},
+	{"bad handshake", "Something answered at that address, but it isn't an Echo server"},
+}
+
+// friendlyError describes err for the login screen. The server's own
+// reasons for refusing a login are written for users already, so they're
+// passed on as they are.
+func friendlyError(err error) string {
+	text := err.Error()
+	if reason, ok := strings.CutPrefix(text, "authentication failed: ERROR:"); ok && strings.TrimSpace(reason) != "" {
+		return strings.TrimSpace(reason)
+	}
+	lower := strings.ToLower(text)
+	for _, f := range friendlyErrors {
+		if strings.Contains(lower, f.substr) {
+			return f.message
+		}
+	}
+	return text
+}
+
+// connectError reads as friendlyError describes it, while errors.Is still
+// sees the error underneath
+type connectError struct{ err error }
+
+func (e connectError) Error() string { return friendlyError(e.err) }
+func (e connectError) Unwrap() error { return e.err }
+
+// Credentials are sent to the server as the first message of a connection
+type Credentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Email    string `json:"email,omitempty"` // Only needed when registering on servers that verify emails
+	Token    string `json:"-"`               // Session token, used instead of the password when set
+	TOTP     string `json:"-"`               // Two-factor or recovery code, sent if the server asks
+}
+
+// DialOptions controls how the connection to the server is made
+type DialOptions struct {
+	TLS                bool   // Use wss:// even if the address doesn't say so
+	InsecureSkipVerify bool   // Accept any certificate - local development only
+	Transport          string // transportWebsocket (the default) or transportGRPC
+}
+
+// serverEndpoint builds the websocket URL for an address like "host:port",
+// "ws://host:port" or "wss://host:port"
+func serverEndpoint(serverURL string, useTLS bool) url.URL {
+	scheme := "ws"
+	if useTLS {
+		scheme = "wss"
+	}
+	if rest, ok := strings.CutPrefix(serverURL, "wss://"); ok {
+		scheme, serverURL = "wss", rest
+	} else if rest, ok := strings.CutPrefix(serverURL, "ws://"); ok {
+		scheme, serverURL = "ws", rest
+	}
+	return url.URL{Scheme: scheme, Host: strings.TrimSuffix(serverURL, "/"), Path: "/"}
+}
+
 // connectWebsocket connects to the server and performs authentication, returning the connection.
-func connectWebsocket(serverURL string, username string, password string) (*websocket.Conn, error) {
-	u := url.URL{Scheme: "ws", Host: serverURL, Path: "/"}
+// A non-empty token resumes a previous session instead of sending the password.
+func connectWebsocket(serverURL string, username string, password string, token string) (*websocket.Conn, error) {
+	creds := Credentials{Username: username, Password: password, Token: token}
+	return ConnectWebsocketWithOptions(context.Background(), serverURL, creds, DialOptions{})
+}
 
+// ConnectWebsocketWithContext is connectWebsocket, but gives up with ErrTimeout
+// once ctx is done, even if the server accepted the connection and went quiet.
+func ConnectWebsocketWithContext(ctx context.Context, serverURL, username, password string) (*websocket.Conn, error) {
+	creds := Credentials{Username: username, Password: password}
+	return ConnectWebsocketWithOptions(ctx, serverURL, creds, DialOptions{})
+}
+
+// ConnectWebsocketWithOptions is ConnectWebsocketWithContext with the full
+// credentials, a two-factor code or session token among them, and dial options
+func ConnectWebsocketWithOptions(ctx context.Context, serverURL string, creds Credentials, opts DialOptions) (*websocket.Conn, error) {
 	// Open the websocket connection
-	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	c, err := dialServer(ctx, serverURL, opts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect: %v", err)
+		return nil, err
 	}
 
-	// Create authentication JSON
-	authData := map[string]string{
-		"username": username,
-		"password": password,
+	// Closing the connection unblocks the auth read below if ctx ends first
+	stop := context.AfterFunc(ctx, func() {
+		c.Close()
+	})
+
+	err = authenticate(c, creds)
+	if !stop() {
+		// ctx ended mid-handshake, so the connection is already closed
+		return nil, ErrTimeout
 	}
-	authJSON, err := json.Marshal(authData)
 	if err != nil {
 		c.Close()
-		return nil, fmt.Errorf("failed to encode auth data: %v", err)
+		return nil, err
+	}
+
+	// Return the successful connection
+	return c, nil
+}
+
+// dialServer opens a websocket to the server without logging in
+func dialServer(ctx context.Context, serverURL string, opts DialOptions) (*websocket.Conn, error) {
+	u := serverEndpoint(serverURL, opts.TLS)
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = protocolVersions
+	if u.Scheme == "wss" && opts.InsecureSkipVerify {
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	// The dialer only minds ctx's deadline once connected, so cancelling
+	// ctx mid-handshake times the connection out by hand. The dialer's own
+	// context ends as soon as it returns, so ctx is watched instead.
+	stopCancel := func() bool { return false }
+	dialer.NetDialContext = func(dialCtx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := (&net.Dialer{}).DialContext(dialCtx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		stopCancel = context.AfterFunc(ctx, func() {
+			conn.SetDeadline(time.Now())
+		})
+		return conn, nil
+	}
+
+	c, resp, err := dialer.DialContext(ctx, u.String(), nil)
+	stopCancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ErrTimeout
+		}
+		// Retry-After tells maintenance apart from a full server
+		if resp != nil && resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "" {
+			return nil, fmt.Errorf("%w: %w", ErrConnect, ErrMaintenance)
+		}
+		return nil, fmt.Errorf("%w: %v", ErrConnect, err)
+	}
+	if c.Subprotocol() == "" {
+		slog.Warn("server didn't negotiate a protocol version, assuming echo-v1", "server", u.Host)
+	} else {
+		slog.Debug("negotiated protocol", "server", u.Host, "protocol", c.Subprotocol())
+	}
+	return c, nil
+}
+
+// authenticate sends the credentials and waits for the server to accept them
+func authenticate(c *websocket.Conn, creds Credentials) error {
+	// Create authentication JSON, or resume the session if we have a token
+	authJSON, err := json.Marshal(creds)
+	if err != nil {
+		return fmt.Errorf("failed to encode auth data: %v", err)
+	}
+	if creds.Token != "" && creds.Password == "" {
+		authJSON = []byte("TOKEN:" + creds.Token)
 	}
 
 	// Send authentication message
 	err = c.WriteMessage(websocket.TextMessage, authJSON)
 	if err != nil {
-		c.Close()
-		return nil, fmt.Errorf("failed to send auth data: %v", err)
+		return fmt.Errorf("failed to send auth data: %v", err)
 	}
 
 	// Wait for authentication response
 	messageType, data, err := c.ReadMessage()
 	if err != nil {
-		c.Close()
-		return nil, fmt.Errorf("connection error during auth: %v", err)
+		return fmt.Errorf("connection error during auth: %v", err)
+	}
+
+	// Accounts with two-factor auth are asked for a code next
+	if messageType == websocket.TextMessage && string(data) == "TOTP_REQUIRED" {
+		if creds.TOTP == "" {
+			return ErrTOTPRequired
+		}
+		if err := c.WriteMessage(websocket.TextMessage, []byte("TOTP:"+creds.TOTP)); err != nil {
+			return fmt.Errorf("failed to send two-factor code: %v", err)
+		}
+		messageType, data, err = c.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("connection error during auth: %v", err)
+		}
 	}
 
 	if messageType == websocket.TextMessage {
 		message := string(data)
 		if strings.HasPrefix(message, "ERROR:") {
-			c.Close()
-			return nil, fmt.Errorf("authentication failed: %s", message)
+			return fmt.Errorf("authentication failed: %s", message)
 		}
 	} else {
 		// Optional: Handle non-text messages if expected, but for auth typically we expect text confirmation
 	}
 
-	// Return the successful connection
-	return c, nil
+	return nil
+}
+
+// DisconnectWithContext sends a websocket close frame, waiting no longer
+// than ctx allows, then closes the connection. Other transports just close.
+func DisconnectWithContext(ctx context.Context, transport ChatTransport) error {
+	ws, ok := transport.(*wsTransport)
+	if !ok {
+		return transport.Close()
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(time.Second)
+	}
+
+	err := ws.sendClose(deadline)
+	if closeErr := ws.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// wireMessage is a stored chat message as sent by the server
+type wireMessage struct {
+	ID           string         `json:"id"`
+	Sender       string         `json:"sender"`
+	Content      string         `json:"content"`
+	Timestamp    string         `json:"timestamp"`
+	Channel      string         `json:"channel"`
+	Edited       bool           `json:"edited,omitempty"`
+	Reactions    map[string]int `json:"reactions,omitempty"`
+	Bot          string         `json:"bot,omitempty"` // Name an incoming webhook posted as
+	ReplyTo      string         `json:"replyTo,omitempty"`
+	ClientID     string         `json:"clientID,omitempty"`     // Set on our own messages, see delivery.go
+	DisplayColor string         `json:"displayColor,omitempty"` // The sender's /setcolor color
+	Ephemeral    bool           `json:"ephemeral,omitempty"`    // Not stored, the sender opted out with /privacy
+	Streaming    bool           `json:"streaming,omitempty"`    // Its text follows in STREAM frames
+}
+
+// serverFrame is a JSON frame sent by the server, identified by its type
+type serverFrame struct {
+	Type     string        `json:"type"`
+	Msg      string        `json:"msg,omitempty"` // Text of "system" frames
+	Messages []wireMessage `json:"messages,omitempty"`
+	wireMessage
+}
+
+// parseServerFrame decodes a JSON frame, reporting false for plain text frames
+func parseServerFrame(raw string) (serverFrame, bool) {
+	var frame serverFrame
+	if !strings.HasPrefix(raw, "{") {
+		return frame, false
+	}
+	if err := json.Unmarshal([]byte(raw), &frame); err != nil || frame.Type == "" {
+		return frame, false
+	}
+	return frame, true
+}
+
+// historyFrame is the replay sent on joining a channel
+type historyFrame struct {
+	Messages []wireMessage   `json:"messages"`
+	Pins     []pinnedMessage `json:"pins"`
+}
+
+// parseHistoryFrame decodes a HISTORY:<channel>:<json> replay frame. Older
+// servers send just the array of messages.
+func parseHistoryFrame(raw string) (string, historyFrame, bool) {
+	var history historyFrame
+	rest, ok := strings.CutPrefix(raw, "HISTORY:")
+	if !ok {
+		return "", history, false
+	}
+	channel, payload, ok := strings.Cut(rest, ":")
+	if !ok {
+		return "", history, false
+	}
+	target := any(&history)
+	if strings.HasPrefix(payload, "[") {
+		target = &history.Messages
+	}
+	if err := json.Unmarshal([]byte(payload), target); err != nil {
+		return "", history, false
+	}
+	return channel, history, true
+}
+
+// serverErrors maps ERR:<code> frames to messages shown in the chat
+var serverErrors = map[string]string{
+	"user_not_found":      "Sorry, that user is not online!",
+	"edit_denied":         "You can only edit your own messages from the last 5 minutes",
+	"delete_denied":       "You can only delete your own messages",
+	"message_not_found":   "That message doesn't exist",
+	"react_denied":        "Couldn't react to that message",
+	"upload_invalid":      "The file upload failed",
+	"upload_too_large":    "That file is too large to upload",
+	"upload_type_denied":  "That file type isn't allowed",
+	"upload_too_many":     "Wait for your other uploads to finish first",
+	"upload_rate_limited": "The file upload was sent too fast and failed",
+	"search_invalid":      "Search failed - try a different query",
+	"channel_invalid":     "Channel names are letters, digits and hyphens, at most 32 characters",
+	"channel_exists":      "That channel already exists",
+	"channel_not_found":   "That channel doesn't exist",
+	"channel_denied":      "You can only delete channels you created",
+	"message_too_long":    "That message is too long for this server",
+	"admin_only":          "Only admins can do that",
+	"mod_only":            "Only mods and admins can do that",
+	"pin_limit":           "This channel already has the most pinned messages it can have; unpin one first",
+	"already_pinned":      "That message is already pinned",
+	"pin_not_found":       "That message isn't pinned",
+	"poll_invalid":        "Polls need a question and 2 to 10 options, and votes an option number from the poll",
+	"poll_not_found":      "There's no poll with that ID in this channel",
+	"poll_closed":         "That poll has closed",
+	"privacy_invalid":     "Usage: /privacy [store on|off]",
+	"mode_invalid":        "Usage: /mode <channel> public|invite-only|read-only",
+	"category_invalid":    "Category names are at most 32 characters, without : or , and not \"Other\"",
+	"category_exists":     "A category with that name already exists",
+	"category_not_found":  "There's no category with that name",
+	"ban_invalid":         "Usage: /ban <username> [duration] [reason]",
+	"history_invalid":     "Usage: /history [N], with N up to 200",
+	"topic_invalid":       "Topics can be at most 200 characters",
+	"permission_denied":   "You don't have permission to do that",
+	"2fa_enabled":         "Two-factor authentication is already on",
+	"2fa_not_enabled":     "Two-factor authentication isn't on",
+	"wrong_password":      "Wrong password",
+	"export_invalid":      "Usage: /export [channel] [from] [to] [--format json|md]",
+	"export_failed":       "The export failed on the server",
+	"guest_denied":        "Guests can't do that - register an account to use it",
+	"webhook_not_found":   "There's no webhook with that name or token",
+	"status_invalid":      "Status messages can be at most 100 characters",
+	"color_invalid":       "Usage: /setcolor #RRGGBB | auto",
+	"motd_invalid":        "The message of the day can be at most 2000 characters",
+	"maintenance_invalid": "Usage: /maintenance on [message] | off, with at most 500 characters",
+}
+
+// serverErrorText returns the chat text for an ERR:<code> frame
+func serverErrorText(code string) string {
+	if text, ok := serverErrors[code]; ok {
+		return text
+	}
+	return "Server error: " + strings.ReplaceAll(code, "_", " ")
 }
 
 func getTimestamp() string {
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestConnectWebsocketTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+	}{
+		{
+			// The upgrade request is read but never answered
+			name: "stalled upgrade",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+		},
+		{
+			// Upgraded, but the reply to the login never comes
+			name: "stalled login",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				upgrader := websocket.Upgrader{Subprotocols: protocolVersions}
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				for {
+					if _, _, err := c.ReadMessage(); err != nil {
+						return
+					}
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+			address := strings.TrimPrefix(server.URL, "http://")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			time.AfterFunc(100*time.Millisecond, cancel)
+
+			start := time.Now()
+			conn, err := ConnectWebsocketWithContext(ctx, address, "alice", "secret")
+			if conn != nil {
+				conn.Close()
+			}
+			if !errors.Is(err, ErrTimeout) {
+				t.Fatalf("err = %v, want ErrTimeout", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("gave up after %v, long after the context was cancelled", elapsed)
+			}
+		})
+	}
+}
+
+func TestConnectWebsocketWithContext(t *testing.T) {
+	server := newFakeServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	conn, err := ConnectWebsocketWithContext(ctx, server.address(), "alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.Subprotocol(); got != "echo-v2" {
+		t.Errorf("protocol = %q, want echo-v2", got)
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	tests := []struct {
+		name   string
+		server []string // What the server speaks, most preferred first
+		want   string
+	}{
+		{"both, preferring echo-v2", []string{"echo-v2", "echo-v1"}, "echo-v2"},
+		{"both, preferring echo-v1", []string{"echo-v1", "echo-v2"}, "echo-v1"},
+		{"echo-v1 only", []string{"echo-v1"}, "echo-v1"},
+		{"from before versioning", nil, ""},
+		{"only newer versions", []string{"echo-v3"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upgrader := websocket.Upgrader{Subprotocols: tt.server}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c, err := upgrader.Upgrade(w, r, nil)
+				if err != nil {
+					return
+				}
+				defer c.Close()
+				c.ReadMessage()
+				c.WriteMessage(websocket.TextMessage, []byte("alice has joined"))
+				c.ReadMessage() // Until the client hangs up
+			}))
+			defer server.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+			conn, err := ConnectWebsocketWithContext(ctx, strings.TrimPrefix(server.URL, "http://"), "alice", "secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got := conn.Subprotocol(); got != tt.want {
+				t.Errorf("protocol = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFriendlyError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{errors.New("dial tcp 127.0.0.1:8080: connect: connection refused"), "Server is offline or the address is wrong"},
+		{fmt.Errorf("%w: %w", ErrConnect, ErrMaintenance), "The server is down for maintenance, try again later"},
+		{errors.New("dial tcp: lookup nowhere.invalid: no such host"), "Hostname could not be resolved — check the address"},
+		{errors.New("authentication failed: unexpected reply"), "Wrong username or password"},
+		{errors.New("context deadline exceeded"), "Connection timed out"},
+		{errors.New("read tcp 10.0.0.1:80: i/o timeout"), "Connection timed out"},
+		{errors.New("dial tcp 10.0.0.1:80: connect: Connection Timed Out"), "Connection timed out"},
+		{errors.New("dial tcp: connect: network is unreachable"), "No network connection - check that you're online"},
+		{errors.New("read: connection reset by peer"), "The server closed the connection"},
+		{errors.New("tls: first record does not look like a TLS handshake"), "The server doesn't use TLS - turn off tls in your config"},
+		{errors.New("x509: certificate signed by unknown authority"), "The server's certificate isn't trusted - check the address"},
+		{errors.New("websocket: bad handshake"), "Something answered at that address, but it isn't an Echo server"},
+		// The server's reasons are passed on as they are
+		{errors.New("authentication failed: ERROR: Invalid password"), "Invalid password"},
+		{errors.New("authentication failed: ERROR:   "), "Wrong username or password"},
+		// Anything else is shown as it is
+		{errors.New("something odd happened"), "something odd happened"},
+	}
+	for _, tt := range tests {
+		if got := friendlyError(tt.err); got != tt.want {
+			t.Errorf("friendlyError(%q) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+
+	// Every mapped error is covered above
+	for _, f := range friendlyErrors {
+		covered := false
+		for _, tt := range tests {
+			if strings.Contains(strings.ToLower(tt.err.Error()), f.substr) && friendlyError(tt.err) == f.message {
+				covered = true
+			}
+		}
+		if !covered {
+			t.Errorf("no case for %q", f.substr)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/atotto/clipboard"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// copiedStatusDuration is how long "[Copied!]" stays in the footer
+const copiedStatusDuration = 2 * time.Second
+
+// copiedMsg reports how copying to the clipboard went
+type copiedMsg struct {
+	err error
+}
+
+// copyable reports whether msg has text worth copying
+func copyable(msg ChatMessage) bool {
+	return msg.Content != "" && !msg.IsSeparator && !msg.Deleted
+}
+
+// bottomCopyable is the last message shown in the chat that can be copied,
+// which is what y copies in vim mode
+func (m mainModel) bottomCopyable() (ChatMessage, bool) {
+	for line := m.viewport.YOffset + m.viewport.Height - 1; line >= m.viewport.YOffset; line-- {
+		if msg, ok := m.messageAtLine(line); ok && copyable(msg) {
+			return msg, true
+		}
+	}
+	return ChatMessage{}, false
+}
+
+// lastReceived is the newest message from someone else, which Ctrl+Y copies
+func (m mainModel) lastReceived() (ChatMessage, bool) {
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		msg := m.messages[i]
+		if copyable(msg) && !msg.IsSystem && msg.User != "" && msg.User != m.username {
+			return msg, true
+		}
+	}
+	return ChatMessage{}, false
+}
+
+// copyMessageCmd puts msg's text on the system clipboard. Without one,
+// e.g. on Linux with no X or Wayland, it's printed to stderr instead.
+func copyMessageCmd(msg ChatMessage) tea.Cmd {
+	text := ansi.Strip(msg.Content)
+	return func() tea.Msg {
+		if err := clipboard.WriteAll(text); err != nil {
+			fmt.Fprintln(os.Stderr, text)
+			return copiedMsg{err: err}
+		}
+		return copiedMsg{}
+	}
+}
+
+// copied flashes the outcome of copyMessageCmd in the footer
+func (m mainModel) copied(msg copiedMsg) (mainModel, tea.Cmd) {
+	m.statusMsg = "[Copied!]"
+	if msg.err != nil {
+		m.statusMsg = "[clipboard unavailable, printed to stderr]"
+	}
+	m.statusUntil = time.Now().Add(copiedStatusDuration)
+	return m, nil
+}
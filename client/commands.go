@@ -0,0 +1,626 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Command is a slash command typed into the chat input, e.g. "/help"
+type Command struct {
+	Name        string // Without the leading slash
+	Usage       string
+	Description string
+	Help        string // More about it, for /help <command>
+	Handler     func(m mainModel, args string) (mainModel, tea.Cmd)
+}
+
+// commands is the registry of slash commands, filled by registerCommand
+// from init functions so features can add commands without touching the
+// dispatcher.
+var commands []Command
+
+func registerCommand(c Command) {
+	commands = append(commands, c)
+}
+
+func init() {
+	registerCommand(Command{
+		Name:        "help",
+		Usage:       "/help [command]",
+		Description: "List available commands, or explain one",
+		Handler:     helpCommand,
+	})
+	registerCommand(Command{
+		Name:        "whisper",
+		Usage:       "/whisper <user> <message>",
+		Description: "Send a private message",
+		Handler:     whisperCommand,
+	})
+	registerCommand(Command{
+		Name:        "w",
+		Usage:       "/w <user> <message>",
+		Description: "Short for /whisper",
+		Handler:     whisperCommand,
+	})
+	registerCommand(Command{
+		Name:        "delete",
+		Usage:       "/delete [msgID | #channel]",
+		Description: "Delete a message (by default your last one) or a channel",
+		Handler:     deleteCommand,
+	})
+	registerCommand(Command{
+		Name:        "category",
+		Usage:       "/category create <name> | add <channel> <name> | remove <channel>",
+		Description: "Group channels into sidebar sections (admins only)",
+		Handler:     categoryCommand,
+	})
+	registerCommand(Command{
+		Name:        "react",
+		Usage:       "/react <msgID> <emoji>",
+		Description: "Toggle a reaction on a message",
+		Handler:     reactCommand,
+	})
+	registerCommand(Command{
+		Name:        "pin",
+		Usage:       "/pin <msgID>",
+		Description: "Pin a message to the channel's pinboard (mods and admins only)",
+		Handler:     pinCommand,
+	})
+	registerCommand(Command{
+		Name:        "pinboard",
+		Usage:       "/pinboard",
+		Description: "Show the channel's pinned messages, where u unpins one",
+		Handler:     pinboardCommand,
+	})
+	registerCommand(Command{
+		Name:        "bookmarks",
+		Usage:       "/bookmarks",
+		Description: "List bookmarked messages, bookmarked with Ctrl+B in vim normal mode",
+		Handler:     bookmarksCommand,
+	})
+	registerCommand(Command{
+		Name:        "poll",
+		Usage:       "/poll <question> | <option> | <option> ...",
+		Description: "Ask the channel a question with 2 to 10 options to vote on",
+		Handler:     pollCommand,
+	})
+	registerCommand(Command{
+		Name:        "vote",
+		Usage:       "/vote <pollID> <option>",
+		Description: "Vote for a poll's option by number; voting again changes your vote",
+		Handler:     voteCommand,
+	})
+	registerCommand(Command{
+		Name:        "privacy",
+		Usage:       "/privacy [store on|off]",
+		Description: "Show or change whether the server saves your messages",
+		Help: "With storing off, your messages still reach everyone in the channel but the server " +
+			"never saves them, and others see them marked [ephemeral]. Whispers aren't saved " +
+			"either, encrypted or not. Unsaved messages aren't in the history, search or " +
+			"exports, and can't be edited, deleted, pinned, reacted or replied to. Anyone " +
+			"in the channel can still copy or log what they see.",
+		Handler: privacyCommand,
+	})
+	registerCommand(Command{
+		Name:        "invite",
+		Usage:       "/invite <username> <channel>",
+		Description: "Let someone into an invite-only channel (mods and admins only)",
+		Handler:     inviteCommand,
+	})
+	registerCommand(Command{
+		Name:        "mode",
+		Usage:       "/mode <channel> public|invite-only|read-only",
+		Description: "Set who may post in a channel (mods and admins only)",
+		Handler:     modeCommand,
+	})
+	registerCommand(Command{
+		Name:        "notify",
+		Usage:       "/notify add <pattern> | list | remove <pattern>",
+		Description: "Ring the bell for messages matching a pattern, like a mention",
+		Handler:     notifyCommand,
+	})
+	registerCommand(Command{
+		Name:        "history",
+		Usage:       "/history [N]",
+		Description: "Load N older messages (default 50); scrolling to the top does it too",
+		Handler:     historyCommand,
+	})
+	registerCommand(Command{
+		Name:        "alias",
+		Usage:       "/alias add <name> <command> | list | remove <name> | save",
+		Description: "Name a command, e.g. /alias add dm /whisper $1 $2",
+		Handler:     aliasCommand,
+	})
+	registerCommand(Command{
+		Name:        "file",
+		Usage:       "/file <path>",
+		Description: "Share a file with the channel",
+		Handler:     fileCommand,
+	})
+	registerCommand(Command{
+		Name:        "search",
+		Usage:       "/search <query>",
+		Description: "Search messages in the channel",
+		Handler:     searchCommand,
+	})
+	registerCommand(Command{
+		Name:        "create",
+		Usage:       "/create <name>",
+		Description: "Create a channel",
+		Handler:     createCommand,
+	})
+	registerCommand(Command{
+		Name:        "join",
+		Usage:       "/join <channel>",
+		Description: "Switch to another channel",
+		Handler:     joinCommand,
+	})
+	registerCommand(Command{
+		Name:        "export",
+		Usage:       "/export [channel] [from] [to] [--format json|md] [--bookmarks]",
+		Description: "Save a channel's messages, or your bookmarks, to a file in your home directory",
+		Handler:     exportCommand,
+	})
+	registerCommand(Command{
+		Name:        "topic",
+		Usage:       "/topic <text>",
+		Description: "Set the channel's topic",
+		Handler:     topicCommand,
+	})
+	registerCommand(Command{
+		Name:        "markdown",
+		Usage:       "/markdown on|off",
+		Description: "Turn Markdown formatting of messages on or off",
+		Handler:     markdownCommand,
+	})
+	registerCommand(Command{
+		Name:        "theme",
+		Usage:       "/theme <number|name>|list|save",
+		Description: "Switch theme, list the presets, or keep the current one",
+		Handler:     themeCommand,
+	})
+	registerCommand(Command{
+		Name:        "compact",
+		Usage:       "/compact",
+		Description: "Toggle showing runs of messages from one person under one name",
+		Handler:     compactCommand,
+	})
+	registerCommand(Command{
+		Name:        "animation",
+		Usage:       "/animation [none|slow|normal|fast]",
+		Description: "Show or change how fast animations run, or turn them off",
+		Help: "none keeps everything still: spinners show …, pulsing dots stay ●, and the " +
+			"connecting bar stays full. It lasts until you quit; set animation_speed in " +
+			"~/.echo/config.toml to keep it, or run with REDUCE_MOTION=1 to always start with none.",
+		Handler: animationCommand,
+	})
+	registerCommand(Command{
+		Name:        "enable2fa",
+		Usage:       "/enable2fa",
+		Description: "Turn on two-factor authentication for your account",
+		Handler:     enable2faCommand,
+	})
+	registerCommand(Command{
+		Name:        "disable2fa",
+		Usage:       "/disable2fa <password>",
+		Description: "Turn off two-factor authentication",
+		Handler:     disable2faCommand,
+	})
+	registerCommand(Command{
+		Name:        "passwd",
+		Usage:       "/passwd <old> <new>",
+		Description: "Change your password, logging out your other sessions",
+		Handler:     passwdCommand,
+	})
+	registerCommand(Command{
+		Name:        "away",
+		Usage:       "/away [message]",
+		Description: "Show others you're away, optionally saying why",
+		Handler:     awayCommand,
+	})
+	registerCommand(Command{
+		Name:        "back",
+		Usage:       "/back",
+		Description: "Show others you're online again",
+		Handler:     backCommand,
+	})
+	registerCommand(Command{
+		Name:        "dnd",
+		Usage:       "/dnd [message]",
+		Description: "Do not disturb: stop mention and typing notifications",
+		Handler:     dndCommand,
+	})
+	registerCommand(Command{
+		Name:        "setstatus",
+		Usage:       "/setstatus <emoji> <text>",
+		Description: "Set a status others see next to your name",
+		Handler:     setStatusCommand,
+	})
+	registerCommand(Command{
+		Name:        "setcolor",
+		Usage:       "/setcolor #RRGGBB | auto",
+		Description: "Pick the color others see your name in",
+		Handler:     setColorCommand,
+	})
+	registerCommand(Command{
+		Name:        "kick",
+		Usage:       "/kick <username> [reason]",
+		Description: "Disconnect a user (admins only)",
+		Handler:     kickCommand,
+	})
+	registerCommand(Command{
+		Name:        "ban",
+		Usage:       "/ban <username> [duration] [reason]",
+		Description: "Ban a user, e.g. for 2h or 7d, or for good (admins only)",
+		Handler:     banCommand,
+	})
+	registerCommand(Command{
+		Name:        "announce",
+		Usage:       "/announce <text>",
+		Description: "Announce something to everyone on the server (admins only)",
+		Handler:     announceCommand,
+	})
+	registerCommand(Command{
+		Name:        "motd",
+		Usage:       "/motd [on|off|set <text>]",
+		Description: "Show the message of the day, hide it on reconnects, or change it (admins only)",
+		Handler:     motdCommand,
+	})
+	registerCommand(Command{
+		Name:        "maintenance",
+		Usage:       "/maintenance on [message] | off",
+		Description: "Put the server in maintenance mode, turning new connections away (admins only)",
+		Handler:     maintenanceCommand,
+	})
+	registerCommand(Command{
+		Name:        "stats",
+		Usage:       "/stats",
+		Description: "Show who is online, guests included (admins only)",
+		Handler:     statsCommand,
+	})
+	registerCommand(Command{
+		Name:        "reloadfilters",
+		Usage:       "/reloadfilters",
+		Description: "Reload the server's word filter list (admins only)",
+		Handler:     reloadFiltersCommand,
+	})
+	registerCommand(Command{
+		Name:        "webhook",
+		Usage:       "/webhook test <name> | create <channel> | revoke <token>",
+		Description: "Ping an outgoing webhook, or create or revoke an incoming one (admins only)",
+		Handler:     webhookCommand,
+	})
+}
+
+// parseCommand splits "/name args..." into its name and arguments
+func parseCommand(input string) (cmd, args string, isCmd bool) {
+	input = strings.TrimSpace(input)
+	if len(input) < 2 || input[0] != '/' {
+		return "", "", false
+	}
+	name, rest, _ := strings.Cut(input[1:], " ")
+	return strings.ToLower(name), strings.TrimSpace(rest), true
+}
+
+// findCommand looks a command up in the registry by name
+func findCommand(name string) (Command, bool) {
+	for _, c := range commands {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Command{}, false
+}
+
+// handleCommand runs a slash command instead of sending it to the server
+func (m mainModel) handleCommand(name string, args string) (mainModel, tea.Cmd) {
+	var cmd tea.Cmd
+	name, args = m.resolveAlias(name, args)
+	if c, ok := findCommand(name); ok {
+		m, cmd = c.Handler(m, args)
+	} else {
+		m.addSystemMessage(fmt.Sprintf("Unknown command /%s - type /help for a list", name))
+	}
+
+	// Commands normally show their output at the bottom, but /join may
+	// restore an earlier reading position
+	m.viewport.SetContent(m.renderMessages())
+	if m.autoScroll {
+		m.viewport.GotoBottom()
+	}
+	return m, cmd
+}
+
+func helpCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	if name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(args), "/")); name != "" {
+		c, ok := findCommand(name)
+		if !ok {
+			m.addSystemMessage(fmt.Sprintf("Unknown command /%s - type /help for a list", name))
+			return m, nil
+		}
+		lines := []string{c.Usage, "    " + c.Description}
+		if c.Help != "" {
+			lines = append(lines, "", c.Help)
+		}
+		m.addSystemMessage(strings.Join(lines, "\n"))
+		return m, nil
+	}
+
+	width := 0
+	for _, c := range commands {
+		width = max(width, len(c.Usage))
+	}
+
+	lines := []string{"Available commands:"}
+	for _, c := range commands {
+		lines = append(lines, fmt.Sprintf("    %-*s  %s", width, c.Usage, c.Description))
+	}
+
+	keys := m.config.Keys
+	lines = append(lines, "Keybindings:")
+	for _, k := range [][2]string{
+		{keys.KeySend, "Send message"},
+		{keys.KeyScrollUp, "Scroll up"},
+		{keys.KeyScrollDown, "Scroll down"},
+		{keys.KeySwitchChannel, "Switch to the next channel"},
+		{keys.KeyQuit, "Quit"},
+	} {
+		lines = append(lines, fmt.Sprintf("    %-*s  %s", width, keyLabel(k[0]), k[1]))
+	}
+	m.addSystemMessage(strings.Join(lines, "\n"))
+	return m, nil
+}
+
+func whisperCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	target, text, _ := strings.Cut(args, " ")
+	text = strings.TrimSpace(text)
+	if target == "" || text == "" {
+		m.addSystemMessage("Usage: /whisper <user> <message>")
+		return m, nil
+	}
+
+	return m, m.sendWhisper(target, text)
+}
+
+// privacyCommand asks the server whether it stores our messages, or
+// changes it; the PRIVACY frame it answers with is shown
+func privacyCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	fields := strings.Fields(strings.ToLower(args))
+	switch {
+	case len(fields) == 0:
+		return m, m.sendMessageCmd("PRIVACY:")
+	case len(fields) == 2 && fields[0] == "store" && (fields[1] == "on" || fields[1] == "off"):
+		return m, m.sendMessageCmd("PRIVACY:store:" + fields[1])
+	}
+	m.addSystemMessage("Usage: /privacy [store on|off]")
+	return m, nil
+}
+
+// messageIDPattern matches server message IDs, telling them apart from
+// channel names in /delete
+var messageIDPattern = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+func deleteCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	id := strings.TrimSpace(args)
+	if id != "" && !messageIDPattern.MatchString(id) {
+		name := strings.TrimPrefix(id, "#")
+		if err := validateChannelName(name); err != nil {
+			m.addSystemMessage("Can't delete #" + name + ": " + err.Error())
+			return m, nil
+		}
+		return m, m.sendMessageCmd("DELETECHANNEL:" + name)
+	}
+	if id == "" {
+		last, ok := m.lastOwnMessage()
+		if !ok {
+			m.addSystemMessage("You have no messages to delete")
+			return m, nil
+		}
+		id = last.ID
+	}
+	return m, m.sendMessageCmd("DELETE:" + id)
+}
+
+func markdownCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	switch strings.ToLower(strings.TrimSpace(args)) {
+	case "on":
+		m.config.Markdown = true
+		m.addSystemMessage("Markdown formatting on")
+	case "off":
+		m.config.Markdown = false
+		m.addSystemMessage("Markdown formatting off")
+	default:
+		state := "off"
+		if m.config.Markdown {
+			state = "on"
+		}
+		m.addSystemMessage("Markdown formatting is " + state + " - usage: /markdown on|off")
+	}
+	return m, nil
+}
+
+// themeCommand switches to a preset theme, lists them, or saves the
+// current one to the config file
+func themeCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	args = strings.TrimSpace(args)
+	switch strings.ToLower(args) {
+	case "":
+		name := themeNames[m.config.Preset]
+		if name == "" {
+			name = "custom colors"
+		}
+		m.addSystemMessage("The theme is " + name + " - usage: /theme <number|name>|list|save")
+		return m, nil
+	case "list":
+		lines := []string{"Themes:"}
+		for n := 1; n <= len(themePresets); n++ {
+			theme := themePresets[n]
+			swatch := lipgloss.NewStyle().Foreground(lipgloss.Color(theme.WindowColor)).Render("■") +
+				lipgloss.NewStyle().Foreground(lipgloss.Color(theme.UserColor)).Render("■")
+			current := ""
+			if n == m.config.Preset {
+				current = "  (current)"
+			}
+			lines = append(lines, fmt.Sprintf("    %2d  %s  %s%s", n, swatch, themeNames[n], current))
+		}
+		m.addSystemMessage(strings.Join(lines, "\n"))
+		return m, nil
+	case "save":
+		if _, ok := themePresets[m.config.Preset]; !ok {
+			m.addOutcomeMessage("Pick a theme with /theme <number|name> first", outcomeError)
+			return m, nil
+		}
+		path := configPath()
+		if err := savePreset(path, m.config.Preset); err != nil {
+			m.addOutcomeMessage("Couldn't save the theme: "+err.Error(), outcomeError)
+			return m, nil
+		}
+		m.addOutcomeMessage(fmt.Sprintf("Saved %s as your theme in %s", themeNames[m.config.Preset], path), outcomeSuccess)
+		return m, nil
+	}
+
+	preset, ok := findPreset(args)
+	if !ok {
+		m.addOutcomeMessage("There's no theme "+args+" - see /theme list", outcomeError)
+		return m, nil
+	}
+	m.setTheme(preset)
+	m.addSystemMessage(fmt.Sprintf("Switched to %s - /theme save keeps it", themeNames[preset]))
+	return m, tea.ClearScreen
+}
+
+// findPreset looks a theme up by number or name, ignoring case and spaces
+func findPreset(query string) (int, bool) {
+	if n, err := strconv.Atoi(query); err == nil {
+		_, ok := themePresets[n]
+		return n, ok
+	}
+	normalize := func(s string) string {
+		return strings.ToLower(strings.NewReplacer(" ", "", "-", "", "_", "").Replace(s))
+	}
+	for n, name := range themeNames {
+		if normalize(name) == normalize(query) {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// setTheme recolors the whole client with a preset
+func (m *mainModel) setTheme(preset int) {
+	m.config.ThemeConfig = themePresets[preset]
+	m.config.Preset = preset
+	m.styles = InitStyles(m.config)
+	m.markdownCache = map[string]string{} // Rendered with the old colors
+}
+
+// compactCommand toggles compact mode, redrawing the chat to match
+func compactCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	m.config.CompactMode = !m.config.CompactMode
+	if m.config.CompactMode {
+		m.addSystemMessage("Compact mode on")
+	} else {
+		m.addSystemMessage("Compact mode off")
+	}
+	return m, nil
+}
+
+func reactCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	id, emoji, _ := strings.Cut(args, " ")
+	emoji = strings.TrimSpace(emoji)
+	if id == "" || emoji == "" {
+		m.addSystemMessage("Usage: /react <msgID> <emoji>")
+		return m, nil
+	}
+	return m, m.sendMessageCmd("REACT:" + id + ":" + emoji)
+}
+
+func fileCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	path := strings.TrimSpace(args)
+	if path == "" {
+		m.addSystemMessage("Usage: /file <path>")
+		return m, nil
+	}
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, rest)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		m.addSystemMessage("Can't read " + path)
+		return m, nil
+	}
+	if info.Size() == 0 {
+		m.addSystemMessage(filepath.Base(path) + " is empty")
+		return m, nil
+	}
+	if info.Size() > m.maxUploadBytes() {
+		m.addSystemMessage(fmt.Sprintf("%s is %s, over the %s upload limit",
+			filepath.Base(path), formatBytes(info.Size()), formatBytes(m.maxUploadBytes())))
+		return m, nil
+	}
+
+	m.addSystemMessage("Uploading " + filepath.Base(path) + "…")
+	return m, m.sendFileCmd(path)
+}
+
+// passwdCommand changes the password, sent as PASSWD:{"old":..,"new":..}
+// so passwords may hold any character. The server replies PASSWD_OK or
+// PASSWD_ERR:<reason>.
+func passwdCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	fields, ok := quotedFields(args)
+	if !ok || len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+		m.addSystemMessage(`Usage: /passwd <old> <new>, quoting passwords with spaces like "my old one"`)
+		return m, nil
+	}
+	frame, err := json.Marshal(struct {
+		Old string `json:"old"`
+		New string `json:"new"`
+	}{fields[0], fields[1]})
+	if err != nil {
+		m.addSystemMessage("Couldn't send the password change: " + err.Error())
+		return m, nil
+	}
+	return m, m.sendMessageCmd("PASSWD:" + string(frame))
+}
+
+// quotedFields splits s at whitespace like strings.Fields, except that a
+// field may be a Go-style "quoted string" holding spaces. It's false for
+// an unterminated quote.
+func quotedFields(s string) ([]string, bool) {
+	var fields []string
+	rest := strings.TrimSpace(s)
+	for rest != "" {
+		if rest[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, false
+			}
+			field, _ := strconv.Unquote(quoted)
+			fields = append(fields, field)
+			rest = rest[len(quoted):]
+			if rest != "" && !unicode.IsSpace(rune(rest[0])) {
+				return nil, false
+			}
+		} else {
+			end := strings.IndexFunc(rest, unicode.IsSpace)
+			if end == -1 {
+				end = len(rest)
+			}
+			fields = append(fields, rest[:end])
+			rest = rest[end:]
+		}
+		rest = strings.TrimLeftFunc(rest, unicode.IsSpace)
+	}
+	return fields, true
+}
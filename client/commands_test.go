@@ -0,0 +1,30 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestQuotedFields(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		ok   bool
+	}{
+		{"old new", []string{"old", "new"}, true},
+		{"  old\tnew  ", []string{"old", "new"}, true},
+		{`"old pass" new`, []string{"old pass", "new"}, true},
+		{`old "new \"quoted\" pass"`, []string{"old", `new "quoted" pass`}, true},
+		{"a:b c:d", []string{"a:b", "c:d"}, true},
+		{`"" new`, []string{"", "new"}, true},
+		{"", nil, true},
+		{`"unterminated new`, nil, false},
+		{`"old"new`, nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := quotedFields(tt.in)
+		if ok != tt.ok || !slices.Equal(got, tt.want) {
+			t.Errorf("quotedFields(%q) = %q, %v, want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
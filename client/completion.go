@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// completionPopupItems is how many candidates the popup shows at once
+const completionPopupItems = 6
+
+// completionCandidates lists what the last word of input could complete to:
+// @users, #channels (or bare names after /join), /commands and :emoji:
+// shortcodes. Matching is case-insensitive by prefix, shortest first.
+func (m mainModel) completionCandidates(input string) []string {
+	fields := strings.Fields(input)
+	if len(fields) == 0 || strings.HasSuffix(input, " ") {
+		// Only "/join " completes an empty word, with channel names
+		if len(fields) != 1 || fields[0] != "/join" {
+			return nil
+		}
+		fields = append(fields, "")
+	}
+	word := fields[len(fields)-1]
+
+	var prefix string
+	var names []string
+	switch {
+	case strings.HasPrefix(word, "@"):
+		prefix = "@"
+		names = m.onlineUsers
+	case strings.HasPrefix(word, "#"):
+		prefix = "#"
+		names = m.channelNames()
+	case len(fields) == 2 && fields[0] == "/join":
+		names = m.channelNames()
+	case strings.HasPrefix(word, "/") && len(fields) == 1:
+		prefix = "/"
+		for _, c := range commands {
+			names = append(names, c.Name)
+		}
+		for name := range m.aliases {
+			names = append(names, name)
+		}
+	case shortcodeWord.MatchString(word):
+		prefix = ":"
+		names = shortcodeNames()
+	default:
+		return nil
+	}
+
+	partial := strings.ToLower(strings.TrimPrefix(word, prefix))
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(strings.ToLower(name), partial) {
+			matches = append(matches, prefix+name)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if len(matches[i]) != len(matches[j]) {
+			return len(matches[i]) < len(matches[j])
+		}
+		return matches[i] < matches[j]
+	})
+	return matches
+}
+
+func (m mainModel) channelNames() []string {
+	names := make([]string, len(m.channels))
+	for i, c := range m.channels {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// complete fills in the word being typed, cycling through the candidates
+// on repeated presses; step is 1 for Tab and -1 for Shift+Tab
+func (m *mainModel) complete(step int) {
+	if len(m.completions) == 0 {
+		input := m.msgInput.Value()
+		m.completions = m.completionCandidates(input)
+		if len(m.completions) == 0 {
+			return
+		}
+		m.completionBase = input[:strings.LastIndexAny(input, " \n")+1]
+		m.completionIdx = 0
+		if step < 0 {
+			m.completionIdx = len(m.completions) - 1
+		}
+	} else {
+		n := len(m.completions)
+		m.completionIdx = (m.completionIdx + step + n) % n
+	}
+
+	m.msgInput.SetValue(m.completionBase + m.completionText(m.completions[m.completionIdx]))
+	m.msgInput.CursorEnd()
+}
+
+// completionText is what a candidate puts in the input: the emoji for a
+// shortcode, unless emoji_expand is off, otherwise the candidate itself
+func (m mainModel) completionText(candidate string) string {
+	if emoji, ok := candidateEmoji(candidate); ok && m.config.EmojiExpand {
+		return emoji
+	}
+	return candidate
+}
+
+// candidateEmoji is the emoji a :shortcode: candidate stands for
+func candidateEmoji(candidate string) (string, bool) {
+	if !strings.HasPrefix(candidate, ":") || !strings.HasSuffix(candidate, ":") {
+		return "", false
+	}
+	emoji, ok := emojiShortcodes[strings.Trim(candidate, ":")]
+	return emoji, ok
+}
+
+func (m *mainModel) resetCompletion() {
+	m.completions = nil
+	m.completionIdx = 0
+	m.completionBase = ""
+}
+
+// renderCompletionPopup shows a window of candidates around the selected one
+func (m mainModel) renderCompletionPopup() string {
+	start := max(0, min(m.completionIdx-completionPopupItems/2, len(m.completions)-completionPopupItems))
+	end := min(len(m.completions), start+completionPopupItems)
+
+	selected := lipgloss.NewStyle().Foreground(m.styles.PrimaryColor).Bold(true)
+	items := make([]string, 0, end-start+2)
+	if start > 0 {
+		items = append(items, m.styles.InlineHint("…"))
+	}
+	for i := start; i < end; i++ {
+		label := m.completions[i]
+		if emoji, ok := candidateEmoji(label); ok {
+			label = emoji + " " + label
+		}
+		if i == m.completionIdx {
+			items = append(items, selected.Render(label))
+		} else {
+			items = append(items, m.styles.Msg.Render(label))
+		}
+	}
+	if end < len(m.completions) {
+		items = append(items, m.styles.InlineHint("…"))
+	}
+
+	return lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(m.styles.PrimaryColor).
+		Padding(0, 1).
+		Render(strings.Join(items, "  "))
+}
+
+// overlay draws top over base with its top-left corner at column x, row y
+func overlay(base string, top string, x int, y int) string {
+	lines := strings.Split(base, "\n")
+	for i, row := range strings.Split(top, "\n") {
+		if y+i < 0 || y+i >= len(lines) {
+			continue
+		}
+		line := lines[y+i]
+		left := ansi.Truncate(line, x, "")
+		if pad := x - ansi.StringWidth(left); pad > 0 {
+			left += strings.Repeat(" ", pad)
+		}
+		right := ansi.TruncateLeft(line, x+ansi.StringWidth(row), "")
+		lines[y+i] = left + row + right
+	}
+	return strings.Join(lines, "\n")
+}
@@ -1,24 +1,133 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+
+	"github.com/BurntSushi/toml"
 )
 
-// Config holds the color configuration for the TUI
+// Config holds the client configuration, read from the sections of
+// ~/.echo/config.toml. The embedded sections keep fields like
+// config.WindowColor directly accessible.
 type Config struct {
-	WindowColor   string
-	UserColor     string
-	DateTimeColor string
-	MsgColor      string
-	TextColor     string
-	PrivMsgColor  string // Color for private/whisper messages
+	ThemeConfig  `toml:"theme"`
+	Keys         Keybindings `toml:"keybindings"`
+	LayoutConfig `toml:"layout"`
+	ServerConfig `toml:"server"`
+	Servers      []SavedServer     `toml:"servers,omitempty"` // Address book shown before the login form
+	Notify       []NotifyRule      `toml:"notify,omitempty"`  // Keywords that alert like mentions, see notify.go
+	Aliases      map[string]string `toml:"aliases,omitempty"` // Names for commands, e.g. j = "/join", see aliases.go
+}
+
+// configFile is the config's name in ~/.echo
+const configFile = "config.toml"
+
+// legacyConfigPath is where the config used to be kept, in the directory
+// the client was run from
+const legacyConfigPath = "theme.conf"
+
+// configPath returns where the config is read from, and saved servers
+// written to: ~/.echo/config.toml, or config.toml in the working directory
+// when there's no home directory
+func configPath() string {
+	dir, err := echoDir()
+	if err != nil {
+		return configFile
+	}
+	return filepath.Join(dir, configFile)
+}
+
+// adoptLegacyConfig copies a theme.conf in the working directory to path,
+// the first time the client runs with the config in ~/.echo
+func adoptLegacyConfig(path string) error {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return nil
+	}
+	data, err := os.ReadFile(legacyConfigPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// ThemeConfig holds the colors of the TUI
+type ThemeConfig struct {
+	Preset        int    `toml:"preset,omitempty"` // Number of a themePresets entry
+	WindowColor   string `toml:"window,omitempty"`
+	UserColor     string `toml:"user,omitempty"`
+	DateTimeColor string `toml:"datetime,omitempty"`
+	MsgColor      string `toml:"msg,omitempty"`
+	TextColor     string `toml:"text,omitempty"`
+	PrivMsgColor  string `toml:"priv_message,omitempty"` // Color for private/whisper messages
+}
+
+// LayoutConfig controls what the chat view shows
+type LayoutConfig struct {
+	ShowSidebar  bool `toml:"show_sidebar"`   // Channels and online users, on wide terminals
+	Mouse        bool `toml:"mouse"`          // Off lets the terminal handle selection for copy-paste
+	RelativeTime bool `toml:"relative_time"`  // "2m ago" instead of "[15:04]"
+	UserColors   bool `toml:"user_colors"`    // A color per username; off shows them all alike
+	Markdown     bool `toml:"markdown"`       // Render **bold**, `code` and the like in messages
+	Hyperlinks   bool `toml:"hyperlinks"`     // Clickable, shortened links on terminals that support them
+	SortByUnread bool `toml:"sort_by_unread"` // List channels with unread messages first
+	VimMode      bool `toml:"vim_mode"`       // Esc enters a normal mode with j/k, gg/G, r, y, / and i
+	CompactMode  bool `toml:"compact_mode"`   // Runs of messages from one author show the name once
+	ShowLatency  bool `toml:"show_latency"`   // Round trip to the server, averaged and colored in the footer
+	EmojiExpand  bool `toml:"emoji_expand"`   // Send :shortcodes: as emoji; off sends them as typed
+	CharCounter  bool `toml:"char_counter"`   // "(42/500)" beside the input, colored as it nears the limit
+	// [ephemeral] on messages the server didn't store, see /privacy
+	ShowEphemeralBadge bool `toml:"show_ephemeral_badge"`
+	// normal, fast, slow or none to keep still; REDUCE_MOTION=1 means none
+	AnimationSpeed string `toml:"animation_speed,omitempty"`
+}
+
+// ServerConfig holds connection settings
+type ServerConfig struct {
+	Address            string `toml:"address,omitempty"`     // Prefilled on the login screen
+	MaxRetries         int    `toml:"max_retries"`           // Connection attempts to retry before giving up
+	TLS                bool   `toml:"tls"`                   // Connect with wss:// by default
+	InsecureSkipVerify bool   `toml:"insecure_skip_verify"`  // Skip TLS certificate checks, for local development only
+	Transport          string `toml:"transport,omitempty"`   // "ws" for websockets, the default, or "grpc"
+	E2E                bool   `toml:"e2e"`                   // Encrypt whispers end to end with peers that have it on too
+	AdminToken         string `toml:"admin_token,omitempty"` // Sent to the server's /api/stats by /stats
+	LogLevel           string `toml:"log_level,omitempty"`   // What ~/.echo/client.log records: debug, info, warn or error
+}
+
+// Keybindings maps chat actions to keys, written the way bubbletea names
+// them, e.g. "enter", "ctrl+s" or "pgup"
+type Keybindings struct {
+	KeySend          string `toml:"send"`
+	KeyQuit          string `toml:"quit"`
+	KeyScrollUp      string `toml:"scroll_up"`
+	KeyScrollDown    string `toml:"scroll_down"`
+	KeySwitchChannel string `toml:"switch_channel"`
 }
 
-// Preset themes - select by number in theme.conf
-var themePresets = map[int]Config{
+// DefaultKeybindings returns the bindings used when the config sets none
+func DefaultKeybindings() Keybindings {
+	return Keybindings{
+		KeySend:          "enter",
+		KeyQuit:          "esc",
+		KeyScrollUp:      "pgup",
+		KeyScrollDown:    "pgdown",
+		KeySwitchChannel: "ctrl+o",
+	}
+}
+
+// Preset themes - select by number in the config
+var themePresets = map[int]ThemeConfig{
 	// 1: Default (Purple/Cyan)
 	1: {
 		WindowColor:   "#7D56F4",
@@ -156,46 +265,251 @@ var themePresets = map[int]Config{
 	},
 }
 
+// themeNames are the presets' names, as listed in theme.conf
+var themeNames = map[int]string{
+	1:  "Default",
+	2:  "Cyberpunk",
+	3:  "Forest",
+	4:  "Ocean",
+	5:  "Sunset",
+	6:  "Dracula",
+	7:  "Nord",
+	8:  "Monokai",
+	9:  "Gruvbox",
+	10: "Tokyo Night",
+	11: "One Dark",
+	12: "Material Dark",
+	13: "Catppuccin",
+	14: "Solarized",
+	15: "Ayu Dark",
+}
+
 // DefaultConfig returns the default configuration
 func DefaultConfig() Config {
-	return themePresets[1] // Default theme
+	theme := themePresets[1] // Default theme
+	theme.Preset = 1
+	return Config{
+		ThemeConfig:  theme,
+		Keys:         DefaultKeybindings(),
+		LayoutConfig: LayoutConfig{ShowSidebar: true, Mouse: true, UserColors: true, Hyperlinks: true, ShowLatency: true, EmojiExpand: true, CharCounter: true, ShowEphemeralBadge: true, AnimationSpeed: animationNormal},
+		ServerConfig: ServerConfig{MaxRetries: defaultMaxRetries},
+	}
 }
 
-// LoadConfig reads the configuration from a file
+// normalizeKeys lowercases bindings, restoring defaults for empty ones
+func normalizeKeys(keys *Keybindings) {
+	defaults := DefaultKeybindings()
+	for _, k := range []struct{ binding, fallback *string }{
+		{&keys.KeySend, &defaults.KeySend},
+		{&keys.KeyQuit, &defaults.KeyQuit},
+		{&keys.KeyScrollUp, &defaults.KeyScrollUp},
+		{&keys.KeyScrollDown, &defaults.KeyScrollDown},
+		{&keys.KeySwitchChannel, &defaults.KeySwitchChannel},
+	} {
+		*k.binding = strings.ToLower(strings.ReplaceAll(*k.binding, " ", ""))
+		if *k.binding == "" {
+			*k.binding = *k.fallback
+		}
+	}
+}
+
+// keyLabel formats a binding for display, e.g. "ctrl+s" as "Ctrl+S"
+func keyLabel(binding string) string {
+	parts := strings.Split(binding, "+")
+	for i, part := range parts {
+		switch part {
+		case "":
+		case "pgup":
+			parts[i] = "PgUp"
+		case "pgdown":
+			parts[i] = "PgDn"
+		default:
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "+")
+}
+
+// LoadConfig reads the configuration from a TOML file. Settings missing
+// from the file keep their defaults, and colors set in [theme] override
+// the chosen preset. Files in the old "KEY: value" format are converted
+// to TOML in place.
 func LoadConfig(path string) (Config, error) {
 	config := DefaultConfig()
 
-	file, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return config, nil // Return default if file doesn't exist
 		}
 		return config, err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
+	if isLegacyConfig(string(data)) {
+		return migrateLegacyConfig(path, string(data))
+	}
+
+	// The preset goes first so that colors in the file can override it
+	var selected struct {
+		Theme struct {
+			Preset int `toml:"preset"`
+		} `toml:"theme"`
+	}
+	if _, err := toml.Decode(string(data), &selected); err != nil {
+		return config, err
+	}
+	if preset, ok := themePresets[selected.Theme.Preset]; ok {
+		config.ThemeConfig = preset
+	}
+
+	if _, err := toml.Decode(string(data), &config); err != nil {
+		return DefaultConfig(), err
+	}
+	normalizeKeys(&config.Keys)
+	config.AnimationSpeed = strings.ToLower(config.AnimationSpeed)
+	return config, nil
+}
+
+// SaveConfig writes cfg to path as TOML. A preset's own colors aren't
+// written out, so that changing the preset later changes them too.
+func SaveConfig(path string, cfg Config) error {
+	if preset, ok := themePresets[cfg.Preset]; ok {
+		preset.Preset = cfg.Preset
+		if cfg.ThemeConfig == preset {
+			cfg.ThemeConfig = ThemeConfig{Preset: cfg.Preset}
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("# Echo client configuration\n\n")
+	enc := toml.NewEncoder(&b)
+	enc.Indent = ""
+	if err := enc.Encode(cfg); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b.Bytes(), 0644)
+}
+
+// appendConfig writes tables, encoded as TOML, to the end of the config
+// file, leaving the rest of it and its comments as they are
+func appendConfig(path string, tables any) error {
+	var b bytes.Buffer
+	b.WriteString("\n")
+	enc := toml.NewEncoder(&b)
+	enc.Indent = ""
+	if err := enc.Encode(tables); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// presetLine matches a preset setting in the config file
+var presetLine = regexp.MustCompile(`^\s*preset\s*=`)
+
+// savePreset sets the preset in the config file's [theme] section,
+// leaving the rest of it and its comments as they are
+func savePreset(path string, preset int) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		cfg := DefaultConfig()
+		cfg.ThemeConfig = themePresets[preset]
+		cfg.Preset = preset
+		return SaveConfig(path, cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	setting := fmt.Sprintf("preset = %d", preset)
+	lines := strings.Split(string(data), "\n")
+	header := -1
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if header == -1 {
+			if line == "[theme]" {
+				header = i
+			}
 			continue
 		}
+		if strings.HasPrefix(line, "[") {
+			break // No preset in [theme] yet
+		}
+		if presetLine.MatchString(line) {
+			lines[i] = setting
+			return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+		}
+	}
+
+	if header == -1 {
+		lines = append([]string{"[theme]", setting, ""}, lines...)
+	} else {
+		lines = append(lines[:header+1], append([]string{setting}, lines[header+1:]...)...)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+}
 
-		parts := strings.SplitN(line, ":", 2)
-		if len(parts) != 2 {
+// isLegacyConfig reports whether data uses the old "KEY: value" format,
+// recognised by its first setting not being a [section] header
+func isLegacyConfig(data string) bool {
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
 			continue
 		}
+		return !strings.HasPrefix(line, "[")
+	}
+	return false
+}
 
-		key := strings.TrimSpace(parts[0])
-		value := strings.TrimSpace(parts[1])
+// parseBool accepts true/false, yes/no, on/off and 1/0
+func parseBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1":
+		return true
+	}
+	return false
+}
 
-		switch key {
+// migrateLegacyConfig reads an old "KEY: value" config, rewrites path as
+// TOML (keeping the original as path.bak) and warns that the old format
+// is deprecated
+func migrateLegacyConfig(path string, data string) (Config, error) {
+	config := DefaultConfig()
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		// Old files allowed trailing notes like "#FF69B4   (pink)"
+		if fields := strings.Fields(value); len(fields) > 0 {
+			value = fields[0]
+		}
+
+		switch strings.TrimSpace(key) {
 		case "THEME":
-			// Load preset theme by number
-			themeNum, err := strconv.Atoi(value)
-			if err == nil {
-				if preset, exists := themePresets[themeNum]; exists {
-					config = preset
+			if n, err := strconv.Atoi(value); err == nil {
+				if preset, ok := themePresets[n]; ok {
+					config.ThemeConfig = preset
+					config.Preset = n
 				}
 			}
 		case "WINDOW":
@@ -210,12 +524,46 @@ func LoadConfig(path string) (Config, error) {
 			config.TextColor = value
 		case "PRIV_MESSAGE":
 			config.PrivMsgColor = value
+		case "SHOW_LATENCY":
+			config.ShowLatency = parseBool(value)
+		case "EMOJI_EXPAND":
+			config.EmojiExpand = parseBool(value)
+		case "CHAR_COUNTER":
+			config.CharCounter = parseBool(value)
+		case "SHOW_EPHEMERAL_BADGE":
+			config.ShowEphemeralBadge = parseBool(value)
+		case "ANIMATION_SPEED":
+			config.AnimationSpeed = strings.ToLower(value)
+		case "TLS":
+			config.TLS = parseBool(value)
+		case "LOG_LEVEL":
+			config.LogLevel = strings.ToLower(value)
+		case "INSECURE_SKIP_VERIFY":
+			config.InsecureSkipVerify = parseBool(value)
+		case "TRANSPORT":
+			config.Transport = strings.ToLower(value)
+		case "MAX_RETRIES":
+			if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+				config.MaxRetries = n
+			}
+		case "KEY_SEND":
+			config.Keys.KeySend = value
+		case "KEY_QUIT":
+			config.Keys.KeyQuit = value
+		case "KEY_SCROLL_UP":
+			config.Keys.KeyScrollUp = value
+		case "KEY_SCROLL_DOWN":
+			config.Keys.KeyScrollDown = value
+		case "KEY_SWITCH_CHANNEL":
+			config.Keys.KeySwitchChannel = value
 		}
 	}
+	normalizeKeys(&config.Keys)
 
-	if err := scanner.Err(); err != nil {
+	fmt.Fprintf(os.Stderr, "Warning: %s uses the old config format, which is deprecated. "+
+		"It has been converted to TOML (original kept as %s.bak).\n", path, path)
+	if err := os.WriteFile(path+".bak", []byte(data), 0644); err != nil {
 		return config, err
 	}
-
-	return config, nil
+	return config, SaveConfig(path, config)
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// limitFlashTicks is how many animation ticks the input's border stays red
+// after typing into a full input
+const limitFlashTicks = 3
+
+var counterWarnColor = lipgloss.Color("#F39C12") // Orange
+
+// charCounter is the "(42/500)" at the right of the input: in the hint
+// color, then yellow from 80% of the server's limit and red from 95%
+func (m mainModel) charCounter() string {
+	limit := m.msgInput.CharLimit
+	if !m.config.CharCounter || limit <= 0 {
+		return ""
+	}
+	count := len([]rune(m.msgInput.Value()))
+	text := fmt.Sprintf("(%d/%d)", count, limit)
+	switch {
+	case count*100 >= limit*95:
+		return m.styles.Error.UnsetPadding().Render(text)
+	case count*100 >= limit*80:
+		return lipgloss.NewStyle().Foreground(counterWarnColor).Render(text)
+	}
+	return m.styles.InlineHint(text)
+}
+
+// counterWidth is the room the counter takes beside the input, so the
+// input doesn't shift as it grows
+func (m mainModel) counterWidth() int {
+	limit := m.msgInput.CharLimit
+	if !m.config.CharCounter || limit <= 0 {
+		return 0
+	}
+	return len(fmt.Sprintf(" (%d/%d)", limit, limit))
+}
+
+// withCounter puts the counter at the bottom right of the input box, which
+// is width wide inside
+func (m mainModel) withCounter(input string, width int) string {
+	counter := m.charCounter()
+	if counter == "" {
+		return input
+	}
+	filler := lipgloss.NewStyle().Width(max(width-lipgloss.Width(input)-lipgloss.Width(counter), 0)).Render("")
+	return lipgloss.JoinHorizontal(lipgloss.Bottom, input, filler, counter)
+}
+
+// flashAtLimit flashes the input's border when a key is typed into an
+// input that's already full, and the keystroke went nowhere
+func (m *mainModel) flashAtLimit(msg tea.Msg) {
+	key, ok := msg.(tea.KeyMsg)
+	if !ok || key.Type != tea.KeyRunes || m.msgInput.CharLimit <= 0 || !m.config.CharCounter {
+		return
+	}
+	if len([]rune(m.msgInput.Value())) >= m.msgInput.CharLimit {
+		m.limitFlash = limitFlashTicks
+	}
+}
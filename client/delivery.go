@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// deliveryTimeout is how long a message we sent waits for the server's ACK
+// before it's marked failed
+const deliveryTimeout = 10 * time.Second
+
+// delivery is how far a message we sent got, shown beside it
+type delivery int
+
+const (
+	deliveryNone    delivery = iota // Someone else's message, or from history
+	deliveryPending                 // Sent, waiting for the ACK
+	deliverySent                    // The server stored and broadcast it
+	deliveryFailed                  // No ACK in time, r sends it again
+)
+
+// deliveryTimeoutMsg is deliveryTimeout after sending the message with
+// clientID, time to give up on its ACK
+type deliveryTimeoutMsg struct{ clientID string }
+
+// legacyWhisper matches the old !whisper <user> <message> form, sent as is
+var legacyWhisper = regexp.MustCompile(`(?is)^!(?:whisper|w)\s+\S+\s+.+$`)
+
+func isLegacyWhisper(text string) bool {
+	return legacyWhisper.MatchString(text)
+}
+
+func newClientID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// chatFrame wraps body in the JSON envelope chat messages are sent in, so
+// text that looks like a command is still posted as chat. The envelope
+// carries the clientID the server acknowledges it with, if any, and the
+// parent it replies to.
+func chatFrame(body, replyTo, clientID string) (string, error) {
+	frame := map[string]string{
+		"type": "message",
+		"body": body,
+	}
+	if clientID != "" {
+		frame["clientID"] = clientID
+	}
+	if replyTo != "" {
+		frame["replyTo"] = replyTo
+	}
+	envelope, err := json.Marshal(frame)
+	return string(envelope), err
+}
+
+// sendChatCmd sends body to the channel in a JSON envelope
+func (m mainModel) sendChatCmd(body, replyTo, clientID string) tea.Cmd {
+	envelope, err := chatFrame(body, replyTo, clientID)
+	if err != nil {
+		return nil
+	}
+	return m.sendMessageCmd(envelope)
+}
+
+// sendPending shows body in the chat straight away, pending until the
+// server acknowledges it, and sends it
+func (m *mainModel) sendPending(body, replyTo string) tea.Cmd {
+	id := newClientID()
+	m.messages = append(m.messages, ChatMessage{
+		Timestamp: time.Now().Format("15:04"),
+		Time:      time.Now(),
+		User:      m.username,
+		Content:   body,
+		ReplyTo:   replyTo,
+		ClientID:  id,
+		Delivery:  deliveryPending,
+	})
+	return tea.Batch(m.sendChatCmd(body, replyTo, id), m.deliveryTimeoutCmd(id))
+}
+
+func (m mainModel) deliveryTimeoutCmd(clientID string) tea.Cmd {
+	return forTab(m.id, tea.Tick(deliveryTimeout, func(time.Time) tea.Msg {
+		return deliveryTimeoutMsg{clientID: clientID}
+	}))
+}
+
+// sentIndex finds the message we sent with clientID. It's looked up rather
+// than remembered by index, as back-filled messages and the like get
+// inserted above it.
+func (m mainModel) sentIndex(clientID string) int {
+	if clientID == "" {
+		return -1
+	}
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].ClientID == clientID {
+			return i
+		}
+	}
+	return -1
+}
+
+// replaceEcho swaps the copy of msg we showed when sending it for the one
+// the server broadcast, with its ID, reporting whether there was one
+func (m *mainModel) replaceEcho(msg ChatMessage) bool {
+	i := m.sentIndex(msg.ClientID)
+	if i == -1 {
+		return false
+	}
+	msg.Delivery = m.messages[i].Delivery
+	m.messages[i] = msg
+	return true
+}
+
+// acknowledged marks the message with clientID as delivered
+func (m *mainModel) acknowledged(clientID string) {
+	if i := m.sentIndex(clientID); i != -1 {
+		m.messages[i].Delivery = deliverySent
+	}
+}
+
+// duplicate handles DUPLICATE:<clientID>, the server turning away a message
+// the same as one we sent moments ago. Nobody else saw it, so our copy goes.
+func (m *mainModel) duplicate(clientID string) {
+	if i := m.sentIndex(clientID); i != -1 {
+		m.messages = append(m.messages[:i:i], m.messages[i+1:]...)
+		m.render.reset()
+	}
+	m.addSystemMessage("You sent that moments ago, so it wasn't sent again")
+}
+
+// whisperRefused handles ERR:user_not_found:<clientID>, a whisper whose
+// target isn't online. It reached nobody, so our copy goes too.
+func (m *mainModel) whisperRefused(clientID string) {
+	if i := m.sentIndex(clientID); i != -1 {
+		m.messages = append(m.messages[:i:i], m.messages[i+1:]...)
+		m.render.reset()
+	}
+	m.addSystemMessage(serverErrorText("user_not_found"))
+}
+
+// deliveryTimedOut marks the message as failed if its ACK never came
+func (m mainModel) deliveryTimedOut(msg deliveryTimeoutMsg) (mainModel, tea.Cmd) {
+	i := m.sentIndex(msg.clientID)
+	if i == -1 || m.messages[i].Delivery != deliveryPending {
+		return m, nil
+	}
+	m.messages[i].Delivery = deliveryFailed
+	m.refreshMessages()
+	return m, nil
+}
+
+// lastFailed is the index of the newest message that failed to send, or -1
+func (m mainModel) lastFailed() int {
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		if m.messages[i].Delivery == deliveryFailed {
+			return i
+		}
+	}
+	return -1
+}
+
+// retrySend sends messages[i] again, under a new clientID so a late ACK
+// for the first attempt can't be mistaken for this one's
+func (m *mainModel) retrySend(i int) tea.Cmd {
+	if i == -1 {
+		return nil
+	}
+	msg := &m.messages[i]
+	msg.ClientID = newClientID()
+	msg.Delivery = deliveryPending
+	m.refreshMessages()
+	body := msg.Content
+	if msg.IsPrivate {
+		body = "/whisper " + msg.To + " " + body
+	}
+	return tea.Batch(m.sendChatCmd(body, msg.ReplyTo, msg.ClientID), m.deliveryTimeoutCmd(msg.ClientID))
+}
+
+// refreshMessages redraws the chat, keeping the scroll position unless
+// following new messages
+func (m *mainModel) refreshMessages() {
+	offset := m.viewport.YOffset
+	m.viewport.SetContent(m.renderMessages())
+	if m.autoScroll {
+		m.viewport.GotoBottom()
+	} else {
+		m.viewport.SetYOffset(offset)
+	}
+}
+
+// deliveryMark is shown after a message we sent: ◷ while pending, ✓ once
+// delivered, and ✗ with how to retry when it failed
+func (m mainModel) deliveryMark(msg ChatMessage) string {
+	switch msg.Delivery {
+	case deliveryPending:
+		return " " + m.styles.InlineHint("◷")
+	case deliverySent:
+		return " " + lipgloss.NewStyle().Foreground(successColor).Render("✓")
+	case deliveryFailed:
+		return " " + lipgloss.NewStyle().Foreground(errorColor).Render("✗ failed") + " " + m.styles.InlineHint("- r to retry")
+	}
+	return ""
+}
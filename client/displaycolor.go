@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// hexColor matches the colors /setcolor takes, #RRGGBB
+var hexColor = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+func setColorCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	color := strings.TrimSpace(args)
+	if strings.EqualFold(color, "auto") {
+		return m, m.sendMessageCmd("SETCOLOR:auto")
+	}
+	if !hexColor.MatchString(color) {
+		m.addSystemMessage("Usage: /setcolor #RRGGBB | auto")
+		return m, nil
+	}
+	return m, m.sendMessageCmd("SETCOLOR:" + strings.ToUpper(color))
+}
+
+// setDisplayColor records the color a user picked for their name, or
+// forgets it for an empty color so they're back to the one from the palette
+func (m *mainModel) setDisplayColor(name string, color string) {
+	if color == "" {
+		delete(m.displayColors, name)
+	} else if hexColor.MatchString(color) && m.displayColors[name] != lipgloss.Color(color) {
+		m.displayColors[name] = lipgloss.Color(color)
+	} else {
+		return
+	}
+	m.render.reset()
+}
+
+// displayColor handles COLOR:<username>:<#RRGGBB>, empty once they've gone
+// back to auto
+func (m *mainModel) displayColor(payload string) {
+	if name, color, ok := strings.Cut(payload, ":"); ok && name != "" {
+		m.setDisplayColor(name, color)
+	}
+}
+
+// colorSet handles COLOR_SET:<#RRGGBB>, the answer to our /setcolor, or
+// COLOR_REJECTED:<#RRGGBB> when the server lightened a color too dark to
+// read on the chat's background
+func (m *mainModel) colorSet(color string, rejected bool) {
+	switch {
+	case rejected:
+		m.addOutcomeMessage("That color is too hard to read on the dark background - using "+color+" instead", outcomeError)
+	case color == "":
+		m.addOutcomeMessage("Your name is back to its automatic color", outcomeSuccess)
+	default:
+		m.addOutcomeMessage("Your name now shows in "+color, outcomeSuccess)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// draftsFile holds unsent input per channel, so it survives restarts
+const draftsFile = "drafts.json"
+
+func loadDrafts() map[string]string {
+	drafts := map[string]string{}
+
+	dir, err := echoDir()
+	if err != nil {
+		return drafts
+	}
+	data, err := os.ReadFile(filepath.Join(dir, draftsFile))
+	if err != nil {
+		return drafts
+	}
+	if err := json.Unmarshal(data, &drafts); err != nil {
+		return map[string]string{}
+	}
+	return drafts
+}
+
+func saveDrafts(drafts map[string]string) error {
+	dir, err := echoDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(drafts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, draftsFile), data, 0600)
+}
+
+// setDraft remembers text as channel's draft, forgetting it when empty
+func (m *mainModel) setDraft(channel string, text string) {
+	if text == m.drafts[channel] {
+		return
+	}
+	if text == "" {
+		delete(m.drafts, channel)
+	} else {
+		m.drafts[channel] = text
+	}
+	// Best effort - drafts are a convenience
+	saveDrafts(m.drafts)
+}
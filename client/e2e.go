@@ -0,0 +1,274 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// How long a whisper waits for the peer's key before going out unencrypted
+const e2eKeyTimeout = 3 * time.Second
+
+// e2eKeyTimeoutMsg is sent when a peer hasn't answered our E2EKEY in time
+type e2eKeyTimeoutMsg struct{ peer string }
+
+// e2eSession holds this connection's ephemeral X25519 key and what we've
+// agreed with each peer. Peers are keyed by lowercased name, as the server
+// matches whisper targets case-insensitively.
+type e2eSession struct {
+	private [32]byte
+	public  []byte
+	keys    map[string][]byte   // ChaCha20-Poly1305 key shared with each peer
+	sentKey map[string]bool     // Peers we've sent our public key to
+	plain   map[string]bool     // Peers that never answered, so don't use E2E
+	pending map[string][]string // Whispers waiting for the peer's key
+}
+
+func newE2ESession() (*e2eSession, error) {
+	s := &e2eSession{
+		keys:    make(map[string][]byte),
+		sentKey: make(map[string]bool),
+		plain:   make(map[string]bool),
+		pending: make(map[string][]string),
+	}
+	if _, err := rand.Read(s.private[:]); err != nil {
+		return nil, fmt.Errorf("failed to generate E2E key: %v", err)
+	}
+	public, err := curve25519.X25519(s.private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate E2E key: %v", err)
+	}
+	s.public = public
+	return s, nil
+}
+
+// keyFrame offers our public key to peer, which the server relays to them
+// as E2EKEY:<our name>:<key>
+func (s *e2eSession) keyFrame(peer string) string {
+	s.sentKey[strings.ToLower(peer)] = true
+	return "E2EKEY:" + peer + ":" + base64.StdEncoding.EncodeToString(s.public)
+}
+
+// addPeerKey derives the key shared with peer from their public key
+func (s *e2eSession) addPeerKey(peer, encoded string) error {
+	public, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid E2E key from %s", peer)
+	}
+	shared, err := curve25519.X25519(s.private[:], public)
+	if err != nil {
+		return fmt.Errorf("invalid E2E key from %s", peer)
+	}
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, nil, []byte("echo e2e dm")), key); err != nil {
+		return err
+	}
+	peer = strings.ToLower(peer)
+	s.keys[peer] = key
+	delete(s.plain, peer)
+	return nil
+}
+
+// dmAssociatedData binds a ciphertext to who sent it to whom, so the server
+// can't pass one peer's message off as another's
+func dmAssociatedData(from, to string) []byte {
+	return []byte(strings.ToLower(from) + "\x00" + strings.ToLower(to))
+}
+
+// encrypt seals text for peer, returning the <nonce>:<ciphertext> part of
+// an E2E frame
+func (s *e2eSession) encrypt(from, peer, text string) (string, error) {
+	key, ok := s.keys[strings.ToLower(peer)]
+	if !ok {
+		return "", fmt.Errorf("no E2E key for %s", peer)
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nil, nonce, []byte(text), dmAssociatedData(from, peer))
+	return base64.StdEncoding.EncodeToString(nonce) + ":" +
+		base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt opens the <nonce>:<ciphertext> payload of an E2E frame from peer
+func (s *e2eSession) decrypt(peer, to, payload string) (string, error) {
+	key, ok := s.keys[strings.ToLower(peer)]
+	if !ok {
+		return "", fmt.Errorf("no E2E key for %s", peer)
+	}
+	encodedNonce, encodedSealed, _ := strings.Cut(payload, ":")
+	nonce, err := base64.StdEncoding.DecodeString(encodedNonce)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encodedSealed)
+	if err != nil {
+		return "", err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return "", err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return "", errors.New("invalid nonce")
+	}
+	text, err := aead.Open(nil, nonce, sealed, dmAssociatedData(peer, to))
+	if err != nil {
+		return "", err
+	}
+	return string(text), nil
+}
+
+// forgetOffline drops keys for peers who have left; they get a new key
+// when they reconnect
+func (s *e2eSession) forgetOffline(online []string) {
+	present := make(map[string]bool, len(online))
+	for _, name := range online {
+		present[strings.ToLower(name)] = true
+	}
+	for _, m := range []map[string]bool{s.sentKey, s.plain} {
+		for peer := range m {
+			if !present[peer] {
+				delete(m, peer)
+			}
+		}
+	}
+	for peer := range s.keys {
+		if !present[peer] {
+			delete(s.keys, peer)
+		}
+	}
+}
+
+// sendWhisper sends a whisper, encrypted when E2E is on and the peer has
+// it too. The first whisper to a peer waits for their key.
+func (m *mainModel) sendWhisper(target, text string) tea.Cmd {
+	peer := strings.ToLower(target)
+	if m.e2e == nil || m.e2e.plain[peer] {
+		return m.sendPlainWhisper(target, text)
+	}
+	if _, ok := m.e2e.keys[peer]; ok {
+		return m.sendEncryptedWhisper(target, text)
+	}
+
+	m.e2e.pending[peer] = append(m.e2e.pending[peer], text)
+	if len(m.e2e.pending[peer]) > 1 {
+		return nil
+	}
+	return tea.Batch(
+		m.sendMessageCmd(m.e2e.keyFrame(target)),
+		forTab(m.id, tea.Tick(e2eKeyTimeout, func(time.Time) tea.Msg {
+			return e2eKeyTimeoutMsg{peer: target}
+		})),
+	)
+}
+
+func (m *mainModel) sendEncryptedWhisper(target, text string) tea.Cmd {
+	payload, err := m.e2e.encrypt(m.username, target, text)
+	if err != nil {
+		m.addSystemMessage("Couldn't encrypt whisper: " + err.Error())
+		return nil
+	}
+	m.echoWhisper(target, text, "", true)
+	return m.sendMessageCmd("E2E:" + target + ":" + payload)
+}
+
+// sendPlainWhisper sends an unencrypted whisper with a clientID, shown
+// pending until the server acknowledges it or says the target is offline
+func (m *mainModel) sendPlainWhisper(target, text string) tea.Cmd {
+	id := newClientID()
+	m.echoWhisper(target, text, id, false)
+	return tea.Batch(m.sendChatCmd("/whisper "+target+" "+text, "", id), m.deliveryTimeoutCmd(id))
+}
+
+// Whispers are only delivered to the target, so echo them locally. Those
+// sent with a clientID wait for its ACK.
+func (m *mainModel) echoWhisper(target, text, clientID string, encrypted bool) {
+	msg := ChatMessage{
+		Timestamp: time.Now().Format("15:04"),
+		User:      m.username,
+		Content:   text,
+		IsPrivate: true,
+		To:        target,
+		Encrypted: encrypted,
+		ClientID:  clientID,
+	}
+	if clientID != "" {
+		msg.Delivery = deliveryPending
+	}
+	m.messages = append(m.messages, msg)
+}
+
+// acceptPeerKey handles E2EKEY:<from>:<key>, answering with our own key if
+// we haven't yet and sending any whispers that were waiting for it
+func (m *mainModel) acceptPeerKey(payload string) tea.Cmd {
+	if m.e2e == nil {
+		return nil
+	}
+	from, encoded, _ := strings.Cut(payload, ":")
+	if err := m.e2e.addPeerKey(from, encoded); err != nil {
+		m.addSystemMessage(err.Error())
+		return nil
+	}
+
+	peer := strings.ToLower(from)
+	var cmds []tea.Cmd
+	if !m.e2e.sentKey[peer] {
+		cmds = append(cmds, m.sendMessageCmd(m.e2e.keyFrame(from)))
+	}
+	for _, text := range m.e2e.pending[peer] {
+		cmds = append(cmds, m.sendEncryptedWhisper(from, text))
+	}
+	delete(m.e2e.pending, peer)
+	return tea.Sequence(cmds...)
+}
+
+// keyTimedOut sends whispers still waiting on a peer unencrypted; the peer
+// doesn't have E2E turned on
+func (m *mainModel) keyTimedOut(target string) tea.Cmd {
+	peer := strings.ToLower(target)
+	if m.e2e == nil || len(m.e2e.pending[peer]) == 0 {
+		return nil
+	}
+	m.e2e.plain[peer] = true
+	m.addSystemMessage(target + " doesn't have encryption on, whispers to them are unencrypted")
+
+	var cmds []tea.Cmd
+	for _, text := range m.e2e.pending[peer] {
+		cmds = append(cmds, m.sendPlainWhisper(target, text))
+	}
+	delete(m.e2e.pending, peer)
+	return tea.Sequence(cmds...)
+}
+
+// decryptWhisper replaces the ciphertext of an encrypted whisper with its
+// text. If that fails, our key may be newer than the one the sender has,
+// so it is offered again.
+func (m *mainModel) decryptWhisper(msg *ChatMessage) tea.Cmd {
+	if m.e2e != nil {
+		if text, err := m.e2e.decrypt(msg.User, m.username, msg.Content); err == nil {
+			msg.Content = text
+			return nil
+		}
+	}
+	msg.Content = "[encrypted message could not be decrypted]"
+	if m.e2e == nil {
+		return nil
+	}
+	return m.sendMessageCmd(m.e2e.keyFrame(msg.User))
+}
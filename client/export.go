@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/progress"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+const exportDateLayout = "2006-01-02"
+
+// exportState is an /export in progress. Chunks are written to a .part
+// file as they arrive, which is renamed once the server says it's done.
+type exportState struct {
+	channel string
+	format  string // "json" or "md"
+	path    string
+	file    *os.File
+	bar     progress.Model
+	written int
+	total   int
+	lastDay string // Date heading last written to a Markdown export
+}
+
+// exportChunk is the EXPORTCHUNK:{json} frame
+type exportChunk struct {
+	Total    int           `json:"total"`
+	Messages []wireMessage `json:"messages"`
+}
+
+// exportCommand handles /export [channel] [from] [to] [--format json|md],
+// with dates as YYYY-MM-DD, and /export --bookmarks [--format json|md]
+func exportCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	if m.export != nil {
+		m.addSystemMessage("An export is already running, Ctrl+C cancels it")
+		return m, nil
+	}
+
+	format := "md"
+	bookmarks := false
+	var positional []string
+	words := strings.Fields(args)
+	for i := 0; i < len(words); i++ {
+		switch word := words[i]; {
+		case word == "--format" && i+1 < len(words):
+			format = words[i+1]
+			i++
+		case strings.HasPrefix(word, "--format="):
+			format = strings.TrimPrefix(word, "--format=")
+		case word == "--bookmarks":
+			bookmarks = true
+		default:
+			positional = append(positional, word)
+		}
+	}
+
+	// Bookmarks are all local, so they're written straight away
+	if bookmarks {
+		if len(positional) > 0 || (format != "json" && format != "md") {
+			m.addSystemMessage("Usage: /export --bookmarks [--format json|md]")
+			return m, nil
+		}
+		m.exportBookmarks(format)
+		return m, nil
+	}
+
+	channel := m.currentChannel
+	if len(positional) > 0 {
+		if _, err := time.Parse(exportDateLayout, positional[0]); err != nil {
+			channel = strings.TrimPrefix(positional[0], "#")
+			positional = positional[1:]
+		}
+	}
+
+	// Both dates are whole days, so "to" runs until the end of its day
+	var from, to int64
+	for i, word := range positional {
+		day, err := time.ParseInLocation(exportDateLayout, word, time.Local)
+		if err != nil || i > 1 {
+			m.addSystemMessage("Usage: /export [channel] [from] [to] [--format json|md], dates as YYYY-MM-DD")
+			return m, nil
+		}
+		if i == 0 {
+			from = day.Unix()
+		} else {
+			to = day.AddDate(0, 0, 1).Unix() - 1
+		}
+	}
+	if (format != "json" && format != "md") || !channelNamePattern.MatchString(channel) {
+		m.addSystemMessage("Usage: /export [channel] [from] [to] [--format json|md], dates as YYYY-MM-DD")
+		return m, nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		m.addSystemMessage("Couldn't find your home directory: " + err.Error())
+		return m, nil
+	}
+	name := fmt.Sprintf("echo-export-%s-%s.%s", channel, time.Now().Format(exportDateLayout), format)
+	path := filepath.Join(home, name+".part")
+	file, err := os.Create(path)
+	if err != nil {
+		m.addSystemMessage("Couldn't create the export file: " + err.Error())
+		return m, nil
+	}
+	if format == "json" {
+		file.WriteString("[")
+	} else {
+		fmt.Fprintf(file, "# #%s\n", channel)
+	}
+
+	m.export = &exportState{
+		channel: channel,
+		format:  format,
+		path:    path,
+		file:    file,
+		bar:     progress.New(progress.WithGradient(string(m.styles.PrimaryColor), string(m.styles.SecondaryColor))),
+	}
+	return m, m.sendMessageCmd(fmt.Sprintf("EXPORT:%s:%d:%d:%s", channel, from, to, format))
+}
+
+// writeExportChunk appends an EXPORTCHUNK's messages to the export file
+func (m *mainModel) writeExportChunk(payload string) {
+	if m.export == nil {
+		return
+	}
+	var chunk exportChunk
+	if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+		return
+	}
+
+	e := m.export
+	var err error
+	for _, w := range chunk.Messages {
+		msg := wireToChatMessage(w)
+		if e.format == "json" {
+			err = e.writeJSON(msg)
+		} else {
+			err = e.writeMarkdown(msg)
+		}
+		if err != nil {
+			m.abortExport("Export failed: " + err.Error())
+			return
+		}
+		e.written++
+	}
+	e.total = chunk.Total
+}
+
+func (e *exportState) writeJSON(msg ChatMessage) error {
+	data, err := json.MarshalIndent(msg, "  ", "  ")
+	if err != nil {
+		return err
+	}
+	separator := ",\n  "
+	if e.written == 0 {
+		separator = "\n  "
+	}
+	_, err = e.file.WriteString(separator + string(data))
+	return err
+}
+
+// writeMarkdown writes "**HH:MM username**: body", with a heading whenever
+// the day changes
+func (e *exportState) writeMarkdown(msg ChatMessage) error {
+	var b strings.Builder
+	if day := msg.Time.Local().Format(exportDateLayout); !msg.Time.IsZero() && day != e.lastDay {
+		e.lastDay = day
+		fmt.Fprintf(&b, "\n## %s\n\n", day)
+	}
+	fmt.Fprintf(&b, "**%s %s**: %s\n", msg.Timestamp, msg.User, msg.Content)
+	_, err := e.file.WriteString(b.String())
+	return err
+}
+
+// finishExport closes the file under the name from EXPORTDONE:<filename>
+func (m *mainModel) finishExport(filename string) {
+	if m.export == nil {
+		return
+	}
+	e := m.export
+	m.export = nil
+
+	if e.format == "json" {
+		if e.written > 0 {
+			e.file.WriteString("\n")
+		}
+		e.file.WriteString("]\n")
+	}
+	if err := e.file.Close(); err != nil {
+		os.Remove(e.path)
+		m.addSystemMessage("Export failed: " + err.Error())
+		return
+	}
+
+	// Only the name is the server's; the file stays next to the .part
+	name := filepath.Base(filename)
+	final := filepath.Join(filepath.Dir(e.path), name)
+	if name == "." || name == string(filepath.Separator) {
+		final = strings.TrimSuffix(e.path, ".part")
+	}
+	if err := os.Rename(e.path, final); err != nil {
+		m.addSystemMessage("Export failed: " + err.Error())
+		return
+	}
+	m.addSystemMessage(fmt.Sprintf("Exported %d messages from #%s to %s", e.written, e.channel, final))
+}
+
+// abortExport stops writing and removes the partial file
+func (m *mainModel) abortExport(reason string) {
+	if m.export == nil {
+		return
+	}
+	m.export.file.Close()
+	os.Remove(m.export.path)
+	m.export = nil
+	m.addSystemMessage(reason)
+}
+
+// cancelExport stops an export on Ctrl+C, telling the server to stop too
+func (m *mainModel) cancelExport() tea.Cmd {
+	m.abortExport("Export cancelled")
+	m.viewport.SetContent(m.renderMessages())
+	return m.sendMessageCmd("EXPORTCANCEL:")
+}
+
+// exportProgressView replaces the input while an export runs
+func (m mainModel) exportProgressView(width int) string {
+	e := m.export
+	label := m.styles.InlineHint(fmt.Sprintf("Exporting #%s… %d/%d - Ctrl+C to cancel", e.channel, e.written, e.total))
+	bar := e.bar
+	bar.Width = max(width-lipgloss.Width(label)-1, 10)
+	percent := 0.0
+	if e.total > 0 {
+		percent = float64(e.written) / float64(e.total)
+	}
+	return bar.ViewAs(percent) + " " + label
+}
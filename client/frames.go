@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleFrame applies server control frames that update the model rather
+// than adding a chat line. It reports false for anything it doesn't handle,
+// which is then rendered as a message by parseMessage.
+func (m *mainModel) handleFrame(raw string) bool {
+	if frame, ok := parseServerFrame(raw); ok && frame.Type == "backfill" {
+		m.insertBackfill(frame.Messages)
+		return true
+	}
+
+	if channel, history, ok := parseHistoryFrame(raw); ok {
+		if channel == m.currentChannel {
+			m.insertHistory(history.Messages)
+			m.resetHistoryPaging()
+			m.pins = history.Pins
+			m.countPins(channel, func(int) int { return len(history.Pins) })
+			m.refreshPinboard()
+			m.resumeBookmark(channel)
+		}
+		return true
+	}
+
+	// Our edit was saved; the EDIT broadcast updates the message itself
+	if raw == "ACK_EDIT" {
+		return true
+	}
+
+	if raw == "MAINTENANCE_END" {
+		m.setMaintenance("")
+		return true
+	}
+
+	if raw == "DUPLICATE" {
+		m.duplicate("")
+		return true
+	}
+
+	if raw == "PASSWD_OK" {
+		m.addOutcomeMessage("Password changed. Your other sessions will have to log in again.", outcomeSuccess)
+		return true
+	}
+
+	kind, payload, ok := strings.Cut(raw, ":")
+	if !ok {
+		return false
+	}
+
+	switch kind {
+	case "USERLIST":
+		m.setOnlineUsers(parseUserList(payload))
+		return true
+	case "PRESENCE":
+		m.presence(payload)
+		return true
+	case "STATUS":
+		if name, status, ok := parseStatusFrame(payload); ok {
+			m.userStatuses[name] = status
+		}
+		return true
+	case "COLOR":
+		m.displayColor(payload)
+		return true
+	case "COLOR_SET", "COLOR_REJECTED":
+		m.colorSet(payload, kind == "COLOR_REJECTED")
+		return true
+	case "SESSION":
+		// Best effort - without a saved token we just ask for the password again
+		if warn, _ := saveSessionToken(m.serverAddr, m.username, payload); warn {
+			m.addSystemMessage("No OS keychain is available, so your session is saved in ~/.echo/session.json, readable only by you")
+		}
+		return true
+	case "EDIT":
+		if id, body, ok := strings.Cut(payload, ":"); ok {
+			m.applyEdit(id, body)
+			m.editPin(id, body)
+			m.refreshPinboard()
+		}
+		return true
+	case "DELETE":
+		m.applyDelete(payload)
+		m.markBookmarkGone(m.serverAddr, payload)
+		return true
+	case "REACT":
+		// REACT:<msgID>:<emoji>:<count>
+		id, rest, _ := strings.Cut(payload, ":")
+		if sep := strings.LastIndex(rest, ":"); sep != -1 {
+			if count, err := strconv.Atoi(rest[sep+1:]); err == nil {
+				m.applyReaction(id, rest[:sep], count)
+			}
+		}
+		return true
+	case "CHANNELLIST":
+		if channels, ok := parseChannelList(payload); ok {
+			m.channels = channels
+			for _, c := range channels {
+				m.channelTopics[c.Name] = c.Topic
+			}
+			m.pruneBookmarks(m.serverAddr, func(name string) bool {
+				return slices.ContainsFunc(channels, func(c channelInfo) bool { return c.Name == name })
+			})
+		}
+		return true
+	case "CHANNELADD":
+		m.addChannel(payload)
+		return true
+	case "CHANNELDEL":
+		m.removeChannel(payload)
+		m.pruneBookmarks(m.serverAddr, func(name string) bool { return name != payload })
+		return true
+	case "SEARCHRESULTS":
+		if results, ok := parseSearchResults(payload); ok {
+			m.openSearch(results)
+		}
+		return true
+	case "ACTIVITY":
+		// ACTIVITY:<channel> - a message we don't get in a channel we're not in
+		if payload != m.currentChannel {
+			m.unreadCounts[payload]++
+		}
+		return true
+	case "UNREADCOUNTS":
+		var counts map[string]int
+		if err := json.Unmarshal([]byte(payload), &counts); err == nil {
+			delete(counts, m.currentChannel)
+			m.unreadCounts = counts
+		}
+		return true
+	case "TOPIC":
+		// TOPIC:<channel>:<text>
+		if channel, topic, ok := strings.Cut(payload, ":"); ok {
+			m.channelTopics[channel] = topic
+		}
+		return true
+	case "MENTION":
+		// MENTION:<channel>:<from> - mentions in the open channel are seen already
+		if channel, _, ok := strings.Cut(payload, ":"); ok && channel != m.currentChannel {
+			m.mentionCounts[channel]++
+		}
+		return true
+	case "SERVERCFG":
+		var caps serverCapabilities
+		if err := json.Unmarshal([]byte(payload), &caps); err == nil {
+			m.serverCaps = caps
+			if caps.MaxMessageSize > 0 {
+				m.msgInput.CharLimit = caps.MaxMessageSize
+				m.resize() // The counter may need more room
+			}
+		}
+		return true
+	case "PONG":
+		m.handlePong(payload)
+		return true
+	case "HISTORYPAGE":
+		m.loadOlder(payload)
+		return true
+	case "THREADREPLIES":
+		// THREADREPLIES:<parentID>:<json>
+		if id, replies, ok := strings.Cut(payload, ":"); ok {
+			m.loadThread(id, replies)
+		}
+		return true
+	case "REPLY":
+		// REPLY:<parentID>:<json> - a new reply in the channel, for the thread panel
+		if id, reply, ok := strings.Cut(payload, ":"); ok {
+			m.addThreadReply(id, reply)
+		}
+		return true
+	case "MAINTENANCE":
+		m.setMaintenance(payload)
+		return true
+	case "MOTD":
+		m.showMotd(payload)
+		return true
+	case "ACK":
+		m.acknowledged(payload)
+		return true
+	case "CHANNELCATEGORY":
+		m.setCategory(payload)
+		return true
+	case "PINNED":
+		if channel, pin, ok := strings.Cut(payload, ":"); ok {
+			m.addPin(channel, pin)
+		}
+		return true
+	case "UNPINNED":
+		if channel, id, ok := strings.Cut(payload, ":"); ok {
+			m.removePin(channel, id)
+		}
+		return true
+	case "PRIVACY":
+		// PRIVACY:store:on|off, answering /privacy
+		if payload == "store:off" {
+			m.addOutcomeMessage("The server isn't saving your messages; they're shown to others as [ephemeral]", outcomeSuccess)
+		} else {
+			m.addOutcomeMessage("The server saves your messages", outcomeSuccess)
+		}
+		return true
+	case "POLLCREATED":
+		m.addPoll(payload)
+		return true
+	case "POLLUPDATE":
+		m.updatePoll(payload, false)
+		return true
+	case "POLLCLOSED":
+		m.updatePoll(payload, true)
+		return true
+	case "DUPLICATE":
+		m.duplicate(payload)
+		return true
+	case "STREAM":
+		m.streamChunk(payload)
+		return true
+	case "STREAM_COMPLETE":
+		m.completeStream(payload)
+		return true
+	case "GUEST":
+		// Logged in as a guest - the server picked our name
+		m.username = payload
+		return true
+	case "EXPORTCHUNK":
+		m.writeExportChunk(payload)
+		return true
+	case "EXPORTDONE":
+		m.finishExport(payload)
+		return true
+	case "ERR":
+		// A whisper to someone offline comes back with its clientID
+		if clientID, ok := strings.CutPrefix(payload, "user_not_found:"); ok {
+			m.whisperRefused(clientID)
+			return true
+		}
+		// A failed export is reported as usual, but its file goes too
+		if m.export != nil && (strings.HasPrefix(payload, "export_") || payload == "channel_not_found" || payload == "permission_denied") {
+			m.abortExport("Export stopped, nothing was saved")
+		}
+		return false
+	case "PASSWD_ERR":
+		m.addOutcomeMessage("Password not changed: "+payload, outcomeError)
+		return true
+	case "TOTP_SETUP":
+		m.showTotpSetup(payload)
+		return true
+	case "TYPING":
+		if payload != "" && payload != m.username {
+			m.typingUsers[payload] = time.Now()
+		}
+		return true
+	}
+	return false
+}
+
+// serverCapabilities are the server's limits from a SERVERCFG frame, sent
+// after login and again whenever the server reloads its config
+type serverCapabilities struct {
+	MaxMessageSize     int     `json:"maxMessageSize"`
+	MaxUploadBytes     int64   `json:"maxUploadBytes"`
+	UploadChunksPerSec float64 `json:"uploadChunksPerSec"`
+	RateLimitPerSec    float64 `json:"rateLimitPerSec"`
+	RateLimitBurst     int     `json:"rateLimitBurst"`
+	IdleTimeoutSeconds int     `json:"idleTimeoutSeconds"`
+}
+
+// parseUserList splits a USERLIST csv into names, dropping empty entries
+func parseUserList(csv string) []string {
+	var users []string
+	for _, name := range strings.Split(csv, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			users = append(users, name)
+		}
+	}
+	return users
+}
+
+// setOnlineUsers replaces who's online, forgetting about those who left
+func (m *mainModel) setOnlineUsers(users []string) {
+	m.onlineUsers = users
+	if m.e2e != nil {
+		m.e2e.forgetOffline(m.onlineUsers)
+	}
+	for name := range m.userStatuses {
+		if !slices.Contains(m.onlineUsers, name) {
+			delete(m.userStatuses, name)
+		}
+	}
+}
+
+// presence handles PRESENCE:<json>, the server's regular list of who's
+// online and their status, which leaves out connections gone quiet
+func (m *mainModel) presence(payload string) {
+	var users []struct {
+		Username string `json:"username"`
+		Status   string `json:"status"`
+	}
+	if err := json.Unmarshal([]byte(payload), &users); err != nil {
+		return
+	}
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Username
+	}
+	m.setOnlineUsers(names)
+	for _, user := range users {
+		status := m.userStatuses[user.Username]
+		if status.state == user.Status || (status.state == "" && user.Status == "online") {
+			continue
+		}
+		status.state = user.Status
+		m.userStatuses[user.Username] = status
+	}
+}
@@ -0,0 +1,93 @@
+//go:build ignore
+
+// gen_emojis writes emojis.go from GitHub's gemoji database, the list of
+// :shortcodes: GitHub and most chat apps understand. Run it with
+//
+//	go generate
+//
+// or point -src at a local copy of emoji.json.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"go/format"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+const gemojiURL = "https://raw.githubusercontent.com/github/gemoji/master/db/emoji.json"
+
+type gemoji struct {
+	Emoji   string   `json:"emoji"`
+	Aliases []string `json:"aliases"`
+}
+
+func main() {
+	src := flag.String("src", gemojiURL, "URL or path of gemoji's emoji.json")
+	out := flag.String("o", "emojis.go", "file to write")
+	flag.Parse()
+
+	data, err := read(*src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var list []gemoji
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Fatal(err)
+	}
+
+	shortcodes := make(map[string]string)
+	for _, e := range list {
+		for _, alias := range e.Aliases {
+			if _, seen := shortcodes[alias]; !seen && alias != "" {
+				shortcodes[alias] = e.Emoji
+			}
+		}
+	}
+	names := make([]string, 0, len(shortcodes))
+	for name := range shortcodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by gen_emojis.go; DO NOT EDIT.\n\n")
+	b.WriteString("package main\n\n")
+	b.WriteString("//go:generate go run gen_emojis.go\n\n")
+	b.WriteString("// emojiShortcodes maps :shortcode: names, without the colons, to emoji\n")
+	b.WriteString("var emojiShortcodes = map[string]string{\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "\t%q: %q,\n", name, shortcodes[name])
+	}
+	b.WriteString("}\n")
+
+	code, err := format.Source(b.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*out, code, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func read(src string) ([]byte, error) {
+	if !strings.HasPrefix(src, "https://") && !strings.HasPrefix(src, "http://") {
+		return os.ReadFile(src)
+	}
+	resp, err := http.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", src, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
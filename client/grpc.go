@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"echo-client-tui/chatpb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// grpcTransport is a ChatTransport over the server's gRPC ChatService
+// (server/proto/chat.proto): frames go out with SendMessage and come in on
+// the ReceiveMessages stream, both naming the session Login returned
+type grpcTransport struct {
+	conn    *grpc.ClientConn
+	client  chatpb.ChatServiceClient
+	session string
+	stream  grpc.ServerStreamingClient[chatpb.MessageEvent]
+	cancel  context.CancelFunc // Ends the stream
+}
+
+// connectGRPC logs in over gRPC and subscribes to the session's frames.
+// The address is host:port of the server's grpc_port, using TLS when the
+// websocket would.
+func connectGRPC(ctx context.Context, serverURL string, creds Credentials, opts DialOptions) (ChatTransport, error) {
+	u := serverEndpoint(serverURL, opts.TLS)
+	transportCreds := insecure.NewCredentials()
+	if u.Scheme == "wss" {
+		transportCreds = credentials.NewTLS(&tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify})
+	}
+	conn, err := grpc.NewClient(u.Host, grpc.WithTransportCredentials(transportCreds))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrConnect, err)
+	}
+
+	client := chatpb.NewChatServiceClient(conn)
+	auth, err := client.Login(ctx, &chatpb.AuthRequest{
+		Username: creds.Username,
+		Password: creds.Password,
+		Email:    creds.Email,
+		Token:    creds.Token,
+		Totp:     creds.TOTP,
+	})
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ErrTimeout
+		}
+		return nil, loginError(err)
+	}
+
+	streamCtx, cancel := context.WithCancel(context.Background())
+	stream, err := client.ReceiveMessages(streamCtx, &chatpb.SubscribeRequest{Session: auth.Session})
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, fmt.Errorf("%w: %v", ErrConnect, err)
+	}
+	return &grpcTransport{conn: conn, client: client, session: auth.Session, stream: stream, cancel: cancel}, nil
+}
+
+// loginError turns a failed Login into the errors a websocket login
+// fails with
+func loginError(err error) error {
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.FailedPrecondition:
+		if st.Message() == "TOTP_REQUIRED" {
+			return ErrTOTPRequired
+		}
+	case codes.Unauthenticated:
+		return fmt.Errorf("authentication failed: %s", st.Message())
+	case codes.Unavailable:
+		if st.Message() == "Server under maintenance" {
+			return fmt.Errorf("%w: %w", ErrConnect, ErrMaintenance)
+		}
+		return fmt.Errorf("%w: %s", ErrConnect, st.Message())
+	}
+	return err
+}
+
+func (t *grpcTransport) Send(frame string) error {
+	_, err := t.client.SendMessage(context.Background(), &chatpb.SendRequest{Session: t.session, Frame: frame})
+	return err
+}
+
+func (t *grpcTransport) Recv() (string, error) {
+	event, err := t.stream.Recv()
+	if err == nil {
+		return event.Frame, nil
+	}
+	if errors.Is(err, io.EOF) {
+		return "", io.EOF
+	}
+	// The server ends the stream the way it would close a websocket
+	st := status.Convert(err)
+	switch st.Code() {
+	case codes.Unavailable:
+		if st.Message() == "Server restarting" {
+			return "", ErrServerRestarting
+		}
+	case codes.PermissionDenied:
+		if reason, ok := strings.CutPrefix(st.Message(), "KICKED:"); ok {
+			return "", kickedError{reason: reason}
+		}
+	}
+	return "", err
+}
+
+func (t *grpcTransport) Close() error {
+	t.cancel()
+	return t.conn.Close()
+}
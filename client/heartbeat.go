@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// Heartbeat: the connection is pinged every pingInterval, and given up on
+// after maxMissedPongs pings in a row go unanswered for pongTimeout
+const (
+	pingInterval   = 30 * time.Second
+	pongTimeout    = 10 * time.Second
+	maxMissedPongs = 3
+)
+
+// Average latency up to these is shown green, then yellow, then red, and
+// above highLatency it's pointed out in the footer
+const (
+	latencyGood = 50 * time.Millisecond
+	latencyFair = 200 * time.Millisecond
+	highLatency = 500 * time.Millisecond
+)
+
+// latencyStatusDuration is how long latency notes stay in the footer
+const latencyStatusDuration = 5 * time.Second
+
+// heartbeat tracks pings on one connection. They're PING:<unix nanos> text
+// frames the server echoes as PONG:<unix nanos>, rather than websocket
+// pings, to time the round trip through the server's message handling.
+type heartbeat struct {
+	conn ChatTransport
+
+	sentAt   int64 // Of the latest ping, in Unix nanoseconds
+	answered bool  // Whether its pong came back
+	missed   int   // Pings in a row without a pong in time
+}
+
+// pingMsg is time to ping the connection again
+type pingMsg struct{ hb *heartbeat }
+
+// pongCheckMsg is pongTimeout after a ping, time to see if it was answered
+type pongCheckMsg struct{ hb *heartbeat }
+
+// startHeartbeat measures latency on conn from now on
+func startHeartbeat(conn ChatTransport) *heartbeat {
+	return &heartbeat{conn: conn}
+}
+
+// check counts the latest ping as missed if its pong hasn't come back,
+// reporting whether to give up on the connection
+func (hb *heartbeat) check() bool {
+	if !hb.answered {
+		hb.missed++
+	}
+	return hb.missed >= maxMissedPongs
+}
+
+// pingCmd waits pingInterval, then asks for the next ping
+func pingCmd(tab int, hb *heartbeat) tea.Cmd {
+	return forTab(tab, tea.Tick(pingInterval, func(time.Time) tea.Msg {
+		return pingMsg{hb: hb}
+	}))
+}
+
+// handlePing pings the connection, checking for the pong pongTimeout later
+func (m mainModel) handlePing(msg pingMsg) (mainModel, tea.Cmd) {
+	if msg.hb != m.heartbeat {
+		return m, nil // From a connection since replaced
+	}
+	msg.hb.sentAt = time.Now().UnixNano()
+	msg.hb.answered = false
+	frame := fmt.Sprintf("PING:%d", msg.hb.sentAt)
+	send := func() tea.Msg {
+		// A failed write means the read loop is about to report it too
+		msg.hb.conn.Send(frame)
+		return nil
+	}
+	return m, tea.Batch(send, forTab(m.id, tea.Tick(pongTimeout, func(time.Time) tea.Msg {
+		return pongCheckMsg{hb: msg.hb}
+	})))
+}
+
+// handlePong takes the round trip from PONG:<unix nanos>, the answer to
+// the latest ping
+func (m *mainModel) handlePong(payload string) {
+	sentAt, err := strconv.ParseInt(payload, 10, 64)
+	hb := m.heartbeat
+	if err != nil || hb == nil || sentAt != hb.sentAt || hb.answered {
+		return // Late, for a ping already counted as missed
+	}
+	hb.answered = true
+	hb.missed = 0
+	m.recordLatency(time.Since(time.Unix(0, sentAt)))
+}
+
+// recordLatency keeps the last few round trips and their average, warning
+// in the footer when it's high
+func (m *mainModel) recordLatency(rtt time.Duration) {
+	copy(m.latencyHistory[1:], m.latencyHistory[:len(m.latencyHistory)-1])
+	m.latencyHistory[0] = rtt.Milliseconds()
+	m.latencySamples = min(m.latencySamples+1, len(m.latencyHistory))
+
+	var total int64
+	for _, ms := range m.latencyHistory[:m.latencySamples] {
+		total += ms
+	}
+	m.latencyAvgMs = total / int64(m.latencySamples)
+	if m.latencyAvgMs > highLatency.Milliseconds() {
+		m.statusMsg = fmt.Sprintf("⚠ High latency: %dms on average", m.latencyAvgMs)
+		m.statusUntil = time.Now().Add(latencyStatusDuration)
+	}
+}
+
+// resetLatency forgets the measurements of a connection that's gone
+func (m *mainModel) resetLatency() {
+	m.latencyHistory = [len(m.latencyHistory)]int64{}
+	m.latencySamples = 0
+	m.latencyAvgMs = 0
+}
+
+// showLatencyHistory lists the last round trips in the footer, for ? on
+// an empty input
+func (m *mainModel) showLatencyHistory() {
+	samples := make([]string, m.latencySamples)
+	for i, ms := range m.latencyHistory[:m.latencySamples] {
+		samples[i] = fmt.Sprintf("%dms", ms)
+	}
+	m.statusMsg = fmt.Sprintf("Last pings, newest first: %s (average %dms)", strings.Join(samples, ", "), m.latencyAvgMs)
+	m.statusUntil = time.Now().Add(latencyStatusDuration)
+}
+
+// handlePongCheck closes a connection that stopped answering pings, so the
+// read loop starts reconnecting
+func (m mainModel) handlePongCheck(msg pongCheckMsg) (mainModel, tea.Cmd) {
+	if msg.hb != m.heartbeat {
+		return m, nil
+	}
+	if msg.hb.check() {
+		m.resetLatency()
+		msg.hb.conn.Close()
+		return m, nil
+	}
+	return m, pingCmd(m.id, msg.hb)
+}
+
+// latencyIndicator is the footer's "⚡ 42ms", the average of the last few
+// round trips colored by how good it is, empty until it's been measured
+func (m mainModel) latencyIndicator() string {
+	if !m.config.ShowLatency || m.latencySamples == 0 || m.state != chatView || m.reconnecting {
+		return ""
+	}
+	avg := time.Duration(m.latencyAvgMs) * time.Millisecond
+	color := successColor
+	switch {
+	case avg > latencyFair:
+		color = errorColor
+	case avg >= latencyGood:
+		color = awayColor
+	}
+	return lipgloss.NewStyle().Foreground(color).Background(lipgloss.Color("#0D1117")).PaddingLeft(1).
+		Render(fmt.Sprintf("⚡ %dms", m.latencyAvgMs))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	historyPageSize = 50                     // Messages per page, unless /history asks for more
+	historyPageMax  = 200                    // The most the server sends in one page
+	historyDebounce = 500 * time.Millisecond // Between fetches when scrolled to the top
+)
+
+// historyPage is a HISTORYPAGE frame's payload: the messages before the
+// cursor the page was asked for with
+type historyPage struct {
+	Before   string        `json:"before"`
+	Messages []wireMessage `json:"messages"`
+}
+
+func historyCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	n := historyPageSize
+	if args = strings.TrimSpace(args); args != "" {
+		var err error
+		if n, err = strconv.Atoi(args); err != nil || n < 1 || n > historyPageMax {
+			m.addSystemMessage(fmt.Sprintf("Usage: /history [N], with N up to %d", historyPageMax))
+			return m, nil
+		}
+	}
+	if m.historyEnd || m.oldestMsgID == "" {
+		m.addSystemMessage("There are no older messages in #" + m.currentChannel)
+		return m, nil
+	}
+	return m, m.fetchOlder(n)
+}
+
+// resetHistoryPaging starts paging from the oldest message shown, after
+// switching channels or a history replay
+func (m *mainModel) resetHistoryPaging() {
+	m.oldestMsgID = ""
+	for _, msg := range m.messages {
+		if msg.ID != "" {
+			m.oldestMsgID = msg.ID
+			break
+		}
+	}
+	m.historyEnd = false
+	m.historyFetching = 0
+}
+
+// fetchOlder asks for the n messages before the oldest one shown
+func (m *mainModel) fetchOlder(n int) tea.Cmd {
+	if m.historyFetching > 0 {
+		return nil
+	}
+	m.historyFetching = n
+	m.historyFetchAt = time.Now()
+	return m.sendMessageCmd(fmt.Sprintf("HISTORY:%s:%d:%s", m.currentChannel, n, m.oldestMsgID))
+}
+
+// fetchOlderAtTop fetches another page when the chat is scrolled up to the
+// top, at most once per historyDebounce
+func (m *mainModel) fetchOlderAtTop() tea.Cmd {
+	if m.state != chatView || m.autoScroll || m.viewport.YOffset != 0 {
+		return nil
+	}
+	if m.historyEnd || m.oldestMsgID == "" || time.Since(m.historyFetchAt) < historyDebounce {
+		return nil
+	}
+	return m.fetchOlder(historyPageSize)
+}
+
+// loadOlder handles HISTORYPAGE:<channel>:<json>, putting the page above
+// the oldest message with the view kept where it was
+func (m *mainModel) loadOlder(payload string) {
+	channel, data, _ := strings.Cut(payload, ":")
+	var page historyPage
+	if err := json.Unmarshal([]byte(data), &page); err != nil {
+		return
+	}
+	// Left over from a channel we've since switched away from
+	if channel != m.currentChannel || page.Before != m.oldestMsgID {
+		return
+	}
+	requested := m.historyFetching
+	m.historyFetching = 0
+	if len(page.Messages) < requested {
+		m.historyEnd = true
+	}
+	block := m.unseen(page.Messages)
+	if len(block) == 0 {
+		return
+	}
+	m.oldestMsgID = block[0].ID
+
+	separator := ChatMessage{
+		Content:     fmt.Sprintf("─── Loaded %d older messages ───", len(block)),
+		IsSeparator: true,
+	}
+	block = append(block, separator)
+	m.messages = append(block, m.messages...)
+	m.connectedMsgIndex += len(block)
+
+	lines := m.viewport.TotalLineCount()
+	m.viewport.SetContent(m.renderMessages())
+	m.viewport.SetYOffset(m.viewport.YOffset + m.viewport.TotalLineCount() - lines)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/charmbracelet/lipgloss"
+)
+
+// urlPattern finds links in message bodies, leaving out punctuation that
+// usually ends the sentence rather than the link
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]*[^\s<>".,;:!?')\]]`)
+
+// maxLinkDisplay is how much of a link's text is shown before it's cut off
+const maxLinkDisplay = 50
+
+// linkDisplay shortens long links to maxLinkDisplay characters
+func linkDisplay(url string) string {
+	runes := []rune(url)
+	if len(runes) <= maxLinkDisplay {
+		return url
+	}
+	return string(runes[:maxLinkDisplay-1]) + "…"
+}
+
+// renderText renders message text in style, with links made clickable on
+// terminals that support OSC-8 hyperlinks unless turned off in the config
+func (m mainModel) renderText(text string, style lipgloss.Style) string {
+	if !m.config.Hyperlinks || !supportsHyperlinks() {
+		return style.Render(text)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, span := range urlPattern.FindAllStringIndex(text, -1) {
+		url := text[span[0]:span[1]]
+		b.WriteString(style.Render(text[last:span[0]]))
+		b.WriteString(hyperlink(url, style.Underline(true).Render(linkDisplay(url))))
+		last = span[1]
+	}
+	b.WriteString(style.Render(text[last:]))
+	return b.String()
+}
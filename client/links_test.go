@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestURLPattern(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"see https://example.com", []string{"https://example.com"}},
+		{"http://example.com/a?b=c&d=e#f", []string{"http://example.com/a?b=c&d=e#f"}},
+		{"https://example.com/path.", []string{"https://example.com/path"}},
+		{"go to https://example.com, then", []string{"https://example.com"}},
+		{"is it https://example.com?", []string{"https://example.com"}},
+		{"wow https://example.com!", []string{"https://example.com"}},
+		{"(https://example.com/x)", []string{"https://example.com/x"}},
+		{"[https://example.com/x]", []string{"https://example.com/x"}},
+		{"'https://example.com/x'", []string{"https://example.com/x"}},
+		{`"https://example.com/x"`, []string{"https://example.com/x"}},
+		{"<https://example.com/x>", []string{"https://example.com/x"}},
+		{"https://example.com/x...", []string{"https://example.com/x"}},
+		{"https://example.com/a.b/c", []string{"https://example.com/a.b/c"}},
+		{"https://example.com:8080/x;", []string{"https://example.com:8080/x"}},
+		{"two https://a.example and http://b.example.", []string{"https://a.example", "http://b.example"}},
+		{"https://例え.jp/パス", []string{"https://例え.jp/パス"}},
+		{"no links here", nil},
+		{"ftp://example.com", nil},
+		{"https://", nil},
+		{"https://.", nil},
+	}
+	for _, tt := range tests {
+		got := urlPattern.FindAllString(tt.text, -1)
+		if strings.Join(got, " ") != strings.Join(tt.want, " ") || len(got) != len(tt.want) {
+			t.Errorf("links in %q = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestLinkDisplay(t *testing.T) {
+	long := "https://example.com/" + strings.Repeat("a", 100)
+	exact := "https://example.com/" + strings.Repeat("b", maxLinkDisplay-len("https://example.com/"))
+	wide := "https://example.com/" + strings.Repeat("é", 60)
+
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"short", "https://example.com", "https://example.com"},
+		{"empty", "", ""},
+		{"exactly the limit", exact, exact},
+		{"one over the limit", exact + "c", exact[:maxLinkDisplay-1] + "…"},
+		{"long", long, long[:maxLinkDisplay-1] + "…"},
+		{"multibyte", wide, string([]rune(wide)[:maxLinkDisplay-1]) + "…"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := linkDisplay(tt.url)
+			if got != tt.want {
+				t.Errorf("linkDisplay(%q) = %q, want %q", tt.url, got, tt.want)
+			}
+			if n := utf8.RuneCountInString(got); n > maxLinkDisplay {
+				t.Errorf("linkDisplay(%q) is %d characters, over %d", tt.url, n, maxLinkDisplay)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logFile is where the client logs what happens behind the scenes, in
+// ~/.echo, since the terminal is taken by the UI. It's rotated at
+// logMaxSizeMB, keeping logMaxBackups old files.
+const (
+	logFile       = "client.log"
+	logMaxSizeMB  = 10
+	logMaxBackups = 3
+)
+
+// defaultLogLevel is used when neither --log-level nor the config sets one
+const defaultLogLevel = "info"
+
+// secretFrames are frames whose payload holds a password or token, logged
+// without it
+var secretFrames = []string{"PASSWD:", "DISABLE2FA:", "SESSION:"}
+
+func init() {
+	// Nothing is logged until setupLogging, and never to the terminal
+	slog.SetDefault(slog.New(slog.DiscardHandler))
+}
+
+// setupLogging sends slog's output at level and above to the log file.
+// The file is only readable by us, as it may hold messages.
+func setupLogging(level string) error {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("log level must be debug, info, warn or error, not %q", level)
+	}
+	dir, err := echoDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, logFile)
+	// lumberjack creates new files 0600, but keeps an existing file's mode
+	if err := os.Chmod(path, 0600); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	out := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    logMaxSizeMB,
+		MaxBackups: logMaxBackups,
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{Level: lvl})))
+	return nil
+}
+
+// loggedFrame is a frame as it goes in the log, with any secret left out
+func loggedFrame(frame string) string {
+	for _, prefix := range secretFrames {
+		if strings.HasPrefix(frame, prefix) {
+			return prefix + "…"
+		}
+	}
+	return frame
+}
@@ -1,25 +1,106 @@
 package main
 
 import (
+	"cmp"
+	"flag"
 	"fmt"
+	"log/slog"
 	"os"
 
 	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/term"
 )
 
 func main() {
-	// Load configuration (ignore error to use defaults)
-	cfg, err := LoadConfig("theme.conf")
-	if err != nil {
-		// Just print a warning if we can't read it, but proceed with defaults
-		// fmt.Printf("Warning: Could not load theme.conf: %v\n", err)
+	var pipe pipeOptions
+	flag.StringVar(&pipe.server, "server", "", "server address, e.g. host:8080 or wss://host")
+	flag.StringVar(&pipe.username, "username", "", "username to log in as")
+	flag.StringVar(&pipe.token, "token", "", "session token to log in with (pipe mode)")
+	flag.StringVar(&pipe.channel, "channel", "", "channel to send to and read from (pipe mode)")
+	logLevel := flag.String("log-level", "", "what ~/.echo/client.log records: debug, info, warn or error")
+	transport := flag.String("transport", "", "how to reach the server: ws (websocket, the default) or grpc")
+	noSession := flag.Bool("no-session", false, "show the login form instead of resuming the last session")
+	clearSession := flag.Bool("clear-session", false, "forget every saved session, in the keychain and ~/.echo")
+	flag.Parse()
+
+	// No config file yet means this is the first run
+	path := configPath()
+	adoptErr := adoptLegacyConfig(path)
+	_, statErr := os.Stat(path)
+	firstRun := os.IsNotExist(statErr)
+
+	// Load configuration, falling back to the defaults
+	cfg, cfgErr := LoadConfig(path)
+
+	// The flag wins over the config
+	level := cmp.Or(*logLevel, cfg.LogLevel, defaultLogLevel)
+	if err := setupLogging(level); err != nil {
+		fmt.Fprintln(os.Stderr, "echo:", err)
+		os.Exit(2)
+	}
+	if adoptErr != nil {
+		slog.Warn("couldn't copy the config from "+legacyConfigPath, "path", path, "err", adoptErr)
+	}
+	if cfgErr != nil {
+		slog.Warn("couldn't load the config, using the defaults", "path", path, "err", cfgErr)
+	}
+	if *clearSession {
+		if err := clearAllSessions(); err != nil {
+			fmt.Fprintln(os.Stderr, "echo: couldn't clear the saved sessions:", err)
+			os.Exit(1)
+		}
+	}
+	cfg.Transport = cmp.Or(*transport, cfg.Transport)
+	if err := validTransport(cfg.Transport); err != nil {
+		fmt.Fprintln(os.Stderr, "echo:", err)
+		os.Exit(2)
+	}
+	if reduceMotion() {
+		cfg.AnimationSpeed = animationNone
+	}
+	cfg.AnimationSpeed = cmp.Or(cfg.AnimationSpeed, animationNormal)
+	if err := validAnimationSpeed(cfg.AnimationSpeed); err != nil {
+		fmt.Fprintln(os.Stderr, "echo:", err)
+		os.Exit(2)
+	}
+
+	// Piped input means a script is talking, so skip the TUI
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		if err := runPipe(cfg, pipe); err != nil {
+			slog.Error("pipe mode failed", "err", err)
+			fmt.Fprintln(os.Stderr, "echo:", err)
+			os.Exit(1)
+		}
+		return
 	}
 
+	if pipe.server != "" {
+		cfg.Address = pipe.server
+	}
 	model := initialModel(cfg)
-	p := tea.NewProgram(model, tea.WithAltScreen())
+	if pipe.server != "" {
+		model.state = loginView // Skip the saved servers
+	} else if firstRun {
+		model.startWizard()
+	} else if pipe.username == "" && !*noSession && !*clearSession {
+		model.resumeSession()
+	}
+	if pipe.username != "" {
+		model.userInput.SetValue(pipe.username)
+	}
+	opts := []tea.ProgramOption{tea.WithAltScreen()}
+	if cfg.Mouse && cfg.RelativeTime {
+		// Hovering a message shows its exact time
+		opts = append(opts, tea.WithMouseAllMotion())
+	} else if cfg.Mouse {
+		opts = append(opts, tea.WithMouseCellMotion())
+	}
+	p := tea.NewProgram(model, opts...)
 
 	if _, err := p.Run(); err != nil {
-		fmt.Printf("Alas, there's been an error: %v", err)
+		slog.Error("the UI stopped", "err", err)
+		// The terminal is back to normal by now, so this can be printed
+		fmt.Fprintf(os.Stderr, "Alas, there's been an error: %v\n", err)
 		os.Exit(1)
 	}
 }
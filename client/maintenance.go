@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// maintenanceRetryDelay is the wait between reconnect attempts while the
+// server is down for maintenance, which takes a while
+const maintenanceRetryDelay = 60 * time.Second
+
+func maintenanceCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	action, text, _ := strings.Cut(strings.TrimSpace(args), " ")
+	switch strings.ToLower(action) {
+	case "on":
+		return m, m.sendMessageCmd("MAINTENANCE:on:" + strings.TrimSpace(text))
+	case "off":
+		return m, m.sendMessageCmd("MAINTENANCE:off")
+	}
+	m.addSystemMessage("Usage: /maintenance on [message] | off")
+	return m, nil
+}
+
+// setMaintenance handles MAINTENANCE:<message> and, with no message,
+// MAINTENANCE_END
+func (m *mainModel) setMaintenance(message string) {
+	m.maintenance = message
+	m.resize()
+}
+
+// maintenanceBannerHeight is the line the banner takes above the header
+func (m mainModel) maintenanceBannerHeight() int {
+	if m.maintenance != "" {
+		return 1
+	}
+	return 0
+}
+
+// maintenanceBanner shows the server's maintenance message until it ends
+func (m mainModel) maintenanceBanner() string {
+	text := ansi.Truncate("🔧 Maintenance: "+m.maintenance, max(m.width-2, 0), "…")
+	return m.styles.Error.Width(m.width).Render(text)
+}
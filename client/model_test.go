@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/exp/teatest"
+	"github.com/gorilla/websocket"
+	"github.com/muesli/termenv"
+	"github.com/zalando/go-keyring"
+)
+
+func TestMain(m *testing.M) {
+	// Keep the tests away from the real keychain and ~/.echo, and render
+	// without colors so the output can be searched as plain text
+	keyring.MockInit()
+	home, err := os.MkdirTemp("", "echo-test-home")
+	if err != nil {
+		panic(err)
+	}
+	os.Setenv("HOME", home)
+	lipgloss.SetColorProfile(termenv.Ascii)
+
+	code := m.Run()
+	os.RemoveAll(home)
+	os.Exit(code)
+}
+
+// fakeServer is an Echo server that accepts any login and hands what the
+// client sends to frames, answering chat messages with the stored copy
+// and an ACK. Only bob is online to whisper to.
+type fakeServer struct {
+	*httptest.Server
+	frames chan string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	t.Helper()
+	s := &fakeServer{frames: make(chan string, 64)}
+	upgrader := websocket.Upgrader{Subprotocols: protocolVersions}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+
+		var creds Credentials
+		_, data, err := c.ReadMessage()
+		if err != nil || json.Unmarshal(data, &creds) != nil {
+			return
+		}
+		c.WriteMessage(websocket.TextMessage, []byte("JOINED:"+creds.Username))
+		c.WriteMessage(websocket.TextMessage, []byte("USERLIST:"+creds.Username+",bob"))
+
+		for {
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			frame := string(data)
+			s.frames <- frame
+
+			var sent struct {
+				Type     string `json:"type"`
+				Body     string `json:"body"`
+				ClientID string `json:"clientID"`
+			}
+			if json.Unmarshal(data, &sent) != nil || sent.Type != "message" {
+				continue
+			}
+			if strings.HasPrefix(sent.Body, "/whisper ") {
+				if strings.HasPrefix(sent.Body, "/whisper bob ") {
+					c.WriteMessage(websocket.TextMessage, []byte("ACK:"+sent.ClientID))
+				} else {
+					c.WriteMessage(websocket.TextMessage, []byte("ERR:user_not_found:"+sent.ClientID))
+				}
+				continue
+			}
+			stored, _ := json.Marshal(map[string]string{
+				"type":      "message",
+				"id":        "m1",
+				"sender":    creds.Username,
+				"content":   sent.Body,
+				"timestamp": time.Now().Format(time.RFC3339),
+				"channel":   defaultChannel,
+				"clientID":  sent.ClientID,
+			})
+			c.WriteMessage(websocket.TextMessage, stored)
+			c.WriteMessage(websocket.TextMessage, []byte("ACK:"+sent.ClientID))
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// address is the server's host:port, as typed into the login form
+func (s *fakeServer) address() string {
+	return strings.TrimPrefix(s.URL, "http://")
+}
+
+// nextChat waits for the next chat message the client sends
+func (s *fakeServer) nextChat(t *testing.T) string {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case frame := <-s.frames:
+			if strings.Contains(frame, `"type":"message"`) {
+				return frame
+			}
+		case <-timeout:
+			t.Fatal("the client sent no chat message")
+			return ""
+		}
+	}
+}
+
+func testModel(t *testing.T, cfg Config) *teatest.TestModel {
+	t.Helper()
+	return teatest.NewTestModel(t, initialModel(cfg), teatest.WithInitialTermSize(100, 30))
+}
+
+func testConfig() Config {
+	cfg := DefaultConfig()
+	cfg.AnimationSpeed = animationNone
+	return cfg
+}
+
+// waitForText waits until the screen has shown every one of texts
+func waitForText(t *testing.T, tm *teatest.TestModel, texts ...string) {
+	t.Helper()
+	teatest.WaitFor(t, tm.Output(), func(out []byte) bool {
+		for _, text := range texts {
+			if !bytes.Contains(out, []byte(text)) {
+				return false
+			}
+		}
+		return true
+	}, teatest.WithDuration(3*time.Second), teatest.WithCheckInterval(20*time.Millisecond))
+}
+
+// logIn fills in the login form and presses Connect
+func logIn(tm *teatest.TestModel, server, username, password string) {
+	tm.Type(server)
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter}) // On to the username
+	tm.Type(username)
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter}) // On to the password
+	tm.Type(password)
+	for range focusConnect - focusPass {
+		tm.Send(tea.KeyMsg{Type: tea.KeyTab})
+	}
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter})
+}
+
+func finalModel(t *testing.T, tm *teatest.TestModel) mainModel {
+	t.Helper()
+	return tm.FinalModel(t, teatest.WithFinalTimeout(3*time.Second)).(mainModel)
+}
+
+func TestLoginToChat(t *testing.T) {
+	server := newFakeServer(t)
+	tm := testModel(t, testConfig())
+
+	logIn(tm, server.address(), "alice", "secret")
+	waitForText(t, tm, "Successfully connected to "+server.address())
+	tm.Type("n") // Don't save the server
+
+	tm.Type("hello there")
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter})
+
+	var sent struct {
+		Type string `json:"type"`
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal([]byte(server.nextChat(t)), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Type != "message" || sent.Body != "hello there" {
+		t.Errorf("sent %+v, want a message saying hello there", sent)
+	}
+	waitForText(t, tm, "hello there")
+
+	tm.Send(tea.KeyMsg{Type: tea.KeyCtrlC})
+	m := finalModel(t, tm)
+	if m.state != chatView {
+		t.Errorf("state = %v, want the chat", m.state)
+	}
+	if m.username != "alice" {
+		t.Errorf("username = %q, want alice", m.username)
+	}
+	if i := m.messageIndex("m1"); i < 0 || m.messages[i].Delivery != deliverySent {
+		t.Errorf("the message wasn't acknowledged: %+v", m.messages)
+	}
+}
+
+func TestLoginRefused(t *testing.T) {
+	upgrader := websocket.Upgrader{Subprotocols: protocolVersions}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.ReadMessage()
+		c.WriteMessage(websocket.TextMessage, []byte("ERROR: Invalid password"))
+	}))
+	defer server.Close()
+
+	cfg := testConfig()
+	cfg.MaxRetries = 0
+	tm := testModel(t, cfg)
+	logIn(tm, strings.TrimPrefix(server.URL, "http://"), "alice", "wrong")
+	waitForText(t, tm, "Invalid password")
+
+	tm.Send(tea.KeyMsg{Type: tea.KeyCtrlC})
+	if m := finalModel(t, tm); m.state == chatView {
+		t.Error("got into the chat with a refused password")
+	}
+}
+
+func TestLoginKeys(t *testing.T) {
+	tm := testModel(t, testConfig())
+
+	tm.Send(tea.KeyMsg{Type: tea.KeyTab}) // Server to username
+	tm.Type("alice")
+	tm.Send(tea.KeyMsg{Type: tea.KeyTab})
+	tm.Type("hunter2")
+	tm.Send(tea.KeyMsg{Type: tea.KeyShiftTab})
+	tm.Send(tea.KeyMsg{Type: tea.KeyTab})
+	tm.Send(tea.KeyMsg{Type: tea.KeyTab}) // On to the show password toggle
+	tm.Send(tea.KeyMsg{Type: tea.KeySpace})
+	waitForText(t, tm, "hunter2")
+
+	tm.Send(tea.KeyMsg{Type: tea.KeyEsc}) // Quits, the default quit key
+	m := finalModel(t, tm)
+	if m.focusIndex != focusToggle {
+		t.Errorf("focus = %d, want the password toggle", m.focusIndex)
+	}
+	if !m.showPassword {
+		t.Error("space on the toggle didn't show the password")
+	}
+	if got := m.userInput.Value(); got != "alice" {
+		t.Errorf("username = %q, want alice", got)
+	}
+	if got := m.passInput.Value(); got != "hunter2" {
+		t.Errorf("password = %q, want hunter2", got)
+	}
+}
+
+func TestChatKeys(t *testing.T) {
+	server := newFakeServer(t)
+	cfg := testConfig()
+	cfg.Keys.KeyQuit = "ctrl+q"
+	tm := testModel(t, cfg)
+
+	logIn(tm, server.address(), "alice", "secret")
+	waitForText(t, tm, "Successfully connected")
+	tm.Type("n")
+
+	// Alt+Enter starts a new line rather than sending
+	tm.Type("first")
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter, Alt: true})
+	tm.Type("second")
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter})
+	var sent struct {
+		Body string `json:"body"`
+	}
+	json.Unmarshal([]byte(server.nextChat(t)), &sent)
+	if sent.Body != "first\nsecond" {
+		t.Errorf("sent %q, want both lines", sent.Body)
+	}
+
+	// Ctrl+U clears what's typed, and Esc no longer quits once it's rebound
+	tm.Type("never sent")
+	tm.Send(tea.KeyMsg{Type: tea.KeyCtrlU})
+	tm.Send(tea.KeyMsg{Type: tea.KeyEsc})
+	tm.Send(tea.KeyMsg{Type: tea.KeyCtrlQ})
+
+	m := finalModel(t, tm)
+	if got := m.msgInput.Value(); got != "" {
+		t.Errorf("input = %q after Ctrl+U, want it empty", got)
+	}
+	if m.state != chatView {
+		t.Errorf("state = %v, want the chat", m.state)
+	}
+}
+
+func TestWhisperDelivery(t *testing.T) {
+	server := newFakeServer(t)
+	tm := testModel(t, testConfig())
+
+	logIn(tm, server.address(), "alice", "secret")
+	waitForText(t, tm, "Successfully connected")
+	tm.Type("n")
+
+	tm.Type("/whisper carol are you there")
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter})
+	server.nextChat(t)
+	waitForText(t, tm, "not online")
+
+	tm.Type("/whisper bob just for you")
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter})
+	server.nextChat(t)
+	waitForText(t, tm, "just for you", "✓")
+
+	tm.Send(tea.KeyMsg{Type: tea.KeyCtrlC})
+	m := finalModel(t, tm)
+	var whispers []ChatMessage
+	for _, msg := range m.messages {
+		if msg.IsPrivate {
+			whispers = append(whispers, msg)
+		}
+	}
+	// The whisper to carol, who is offline, was taken back
+	if len(whispers) != 1 || whispers[0].To != "bob" {
+		t.Fatalf("whispers = %+v, want only the one to bob", whispers)
+	}
+	if whispers[0].Delivery != deliverySent {
+		t.Errorf("the whisper to bob wasn't acknowledged: %+v", whispers[0])
+	}
+}
+
+func TestThemeSave(t *testing.T) {
+	server := newFakeServer(t)
+	tm := testModel(t, testConfig())
+
+	logIn(tm, server.address(), "alice", "secret")
+	waitForText(t, tm, "Successfully connected")
+	tm.Type("n")
+
+	// Saved in ~/.echo whatever directory the client runs in
+	tm.Type("/theme 3")
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter})
+	tm.Type("/theme save")
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter})
+	waitForText(t, tm, "Saved Forest as your theme")
+	tm.Send(tea.KeyMsg{Type: tea.KeyCtrlC})
+	finalModel(t, tm)
+
+	path := filepath.Join(os.Getenv("HOME"), ".echo", "config.toml")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Preset != 3 {
+		t.Errorf("preset = %d in %s, want 3", cfg.Preset, path)
+	}
+}
+
+func TestPasswd(t *testing.T) {
+	server := newFakeServer(t)
+	tm := testModel(t, testConfig())
+
+	logIn(tm, server.address(), "alice", "secret")
+	waitForText(t, tm, "Successfully connected")
+	tm.Type("n")
+
+	// Quotes let a password hold spaces, and colons need nothing
+	tm.Type(`/passwd "old pass" new:pass`)
+	tm.Send(tea.KeyMsg{Type: tea.KeyEnter})
+	timeout := time.After(3 * time.Second)
+	var frame string
+	for !strings.HasPrefix(frame, "PASSWD:") {
+		select {
+		case frame = <-server.frames:
+		case <-timeout:
+			t.Fatal("the client sent no PASSWD frame")
+		}
+	}
+	var change struct {
+		Old string `json:"old"`
+		New string `json:"new"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(frame, "PASSWD:")), &change); err != nil {
+		t.Fatalf("sent %q: %v", frame, err)
+	}
+	if change.Old != "old pass" || change.New != "new:pass" {
+		t.Errorf("sent %+v, want old pass and new:pass", change)
+	}
+	tm.Send(tea.KeyMsg{Type: tea.KeyCtrlC})
+	finalModel(t, tm)
+}
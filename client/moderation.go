@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// kickedMsg is sent when the server closes our connection with a
+// KICKED:<reason> close frame
+type kickedMsg struct{ reason string }
+
+func kickCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	user, reason, _ := strings.Cut(args, " ")
+	user = strings.TrimPrefix(user, "@")
+	if user == "" {
+		m.addSystemMessage("Usage: /kick <username> [reason]")
+		return m, nil
+	}
+	return m, m.sendMessageCmd("KICK:" + user + ":" + strings.TrimSpace(reason))
+}
+
+func banCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	user, rest, _ := strings.Cut(args, " ")
+	user = strings.TrimPrefix(user, "@")
+	if user == "" {
+		m.addSystemMessage("Usage: /ban <username> [duration] [reason]")
+		return m, nil
+	}
+
+	// The duration is optional, so only take the next word if it is one
+	var duration time.Duration
+	rest = strings.TrimSpace(rest)
+	if word, reason, _ := strings.Cut(rest, " "); word != "" {
+		if d, err := parseBanDuration(word); err == nil {
+			duration = d
+			rest = strings.TrimSpace(reason)
+		}
+	}
+	return m, m.sendMessageCmd(fmt.Sprintf("BAN:%s:%d:%s", user, int(duration.Seconds()), rest))
+}
+
+func announceCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	if args == "" {
+		m.addSystemMessage("Usage: /announce <text>")
+		return m, nil
+	}
+	return m, m.sendMessageCmd("ANNOUNCE:" + args)
+}
+
+// ringBell sounds the terminal bell, for announcements
+func ringBell() tea.Msg {
+	os.Stdout.WriteString("\a")
+	return nil
+}
+
+// statsCommand shows server stats from /api/stats when admin_token is set
+// in the config, otherwise the summary admins get over the chat connection
+func statsCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	if m.config.AdminToken != "" {
+		return m, m.fetchStatsCmd()
+	}
+	return m, m.sendMessageCmd("STATS")
+}
+
+func reloadFiltersCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	return m, m.sendMessageCmd("RELOADFILTERS")
+}
+
+// webhookCommand tests the server's outgoing webhooks, and creates or
+// revokes incoming ones
+func webhookCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	action, arg, _ := strings.Cut(strings.TrimSpace(args), " ")
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		action = ""
+	}
+	switch action {
+	case "test":
+		return m, m.sendMessageCmd("WEBHOOKTEST:" + arg)
+	case "create":
+		return m, m.sendMessageCmd("WEBHOOKCREATE:" + strings.TrimPrefix(arg, "#"))
+	case "revoke":
+		return m, m.sendMessageCmd("WEBHOOKREVOKE:" + arg)
+	}
+	m.addSystemMessage("Usage: /webhook test <name> | create <channel> | revoke <token>")
+	return m, nil
+}
+
+// parseBanDuration accepts Go durations like "90m" or "2h30m", plus whole
+// days like "7d"
+func parseBanDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// showMotd adds the server's message of the day above the channel history,
+// unless /motd off hid it for this session
+func (m *mainModel) showMotd(text string) {
+	m.motd = text
+	if m.hideMotd {
+		return
+	}
+	m.insertBeforeWelcome([]ChatMessage{{
+		Timestamp: time.Now().Format("15:04"),
+		Content:   text,
+		IsMotd:    true,
+	}})
+}
+
+// motdCommand shows the message of the day again, hides it on reconnects,
+// or lets admins change it
+func motdCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	action, text, _ := strings.Cut(strings.TrimSpace(args), " ")
+	switch strings.ToLower(action) {
+	case "":
+		if m.motd == "" {
+			m.addSystemMessage("This server has no message of the day")
+			return m, nil
+		}
+		m.messages = append(m.messages, ChatMessage{
+			Timestamp: time.Now().Format("15:04"),
+			Content:   m.motd,
+			IsMotd:    true,
+		})
+	case "off":
+		m.hideMotd = true
+		m.addSystemMessage("The message of the day won't be shown when reconnecting")
+	case "on":
+		m.hideMotd = false
+		m.addSystemMessage("The message of the day will be shown when reconnecting")
+	case "set":
+		return m, m.sendMessageCmd("MOTD:" + strings.TrimSpace(text))
+	default:
+		m.addSystemMessage("Usage: /motd [on|off|set <text>]")
+	}
+	return m, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// mouseScrollLines is how far one wheel step scrolls the chat
+const mouseScrollLines = 3
+
+// hoverStatusDuration is how long a hovered message's time stays in the footer
+const hoverStatusDuration = time.Second
+
+// chatTop is the screen row of the chat box's top border, below the tab
+// bar, the reconnect banner, the header, its separator and the "more
+// messages above" hint when that is shown
+func (m mainModel) chatTop() int {
+	top := 2 + m.tabBarHeight() + m.reconnectBannerHeight() + m.maintenanceBannerHeight()
+	if m.viewport.YOffset > 0 {
+		top++
+	}
+	return top
+}
+
+// handleMouse scrolls the chat with the wheel, switches channels when one
+// is clicked in the sidebar and opens links clicked in messages
+func (m mainModel) handleMouse(msg tea.MouseMsg) (mainModel, tea.Cmd) {
+	if m.state != chatView && m.state != searchView && m.state != pinboardView && m.state != bookmarkView {
+		return m, nil
+	}
+
+	if msg.Action == tea.MouseActionMotion && msg.Button == tea.MouseButtonNone {
+		m.showHoveredTime(msg)
+		return m, nil
+	}
+
+	sidebarLeft := m.width - 2 - m.sidebarWidth()
+	overThread := m.thread != nil && msg.X >= sidebarLeft
+
+	switch msg.Button {
+	case tea.MouseButtonWheelUp:
+		if overThread {
+			m.thread.viewport.ScrollUp(mouseScrollLines)
+			return m, nil
+		}
+		m.viewport.ScrollUp(mouseScrollLines)
+		m.followScroll()
+		return m, nil
+	case tea.MouseButtonWheelDown:
+		if overThread {
+			m.thread.viewport.ScrollDown(mouseScrollLines)
+			return m, nil
+		}
+		m.viewport.ScrollDown(mouseScrollLines)
+		m.followScroll()
+		return m, nil
+	case tea.MouseButtonLeft:
+		if msg.Action != tea.MouseActionPress || m.state != chatView {
+			return m, nil
+		}
+	default:
+		return m, nil
+	}
+
+	top := m.chatTop()
+
+	// The new messages badge sits just below the chat box
+	if m.unreadSinceScroll > 0 && msg.Y == top+m.viewport.Height+4 {
+		m.jumpToBottom()
+		return m, nil
+	}
+
+	if overThread {
+		return m, nil
+	}
+
+	// Channel rows start below the sidebar's border and "Channels" title
+	if m.sidebarWidth() > 0 && msg.X >= sidebarLeft {
+		rows := m.sidebarRows()
+		i := msg.Y - top - 2
+		if i < 0 || i >= len(rows) {
+			return m, nil
+		}
+		if rows[i].category != "" {
+			m.toggleCategory(rows[i].category)
+		} else if rows[i].channel.Name != m.currentChannel {
+			return m.handleCommand("join", rows[i].channel.Name)
+		}
+		return m, nil
+	}
+
+	// Message text starts inside the chat box's border and padding
+	row := msg.Y - top - 1
+	if row < 0 || row >= m.viewport.Height {
+		return m, nil
+	}
+	if url := m.urlAt(m.viewport.YOffset+row, msg.X-2); url != "" {
+		openURL(url)
+	}
+	return m, nil
+}
+
+// showHoveredTime puts the exact time of the message under the pointer in
+// the footer for a moment
+func (m *mainModel) showHoveredTime(msg tea.MouseMsg) {
+	row := msg.Y - m.chatTop() - 1
+	if m.state != chatView || row < 0 || row >= m.viewport.Height {
+		return
+	}
+	if hovered, ok := m.messageAtLine(m.viewport.YOffset + row); ok && !hovered.Time.IsZero() {
+		m.statusMsg = hovered.Time.Local().Format(time.RFC3339)
+		m.statusUntil = time.Now().Add(hoverStatusDuration)
+	}
+}
+
+// urlAt returns the link at column col of rendered chat line, if any
+func (m mainModel) urlAt(line int, col int) string {
+	lines := strings.Split(m.renderMessages(), "\n")
+	if line < 0 || line >= len(lines) {
+		return ""
+	}
+
+	text := ansi.Strip(lines[line])
+	for _, span := range urlPattern.FindAllStringIndex(text, -1) {
+		start := ansi.StringWidth(text[:span[0]])
+		end := start + ansi.StringWidth(text[span[0]:span[1]])
+		if col >= start && col < end {
+			return m.fullURL(line, text[span[0]:span[1]])
+		}
+	}
+	return ""
+}
+
+// fullURL undoes linkDisplay's shortening of a link shown on line
+func (m mainModel) fullURL(line int, shown string) string {
+	prefix, shortened := strings.CutSuffix(shown, "…")
+	if !shortened {
+		return shown
+	}
+	if msg, ok := m.messageAtLine(line); ok {
+		for _, url := range urlPattern.FindAllString(msg.Content, -1) {
+			if strings.HasPrefix(url, prefix) {
+				return url
+			}
+		}
+	}
+	return ""
+}
+
+// openURL hands url to the system's default browser
+func openURL(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
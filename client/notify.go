@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// alertFlashTicks is how many animation ticks the chat's border stays lit
+// after a visual alert
+const alertFlashTicks = 3
+
+// NotifyRule is a [[notify]] entry in the config: messages matching the
+// pattern alert us, like mentions do
+type NotifyRule struct {
+	Pattern string `toml:"pattern"`         // A regular expression, matched against message text
+	Sound   string `toml:"sound,omitempty"` // bell (the default), visual or none
+}
+
+// notifyRule is a NotifyRule with its pattern compiled
+type notifyRule struct {
+	NotifyRule
+	re *regexp.Regexp
+}
+
+// visualAlertMsg flashes the chat's border for a matched notify rule
+type visualAlertMsg struct{}
+
+// compileNotifyRules compiles the config's rules, leaving out any whose
+// pattern isn't a valid regular expression; /notify list points those out
+func compileNotifyRules(rules []NotifyRule) []notifyRule {
+	var compiled []notifyRule
+	for _, rule := range rules {
+		if re, err := regexp.Compile(rule.Pattern); err == nil {
+			compiled = append(compiled, notifyRule{rule, re})
+		}
+	}
+	return compiled
+}
+
+// notifyCmd alerts us to msg if it matches a notify rule, the first
+// matching rule deciding how. Our own messages never do.
+func (m mainModel) notifyCmd(msg ChatMessage) tea.Cmd {
+	if msg.User == "" || msg.User == m.username || msg.IsSystem {
+		return nil
+	}
+	for _, rule := range m.notifyRules {
+		if rule.re.FindString(msg.Content) == "" {
+			continue
+		}
+		switch rule.Sound {
+		case "none":
+			return nil
+		case "visual":
+			return forTab(m.id, func() tea.Msg { return visualAlertMsg{} })
+		}
+		return ringBell
+	}
+	return nil
+}
+
+func notifyCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	action, pattern, _ := strings.Cut(strings.TrimSpace(args), " ")
+	pattern = strings.TrimSpace(pattern)
+	switch {
+	case action == "list":
+		m.listNotifyRules()
+	case action == "add" && pattern != "":
+		m.addNotifyRule(pattern)
+	case action == "remove" && pattern != "":
+		m.removeNotifyRule(pattern)
+	default:
+		m.addSystemMessage("Usage: /notify add <pattern> | list | remove <pattern>")
+	}
+	return m, nil
+}
+
+func (m *mainModel) listNotifyRules() {
+	if len(m.config.Notify) == 0 {
+		m.addSystemMessage("No notify rules - /notify add <pattern> to alert on a keyword")
+		return
+	}
+	lines := []string{"Notify rules:"}
+	for _, rule := range m.config.Notify {
+		sound := rule.Sound
+		if sound == "" {
+			sound = "bell"
+		}
+		line := fmt.Sprintf("  %s (%s)", rule.Pattern, sound)
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			line += " - not a valid pattern, ignored"
+		}
+		lines = append(lines, line)
+	}
+	m.addSystemMessage(strings.Join(lines, "\n"))
+}
+
+func (m *mainModel) addNotifyRule(pattern string) {
+	if _, err := regexp.Compile(pattern); err != nil {
+		m.addOutcomeMessage("Not a valid pattern: "+err.Error(), outcomeError)
+		return
+	}
+	for _, rule := range m.config.Notify {
+		if rule.Pattern == pattern {
+			m.addSystemMessage("Already notifying on " + pattern)
+			return
+		}
+	}
+	rule := NotifyRule{Pattern: pattern}
+	if err := appendNotifyRule(configPath(), rule); err != nil {
+		m.addOutcomeMessage("Couldn't save the rule: "+err.Error(), outcomeError)
+		return
+	}
+	m.config.Notify = append(m.config.Notify, rule)
+	m.notifyRules = compileNotifyRules(m.config.Notify)
+	m.addOutcomeMessage("Messages matching "+pattern+" will ring the bell", outcomeSuccess)
+}
+
+func (m *mainModel) removeNotifyRule(pattern string) {
+	for i, rule := range m.config.Notify {
+		if rule.Pattern != pattern {
+			continue
+		}
+		if err := deleteNotifyRule(configPath(), pattern); err != nil {
+			m.addOutcomeMessage("Couldn't save the change: "+err.Error(), outcomeError)
+			return
+		}
+		m.config.Notify = append(m.config.Notify[:i], m.config.Notify[i+1:]...)
+		m.notifyRules = compileNotifyRules(m.config.Notify)
+		m.addOutcomeMessage("Removed the notify rule for "+pattern, outcomeSuccess)
+		return
+	}
+	m.addSystemMessage("No notify rule for " + pattern + " - /notify list shows them")
+}
+
+// appendNotifyRule adds a [[notify]] entry to the end of the config file
+func appendNotifyRule(path string, rule NotifyRule) error {
+	return appendConfig(path, struct {
+		Notify []NotifyRule `toml:"notify"`
+	}{[]NotifyRule{rule}})
+}
+
+// deleteNotifyRule takes the [[notify]] entry for pattern out of the config
+// file, leaving the rest of it and its comments as they are
+func deleteNotifyRule(path string, pattern string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+
+	// An entry runs from its header to the next table's
+	start := -1
+	for i := 0; i <= len(lines); i++ {
+		header := i == len(lines) || strings.HasPrefix(strings.TrimSpace(lines[i]), "[")
+		if !header {
+			continue
+		}
+		if start != -1 {
+			var rule NotifyRule
+			if _, err := toml.Decode(strings.Join(lines[start+1:i], "\n"), &rule); err == nil && rule.Pattern == pattern {
+				lines = append(lines[:start], lines[i:]...)
+				return os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644)
+			}
+		}
+		start = -1
+		if i < len(lines) && strings.TrimSpace(lines[i]) == "[[notify]]" {
+			start = i
+		}
+	}
+	return fmt.Errorf("no [[notify]] entry for %s in %s", pattern, path)
+}
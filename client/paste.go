@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// pasteNoticeDuration is how long the note about a sanitized paste stays
+// under the input
+const pasteNoticeDuration = 3 * time.Second
+
+// unsafePaste matches what's taken out of pasted text: terminal escape
+// codes, null bytes, and the invisible and bidirectional characters that
+// can make a message read differently from what it says
+var unsafePaste = regexp.MustCompile(`\x1b\[[0-9;]*[a-zA-Z]|\x00|[\x{200B}-\x{200F}\x{202A}-\x{202E}\x{2066}-\x{2069}]`)
+
+// sanitizePaste takes what unsafePaste matches out of pasted text
+func sanitizePaste(s string) string {
+	return unsafePaste.ReplaceAllString(s, "")
+}
+
+// pastedFile is the file a paste names, if it's nothing but the path of
+// one, absolute or under ~/; a pasted /command isn't one
+func pastedFile(text string) (string, bool) {
+	path := strings.TrimSpace(text)
+	if strings.Contains(path, "\n") {
+		return "", false
+	}
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", false
+		}
+		path = filepath.Join(home, rest)
+	} else if !strings.HasPrefix(path, "/") {
+		return "", false
+	}
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false
+	}
+	return path, true
+}
+
+// paste puts pasted text into the input, sanitized, or asks whether to
+// send the file it's the path of
+func (m mainModel) paste(msg tea.KeyMsg) (mainModel, tea.Cmd) {
+	raw := string(msg.Runes)
+	text := sanitizePaste(raw)
+	if removed := utf8.RuneCountInString(raw) - utf8.RuneCountInString(text); removed > 0 {
+		m.pasteNotice = fmt.Sprintf("[Pasted text sanitized: removed %d unsafe characters]", removed)
+		m.pasteNoticeUntil = time.Now().Add(pasteNoticeDuration)
+		slog.Debug("sanitized paste", "removed", removed, "text", raw)
+	}
+	if path, ok := pastedFile(text); ok {
+		m.pastePath = path
+		m.pasteText = text
+		return m, nil
+	}
+	m.msgInput.InsertString(text)
+	return m, nil
+}
+
+// answerPastePrompt handles the key pressed at "Send file? [y/N]". Saying
+// no pastes the path as text; other keys do that too, then act as usual.
+func (m mainModel) answerPastePrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	path, text := m.pastePath, m.pasteText
+	m.pastePath, m.pasteText = "", ""
+	switch msg.String() {
+	case "y", "Y":
+		return fileCommand(m, path)
+	case "esc":
+		return m, nil
+	}
+	m.msgInput.InsertString(text)
+	switch msg.String() {
+	case "n", "N", "enter":
+		return m, nil
+	}
+	return m.Update(msg)
+}
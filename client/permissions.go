@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// Who may post in a channel, from channelInfo.Permissions
+const (
+	channelPublic     = "public"
+	channelInviteOnly = "invite-only"
+	channelReadOnly   = "read-only"
+)
+
+// channelLabel is how the sidebar names a channel: #name when anyone may
+// post, otherwise with an icon for who may
+func channelLabel(c channelInfo) string {
+	switch {
+	case c.Permissions == channelReadOnly:
+		return IconReadOnly + " " + c.Name
+	case c.Permissions == channelInviteOnly, c.IsPrivate:
+		return IconLock + " " + c.Name
+	}
+	return "#" + c.Name
+}
+
+func inviteCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		m.addSystemMessage("Usage: /invite <username> <channel>")
+		return m, nil
+	}
+	return m, m.sendMessageCmd(fmt.Sprintf("INVITE:%s:%s", strings.TrimPrefix(fields[1], "#"), fields[0]))
+}
+
+func modeCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	fields := strings.Fields(args)
+	if len(fields) == 2 {
+		switch mode := strings.ToLower(fields[1]); mode {
+		case channelPublic, channelInviteOnly, channelReadOnly:
+			return m, m.sendMessageCmd(fmt.Sprintf("CHANNELMODE:%s:%s", strings.TrimPrefix(fields[0], "#"), mode))
+		}
+	}
+	m.addSystemMessage("Usage: /mode <channel> public|invite-only|read-only")
+	return m, nil
+}
+
+// permissionDeniedText explains a PERMISSION_DENIED frame's reason
+func permissionDeniedText(channel, reason string) string {
+	switch reason {
+	case "read_only":
+		return fmt.Sprintf("#%s is read-only - only admins can post there", channel)
+	case "invite_only":
+		return fmt.Sprintf("#%s is invite-only - ask a mod to /invite you", channel)
+	}
+	return serverErrorText("permission_denied")
+}
+
+// permissionDenied handles PERMISSION_DENIED:<channel>:<reason>[:<clientID>].
+// With a clientID it's a message we sent, marked failed; without, a /join
+// the server refused, so we go back to where it kept us.
+func (m *mainModel) permissionDenied(payload string) tea.Cmd {
+	channel, rest, _ := strings.Cut(payload, ":")
+	reason, clientID, _ := strings.Cut(rest, ":")
+
+	var cmd tea.Cmd
+	if i := m.sentIndex(clientID); i != -1 {
+		m.messages[i].Delivery = deliveryFailed
+	} else if clientID == "" && channel == m.currentChannel && m.previousChannel != "" {
+		*m, cmd = m.handleCommand("join", m.previousChannel)
+	}
+	m.addOutcomeMessage(permissionDeniedText(channel, reason), outcomeError)
+	return cmd
+}
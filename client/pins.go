@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// pinnedMessage is one message on a channel's pinboard, from the HISTORY
+// replay and PINNED frames
+type pinnedMessage struct {
+	wireMessage
+	PinnedBy string `json:"pinnedBy"`
+	PinnedAt string `json:"pinnedAt"`
+}
+
+func pinCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	id := strings.TrimSpace(args)
+	if id == "" || strings.Contains(id, " ") {
+		m.addSystemMessage("Usage: /pin <msgID>")
+		return m, nil
+	}
+	return m, m.sendMessageCmd("PIN:" + m.currentChannel + ":" + id)
+}
+
+func pinboardCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	m.openPinboard()
+	return m, nil
+}
+
+// openPinboard shows the current channel's pins in place of the chat
+func (m *mainModel) openPinboard() {
+	m.state = pinboardView
+	m.pinIndex = 0
+	m.msgInput.Blur()
+	content, _ := m.renderPinboard()
+	m.viewport.SetContent(content)
+	m.viewport.GotoTop()
+}
+
+// closePinboard goes back to the chat, scrolled to the bottom
+func (m *mainModel) closePinboard() tea.Cmd {
+	m.state = chatView
+	m.viewport.SetContent(m.renderMessages())
+	m.viewport.GotoBottom()
+	return m.msgInput.Focus()
+}
+
+// movePinSelection moves the highlighted pin, keeping it in view
+func (m *mainModel) movePinSelection(delta int) {
+	if len(m.pins) == 0 {
+		return
+	}
+	m.pinIndex = max(0, min(len(m.pins)-1, m.pinIndex+delta))
+	content, starts := m.renderPinboard()
+	m.viewport.SetContent(content)
+
+	// Pins are separated by a blank line
+	top, bottom := starts[m.pinIndex], starts[m.pinIndex+1]-2
+	if top < m.viewport.YOffset || m.pinIndex == 0 {
+		m.viewport.SetYOffset(top - 1) // With the blank line above
+	} else if bottom >= m.viewport.YOffset+m.viewport.Height {
+		m.viewport.SetYOffset(bottom - m.viewport.Height + 1)
+	}
+}
+
+// refreshPinboard redraws the pinboard after the pins changed
+func (m *mainModel) refreshPinboard() {
+	if m.state != pinboardView {
+		return
+	}
+	m.pinIndex = max(0, min(len(m.pins)-1, m.pinIndex))
+	offset := m.viewport.YOffset
+	content, _ := m.renderPinboard()
+	m.viewport.SetContent(content)
+	m.viewport.SetYOffset(offset)
+}
+
+// unpinSelected asks the server to unpin the highlighted pin; the
+// UNPINNED frame that follows takes it off the board
+func (m mainModel) unpinSelected() tea.Cmd {
+	if len(m.pins) == 0 {
+		return nil
+	}
+	return m.sendMessageCmd("UNPIN:" + m.currentChannel + ":" + m.pins[m.pinIndex].ID)
+}
+
+// addPin handles PINNED:<channel>:<json>
+func (m *mainModel) addPin(channel string, payload string) {
+	var pin pinnedMessage
+	if err := json.Unmarshal([]byte(payload), &pin); err != nil {
+		return
+	}
+	m.countPins(channel, func(n int) int { return n + 1 })
+	if channel != m.currentChannel {
+		return
+	}
+	m.pins = append(m.pins, pin)
+	m.addSystemMessage(fmt.Sprintf("%s %s pinned a message by %s - /pinboard to see it", IconPin, pin.PinnedBy, pin.Sender))
+	m.refreshPinboard()
+}
+
+// removePin handles UNPINNED:<channel>:<msgID>
+func (m *mainModel) removePin(channel string, id string) {
+	m.countPins(channel, func(n int) int { return max(n-1, 0) })
+	if channel != m.currentChannel {
+		return
+	}
+	for i := range m.pins {
+		if m.pins[i].ID == id {
+			m.pins = append(m.pins[:i], m.pins[i+1:]...)
+			break
+		}
+	}
+	m.refreshPinboard()
+}
+
+// countPins updates the sidebar's pin count for channel
+func (m *mainModel) countPins(channel string, update func(int) int) {
+	for i := range m.channels {
+		if m.channels[i].Name == channel {
+			m.channels[i].Pins = update(m.channels[i].Pins)
+			return
+		}
+	}
+}
+
+// editPin keeps a pin's text in step with EDIT frames
+func (m *mainModel) editPin(id string, body string) {
+	for i := range m.pins {
+		if m.pins[i].ID == id {
+			m.pins[i].Content = body
+			m.pins[i].Edited = true
+		}
+	}
+}
+
+// renderPinboard lays out every pin in full, along with the line each pin
+// starts on and, last, the line after them all
+func (m mainModel) renderPinboard() (string, []int) {
+	width := m.viewport.Width
+	if width == 0 {
+		width = 80
+	}
+	indent := lipgloss.NewStyle().PaddingLeft(4).Width(max(width-2, 20))
+
+	count := fmt.Sprintf("%d pinned messages", len(m.pins))
+	if len(m.pins) == 1 {
+		count = "1 pinned message"
+	}
+	// Rendered blocks can span lines, which are counted one by one
+	var lines []string
+	add := func(blocks ...string) {
+		for _, block := range blocks {
+			lines = append(lines, strings.Split(block, "\n")...)
+		}
+	}
+	add(m.styles.Subtitle.Render(fmt.Sprintf("%s %s in #%s", IconPin, count, m.currentChannel)))
+	if len(m.pins) == 0 {
+		add("", m.styles.InlineHint("Mods can pin a message with /pin <msgID>"))
+	}
+
+	starts := make([]int, 0, len(m.pins)+1)
+	for i, pin := range m.pins {
+		add("")
+		starts = append(starts, len(lines))
+
+		marker := "  "
+		if i == m.pinIndex {
+			marker = lipgloss.NewStyle().Foreground(m.styles.PrimaryColor).Bold(true).Render("▸ ")
+		}
+		body := m.renderText(pin.Content, m.styles.Msg)
+		if pin.Edited {
+			body += " " + m.styles.InlineHint("(edited)")
+		}
+		add(marker+m.styles.DateTime.Render("["+pinTime(pin.Timestamp)+"]")+" "+m.userStyle(pin.Sender).Render(pin.Sender+":"),
+			indent.Render(body),
+			indent.Render(m.styles.InlineHint(fmt.Sprintf("pinned by %s, %s", pin.PinnedBy, pinTime(pin.PinnedAt)))))
+	}
+	starts = append(starts, len(lines)+1)
+	return strings.Join(lines, "\n"), starts
+}
+
+// pinTime formats an RFC 3339 time from the server like search results do
+func pinTime(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.Local().Format("Jan 02 15:04")
+}
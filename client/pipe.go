@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// pipeOptions are the command-line flags that configure pipe mode
+type pipeOptions struct {
+	server   string
+	username string
+	token    string // Session token; a saved session or $ECHO_PASSWORD is used without one
+	channel  string
+}
+
+// runPipe is the client without the TUI, for when stdin isn't a terminal:
+// each line read is posted as a chat message, even one that looks like a
+// command, and messages received are printed
+// as "[HH:MM] #channel username: body" until stdin ends.
+func runPipe(cfg Config, opts pipeOptions) error {
+	server := opts.server
+	if server == "" {
+		server = "localhost:8080"
+	}
+	channel := strings.TrimPrefix(opts.channel, "#")
+	if channel == "" {
+		channel = defaultChannel
+	}
+	if err := validateChannelName(channel); err != nil {
+		return fmt.Errorf("invalid channel %q: %v", channel, err)
+	}
+
+	creds := Credentials{
+		Username: opts.username,
+		Password: os.Getenv("ECHO_PASSWORD"),
+		Token:    opts.token,
+	}
+	if creds.Token == "" && creds.Password == "" {
+		creds.Token = loadSessionToken(server, creds.Username)
+	}
+	if creds.Token == "" && creds.Password == "" {
+		return errors.New("no credentials: pass --token, set ECHO_PASSWORD, or log in with the TUI once to save a session")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+	dial := DialOptions{TLS: cfg.TLS, InsecureSkipVerify: cfg.InsecureSkipVerify, Transport: cfg.Transport}
+	conn, err := connectServer(ctx, server, creds, dial)
+	if err != nil {
+		return err
+	}
+
+	if channel != defaultChannel {
+		if err := conn.Send("JOIN:" + channel); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+
+	// The reader has the model to itself, so frames like SESSION and the
+	// history replays are handled just as in the TUI
+	m := initialModel(cfg)
+	m.serverAddr = server
+	m.username = creds.Username
+	m.currentChannel = channel
+	done := make(chan error, 1)
+	go func() {
+		done <- m.printIncoming(conn, os.Stdout)
+	}()
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			// The server closed the connection
+			return err
+		case line, ok := <-lines:
+			if !ok {
+				// End of input, e.g. Ctrl+D
+				ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+				err := DisconnectWithContext(ctx, conn)
+				cancel()
+				return err
+			}
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			frame, err := chatFrame(line, "", "")
+			if err != nil {
+				return err
+			}
+			if err := conn.Send(frame); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// printIncoming prints chat messages as they arrive, until the connection
+// closes
+func (m *mainModel) printIncoming(conn ChatTransport, out io.Writer) error {
+	for {
+		raw, err := conn.Recv()
+		if errors.Is(err, io.EOF) || errors.Is(err, ErrServerRestarting) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Streamed messages are printed whole, once complete
+		if payload, ok := strings.CutPrefix(raw, "STREAM_COMPLETE:"); ok {
+			var stored wireMessage
+			if json.Unmarshal([]byte(payload), &stored) == nil {
+				fmt.Fprintln(out, pipeLine(m.currentChannel, wireToChatMessage(stored)))
+			}
+			continue
+		}
+		if strings.HasPrefix(raw, "E2EKEY:") || m.handleFrame(raw) {
+			continue
+		}
+		msg := parseMessage(raw)
+		if msg.IsSeparator || msg.Streaming {
+			continue
+		}
+		fmt.Fprintln(out, pipeLine(m.currentChannel, msg))
+	}
+}
+
+// pipeLine formats msg as "[HH:MM] #channel username: body"
+func pipeLine(channel string, msg ChatMessage) string {
+	prefix := fmt.Sprintf("[%s] #%s", msg.Timestamp, channel)
+	switch {
+	case msg.IsPrivate:
+		return fmt.Sprintf("[%s] (whisper) %s: %s", msg.Timestamp, msg.User, msg.Content)
+	case msg.IsSystem && msg.User != "":
+		return fmt.Sprintf("%s * %s %s", prefix, msg.User, msg.Content)
+	case msg.IsSystem || msg.User == "":
+		return fmt.Sprintf("%s * %s", prefix, msg.Content)
+	}
+	return fmt.Sprintf("%s %s: %s", prefix, msg.User, msg.Content)
+}
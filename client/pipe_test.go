@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestChatFrame(t *testing.T) {
+	for _, line := range []string{
+		"hello",
+		"STATUS:away:gone fishing",
+		"JOIN:secret",
+		"KICK:bob:bye",
+		"PASSWD:old:new",
+		`{"type":"backfill_req"}`,
+	} {
+		frame, err := chatFrame(line, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sent map[string]string
+		if err := json.Unmarshal([]byte(frame), &sent); err != nil {
+			t.Fatalf("chatFrame(%q) = %q, not JSON: %v", line, frame, err)
+		}
+		want := map[string]string{"type": "message", "body": line}
+		if len(sent) != len(want) || sent["type"] != want["type"] || sent["body"] != want["body"] {
+			t.Errorf("chatFrame(%q) = %v, want %v", line, sent, want)
+		}
+	}
+}
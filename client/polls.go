@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// pollBarWidth is how many cells an option's vote bar spans
+const pollBarWidth = 10
+
+// chatPoll is a poll shown in the chat, from POLLCREATED frames and kept
+// current by POLLUPDATE and POLLCLOSED. It's a pointer in its ChatMessage
+// so updates reach the message wherever it's been copied.
+type chatPoll struct {
+	ID       string
+	Question string
+	Options  []string
+	Tallies  []int
+	Closed   bool
+	Voted    int // The option we voted for, from 1, or 0
+}
+
+func pollCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	parts := strings.Split(args, "|")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	if len(parts) < 3 || slices.Contains(parts, "") {
+		m.addSystemMessage("Usage: /poll <question> | <option> | <option> ...")
+		return m, nil
+	}
+	request, _ := json.Marshal(struct {
+		Question string   `json:"question"`
+		Options  []string `json:"options"`
+	}{parts[0], parts[1:]})
+	return m, m.sendMessageCmd("POLL:" + string(request))
+}
+
+func voteCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	fields := strings.Fields(args)
+	var option int
+	if len(fields) == 2 {
+		option, _ = strconv.Atoi(fields[1])
+	}
+	if option < 1 {
+		m.addSystemMessage("Usage: /vote <pollID> <option>")
+		return m, nil
+	}
+	// Marked as ours now; a refused vote is reported as an error
+	if i := m.pollIndex(fields[0]); i >= 0 && !m.messages[i].Poll.Closed {
+		m.messages[i].Poll.Voted = option
+		m.render.invalidate(i)
+	}
+	return m, m.sendMessageCmd("VOTE:" + fields[0] + ":" + strconv.Itoa(option))
+}
+
+// pollIndex is the index of the message showing poll id, or -1
+func (m *mainModel) pollIndex(id string) int {
+	for i := range m.messages {
+		if m.messages[i].Poll != nil && m.messages[i].Poll.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// addPoll handles POLLCREATED:<id>:<question>:<options>, the options a
+// JSON array. Polls already shown, sent again with the channel's history,
+// are left where they are.
+func (m *mainModel) addPoll(payload string) {
+	id, rest, ok := strings.Cut(payload, ":")
+	if !ok || m.pollIndex(id) >= 0 {
+		return
+	}
+	// The question may hold colons, so the options are the first suffix
+	// that reads as an array
+	for at := 0; ; {
+		sep := strings.Index(rest[at:], ":[")
+		if sep == -1 {
+			return
+		}
+		at += sep
+		var options []string
+		if json.Unmarshal([]byte(rest[at+1:]), &options) == nil {
+			m.messages = append(m.messages, ChatMessage{
+				Timestamp: time.Now().Format("15:04"),
+				Time:      time.Now(),
+				Content:   rest[:at],
+				Poll: &chatPoll{
+					ID:       id,
+					Question: rest[:at],
+					Options:  options,
+					Tallies:  make([]int, len(options)),
+				},
+			})
+			if !m.autoScroll {
+				m.unreadSinceScroll++
+			}
+			return
+		}
+		at++
+	}
+}
+
+// updatePoll handles POLLUPDATE:<id>:<tallies> and, closed, POLLCLOSED,
+// the tallies being each option's votes, comma-separated
+func (m *mainModel) updatePoll(payload string, closed bool) {
+	id, list, _ := strings.Cut(payload, ":")
+	i := m.pollIndex(id)
+	if i < 0 {
+		return
+	}
+	poll := m.messages[i].Poll
+	for n, count := range strings.Split(list, ",") {
+		if n < len(poll.Tallies) {
+			poll.Tallies[n], _ = strconv.Atoi(count)
+		}
+	}
+	poll.Closed = poll.Closed || closed
+	m.render.invalidate(i)
+}
+
+// renderPoll draws poll as a box of its options, each with a bar of its
+// share of the votes, width cells wide
+func (m mainModel) renderPoll(poll *chatPoll, width int) string {
+	total, labelWidth := 0, 0
+	for n, option := range poll.Options {
+		total += poll.Tallies[n]
+		labelWidth = max(labelWidth, lipgloss.Width(option))
+	}
+
+	rows := []string{lipgloss.NewStyle().Bold(true).Render("📊 " + poll.Question)}
+	for n, option := range poll.Options {
+		share := 0.0
+		if total > 0 {
+			share = float64(poll.Tallies[n]) / float64(total)
+		}
+		filled := int(math.Round(share * pollBarWidth))
+		bar := strings.Repeat("█", filled) + strings.Repeat("░", pollBarWidth-filled)
+		label := option + strings.Repeat(" ", labelWidth-lipgloss.Width(option))
+		row := fmt.Sprintf("%d. %s %s %3.0f%%", n+1, label, bar, share*100)
+		if poll.Voted == n+1 {
+			row += " ✓"
+		}
+		rows = append(rows, row)
+	}
+
+	votes := fmt.Sprintf("%d votes", total)
+	if total == 1 {
+		votes = "1 vote"
+	}
+	footer := fmt.Sprintf("/vote %s <option> · %s", poll.ID, votes)
+	border := m.styles.PrimaryColor
+	if poll.Closed {
+		footer = "Closed · " + votes
+		border = dimColor
+	}
+	rows = append(rows, m.styles.InlineHint(footer))
+
+	return lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(border).
+		Padding(0, 1).
+		Width(width).
+		Render(strings.Join(rows, "\n"))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// connectionLostMsg is sent when reading from the connection fails. The
+// chat stays up while we reconnect behind a banner.
+type connectionLostMsg struct{ err error }
+
+// lostConnection starts reconnecting, with the same backoff as the
+// connecting screen. With retries turned off it's back to the login form.
+func (m mainModel) lostConnection(err error) (mainModel, tea.Cmd) {
+	slog.Info("connection lost", "server", m.serverAddr, "tab", m.id, "err", err)
+	m.conn = nil
+	m.heartbeat = nil
+	m.resetLatency()
+	m.dropStreams()
+	if m.config.MaxRetries == 0 || (m.state != chatView && m.state != searchView && m.state != pinboardView && m.state != bookmarkView) {
+		m.state = loginView
+		m.err = err
+		return m, nil
+	}
+	m.reconnecting = true
+	m.retryCount = 0
+	m.resize()
+	delay := retryDelay(0)
+	if m.maintenance != "" {
+		// Going down for maintenance, which won't be over in a second
+		delay = maintenanceRetryDelay
+	}
+	return m, forTab(m.id, func() tea.Msg {
+		return progressMsg{attempt: 1, delay: delay, err: err}
+	})
+}
+
+// cancelReconnect gives up reconnecting, back to the login form
+func (m mainModel) cancelReconnect() (mainModel, tea.Cmd) {
+	m.reconnecting = false
+	m.state = loginView
+	m.err = nil
+	m.msgInput.Blur()
+	m.resize()
+	return m, m.updateFocus()
+}
+
+// reconnectBannerHeight is the line the banner takes above the header
+func (m mainModel) reconnectBannerHeight() int {
+	if m.reconnecting {
+		return 1
+	}
+	return 0
+}
+
+// reconnectBanner counts down to the next attempt. Animation ticks redraw
+// it, so the seconds stay current.
+func (m mainModel) reconnectBanner() string {
+	text := "⚠ Disconnected. Reconnecting… [C]ancel"
+	if wait := time.Until(m.retryAt); wait > 0 {
+		seconds := int((wait + time.Second - 1) / time.Second)
+		text = fmt.Sprintf("⚠ Disconnected. Reconnecting in %ds… [C]ancel", seconds)
+	}
+	return m.styles.Error.Width(m.width).Render(text)
+}
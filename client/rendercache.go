@@ -0,0 +1,133 @@
+package main
+
+import "strings"
+
+// renderCache keeps what each message rendered as, parallel to m.messages,
+// so redrawing the chat only renders the messages that changed rather than
+// the whole history. It's a pointer in serverTab, as rendering happens on
+// copies of the model.
+type renderCache struct {
+	settings    renderSettings
+	entries     []renderEntry
+	invalidFrom int // Entries from here on are rendered again
+
+	// The lines last joined, the result, and where each line ends in it
+	lines  []string
+	joined string
+	ends   []int
+}
+
+// renderSettings are what every message is rendered with; when any of
+// them change, the whole chat is rendered again
+type renderSettings struct {
+	width    int
+	username string
+	theme    ThemeConfig
+	layout   LayoutConfig
+}
+
+// renderKey is what a message's rendering depends on besides the settings.
+// An entry whose key no longer matches is rendered again, which covers
+// edits, deletes, delivery marks and messages moving about.
+type renderKey struct {
+	id, clientID, timestamp, content string
+	edited, deleted, mention         bool
+	delivery                         delivery
+	expanded                         bool
+	depth, nested                    int  // Reply depth, and replies hidden below at maxReplyDepth
+	continued, gap                   bool // Compact mode's name left out, and time shown before
+}
+
+// renderEntry is a message's blocks of text, from start on; any before
+// start are a compact mode time separator
+type renderEntry struct {
+	key   renderKey
+	lines []string
+	start int
+}
+
+func newRenderCache() *renderCache {
+	return &renderCache{}
+}
+
+// prepare readies the cache to render n messages with settings, starting
+// over if they've changed since the last render
+func (c *renderCache) prepare(settings renderSettings, n int) {
+	if settings != c.settings {
+		c.settings = settings
+		c.invalidFrom = 0
+	}
+	if n < len(c.entries) {
+		c.entries = c.entries[:n]
+	}
+	for len(c.entries) < n {
+		c.entries = append(c.entries, renderEntry{})
+	}
+	c.invalidFrom = min(c.invalidFrom, n)
+}
+
+// lookup finds message i's entry, if it was rendered with key
+func (c *renderCache) lookup(i int, key *renderKey) (*renderEntry, bool) {
+	entry := &c.entries[i]
+	if i >= c.invalidFrom || entry.lines == nil || entry.key != *key {
+		return nil, false
+	}
+	return entry, true
+}
+
+func (c *renderCache) store(i int, entry renderEntry) *renderEntry {
+	c.entries[i] = entry
+	return &c.entries[i]
+}
+
+// done marks a render finished. The last message is always rendered again,
+// as a system message there pulses.
+func (c *renderCache) done(n int) {
+	c.invalidFrom = max(n-1, 0)
+}
+
+// invalidate renders message i and those after it again, for changes the
+// key doesn't see, like reactions
+func (c *renderCache) invalidate(i int) {
+	c.invalidFrom = min(c.invalidFrom, i)
+}
+
+// join joins lines with newlines, reusing the last result for the lines
+// at the start that haven't changed since
+func (c *renderCache) join(lines []string) string {
+	same := 0
+	for same < len(lines) && same < len(c.lines) && lines[same] == c.lines[same] {
+		same++
+	}
+	if same == len(lines) && same == len(c.lines) {
+		c.lines = lines
+		return c.joined
+	}
+	prefix := 0
+	if same > 0 {
+		prefix = c.ends[same-1]
+	}
+
+	var b strings.Builder
+	size := prefix
+	for _, line := range lines[same:] {
+		size += len(line) + 1
+	}
+	b.Grow(size)
+	b.WriteString(c.joined[:prefix])
+	ends := c.ends[:same]
+	for i, line := range lines[same:] {
+		if same+i > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+		ends = append(ends, b.Len())
+	}
+	c.lines, c.joined, c.ends = lines, b.String(), ends
+	return c.joined
+}
+
+// reset renders every message again, e.g. after a user's color changed
+func (c *renderCache) reset() {
+	c.invalidFrom = 0
+}
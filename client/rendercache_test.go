@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/termenv"
+)
+
+// chatModel is a logged-in model of the given width showing n messages
+func chatModel(width, n int) mainModel {
+	m := initialModel(testConfig())
+	m.username = "alice"
+	m.width, m.height = width, 40
+	m.resize()
+	start := time.Date(2026, 3, 4, 9, 0, 0, 0, time.Local)
+	users := []string{"alice", "bob", "carol"}
+	for i := range n {
+		at := start.Add(time.Duration(i) * time.Second)
+		m.messages = append(m.messages, ChatMessage{
+			ID:        fmt.Sprintf("%024x", i+1),
+			User:      users[i%len(users)],
+			Content:   fmt.Sprintf("message %d, long enough that a narrow window has to wrap it onto another line", i+1),
+			Timestamp: at.Format("15:04:05"),
+			Time:      at,
+		})
+	}
+	return m
+}
+
+// uncached renders m's chat from scratch, leaving its cache alone
+func uncached(m mainModel) string {
+	m.render = newRenderCache()
+	return m.renderMessages()
+}
+
+func TestRenderCacheInvalidation(t *testing.T) {
+	// A theme change only shows in the output with colors on
+	lipgloss.SetColorProfile(termenv.TrueColor)
+	t.Cleanup(func() { lipgloss.SetColorProfile(termenv.Ascii) })
+
+	tests := []struct {
+		name   string
+		change func(m *mainModel)
+	}{
+		{"theme", func(m *mainModel) { m.setTheme(m.config.Preset%len(themePresets) + 1) }},
+		{"resize", func(m *mainModel) {
+			m.width = 70
+			m.resize()
+		}},
+		{"edit", func(m *mainModel) { m.applyEdit(m.messages[2].ID, "edited away") }},
+		{"delete", func(m *mainModel) { m.applyDelete(m.messages[2].ID) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := chatModel(120, 10)
+			before := m.renderMessages()
+			tt.change(&m)
+			got := m.renderMessages()
+			if got == before {
+				t.Fatal("the chat rendered the same after the change")
+			}
+			if want := uncached(m); got != want {
+				t.Errorf("cached render differs from rendering afresh:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func BenchmarkRenderMessages(b *testing.B) {
+	const n = 10000
+	b.Run("uncached", func(b *testing.B) {
+		m := chatModel(120, n)
+		for b.Loop() {
+			m.render.reset()
+			m.renderMessages()
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		m := chatModel(120, n)
+		m.renderMessages()
+		for b.Loop() {
+			m.renderMessages()
+		}
+	})
+	b.Run("new message", func(b *testing.B) {
+		m := chatModel(120, n)
+		m.renderMessages()
+		for b.Loop() {
+			m.messages = append(m.messages[:n], ChatMessage{User: "bob", Content: "one more", Time: time.Now()})
+			m.renderMessages()
+		}
+	})
+}
+
+func TestMarkdownCacheLimit(t *testing.T) {
+	m := chatModel(120, markdownCacheLimit+50)
+	m.config.Markdown = true
+	for i := range m.messages {
+		m.messages[i].Content = fmt.Sprintf("**message** %d", i)
+	}
+	m.renderMessages()
+	if n := len(m.markdownCache); n == 0 || n > markdownCacheLimit {
+		t.Errorf("markdownCache holds %d entries, want 1 to %d", n, markdownCacheLimit)
+	}
+}
+
+func TestExpandedBlocksFollowMessages(t *testing.T) {
+	m := chatModel(120, 3)
+	m.config.Markdown = true
+	m.messages[1].Content = "```\n" + strings.Repeat("line\n", collapsedCodeLines+5) + "```"
+	m.oldestMsgID = m.messages[0].ID
+	if !m.hasCollapsedCode(1) {
+		t.Fatal("the long code block isn't collapsed")
+	}
+	codeID := m.messages[1].ID
+	m.expandedBlocks[expandKey(m.messages[1])] = true
+
+	// A page of older history moves the message down, its block still open
+	page, _ := json.Marshal(historyPage{
+		Before:   m.oldestMsgID,
+		Messages: []wireMessage{{ID: "older", Sender: "bob", Content: "before everything", Timestamp: "08:00:00"}},
+	})
+	m.loadOlder(m.currentChannel + ":" + string(page))
+	i := m.messageIndex(codeID)
+	if len(m.messages) != 5 || i != 3 {
+		t.Fatalf("the code is message %d of %d, want 3 of 5 with the older page loaded", i, len(m.messages))
+	}
+	if m.hasCollapsedCode(i) {
+		t.Error("the code block collapsed again after older history loaded")
+	}
+	if got := m.renderMessages(); strings.Count(got, "line") < collapsedCodeLines+5 {
+		t.Errorf("the expanded block shows %d lines, want all %d", strings.Count(got, "line"), collapsedCodeLines+5)
+	}
+}
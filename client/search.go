@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// searchLimit is how many results /search asks the server for
+const searchLimit = 20
+
+// searchResult is one match from a SEARCHRESULTS frame
+type searchResult struct {
+	wireMessage
+	Snippet string `json:"snippet"`
+}
+
+func parseSearchResults(payload string) ([]searchResult, bool) {
+	var results []searchResult
+	if err := json.Unmarshal([]byte(payload), &results); err != nil {
+		return nil, false
+	}
+	return results, true
+}
+
+func searchCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	query := strings.TrimSpace(args)
+	if query == "" {
+		m.addSystemMessage("Usage: /search <query>")
+		return m, nil
+	}
+
+	m.searchQuery = query
+	return m, m.sendMessageCmd(fmt.Sprintf("SEARCH:%s:%s:%d", m.currentChannel, query, searchLimit))
+}
+
+// openSearch shows results from the server in place of the chat
+func (m *mainModel) openSearch(results []searchResult) {
+	m.searchResults = results
+	m.searchIndex = 0
+	m.state = searchView
+	m.msgInput.Blur()
+	m.viewport.SetContent(m.renderSearchResults())
+	m.viewport.GotoTop()
+}
+
+// closeSearch goes back to the chat, scrolled to the bottom
+func (m *mainModel) closeSearch() tea.Cmd {
+	m.state = chatView
+	m.searchResults = nil
+	m.viewport.SetContent(m.renderMessages())
+	m.viewport.GotoBottom()
+	return m.msgInput.Focus()
+}
+
+// moveSearchSelection moves the highlighted result, keeping it in view
+func (m *mainModel) moveSearchSelection(delta int) {
+	if len(m.searchResults) == 0 {
+		return
+	}
+	m.searchIndex = max(0, min(len(m.searchResults)-1, m.searchIndex+delta))
+	m.viewport.SetContent(m.renderSearchResults())
+
+	// One header line, then one line per result
+	line := m.searchIndex + 1
+	if line < m.viewport.YOffset {
+		m.viewport.SetYOffset(line)
+	} else if line >= m.viewport.YOffset+m.viewport.Height {
+		m.viewport.SetYOffset(line - m.viewport.Height + 1)
+	}
+}
+
+// jumpToSearchResult returns to the chat scrolled to the selected message
+func (m *mainModel) jumpToSearchResult() tea.Cmd {
+	if len(m.searchResults) == 0 {
+		return m.closeSearch()
+	}
+	id := m.searchResults[m.searchIndex].ID
+	cmd := m.closeSearch()
+
+	if i := m.messageIndex(id); i != -1 {
+		m.scrollToMessage(i)
+		return cmd
+	}
+
+	m.addSystemMessage("That message is older than the loaded history")
+	m.viewport.SetContent(m.renderMessages())
+	m.viewport.GotoBottom()
+	return cmd
+}
+
+// scrollToMessage scrolls the chat to put message i at the top
+func (m *mainModel) scrollToMessage(i int) {
+	m.viewport.SetContent(m.renderMessages())
+	// Count the rendered lines above the message to find its offset
+	before := *m
+	before.messages = m.messages[:i]
+	before.render = newRenderCache()
+	if i > 0 {
+		m.viewport.SetYOffset(lipgloss.Height(before.renderMessages()))
+	} else {
+		m.viewport.GotoTop()
+	}
+	m.followScroll()
+}
+
+func (m mainModel) renderSearchResults() string {
+	width := m.viewport.Width
+	if width == 0 {
+		width = 80
+	}
+	line := lipgloss.NewStyle().MaxWidth(max(width-2, 20))
+
+	count := fmt.Sprintf("%d results", len(m.searchResults))
+	if len(m.searchResults) == 1 {
+		count = "1 result"
+	}
+	lines := []string{m.styles.Subtitle.Render(fmt.Sprintf("%s for %q", count, m.searchQuery))}
+
+	for i, r := range m.searchResults {
+		timestamp := time.Now().Format("Jan 02 15:04")
+		if t, err := time.Parse(time.RFC3339, r.Timestamp); err == nil {
+			timestamp = t.Local().Format("Jan 02 15:04")
+		}
+
+		marker := "  "
+		user := m.styles.User.Render(r.Sender + ":")
+		if i == m.searchIndex {
+			marker = lipgloss.NewStyle().Foreground(m.styles.PrimaryColor).Bold(true).Render("▸ ")
+		}
+		lines = append(lines, line.Render(fmt.Sprintf("%s%s %s %s %s",
+			marker,
+			m.styles.DateTime.Render("["+timestamp+"]"),
+			m.styles.InlineHint("#"+r.Channel),
+			user,
+			m.highlightTerms(r.Snippet))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// highlightTerms renders snippet with the words of the search query in bold
+func (m mainModel) highlightTerms(snippet string) string {
+	bold := lipgloss.NewStyle().Foreground(m.styles.PrimaryColor).Bold(true)
+	terms := strings.Fields(strings.ToLower(m.searchQuery))
+
+	var b strings.Builder
+	for _, word := range strings.SplitAfter(snippet, " ") {
+		lower := strings.ToLower(word)
+		matched := false
+		for _, term := range terms {
+			if term = strings.Trim(term, `"-`); term != "" && strings.Contains(lower, term) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			b.WriteString(bold.Render(word))
+		} else {
+			b.WriteString(m.styles.Msg.Render(word))
+		}
+	}
+	return b.String()
+}
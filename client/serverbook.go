@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// SavedServer is a [[servers]] entry in the config, listed before the
+// login form
+type SavedServer struct {
+	Name     string `toml:"name"`
+	Address  string `toml:"address"` // Without the ws:// or wss:// scheme
+	Username string `toml:"username,omitempty"`
+	TLS      bool   `toml:"tls,omitempty"`
+}
+
+// loginAddress is what the server field is filled with, with wss:// when
+// the server needs TLS
+func (s SavedServer) loginAddress() string {
+	if s.TLS && !strings.Contains(s.Address, "://") {
+		return "wss://" + s.Address
+	}
+	return s.Address
+}
+
+// splitScheme separates a typed address into host:port and whether it
+// uses TLS
+func splitScheme(address string, defaultTLS bool) (string, bool) {
+	if rest, ok := strings.CutPrefix(address, "wss://"); ok {
+		return rest, true
+	}
+	if rest, ok := strings.CutPrefix(address, "ws://"); ok {
+		return rest, false
+	}
+	return address, defaultTLS
+}
+
+// hasServer reports whether address is in the address book already
+func (c Config) hasServer(address string) bool {
+	host, _ := splitScheme(address, c.TLS)
+	for _, s := range c.Servers {
+		if saved, _ := splitScheme(s.Address, s.TLS); strings.EqualFold(saved, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendServer adds a [[servers]] entry to the end of the config file,
+// leaving the rest of it and its comments as they are
+func appendServer(path string, s SavedServer) error {
+	return appendConfig(path, struct {
+		Servers []SavedServer `toml:"servers"`
+	}{[]SavedServer{s}})
+}
+
+// selectServerKey moves through the server list, or picks a server with
+// Enter or its number. The row after the saved servers is "[+] New server".
+func (m mainModel) selectServerKey(key string) (mainModel, tea.Cmd) {
+	rows := len(m.config.Servers) + 1
+	switch key {
+	case "up", "k":
+		m.serverCursor = (m.serverCursor - 1 + rows) % rows
+		return m, nil
+	case "down", "j":
+		m.serverCursor = (m.serverCursor + 1) % rows
+		return m, nil
+	case "enter":
+	default:
+		n := int(key[0] - '0')
+		if len(key) != 1 || n < 1 || n > rows {
+			return m, nil
+		}
+		m.serverCursor = n - 1
+	}
+
+	m.state = loginView
+	if m.serverCursor == len(m.config.Servers) {
+		m.focusIndex = focusServer
+		return m, m.updateFocus()
+	}
+
+	server := m.config.Servers[m.serverCursor]
+	m.serverInput.SetValue(server.loginAddress())
+	m.userInput.SetValue(server.Username)
+	m.passInput.Reset()
+
+	// A saved session logs straight in, otherwise only the password is left
+	if server.Username != "" && loadSessionToken(m.serverInput.Value(), server.Username) != "" {
+		m.state = connectingView
+		m.isConnecting = true
+		m.retryCount = 0
+		m.restarting = false
+		return m, tea.Batch(m.connectCmd(), m.animTick())
+	}
+	m.focusIndex = focusUser
+	if server.Username != "" {
+		m.focusIndex = focusPass
+	}
+	return m, m.updateFocus()
+}
+
+// resumeSession fills in the login form with the session saved last and
+// connects with its token, if it hasn't expired
+func (m *mainModel) resumeSession() {
+	server, username, ok := lastSession()
+	if !ok {
+		return
+	}
+	m.serverInput.SetValue(server)
+	m.userInput.SetValue(username)
+	m.state = connectingView
+	m.isConnecting = true
+}
+
+// isServerSelectKey reports whether key is handled by selectServerKey
+func isServerSelectKey(key string) bool {
+	switch key {
+	case "up", "down", "k", "j", "enter":
+		return true
+	}
+	return len(key) == 1 && key[0] >= '1' && key[0] <= '9'
+}
+
+// answerSavePrompt handles the key pressed at "Save this server? [y/N]".
+// Keys other than y, n, Enter and Esc dismiss it and then act as usual.
+func (m mainModel) answerSavePrompt(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	m.savePrompt = false
+	switch msg.String() {
+	case "y", "Y":
+		m.saveServer()
+		m.viewport.SetContent(m.renderMessages())
+		m.viewport.GotoBottom()
+		return m, nil
+	case "n", "N", "enter", "esc":
+		return m, nil
+	}
+	return m.Update(msg)
+}
+
+// saveServer adds the server we're connected to to the address book
+func (m *mainModel) saveServer() {
+	address, useTLS := splitScheme(m.serverAddr, m.config.TLS)
+	server := SavedServer{
+		Name:     m.title(),
+		Address:  address,
+		Username: m.username,
+		TLS:      useTLS,
+	}
+	if err := appendServer(configPath(), server); err != nil {
+		m.addSystemMessage("Couldn't save the server: " + err.Error())
+		return
+	}
+	m.config.Servers = append(m.config.Servers, server)
+	m.addSystemMessage(fmt.Sprintf("Saved %s to your servers", server.Name))
+}
+
+func (m mainModel) serverSelectView() string {
+	titleStyle := lipgloss.NewStyle().
+		Foreground(m.styles.PrimaryColor).
+		Bold(true)
+	rowStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("#9CA3AF")).
+		Width(46)
+	selectedStyle := rowStyle.
+		Foreground(m.styles.SecondaryColor).
+		Bold(true)
+	detailStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("#6B7280")).
+		Italic(true)
+
+	parts := []string{titleStyle.Render("SELECT A SERVER"), ""}
+	for i, server := range m.config.Servers {
+		detail := server.loginAddress()
+		if server.Username != "" {
+			detail = server.Username + " @ " + detail
+		}
+		row := fmt.Sprintf("%d. %s  %s", i+1, server.Name, detailStyle.Render(detail))
+		if i == m.serverCursor {
+			parts = append(parts, selectedStyle.Render("▶ "+row))
+		} else {
+			parts = append(parts, rowStyle.Render("  "+row))
+		}
+	}
+	newRow := "[+] New server"
+	if m.serverCursor == len(m.config.Servers) {
+		parts = append(parts, selectedStyle.Render("▶ "+newRow))
+	} else {
+		parts = append(parts, rowStyle.Render("  "+newRow))
+	}
+	parts = append(parts, "", m.styles.InlineHint("↑/↓: Navigate | Enter or 1-9: Select | Esc: Quit"))
+	content := lipgloss.JoinVertical(lipgloss.Left, parts...)
+
+	box := lipgloss.NewStyle().
+		Border(lipgloss.DoubleBorder()).
+		BorderForeground(m.styles.PrimaryColor).
+		Padding(1, 4).
+		Render(content)
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, box)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zalando/go-keyring"
+)
+
+// keyringService names our entries in the OS keychain, each under the
+// account "<username>@<server>"
+const keyringService = "echo-chat"
+
+// sessionFile lists the saved sessions, keyed by "<username>@<server>".
+// Tokens are kept in the OS keychain, and only written here where there's
+// none, like headless Linux without a D-Bus secret service. Passwords are
+// never saved anywhere.
+const sessionFile = "session.json"
+
+// sessionStore is what sessionFile holds
+type sessionStore struct {
+	Last   string            `json:"last,omitempty"` // The session resumed on launch
+	Tokens map[string]string `json:"tokens"`         // Empty when the token is in the keychain
+}
+
+// keyringFallback warns once that tokens are going to a file instead
+var keyringFallback sync.Once
+
+// echoDir returns ~/.echo, where the client keeps its local state
+func echoDir() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".echo"), nil
+}
+
+func sessionKey(server string, username string) string {
+	return username + "@" + server
+}
+
+func loadSessions() (sessionStore, error) {
+	empty := sessionStore{Tokens: map[string]string{}}
+
+	dir, err := echoDir()
+	if err != nil {
+		return empty, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, sessionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return empty, nil
+		}
+		return empty, err
+	}
+	var store sessionStore
+	if err := json.Unmarshal(data, &store); err != nil || store.Tokens == nil {
+		// Before the keychain, the file was just the tokens by key
+		store = sessionStore{}
+		if err := json.Unmarshal(data, &store.Tokens); err != nil || store.Tokens == nil {
+			return empty, err
+		}
+	}
+	return store, nil
+}
+
+func writeSessions(store sessionStore) error {
+	dir, err := echoDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(store, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, sessionFile)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile only sets the mode of a new file
+	return os.Chmod(path, 0600)
+}
+
+// loadSessionToken returns the saved token for username on server, if any
+func loadSessionToken(server string, username string) string {
+	store, _ := loadSessions()
+	key := sessionKey(server, username)
+	token, ok := store.Tokens[key]
+	if !ok || token != "" {
+		return token
+	}
+	token, err := keyring.Get(keyringService, key)
+	if err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		slog.Warn("couldn't read the session from the keychain", "session", key, "err", err)
+	}
+	return token
+}
+
+// saveSessionToken remembers the token for username on server, as the
+// session to resume on launch. It reports whether the token had to go in
+// sessionFile for want of a keychain, the first time that happens.
+func saveSessionToken(server string, username string, token string) (warn bool, err error) {
+	store, _ := loadSessions()
+	key := sessionKey(server, username)
+	if keyErr := keyring.Set(keyringService, key, token); keyErr != nil {
+		store.Tokens[key] = token
+		keyringFallback.Do(func() {
+			slog.Warn("no keychain to keep the session in, saving it to a file", "file", sessionFile, "err", keyErr)
+			warn = true
+		})
+	} else {
+		store.Tokens[key] = ""
+	}
+	store.Last = key
+	return warn, writeSessions(store)
+}
+
+// clearSessionToken forgets the token for username on server
+func clearSessionToken(server string, username string) error {
+	store, err := loadSessions()
+	if err != nil {
+		return err
+	}
+	key := sessionKey(server, username)
+	if token, ok := store.Tokens[key]; ok && token == "" {
+		if err := keyring.Delete(keyringService, key); err != nil && !errors.Is(err, keyring.ErrNotFound) {
+			return err
+		}
+	}
+	delete(store.Tokens, key)
+	if store.Last == key {
+		store.Last = ""
+	}
+	return writeSessions(store)
+}
+
+// clearAllSessions forgets every saved session, for --clear-session
+func clearAllSessions() error {
+	if err := keyring.DeleteAll(keyringService); err != nil {
+		slog.Warn("couldn't clear the keychain", "err", err)
+	}
+	dir, err := echoDir()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(dir, sessionFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// lastSession returns the server and username of the session saved last,
+// if its token is still good
+func lastSession() (server string, username string, ok bool) {
+	store, _ := loadSessions()
+	username, server, ok = strings.Cut(store.Last, "@")
+	if !ok {
+		return "", "", false
+	}
+	token := loadSessionToken(server, username)
+	if token == "" || tokenExpired(token) {
+		return "", "", false
+	}
+	return server, username, true
+}
+
+// tokenExpired reports whether a session token, a JWT, is past its exp
+// claim, or unreadable. The server still checks its signature.
+func tokenExpired(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return true
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return true
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return true
+	}
+	return time.Now().Unix() >= claims.Exp
+}
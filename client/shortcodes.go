@@ -0,0 +1,41 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// shortcodePattern matches a complete :shortcode:, see emojis.go
+var shortcodePattern = regexp.MustCompile(`:[a-z0-9_+-]+:`)
+
+// shortcodeWord matches a shortcode being typed, for Tab to complete
+var shortcodeWord = regexp.MustCompile(`(?i)^:[a-z0-9_+-]+:?$`)
+
+// expandShortcodes turns the :shortcodes: in text into their emoji, leaving
+// unknown ones and anything inside `code` as typed
+func expandShortcodes(text string) string {
+	if !strings.Contains(text, ":") {
+		return text
+	}
+	// Between backticks, i.e. at odd indexes, is code
+	parts := strings.Split(text, "`")
+	for i := 0; i < len(parts); i += 2 {
+		parts[i] = shortcodePattern.ReplaceAllStringFunc(parts[i], func(code string) string {
+			if emoji, ok := emojiShortcodes[strings.Trim(code, ":")]; ok {
+				return emoji
+			}
+			return code
+		})
+	}
+	return strings.Join(parts, "`")
+}
+
+// shortcodeNames lists every shortcode with its closing colon, for
+// completing the name after an opening one
+func shortcodeNames() []string {
+	names := make([]string, 0, len(emojiShortcodes))
+	for name := range emojiShortcodes {
+		names = append(names, name+":")
+	}
+	return names
+}
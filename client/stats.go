@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// statsTimeout bounds the /api/stats request; the server answers well
+// within it
+const statsTimeout = 5 * time.Second
+
+// serverStats is the /api/stats response. The database figures are null
+// when the server's database was too slow to answer.
+type serverStats struct {
+	ConnectedClients int     `json:"connectedClients"`
+	TotalMessages    *int64  `json:"totalMessages"`
+	ChannelsActive   int     `json:"channelsActive"`
+	DBSizeBytes      *int64  `json:"dbSizeBytes"`
+	Maintenance      *string `json:"maintenance"` // Its message, null when off
+}
+
+// statsMsg carries the result of fetchStatsCmd
+type statsMsg struct {
+	stats serverStats
+	err   error
+}
+
+// apiURL turns the chat server's address into the URL of an HTTP endpoint
+// on the same host
+func apiURL(serverAddr string, useTLS bool, path string) string {
+	u := serverEndpoint(serverAddr, useTLS)
+	u.Scheme = strings.Replace(u.Scheme, "ws", "http", 1)
+	u.Path = path
+	return u.String()
+}
+
+// fetchStatsCmd asks the server's /api/stats endpoint, authenticating with
+// the admin token from the config
+func (m mainModel) fetchStatsCmd() tea.Cmd {
+	return forTab(m.id, func() tea.Msg {
+		client := &http.Client{Timeout: statsTimeout}
+		if m.config.InsecureSkipVerify {
+			client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+		}
+		req, err := http.NewRequest(http.MethodGet, apiURL(m.serverAddr, m.config.TLS, "/api/stats"), nil)
+		if err != nil {
+			return statsMsg{err: err}
+		}
+		req.Header.Set("X-Admin-Token", m.config.AdminToken)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return statsMsg{err: err}
+		}
+		defer resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+		case http.StatusUnauthorized:
+			return statsMsg{err: fmt.Errorf("the server didn't accept admin_token")}
+		default:
+			return statsMsg{err: fmt.Errorf("server replied %s", resp.Status)}
+		}
+
+		var stats serverStats
+		if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+			return statsMsg{err: fmt.Errorf("invalid stats: %v", err)}
+		}
+		return statsMsg{stats: stats}
+	})
+}
+
+// formatStats lays the stats out as a two-column table
+func formatStats(s serverStats) string {
+	unknown := func(n *int64, format func(int64) string) string {
+		if n == nil {
+			return "unknown"
+		}
+		return format(*n)
+	}
+	rows := [][2]string{
+		{"Connected clients", fmt.Sprint(s.ConnectedClients)},
+		{"Active channels", fmt.Sprint(s.ChannelsActive)},
+		{"Stored messages", unknown(s.TotalMessages, func(n int64) string { return fmt.Sprint(n) })},
+		{"Database size", unknown(s.DBSizeBytes, formatBytes)},
+		{"Maintenance", "off"},
+	}
+	if s.Maintenance != nil {
+		rows[len(rows)-1][1] = "on - " + *s.Maintenance
+	}
+
+	var b strings.Builder
+	b.WriteString("Server stats:")
+	for _, row := range rows {
+		fmt.Fprintf(&b, "\n    %-18s %s", row[0], row[1])
+	}
+	return b.String()
+}
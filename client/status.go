@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// userStatus is what a STATUS frame says about a user. Users without one
+// are simply online.
+type userStatus struct {
+	state   string // "online", "away" or "dnd"
+	message string
+}
+
+// parseStatusFrame splits the payload of STATUS:<username>:<status>:<message>
+func parseStatusFrame(payload string) (string, userStatus, bool) {
+	name, rest, ok := strings.Cut(payload, ":")
+	if !ok || name == "" {
+		return "", userStatus{}, false
+	}
+	state, message, _ := strings.Cut(rest, ":")
+	return name, userStatus{state: state, message: message}, true
+}
+
+// statusIcon is the dot shown before a name in the online users panel
+func (m mainModel) statusIcon(name string) string {
+	switch m.userStatuses[name].state {
+	case "away":
+		return lipgloss.NewStyle().Foreground(awayColor).Bold(true).Render("◐")
+	case "dnd":
+		return lipgloss.NewStyle().Foreground(errorColor).Bold(true).Render("⊘")
+	}
+	return m.styles.OnlineUser.Render(IconConnected)
+}
+
+func awayCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	return m, m.sendMessageCmd("STATUS:away:" + args)
+}
+
+func backCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	return m, m.sendMessageCmd("STATUS:online:")
+}
+
+func dndCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	return m, m.sendMessageCmd("STATUS:dnd:" + args)
+}
+
+// setStatusCommand handles /setstatus <emoji> <text>, keeping whether we
+// are online, away or dnd
+func setStatusCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	if len(strings.Fields(args)) < 2 {
+		m.addSystemMessage("Usage: /setstatus <emoji> <text>")
+		return m, nil
+	}
+	return m, m.sendMessageCmd("STATUS::" + args)
+}
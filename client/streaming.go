@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// startStream notes msg, just added with Streaming set, as the start of a
+// message whose text follows in STREAM frames
+func (m *mainModel) startStream(msg ChatMessage) {
+	m.streamingMessages[msg.ID] = &strings.Builder{}
+}
+
+// streamChunk handles STREAM:<id>:<n>:<last>:<text>, a piece of a message
+// a bot is still writing. The last piece, with last 1, finishes it. Pieces
+// of messages we never got the start of, say from before a /join, are
+// dropped, as STREAM_COMPLETE brings those whole.
+func (m *mainModel) streamChunk(payload string) {
+	parts := strings.SplitN(payload, ":", 4)
+	if len(parts) != 4 {
+		return
+	}
+	id, last, text := parts[0], parts[2] == "1", parts[3]
+	if _, err := strconv.Atoi(parts[1]); err != nil {
+		return
+	}
+	body, ok := m.streamingMessages[id]
+	i := m.messageIndex(id)
+	if !ok || i < 0 {
+		return
+	}
+
+	body.WriteString(text)
+	m.messages[i].Content = body.String()
+	if last {
+		m.messages[i].Streaming = false
+		delete(m.streamingMessages, id)
+	}
+	m.render.invalidate(i)
+}
+
+// completeStream handles STREAM_COMPLETE:<message>, the finished message
+// as stored. It takes the place of the one streamed, or is added if we
+// missed its start.
+func (m *mainModel) completeStream(payload string) {
+	var stored wireMessage
+	if err := json.Unmarshal([]byte(payload), &stored); err != nil || stored.ID == "" {
+		return
+	}
+	msg := wireToChatMessage(stored)
+	msg.HasMention = m.mentionsMe(msg)
+	delete(m.streamingMessages, msg.ID)
+	m.trackReceived(msg)
+
+	if i := m.messageIndex(msg.ID); i >= 0 {
+		m.messages[i] = msg
+		m.render.invalidate(i)
+		return
+	}
+	if stored.Channel != m.currentChannel {
+		return
+	}
+	m.messages = append(m.messages, msg)
+	if !m.autoScroll {
+		m.unreadSinceScroll++
+	}
+}
+
+// dropStreams removes the messages still streaming, for when we stop
+// hearing of them. What they became comes back with the channel's history.
+func (m *mainModel) dropStreams() {
+	if len(m.streamingMessages) == 0 {
+		return
+	}
+	kept := make([]ChatMessage, 0, len(m.messages))
+	for _, msg := range m.messages {
+		if !msg.Streaming {
+			kept = append(kept, msg)
+		}
+	}
+	if len(kept) < len(m.messages) {
+		m.messages = kept
+		m.render.reset()
+	}
+	m.streamingMessages = map[string]*strings.Builder{}
+}
+
+// animateStreams draws the messages still streaming again, for their dots
+func (m *mainModel) animateStreams() {
+	for id := range m.streamingMessages {
+		if i := m.messageIndex(id); i >= 0 {
+			m.render.invalidate(i)
+		}
+	}
+	m.viewport.SetContent(m.renderMessages())
+	if m.autoScroll {
+		m.viewport.GotoBottom()
+	}
+}
+
+// streamingPlaceholder is shown after a message still streaming, its dots
+// going round with the animation
+func (m mainModel) streamingPlaceholder() string {
+	return m.styles.InlineHint("[…streaming" + strings.Repeat(".", m.animFrame%4) + "]")
+}
@@ -1,16 +1,45 @@
 package main
 
-import "github.com/charmbracelet/lipgloss"
+import (
+	"hash/fnv"
+
+	"github.com/charmbracelet/lipgloss"
+)
 
 // Base colors that don't change with themes
 var (
 	successColor = lipgloss.Color("#00FF88") // Green
 	errorColor   = lipgloss.Color("#FF4757") // Red
+	awayColor    = lipgloss.Color("#FFD43B") // Yellow
 	dimColor     = lipgloss.Color("#6B7280") // Gray
 	bgDark       = lipgloss.Color("#0D1117") // Dark background
 	bgMedium     = lipgloss.Color("#161B22") // Medium background
 )
 
+// userPalette holds the name colors picked by usernameColor, chosen to stay
+// readable on dark backgrounds
+var userPalette = []lipgloss.Color{
+	"#FF6B6B", // Coral
+	"#FFA94D", // Orange
+	"#FFD43B", // Yellow
+	"#A9E34B", // Lime
+	"#51CF66", // Green
+	"#38D9A9", // Teal
+	"#3BC9DB", // Cyan
+	"#4DABF7", // Blue
+	"#748FFC", // Indigo
+	"#9775FA", // Violet
+	"#DA77F2", // Purple
+	"#F783AC", // Pink
+}
+
+// usernameColor gives each name a stable color from userPalette
+func usernameColor(name string) lipgloss.Color {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return userPalette[h.Sum32()%uint32(len(userPalette))]
+}
+
 type Styles struct {
 	// Layout
 	App           lipgloss.Style
@@ -45,6 +74,22 @@ type Styles struct {
 	PrimaryColor   lipgloss.Color
 	SecondaryColor lipgloss.Color
 	PrivMsgColor   lipgloss.Color
+
+	CodeStyle string // Chroma style for highlighting code blocks
+}
+
+// codeStyles matches theme presets to the closest chroma style; other
+// themes use monokai
+var codeStyles = map[int]string{
+	6: "dracula",
+	7: "nord",
+}
+
+func codeStyle(preset int) string {
+	if style, ok := codeStyles[preset]; ok {
+		return style
+	}
+	return "monokai"
 }
 
 func InitStyles(cfg Config) Styles {
@@ -56,6 +101,7 @@ func InitStyles(cfg Config) Styles {
 		// Store colors for external use
 		PrimaryColor:   primaryColor,
 		SecondaryColor: secondaryColor,
+		CodeStyle:      codeStyle(cfg.Preset),
 
 		// Full app container
 		App: lipgloss.NewStyle().
@@ -198,6 +244,12 @@ func InitStyles(cfg Config) Styles {
 	}
 }
 
+// InlineHint renders text in the hint style without its margins, for use
+// inside a line of other content
+func (s Styles) InlineHint(text string) string {
+	return s.Hint.UnsetMargins().Render(text)
+}
+
 // Animation frames for spinner
 var SpinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
 
@@ -212,6 +264,10 @@ const (
 	IconSend         = "➤"
 	IconUser         = "👤"
 	IconLock         = "🔒"
+	IconMail         = "✉"
+	IconFile         = "📎"
+	IconPin          = "📌"
+	IconReadOnly     = "📢"
 	IconServer       = "🌐"
 	IconChat         = "💬"
 	IconOnline       = "🟢"
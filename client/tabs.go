@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/textarea"
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// tabMsg is a message for one tab, like a frame from its websocket. Tabs
+// are identified by id rather than index, which shifts as tabs close.
+type tabMsg struct {
+	tab int
+	msg tea.Msg
+}
+
+// forTab tags whatever cmd returns with the tab it belongs to. Batches and
+// sequences have each of their commands tagged instead, and Bubble Tea's
+// other messages, like tea.Quit's, are left for it to act on.
+func forTab(id int, cmd tea.Cmd) tea.Cmd {
+	if cmd == nil {
+		return nil
+	}
+	return func() tea.Msg {
+		msg := cmd()
+		switch msg := msg.(type) {
+		case nil, tabMsg:
+			return msg
+		case tea.BatchMsg:
+			return tea.BatchMsg(forTabAll(id, msg))
+		}
+		if reflect.TypeOf(msg).PkgPath() != teaPackage {
+			return tabMsg{tab: id, msg: msg}
+		}
+		// tea.Sequence's message is unexported, but is a []tea.Cmd
+		if v := reflect.ValueOf(msg); v.Kind() == reflect.Slice && v.Type().Elem() == cmdType {
+			return tea.Sequence(forTabAll(id, v.Convert(reflect.TypeOf([]tea.Cmd{})).Interface().([]tea.Cmd))...)()
+		}
+		return msg
+	}
+}
+
+var (
+	teaPackage = reflect.TypeOf(tea.QuitMsg{}).PkgPath()
+	cmdType    = reflect.TypeOf(tea.Cmd(nil))
+)
+
+func forTabAll(id int, cmds []tea.Cmd) []tea.Cmd {
+	tagged := make([]tea.Cmd, len(cmds))
+	for i, cmd := range cmds {
+		tagged[i] = forTab(id, cmd)
+	}
+	return tagged
+}
+
+// serverTab is everything belonging to one server connection. The active
+// tab's is embedded in mainModel; switching tabs swaps it with tabs[i].
+type serverTab struct {
+	id          int // Tags the tab's websocket and connect messages, see tabMsg
+	state       sessionState
+	unseenCount int // Messages that arrived while another tab was shown
+
+	// Login Inputs
+	serverInput  textinput.Model
+	userInput    textinput.Model
+	passInput    textinput.Model
+	emailInput   textinput.Model // Optional, for servers that verify emails on registration
+	totpInput    textinput.Model // Two-factor or recovery code, when the server asks
+	focusIndex   int
+	showPassword bool
+
+	// Chat Components
+	viewport     viewport.Model
+	msgInput     textarea.Model
+	limitFlash   int // Animation ticks left of the input border's flash, see counter.go
+	alertFlash   int // Animation ticks left of the chat border's flash, see notify.go
+	messages     []ChatMessage
+	onlineUsers  []string              // Kept current by USERLIST frames
+	userStatuses map[string]userStatus // Away and dnd users, from STATUS frames
+	// Colors users picked with /setcolor, from COLOR frames and their messages
+	displayColors map[string]lipgloss.Color
+
+	expandedBlocks map[string]bool // Messages whose long code blocks are shown in full, by expandKey
+	render         *renderCache    // Messages as last rendered, see rendercache.go
+
+	// Channels, kept current by CHANNELLIST/CHANNELADD/CHANNELDEL frames
+	channels        []channelInfo
+	currentChannel  string
+	previousChannel string            // Where /join came from, to go back if refused
+	mentionCounts   map[string]int    // Unread @mentions per other channel, from MENTION frames
+	unreadCounts    map[string]int    // Unread messages per other channel, from ACTIVITY frames
+	channelTopics   map[string]string // From channel lists and TOPIC frames
+
+	// Sidebar sections, from CHANNELCATEGORY frames, see categories.go
+	channelCategories   map[string][]string
+	collapsedCategories map[string]bool
+	sidebarFocused      bool // Ctrl+B moved the keyboard to the channel list
+	sidebarCursor       int  // Highlighted row of sidebarRows
+
+	// Inactive channels' messages and scroll offsets, see cacheChannel
+	messageCache    map[string][]ChatMessage
+	scrollPositions map[string]int
+
+	// The current channel's pinboard
+	pins     []pinnedMessage
+	pinIndex int // Highlighted pin
+
+	bookmarkIndex   int       // Highlighted row of /bookmarks
+	pendingBookmark *bookmark // Opened in another channel, scrolled to once it's joined
+
+	editingID string       // Server ID of our message being edited, empty when composing
+	replyToID string       // Server ID of the message being replied to, empty otherwise
+	thread    *threadPanel // Open thread beside the chat, nil when closed
+
+	// Pasting
+	pastePath        string    // File a paste named, while asking "Send file? [y/N]"
+	pasteText        string    // The paste itself, put in the input if not
+	pasteNotice      string    // Shown under the input after unsafe characters were taken out
+	pasteNoticeUntil time.Time // When pasteNotice stops showing
+
+	// Message of the day, from the MOTD frame sent on login
+	motd     string
+	hideMotd bool // Set by /motd off, for the rest of the session
+
+	maintenance string // The server's maintenance message, shown in a banner while set
+
+	// Address book
+	serverCursor int  // Highlighted row of the server list
+	savePrompt   bool // Asking "Save this server? [y/N]"
+	saveOffered  bool // Only asked on the first connection
+
+	// Tab completion of the word being typed
+	completions    []string
+	completionIdx  int
+	completionBase string // Input before the completed word
+
+	// Search
+	searchQuery   string
+	searchResults []searchResult
+	searchIndex   int // Highlighted result
+
+	// Paging back through the channel, see history.go
+	oldestMsgID     string    // Cursor: the oldest message shown
+	historyFetching int       // Messages asked for, 0 when not fetching
+	historyEnd      bool      // The server had nothing older
+	historyFetchAt  time.Time // When the last page was asked for
+
+	// Follow new messages unless the user scrolled up to read
+	autoScroll        bool
+	unreadSinceScroll int // Messages that arrived below while scrolled up
+
+	// Typing indicator
+	typingUsers    map[string]time.Time // Who is typing, by when we last heard
+	lastTypingSent time.Time
+
+	chatStartTime time.Time // Track when chat started for adaptive animation
+
+	// Connection
+	conn       ChatTransport
+	serverAddr string      // Address we're connected to, defaults applied
+	e2e        *e2eSession // Whisper encryption keys, nil when E2E is off
+	export     *exportState
+	err        error
+	username   string // Store current username for message alignment
+	serverCaps serverCapabilities
+
+	isConnecting bool
+	reconnecting bool // Lost the connection, retrying behind a banner in the chat
+
+	heartbeat      *heartbeat // Pings the connection, see heartbeat.go
+	latencyHistory [5]int64   // Round trips of the last pings in ms, newest first
+	latencySamples int        // How many of latencyHistory are measured yet
+	latencyAvgMs   int64      // Their average, shown in the footer
+
+	// Connection retries with exponential backoff
+	retryCount     int
+	nextRetryDelay time.Duration
+	retryAt        time.Time
+	restarting     bool // Reconnecting because the server is restarting
+
+	// Vim mode, when turned on in the config
+	vimMode    bool   // In normal mode, with the input unfocused
+	vimPending string // First key of a two-key command like gg
+
+	// Back-fill tracking for messages missed while disconnected
+	lastReceivedMsgID string
+	lastReceivedAt    time.Time
+	seenMsgIDs        map[string]struct{} // Server messages shown, so replays don't show them twice
+	replaying         bool                // Reconnected, until the replay of missed messages arrives
+	replaySeparated   bool                // The missed messages' separator is up for this reconnect
+	connectedMsgIndex int                 // Index of the latest "connected" system message
+
+	// Text so far of the messages bots are streaming, by ID, see streaming.go
+	streamingMessages map[string]*strings.Builder
+}
+
+// updateTab hands msg to its tab. Messages for a background tab are
+// handled with that tab swapped in, counting what arrived as unseen.
+func (m mainModel) updateTab(msg tabMsg) (tea.Model, tea.Cmd) {
+	if msg.tab == m.id {
+		return m.Update(msg.msg)
+	}
+
+	i := m.tabIndex(msg.tab)
+	if i == -1 {
+		// The tab was closed while connecting
+		if connected, ok := msg.msg.(connectedMsg); ok {
+			connected.conn.Close()
+		}
+		return m, nil
+	}
+
+	active := m.serverTab
+	m.serverTab = m.tabs[i]
+	before := len(m.messages)
+	updated, cmd := m.Update(msg.msg)
+	m = updated.(mainModel)
+	m.unseenCount += max(len(m.messages)-before, 0)
+	m.tabs[i] = m.serverTab
+	m.serverTab = active
+	// What the tab asked for, like its next frame or a timer, comes back
+	// to it rather than to whichever tab is showing by then
+	return m, forTab(msg.tab, cmd)
+}
+
+func (m mainModel) tabIndex(id int) int {
+	for i, tab := range m.tabs {
+		if tab.id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// newTab opens a tab on the login screen, for connecting to another server
+func (m mainModel) newTab() (mainModel, tea.Cmd) {
+	tab := newServerTab(m.config, m.nextTabID)
+	m.nextTabID++
+	m.tabs = append(m.tabs, tab)
+	return m.switchTab(len(m.tabs) - 1)
+}
+
+// switchTab shows tabs[i], saving the active tab back to the slice
+func (m mainModel) switchTab(i int) (mainModel, tea.Cmd) {
+	m.tabs[m.activeTab] = m.serverTab
+	m.activeTab = i
+	m.serverTab = m.tabs[i]
+	m.unseenCount = 0
+	m.resize()
+
+	if m.state == chatView {
+		m.viewport.SetContent(m.renderMessages())
+		if m.autoScroll {
+			m.viewport.GotoBottom()
+		}
+	}
+	if m.state == loginView {
+		return m, m.updateFocus()
+	}
+	return m, nil
+}
+
+// cycleTab switches to the next tab, or the previous one when step is -1
+func (m mainModel) cycleTab(step int) (mainModel, tea.Cmd) {
+	if len(m.tabs) < 2 {
+		return m, nil
+	}
+	return m.switchTab((m.activeTab + step + len(m.tabs)) % len(m.tabs))
+}
+
+// closeTab disconnects the active tab and removes it. Closing the last
+// tab quits.
+func (m mainModel) closeTab() (mainModel, tea.Cmd) {
+	if m.conn != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		DisconnectWithContext(ctx, m.conn)
+		cancel()
+	}
+	if m.export != nil {
+		m.abortExport("Export cancelled")
+	}
+	if len(m.tabs) == 1 {
+		return m, tea.Quit
+	}
+
+	m.tabs = append(m.tabs[:m.activeTab], m.tabs[m.activeTab+1:]...)
+	i := min(m.activeTab, len(m.tabs)-1)
+	m.activeTab = i
+	m.serverTab = m.tabs[i]
+	m.unseenCount = 0
+	m.resize()
+	if m.state == chatView {
+		m.viewport.SetContent(m.renderMessages())
+	}
+	return m, nil
+}
+
+// disconnectAll closes every tab's connection before quitting
+func (m mainModel) disconnectAll() {
+	conns := []ChatTransport{m.conn}
+	for i, tab := range m.tabs {
+		if i != m.activeTab {
+			conns = append(conns, tab.conn)
+		}
+	}
+	for _, conn := range conns {
+		if conn == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		DisconnectWithContext(ctx, conn)
+		cancel()
+	}
+}
+
+// tabBarHeight is the line taken by the tab bar, shown once there are two
+func (m mainModel) tabBarHeight() int {
+	if len(m.tabs) < 2 {
+		return 0
+	}
+	return 1
+}
+
+// tabBar shows each tab's server, with a badge for unseen messages
+func (m mainModel) tabBar() string {
+	active := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("#FFFFFF")).
+		Background(m.styles.PrimaryColor).
+		Bold(true).
+		Padding(0, 1)
+	inactive := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("#9CA3AF")).
+		Padding(0, 1)
+	badge := lipgloss.NewStyle().
+		Foreground(m.styles.SecondaryColor).
+		Bold(true)
+
+	var parts []string
+	for i, tab := range m.tabs {
+		if i == m.activeTab {
+			parts = append(parts, active.Render(tab.title()))
+			continue
+		}
+		label := tab.title()
+		if tab.unseenCount > 0 {
+			label += " " + badge.Render(fmt.Sprintf("(%d)", tab.unseenCount))
+		}
+		parts = append(parts, inactive.Render(label))
+	}
+	bar := strings.Join(parts, " ")
+	hint := m.styles.InlineHint("Ctrl+N new • Ctrl+←/→ switch • Ctrl+W close")
+	if lipgloss.Width(bar)+lipgloss.Width(hint)+1 <= m.width {
+		bar += strings.Repeat(" ", m.width-lipgloss.Width(bar)-lipgloss.Width(hint)) + hint
+	}
+	return bar
+}
+
+// title is the tab's server host, without the port
+func (t serverTab) title() string {
+	addr := t.serverAddr
+	if addr == "" {
+		addr = t.serverInput.Value()
+	}
+	if addr == "" {
+		return "new tab"
+	}
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "wss://"), "ws://")
+	if host, _, found := strings.Cut(addr, ":"); found && host != "" {
+		return host
+	}
+	return addr
+}
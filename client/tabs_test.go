@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type pingedMsg struct{}
+
+func pinged() tea.Msg { return pingedMsg{} }
+
+func TestForTab(t *testing.T) {
+	if got := forTab(3, pinged)(); got != (tabMsg{tab: 3, msg: pingedMsg{}}) {
+		t.Errorf("forTab = %#v, want pingedMsg for tab 3", got)
+	}
+	if got := forTab(3, forTab(2, pinged))(); got != (tabMsg{tab: 2, msg: pingedMsg{}}) {
+		t.Errorf("forTab over forTab = %#v, want the inner tab kept", got)
+	}
+	if got := forTab(3, tea.Quit)(); got != (tea.QuitMsg{}) {
+		t.Errorf("forTab(tea.Quit) = %#v, want it left for Bubble Tea", got)
+	}
+
+	// Each command of a batch or sequence is tagged, as Bubble Tea only
+	// runs them when they arrive untagged
+	batch, ok := forTab(3, tea.Batch(pinged, pinged))().(tea.BatchMsg)
+	if !ok || len(batch) != 2 {
+		t.Fatalf("forTab(tea.Batch) = %#v, want a batch of 2", batch)
+	}
+	for _, cmd := range batch {
+		if got := cmd(); got != (tabMsg{tab: 3, msg: pingedMsg{}}) {
+			t.Errorf("batched command = %#v, want pingedMsg for tab 3", got)
+		}
+	}
+	sequence := forTab(3, tea.Sequence(pinged, pinged))()
+	if _, ok := sequence.(tabMsg); ok {
+		t.Errorf("forTab(tea.Sequence) = %#v, want a sequence", sequence)
+	}
+}
+
+func TestBackgroundTabCommands(t *testing.T) {
+	cfg := testConfig()
+	cfg.AnimationSpeed = animationFast
+	m := initialModel(cfg)
+	m, _ = m.newTab()
+	background := m.tabs[0].id
+
+	// Everything a background tab starts on hearing its server is
+	// restarting, the animation tick included, comes back to it rather
+	// than to the tab that's showing
+	_, cmd := m.updateTab(tabMsg{tab: background, msg: goingAwayMsg{}})
+	batch, ok := cmd().(tea.BatchMsg)
+	if !ok {
+		t.Fatalf("got %#v, want a batch", batch)
+	}
+	for _, cmd := range batch {
+		done := make(chan tea.Msg, 1)
+		go func() { done <- cmd() }()
+		select {
+		case got := <-done:
+			if tagged, ok := got.(tabMsg); !ok || tagged.tab != background {
+				t.Errorf("got %#v, want a message for tab %d", got, background)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("a command took over a second")
+		}
+	}
+}
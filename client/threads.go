@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/charmbracelet/bubbles/viewport"
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// maxReplyDepth is how deeply replies nest before the rest of a chain is
+// collapsed into "[+N nested replies]"
+const maxReplyDepth = 3
+
+// replyPreviewLength is how much of the parent the reply banner quotes
+const replyPreviewLength = 40
+
+// threadOrder lists the indexes of msgs with each reply after its parent
+// and the parent's earlier replies, along with how deeply each is nested.
+// Replies to messages that aren't loaded start threads of their own.
+func threadOrder(msgs []ChatMessage) (order []int, depths []int) {
+	// Most chats have no replies, leaving everything where it is
+	if !slices.ContainsFunc(msgs, func(msg ChatMessage) bool { return msg.ReplyTo != "" }) {
+		order = make([]int, len(msgs))
+		for i := range order {
+			order[i] = i
+		}
+		return order, make([]int, len(msgs))
+	}
+
+	byID := make(map[string]int, len(msgs))
+	children := map[int][]int{}
+	var roots []int
+	for i, msg := range msgs {
+		if parent, ok := byID[msg.ReplyTo]; ok && msg.ReplyTo != "" {
+			children[parent] = append(children[parent], i)
+		} else {
+			roots = append(roots, i)
+		}
+		if msg.ID != "" {
+			byID[msg.ID] = i
+		}
+	}
+
+	depths = make([]int, len(msgs))
+	var visit func(i, depth int)
+	visit = func(i, depth int) {
+		order = append(order, i)
+		depths[i] = depth
+		for _, child := range children[i] {
+			visit(child, depth+1)
+		}
+	}
+	for _, root := range roots {
+		visit(root, 0)
+	}
+	return order, depths
+}
+
+// nestedBelow counts the replies nested under order[pos], which follow it
+// in thread order
+func nestedBelow(order []int, depths []int, pos int) int {
+	n := 0
+	for _, i := range order[pos+1:] {
+		if depths[i] <= depths[order[pos]] {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+// bottomMessage is the last message shown in the chat that can be replied to
+func (m mainModel) bottomMessage() (ChatMessage, bool) {
+	for line := m.viewport.YOffset + m.viewport.Height - 1; line >= m.viewport.YOffset; line-- {
+		msg, ok := m.messageAtLine(line)
+		if ok && msg.ID != "" && !msg.IsSystem && !msg.IsPrivate && !msg.Deleted {
+			return msg, true
+		}
+	}
+	return ChatMessage{}, false
+}
+
+// startReply makes the next message sent a reply to msg
+func (m *mainModel) startReply(msg ChatMessage) {
+	m.replyToID = msg.ID
+	m.editingID = ""
+	m.resize()
+}
+
+// cancelReply goes back to sending plain messages, keeping what was typed
+func (m *mainModel) cancelReply() {
+	m.replyToID = ""
+	m.resize()
+}
+
+// replyBannerHeight is the line the reply banner takes above the input
+func (m mainModel) replyBannerHeight() int {
+	if m.replyToID == "" {
+		return 0
+	}
+	return 1
+}
+
+// replyBanner is "Replying to @alice: first 40 chars…", shown above the input
+func (m mainModel) replyBanner() string {
+	text := "Replying to a message"
+	for _, msg := range m.messages {
+		if msg.ID == m.replyToID {
+			text = "Replying to @" + msg.User + ": " + ansi.Truncate(msg.Content, replyPreviewLength, "…")
+			break
+		}
+	}
+	if m.thread != nil {
+		return m.styles.InlineHint(" " + text + " - [Esc] Close thread")
+	}
+	return m.styles.InlineHint(" " + text + " - [Esc] Cancel")
+}
+
+// threadPanel shows the replies under one message beside the chat, in
+// place of the sidebar. It's opened and closed with Ctrl+T.
+type threadPanel struct {
+	parent   ChatMessage
+	replies  []ChatMessage // Oldest first, from THREADREPLIES and REPLY frames
+	viewport viewport.Model
+}
+
+// threadPanelWidth is how much of the width the thread panel takes
+func (m mainModel) threadPanelWidth() int {
+	return m.width * 2 / 5
+}
+
+// toggleThread opens the thread of the bottom message, making what's
+// typed a reply to it, or closes the open one
+func (m mainModel) toggleThread() (mainModel, tea.Cmd) {
+	if m.thread != nil {
+		m.closeThread()
+		m.viewport.SetContent(m.renderMessages())
+		return m, m.sendMessageCmd("THREAD:")
+	}
+	parent, ok := m.bottomMessage()
+	if !ok {
+		m.statusMsg = "No message to open the thread of"
+		m.statusUntil = time.Now().Add(vimStatusDuration)
+		return m, nil
+	}
+	m.thread = &threadPanel{parent: parent, viewport: viewport.New(0, 0)}
+	m.startReply(parent)
+	m.refreshThread()
+	m.viewport.SetContent(m.renderMessages())
+	return m, m.sendMessageCmd("THREAD:" + parent.ID)
+}
+
+// closeThread hides the thread panel, going back to plain messages
+func (m *mainModel) closeThread() {
+	m.thread = nil
+	m.cancelReply()
+}
+
+// loadThread shows the replies from a THREADREPLIES:<parentID>:<json> frame
+func (m *mainModel) loadThread(parentID string, payload string) {
+	if m.thread == nil || m.thread.parent.ID != parentID {
+		return
+	}
+	var replies []wireMessage
+	if err := json.Unmarshal([]byte(payload), &replies); err != nil {
+		return
+	}
+	m.thread.replies = m.thread.replies[:0]
+	for _, w := range replies {
+		m.thread.replies = append(m.thread.replies, wireToChatMessage(w))
+	}
+	m.refreshThread()
+}
+
+// addThreadReply adds a reply from a REPLY:<parentID>:<json> frame, if
+// it's to the open thread's message or one of its replies
+func (m *mainModel) addThreadReply(parentID string, payload string) {
+	if m.thread == nil {
+		return
+	}
+	var w wireMessage
+	if err := json.Unmarshal([]byte(payload), &w); err != nil {
+		return
+	}
+	inThread := parentID == m.thread.parent.ID
+	for _, reply := range m.thread.replies {
+		if reply.ID == w.ID {
+			return
+		}
+		inThread = inThread || reply.ID == parentID
+	}
+	if !inThread {
+		return
+	}
+	m.thread.replies = append(m.thread.replies, wireToChatMessage(w))
+	m.refreshThread()
+}
+
+// refreshThread fits the thread panel's replies to its width, showing the
+// newest
+func (m *mainModel) refreshThread() {
+	if m.thread == nil {
+		return
+	}
+	vp := &m.thread.viewport
+	if len(m.thread.replies) == 0 {
+		vp.SetContent(m.styles.InlineHint("No replies yet"))
+		return
+	}
+	wrap := lipgloss.NewStyle().Width(max(vp.Width, 1))
+	var lines []string
+	for _, reply := range m.thread.replies {
+		header := m.styles.DateTime.Render("["+m.displayTime(reply)+"]") + " " +
+			m.userStyle(reply.User).Render(reply.User)
+		lines = append(lines, header, wrap.Render(reply.Content))
+	}
+	vp.SetContent(strings.Join(lines, "\n"))
+	vp.GotoBottom()
+}
+
+// renderThreadPanel renders the bordered thread panel to the given height
+func (m mainModel) renderThreadPanel(height int) string {
+	width := m.threadPanelWidth()
+	innerWidth := width - 4 // Border and padding
+
+	title := m.styles.User.Render(fmt.Sprintf("Thread (%d)", len(m.thread.replies)))
+	parent := firstLine(m.thread.parent.Content)
+	parent = ansi.Truncate("@"+m.thread.parent.User+": "+parent, innerWidth, "…")
+
+	return lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(lipgloss.Color("#3B4252")).
+		Width(width-2).
+		Height(height-2).
+		Padding(0, 1).
+		Render(lipgloss.JoinVertical(lipgloss.Left, title, m.styles.InlineHint(parent), m.thread.viewport.View()))
+}
+
+// firstLine is text up to its first line break
+func firstLine(text string) string {
+	line, _, _ := strings.Cut(text, "\n")
+	return line
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transports the client can reach a server over
+const (
+	transportWebsocket = "ws"
+	transportGRPC      = "grpc"
+)
+
+// ChatTransport carries the protocol's text frames to and from the server
+// once logged in, whether over a websocket or gRPC. Recv returns io.EOF
+// when the server closed the connection normally, ErrServerRestarting when
+// it's going away, and a kickedError when a moderator kicked us.
+type ChatTransport interface {
+	Send(frame string) error
+	Recv() (string, error)
+	Close() error
+}
+
+// kickedError ends a connection a moderator kicked us from
+type kickedError struct{ reason string }
+
+func (e kickedError) Error() string { return "kicked: " + e.reason }
+
+// validTransport reports whether name is a transport the client speaks,
+// the empty default included
+func validTransport(name string) error {
+	switch name {
+	case "", transportWebsocket, transportGRPC:
+		return nil
+	}
+	return fmt.Errorf("unknown transport %q, want %s or %s", name, transportWebsocket, transportGRPC)
+}
+
+// connectServer connects and logs in over the transport opts picks,
+// giving up with ErrTimeout once ctx is done
+func connectServer(ctx context.Context, serverURL string, creds Credentials, opts DialOptions) (ChatTransport, error) {
+	if opts.Transport == transportGRPC {
+		return connectGRPC(ctx, serverURL, creds, opts)
+	}
+	conn, err := ConnectWebsocketWithOptions(ctx, serverURL, creds, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &wsTransport{conn: conn}, nil
+}
+
+// wsTransport is a ChatTransport over a websocket. Frames are sent from
+// several tea.Cmd goroutines at once, typing notices, pings and file
+// chunks among them, and a websocket takes one writer at a time, so every
+// write holds writeMu.
+type wsTransport struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex
+}
+
+func (t *wsTransport) Send(frame string) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.conn.WriteMessage(websocket.TextMessage, []byte(frame))
+}
+
+// sendClose sends a close frame, giving up at deadline
+func (t *wsTransport) sendClose(deadline time.Time) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	return t.conn.WriteControl(websocket.CloseMessage, closeFrame, deadline)
+}
+
+func (t *wsTransport) Recv() (string, error) {
+	_, data, err := t.conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		switch {
+		case closeErr.Code == websocket.CloseNormalClosure:
+			return "", io.EOF
+		case closeErr.Code == websocket.CloseGoingAway:
+			return "", ErrServerRestarting
+		}
+		if reason, ok := strings.CutPrefix(closeErr.Text, "KICKED:"); ok {
+			return "", kickedError{reason: reason}
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (t *wsTransport) Close() error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.conn.Close()
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/alecthomas/chroma/v2/quick"
 	"github.com/charmbracelet/bubbles/spinner"
 	"github.com/charmbracelet/bubbles/textarea"
 	"github.com/charmbracelet/bubbles/textinput"
 	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/glamour"
+	glamouransi "github.com/charmbracelet/glamour/ansi"
+	glamourstyles "github.com/charmbracelet/glamour/styles"
 	"github.com/charmbracelet/lipgloss"
-	"github.com/gorilla/websocket"
+	"github.com/charmbracelet/x/ansi"
 )
 
 // ASCII Art Logo with gradient effect
@@ -47,71 +57,148 @@ var connectFrames = []string{
 	"[   =]",
 }
 
+// Typing notices are sent at most once per interval and shown until they go stale
+const (
+	typingSendInterval = time.Second
+	typingTimeout      = 3 * time.Second
+)
+
+// Right sidebar, hidden on terminals too narrow to fit it beside the chat
+const (
+	sidebarWidth       = 24
+	sidebarMinTermSize = 70
+)
+
 type sessionState int
 
 const (
 	loginView sessionState = iota
 	connectingView
 	chatView
+	searchView       // Results of /search, shown in place of the chat
+	totpView         // Asking for a two-factor code after the password was accepted
+	serverSelectView // Saved servers to pick from, shown before the login form
+	wizardView       // First-run setup, see wizard.go
+	pinboardView     // The channel's pinned messages, shown in place of the chat
+	bookmarkView     // Messages bookmarked on any server, see bookmarks.go
+)
+
+// Login form focus order
+const (
+	focusServer = iota
+	focusUser
+	focusPass
+	focusToggle
+	focusEmail
+	focusConnect
+	focusCount
 )
 
 type mainModel struct {
-	state  sessionState
 	styles Styles
 	config Config
 
-	// Login Inputs
-	serverInput  textinput.Model
-	userInput    textinput.Model
-	passInput    textinput.Model
-	focusIndex   int
-	showPassword bool
+	// The active tab's session is embedded; see tabs.go
+	serverTab
+	tabs      []serverTab // Every open tab, the active one's entry saved on switching away
+	activeTab int
+	nextTabID int
 
-	// Chat Components
-	viewport viewport.Model
-	msgInput textarea.Model
-	messages []ChatMessage
+	userColors    map[string]lipgloss.Color // usernameColor results, filled as names render
+	markdownCache map[string]string         // Rendered Markdown by wrap width and message text
+	drafts        map[string]string         // Unsent input per channel
+	bookmarks     []bookmark                // Saved in ~/.echo/bookmarks.json
+	notifyRules   []notifyRule              // config.Notify, compiled
+	aliases       map[string]string         // config.Aliases, plus any added with /alias add
+	wizard        setupWizard               // First-run setup progress
 
 	// Animation
-	spinner       spinner.Model
-	animFrame     int
-	pulseFrame    int
-	showCursor    bool
-	chatStartTime time.Time // Track when chat started for adaptive animation
-
-	// Connection
-	conn     *websocket.Conn
-	err      error
-	width    int
-	height   int
-	username string // Store current username for message alignment
+	spinner    spinner.Model
+	animFrame  int
+	animTicks  int // Every animation tick so far, for the topic marquee
+	pulseFrame int
+	showCursor bool
+
+	width  int
+	height int
 
 	// Status
-	isConnecting bool
-	statusMsg    string
+	statusMsg   string    // Transient footer text, e.g. a hovered message's time
+	statusUntil time.Time // When statusMsg stops showing
 }
 
 // ChatMessage holds parsed message data for styled rendering
 type ChatMessage struct {
-	Timestamp string
-	User      string
-	Content   string
-	IsSystem  bool
-	IsPrivate bool // For whisper/private messages
+	ID             string // Server-assigned ID, empty for local/system messages
+	Timestamp      string
+	User           string
+	Content        string
+	IsSystem       bool
+	IsPrivate      bool   // For whisper/private messages
+	To             string // Recipient of a whisper we sent ourselves
+	Edited         bool
+	Deleted        bool      // Rendered as a "[message deleted]" tombstone
+	IsSeparator    bool      // Subtle divider line, e.g. before back-filled messages
+	Time           time.Time // When the message was sent, zero if unknown
+	Reactions      map[string]int
+	FileURL        string // Shared file, with Content holding its name
+	FileSize       int64
+	HasMention     bool      // Someone else's message that @mentions us
+	IsAnnouncement bool      // Admin announcement, shown boxed across the chat
+	IsMotd         bool      // Server's message of the day, boxed above the history
+	Encrypted      bool      // Whisper sent end-to-end encrypted
+	Bot            string    // Name an incoming webhook posted as, with User "[webhook]"
+	ReplyTo        string    // Server ID of the message this replies to
+	ClientID       string    // Our ID for a message we sent, acknowledged by the server
+	DisplayColor   string    // The sender's /setcolor color, on live messages
+	Poll           *chatPoll // Shown as the poll's box, see polls.go
+	Ephemeral      bool      // The server didn't store it, see /privacy
+	Streaming      bool      // A bot is still writing it, see streaming.go
+	Delivery       delivery
+	Outcome        outcome
 }
 
+// outcome colors a system message reporting whether a request worked
+type outcome int
+
+const (
+	outcomeNone outcome = iota
+	outcomeSuccess
+	outcomeError
+)
+
 type errMsg error
 type wsMsg string
 type clearInputMsg struct{}
 type tickMsg time.Time
 type animTickMsg time.Time
+type retryConnectMsg struct{}
 
-func initialModel(cfg Config) mainModel {
-	styles := InitStyles(cfg)
+// goingAwayMsg is sent when the server closes the connection to restart
+type goingAwayMsg struct{}
+
+// progressMsg reports a failed connection attempt that will be retried
+type progressMsg struct {
+	attempt int
+	delay   time.Duration
+	err     error
+}
+
+// newServerTab is a tab on the login screen, or the list of saved servers
+// when there are any
+func newServerTab(cfg Config, id int) serverTab {
+	state := loginView
+	if len(cfg.Servers) > 0 {
+		state = serverSelectView
+	}
 
 	// Server input
 	s := textinput.New()
 	s.Placeholder = "localhost:8080"
+	if cfg.TLS {
+		s.Placeholder = "wss://chat.example.com"
+	}
+	s.SetValue(cfg.Address)
 	s.Focus()
 	s.Prompt = ""
 	s.CharLimit = 64
@@ -139,6 +226,24 @@ func initialModel(cfg Config) mainModel {
 	p.TextStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#00D9FF"))
 	p.PlaceholderStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#6B7280"))
 
+	// Email input - optional, only needed to register on some servers
+	e := textinput.New()
+	e.Placeholder = "Email (optional)"
+	e.Prompt = ""
+	e.CharLimit = 64
+	e.Width = 44
+	e.TextStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#00D9FF"))
+	e.PlaceholderStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#6B7280"))
+
+	// Two-factor code input - six digits, or a recovery code like k3f9-x2mq
+	t := textinput.New()
+	t.Placeholder = "123456"
+	t.Prompt = ""
+	t.CharLimit = 9
+	t.Width = 12
+	t.TextStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#00D9FF"))
+	t.PlaceholderStyle = lipgloss.NewStyle().Foreground(lipgloss.Color("#6B7280"))
+
 	// Message input - textarea for multi-line support
 	mi := textarea.New()
 	mi.Placeholder = "Type your message..."
@@ -150,37 +255,71 @@ func initialModel(cfg Config) mainModel {
 	mi.FocusedStyle.Base = lipgloss.NewStyle().Foreground(lipgloss.Color("#FFFFFF"))
 	mi.BlurredStyle.Base = lipgloss.NewStyle().Foreground(lipgloss.Color("#6B7280"))
 
+	return serverTab{
+		id:                  id,
+		state:               state,
+		serverInput:         s,
+		userInput:           u,
+		passInput:           p,
+		emailInput:          e,
+		totpInput:           t,
+		msgInput:            mi,
+		messages:            []ChatMessage{},
+		typingUsers:         map[string]time.Time{},
+		userStatuses:        map[string]userStatus{},
+		displayColors:       map[string]lipgloss.Color{},
+		render:              newRenderCache(),
+		expandedBlocks:      map[string]bool{},
+		viewport:            viewport.New(80, 20),
+		currentChannel:      defaultChannel,
+		mentionCounts:       map[string]int{},
+		unreadCounts:        map[string]int{},
+		channelTopics:       map[string]string{},
+		autoScroll:          true,
+		channelCategories:   map[string][]string{},
+		collapsedCategories: map[string]bool{},
+		messageCache:        map[string][]ChatMessage{},
+		scrollPositions:     map[string]int{},
+		seenMsgIDs:          map[string]struct{}{},
+		streamingMessages:   map[string]*strings.Builder{},
+	}
+}
+
+func initialModel(cfg Config) mainModel {
 	// Spinner for loading animation
 	sp := spinner.New()
 	sp.Spinner = spinner.MiniDot
 	sp.Style = lipgloss.NewStyle().Foreground(lipgloss.Color("#7D56F4"))
 
 	return mainModel{
-		state:        loginView,
-		styles:       styles,
-		config:       cfg,
-		serverInput:  s,
-		userInput:    u,
-		passInput:    p,
-		msgInput:     mi,
-		spinner:      sp,
-		messages:     []ChatMessage{},
-		viewport:     viewport.New(80, 20),
-		showPassword: false,
-		animFrame:    0,
-		pulseFrame:   0,
+		styles:        InitStyles(cfg),
+		config:        cfg,
+		serverTab:     newServerTab(cfg, 0),
+		tabs:          make([]serverTab, 1),
+		nextTabID:     1,
+		spinner:       sp,
+		userColors:    map[string]lipgloss.Color{},
+		markdownCache: map[string]string{},
+		drafts:        loadDrafts(),
+		bookmarks:     loadBookmarks(),
+		notifyRules:   compileNotifyRules(cfg.Notify),
+		aliases:       loadAliases(cfg.Aliases),
 	}
 }
 
 func (m mainModel) Init() tea.Cmd {
-	return tea.Batch(textinput.Blink, m.spinner.Tick, animTick())
-}
-
-// Animation tick command
-func animTick() tea.Cmd {
-	return tea.Tick(time.Millisecond*150, func(t time.Time) tea.Msg {
-		return animTickMsg(t)
-	})
+	cmds := []tea.Cmd{textinput.Blink, m.animTick()}
+	if m.animated() {
+		cmds = append(cmds, m.spinner.Tick)
+	}
+	// Resuming the last session, see resumeSession
+	if m.isConnecting {
+		cmds = append(cmds, m.connectCmd())
+	}
+	if m.config.RelativeTime {
+		cmds = append(cmds, tickCmd())
+	}
+	return tea.Batch(cmds...)
 }
 
 func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
@@ -189,29 +328,183 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	switch msg := msg.(type) {
 	case tea.KeyMsg:
-		switch msg.Type {
-		case tea.KeyCtrlC, tea.KeyEsc:
-			if m.conn != nil {
-				m.conn.Close()
+		// Tab completes; any other key ends the completion
+		if m.state == chatView {
+			switch msg.String() {
+			case "tab":
+				m.complete(1)
+				return m, nil
+			case "shift+tab":
+				m.complete(-1)
+				return m, nil
+			}
+			m.resetCompletion()
+		}
+
+		if key := msg.String(); m.reconnecting && (key == "c" || key == "C") && m.msgInput.Value() == "" {
+			return m.cancelReconnect()
+		}
+
+		if m.savePrompt && m.state == chatView {
+			return m.answerSavePrompt(msg)
+		}
+
+		if m.pastePath != "" && m.state == chatView {
+			return m.answerPastePrompt(msg)
+		}
+		if msg.Paste && m.state == chatView && m.msgInput.Focused() {
+			return m.paste(msg)
+		}
+
+		if m.state == chatView && m.sidebarFocused && isSidebarKey(msg.String()) {
+			return m.sidebarKey(msg.String())
+		}
+
+		// Esc drops the reply we're writing before anything else it does
+		if m.state == chatView && m.replyToID != "" && !m.vimMode && msg.Type == tea.KeyEsc {
+			if m.thread != nil {
+				return m.toggleThread()
+			}
+			m.cancelReply()
+			return m, nil
+		}
+
+		// Vim mode: Esc leaves the input for normal mode, where letters
+		// navigate; other keys like Ctrl+C still work as usual
+		if m.state == chatView && m.config.VimMode {
+			if m.vimMode && msg.Type == tea.KeyCtrlB {
+				m.bookmarkBottom()
+				return m, nil
+			}
+			if m.vimMode && (msg.Type == tea.KeyRunes || msg.Type == tea.KeyEsc) {
+				return handleVimKey(m, msg)
 			}
+			if !m.vimMode && msg.Type == tea.KeyEsc {
+				m.enterNormalMode()
+				return m, nil
+			}
+		}
+
+		if m.state == wizardView {
+			return m.wizardKey(msg)
+		}
+
+		// Configurable bindings first, see Keybindings
+		keys := m.config.Keys
+		switch key := msg.String(); {
+		case m.state == serverSelectView && isServerSelectKey(key):
+			return m.selectServerKey(key)
+
+		case m.state == chatView && key == "ctrl+b":
+			return m, m.toggleSidebarFocus()
+
+		case m.state == searchView && key == "esc":
+			// Esc only leaves the search results
+			return m, m.closeSearch()
+
+		case m.state == pinboardView && key == "esc":
+			return m, m.closePinboard()
+
+		case m.state == pinboardView && key == "u":
+			return m, m.unpinSelected()
+
+		case m.state == bookmarkView && key == "esc":
+			return m, m.closeBookmarks()
+
+		case m.state == bookmarkView && key == "d":
+			m.deleteSelectedBookmark()
+			return m, nil
+
+		case m.state == totpView && key == "esc":
+			// Back to the login form, e.g. to use another account
+			m.state = loginView
+			m.err = nil
+			m.totpInput.Reset()
+			return m, nil
+
+		case m.export != nil && key == "ctrl+c":
+			// Ctrl+C stops a running export rather than quitting
+			return m, m.cancelExport()
+
+		case key == "ctrl+n" && keys.KeySwitchChannel != "ctrl+n":
+			// Unless switch_channel is still bound to it from before tabs
+			return m.newTab()
+
+		case key == "ctrl+left":
+			return m.cycleTab(-1)
+
+		case key == "ctrl+right":
+			return m.cycleTab(1)
+
+		case key == "ctrl+w":
+			return m.closeTab()
+
+		case key == "ctrl+c" || key == keys.KeyQuit:
+			m.disconnectAll()
 			return m, tea.Quit
 
+		case m.state == chatView && key == keys.KeySend:
+			return m.submitInput()
+
+		case (m.state == chatView || m.state == searchView || m.state == pinboardView || m.state == bookmarkView) && key == keys.KeyScrollUp:
+			m.viewport.PageUp()
+			m.followScroll()
+			return m, nil
+
+		case (m.state == chatView || m.state == searchView || m.state == pinboardView || m.state == bookmarkView) && key == keys.KeyScrollDown:
+			m.viewport.PageDown()
+			m.followScroll()
+			return m, nil
+
+		case m.state == chatView && key == " " && m.unreadSinceScroll > 0 && m.msgInput.Value() == "":
+			m.jumpToBottom()
+			return m, nil
+
+		case m.state == chatView && key == "e" && m.msgInput.Value() == "" && m.expandCodeBlock():
+			return m, nil
+
+		case m.state == chatView && key == "r" && m.msgInput.Value() == "" && m.lastFailed() != -1:
+			return m, m.retrySend(m.lastFailed())
+
+		case m.state == chatView && key == "?" && m.msgInput.Value() == "" && m.latencySamples > 0:
+			m.showLatencyHistory()
+			return m, nil
+
+		case m.state == chatView && key == "ctrl+t":
+			return m.toggleThread()
+
+		case m.state == chatView && key == "ctrl+y":
+			// Copies the newest message from someone else
+			if msg, ok := m.lastReceived(); ok {
+				return m, copyMessageCmd(msg)
+			}
+			return m, nil
+
+		case m.state == chatView && key == keys.KeySwitchChannel:
+			if next, ok := m.nextChannel(); ok {
+				return m.handleCommand("join", next)
+			}
+			return m, nil
+		}
+
+		switch msg.Type {
+
 		case tea.KeyTab, tea.KeyShiftTab:
 			if m.state == loginView {
 				if msg.Type == tea.KeyShiftTab {
 					m.focusIndex--
 					if m.focusIndex < 0 {
-						m.focusIndex = 4
+						m.focusIndex = focusCount - 1
 					}
 				} else {
-					m.focusIndex = (m.focusIndex + 1) % 5
+					m.focusIndex = (m.focusIndex + 1) % focusCount
 				}
 				cmds = append(cmds, m.updateFocus())
 			}
 
 		case tea.KeySpace:
 			// Space to toggle password visibility in login view
-			if m.state == loginView && m.focusIndex == 3 {
+			if m.state == loginView && m.focusIndex == focusToggle {
 				m.showPassword = !m.showPassword
 				if m.showPassword {
 					m.passInput.EchoMode = textinput.EchoNormal
@@ -229,8 +522,17 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				m.msgInput.InsertString("\n")
 				return m, nil
 			}
+			if m.state == searchView {
+				return m, m.jumpToSearchResult()
+			}
+			if m.state == bookmarkView {
+				return m, m.openSelectedBookmark()
+			}
+			if m.state == totpView {
+				return m.submitTotp()
+			}
 			if m.state == loginView {
-				if m.focusIndex == 3 {
+				if m.focusIndex == focusToggle {
 					// Toggle password visibility
 					m.showPassword = !m.showPassword
 					if m.showPassword {
@@ -240,94 +542,298 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					}
 					return m, nil
 				}
-				if m.focusIndex == 4 {
+				if m.focusIndex == focusConnect {
 					// Connect button pressed - switch to connecting view
 					m.state = connectingView
 					m.isConnecting = true
-					return m, tea.Batch(m.connectCmd(), animTick())
+					m.retryCount = 0
+					m.restarting = false
+					return m, tea.Batch(m.connectCmd(), m.animTick())
 				}
 				// Move to next field
-				m.focusIndex++
-				if m.focusIndex > 4 {
-					m.focusIndex = 0
-				}
+				m.focusIndex = (m.focusIndex + 1) % focusCount
 				cmds = append(cmds, m.updateFocus())
-			} else if m.state == chatView {
-				// Enter sends message in chat view
-				if strings.TrimSpace(m.msgInput.Value()) != "" {
-					msgToSend := m.msgInput.Value()
-					m.msgInput.Reset()
-					m.msgInput.SetHeight(1) // Reset to 1 line
-					return m, m.sendMessageCmd(msgToSend)
-				}
 			}
 
 		case tea.KeyCtrlU: // Ctrl+U to clear textarea (Unix-style)
 			if m.state == chatView {
 				m.msgInput.Reset()
 				m.msgInput.SetHeight(1)
+				m.editingID = "" // Also cancels editing
 				return m, nil
 			}
 
 		case tea.KeyUp, tea.KeyDown:
+			if m.state == searchView {
+				if msg.Type == tea.KeyUp {
+					m.moveSearchSelection(-1)
+				} else {
+					m.moveSearchSelection(1)
+				}
+				return m, nil
+			}
+			if m.state == pinboardView {
+				if msg.Type == tea.KeyUp {
+					m.movePinSelection(-1)
+				} else {
+					m.movePinSelection(1)
+				}
+				return m, nil
+			}
+			if m.state == bookmarkView {
+				if msg.Type == tea.KeyUp {
+					m.moveBookmarkSelection(-1)
+				} else {
+					m.moveBookmarkSelection(1)
+				}
+				return m, nil
+			}
 			if m.state == chatView {
+				// Up on an empty input recalls our last message for editing
+				if msg.Type == tea.KeyUp && m.msgInput.Value() == "" {
+					if last, ok := m.lastOwnMessage(); ok {
+						m.editingID = last.ID
+						m.msgInput.SetValue(last.Content)
+						return m, nil
+					}
+				}
 				// Let textarea handle up/down for cursor movement
 				// Use PageUp/PageDown for scrolling viewport
 			}
-		case tea.KeyPgUp, tea.KeyPgDown:
-			if m.state == chatView {
-				m.viewport, cmd = m.viewport.Update(msg)
-				cmds = append(cmds, cmd)
-			}
 		}
 
+	case tea.MouseMsg:
+		return m.handleMouse(msg)
+
+	case tabMsg:
+		return m.updateTab(msg)
+
 	case tea.WindowSizeMsg:
 		m.width = msg.Width
 		m.height = msg.Height
-
-		headerHeight := 3
-		inputHeight := 6 // Allow up to 5 lines for input
-		chatHeight := m.height - headerHeight - inputHeight - 4
-
-		m.viewport.Width = msg.Width - 4
-		m.viewport.Height = chatHeight
-		m.msgInput.SetWidth(msg.Width - 10)
+		m.resize()
 
 	case spinner.TickMsg:
-		m.spinner, cmd = m.spinner.Update(msg)
-		cmds = append(cmds, cmd)
+		// Left to stop with animations off; /animation starts it again
+		if m.animated() {
+			m.spinner, cmd = m.spinner.Update(msg)
+			cmds = append(cmds, cmd)
+		}
 
 	case animTickMsg:
-		// Update animation frames
-		m.animFrame = (m.animFrame + 1) % len(connectFrames)
-		m.pulseFrame = (m.pulseFrame + 1) % len(pulseFrames)
-		cmds = append(cmds, animTick())
+		// Update animation frames, which stay put with animations off
+		if m.animated() {
+			m.animFrame = (m.animFrame + 1) % len(connectFrames)
+			m.pulseFrame = (m.pulseFrame + 1) % len(pulseFrames)
+			m.animTicks++
+		}
+		m.limitFlash = max(m.limitFlash-1, 0)
+		m.alertFlash = max(m.alertFlash-1, 0)
+		m.pruneTyping()
+		if len(m.streamingMessages) > 0 && m.state == chatView && m.animated() {
+			m.animateStreams()
+		}
+		cmds = append(cmds, m.animTick(), m.fetchOlderAtTop())
 
 	case tickMsg:
+		// Keep relative times like "2m ago" current
+		if m.state == chatView {
+			m.viewport.SetContent(m.renderMessages())
+		}
 		cmds = append(cmds, tickCmd())
 
 	case errMsg:
+		if m.reconnecting && errors.Is(msg, ErrNotConnected) {
+			m.addSystemMessage("Not sent, still reconnecting")
+			m.viewport.SetContent(m.renderMessages())
+			return m, nil
+		}
+		if m.reconnecting {
+			m.reconnecting = false
+			m.resize()
+		}
 		m.err = msg
+		m.isConnecting = false
+		m.restarting = false
+		// Right password, but a code is needed - or the code was wrong
+		if errors.Is(msg, ErrTOTPRequired) || (m.state == connectingView && m.totpInput.Value() != "") {
+			if errors.Is(msg, ErrTOTPRequired) {
+				m.err = nil
+			}
+			m.state = totpView
+			m.totpInput.Reset()
+			return m, m.totpInput.Focus()
+		}
+		m.state = loginView
+		return m, nil
+
+	case kickedMsg:
+		// Shown on the login screen, which renders m.err in the error style
+		m.err = fmt.Errorf("removed from the server: %s", msg.reason)
 		m.state = loginView
 		m.isConnecting = false
+		m.restarting = false
+		m.conn = nil
+		return m, nil
+
+	case goingAwayMsg:
+		// Go through the usual retry flow, starting with the shortest delay
+		m.state = connectingView
+		m.isConnecting = true
+		m.restarting = true
+		m.retryCount = 0
+		m.msgInput.Blur()
+		return m, tea.Batch(m.animTick(), forTab(m.id, func() tea.Msg {
+			return progressMsg{attempt: 1, delay: retryDelay(0), err: ErrServerRestarting}
+		}))
+
+	case progressMsg:
+		m.retryCount = msg.attempt
+		m.nextRetryDelay = msg.delay
+		m.retryAt = time.Now().Add(msg.delay)
+		m.err = msg.err
+		return m, forTab(m.id, tea.Tick(msg.delay, func(time.Time) tea.Msg {
+			return retryConnectMsg{}
+		}))
+
+	case retryConnectMsg:
+		// The user may have quit the connecting screen meanwhile
+		if m.state == connectingView || m.reconnecting {
+			return m, m.connectCmd()
+		}
 		return m, nil
 
 	case wsMsg:
-		chatMsg := parseMessage(string(msg))
-		m.messages = append(m.messages, chatMsg)
+		var bell, reply tea.Cmd
+		if payload, ok := strings.CutPrefix(string(msg), "E2EKEY:"); ok {
+			reply = m.acceptPeerKey(payload)
+		} else if payload, ok := strings.CutPrefix(string(msg), "PERMISSION_DENIED:"); ok {
+			reply = m.permissionDenied(payload)
+		} else if !m.handleFrame(string(msg)) {
+			chatMsg := parseMessage(string(msg))
+			if chatMsg.Time.IsZero() {
+				chatMsg.Time = time.Now()
+			}
+			if chatMsg.Encrypted {
+				reply = m.decryptWhisper(&chatMsg)
+			}
+			chatMsg.HasMention = m.mentionsMe(chatMsg)
+			if chatMsg.DisplayColor != "" {
+				m.setDisplayColor(chatMsg.User, chatMsg.DisplayColor)
+			}
+			_, shown := m.seenMsgIDs[chatMsg.ID]
+			// A message still streaming isn't stored yet, so isn't there
+			// to replay; it counts as received once complete
+			if !chatMsg.Streaming {
+				m.trackReceived(chatMsg)
+			}
+			delete(m.typingUsers, chatMsg.User)
+			// What a replay showed already isn't added again
+			if !shown && !m.replaceEcho(chatMsg) {
+				m.messages = append(m.messages, chatMsg)
+				if !m.autoScroll {
+					m.unreadSinceScroll++
+				}
+				if chatMsg.Streaming {
+					m.startStream(chatMsg)
+				}
+			}
+			if chatMsg.IsAnnouncement {
+				bell = ringBell
+			} else if !shown && !chatMsg.Streaming {
+				bell = m.notifyCmd(chatMsg)
+			}
+		}
+		// Search results stay put while new messages arrive behind them
+		if m.state == chatView {
+			m.viewport.SetContent(m.renderMessages())
+			if m.autoScroll {
+				m.viewport.GotoBottom()
+			}
+		}
+		return m, tea.Batch(waitForIncomingMessage(m.id, m.conn), bell, reply)
+
+	case visualAlertMsg:
+		m.alertFlash = alertFlashTicks
+		return m, nil
+
+	case e2eKeyTimeoutMsg:
+		cmd := m.keyTimedOut(msg.peer)
+		m.viewport.SetContent(m.renderMessages())
+		if m.autoScroll {
+			m.viewport.GotoBottom()
+		}
+		return m, cmd
+
+	case connectionLostMsg:
+		return m.lostConnection(msg.err)
+
+	case probeResultMsg:
+		return m.probed(msg)
+
+	case copiedMsg:
+		return m.copied(msg)
+
+	case uploadTooLargeMsg:
+		return m.uploadTooLarge()
+
+	case pingMsg:
+		return m.handlePing(msg)
+
+	case pongCheckMsg:
+		return m.handlePongCheck(msg)
+
+	case deliveryTimeoutMsg:
+		return m.deliveryTimedOut(msg)
+
+	case statsMsg:
+		if msg.err != nil {
+			m.addOutcomeMessage("Couldn't get server stats: "+msg.err.Error(), outcomeError)
+		} else {
+			m.addSystemMessage(formatStats(msg.stats))
+		}
 		m.viewport.SetContent(m.renderMessages())
 		m.viewport.GotoBottom()
-		return m, waitForIncomingMessage(m.conn)
+		return m, nil
 
 	case connectedMsg:
+		slog.Info("connected", "server", msg.server, "username", m.userInput.Value(), "tab", m.id)
 		m.state = chatView
+		if m.reconnecting {
+			m.reconnecting = false
+			m.resize()
+		}
 		m.conn = msg.conn
+		m.heartbeat = startHeartbeat(msg.conn)
+		m.resetLatency()
+		m.serverAddr = msg.server
 		m.isConnecting = false
 		m.err = nil
+		m.retryCount = 0
+		m.restarting = false
+		m.maintenance = ""               // Over, since we got in
+		m.totpInput.Reset()              // Reconnects resume the session instead
 		m.username = m.userInput.Value() // Store username for message alignment
 		m.chatStartTime = time.Now()     // Start tracking for adaptive animation
 
+		// Offer to add a server we haven't saved, once per tab
+		if !m.saveOffered && !m.config.hasServer(msg.server) {
+			m.savePrompt = true
+		}
+		m.saveOffered = true
+
+		// A fresh key per connection, so peers exchange keys again
+		m.e2e = nil
+		if m.config.E2E {
+			if session, err := newE2ESession(); err == nil {
+				m.e2e = session
+			} else {
+				m.addSystemMessage(err.Error() + ", whispers will be unencrypted")
+			}
+		}
+
 		// Add animated welcome message
+		m.connectedMsgIndex = len(m.messages)
 		welcomeMsg := ChatMessage{
 			Timestamp: time.Now().Format("15:04"),
 			Content:   fmt.Sprintf("Successfully connected to %s", m.serverInput.Value()),
@@ -345,7 +851,22 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.viewport.SetContent(m.renderMessages())
 
 		m.msgInput.Focus()
-		return m, tea.Batch(waitForIncomingMessage(m.conn), textarea.Blink, animTick())
+		if draft := m.drafts[m.currentChannel]; draft != "" && m.msgInput.Value() == "" {
+			m.msgInput.SetValue(draft)
+		}
+		hb := m.heartbeat
+		cmds = append(cmds, waitForIncomingMessage(m.id, m.conn), textarea.Blink, m.animTick(), m.listChannelsCmd(),
+			forTab(m.id, func() tea.Msg { return pingMsg{hb: hb} }))
+
+		// Reconnected after having received messages - ask for what we missed
+		if m.lastReceivedMsgID != "" {
+			m.replaying, m.replaySeparated = true, false
+			cmds = append(cmds, m.reconnectCmd())
+		}
+		if m.thread != nil {
+			cmds = append(cmds, m.sendMessageCmd("THREAD:"+m.thread.parent.ID))
+		}
+		return m, tea.Batch(cmds...)
 
 	case clearInputMsg:
 		m.msgInput.SetValue("")
@@ -359,11 +880,18 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		cmds = append(cmds, cmd)
 		m.passInput, cmd = m.passInput.Update(msg)
 		cmds = append(cmds, cmd)
+		m.emailInput, cmd = m.emailInput.Update(msg)
+		cmds = append(cmds, cmd)
+	} else if m.state == totpView {
+		m.totpInput, cmd = m.totpInput.Update(msg)
+		cmds = append(cmds, cmd)
 	} else if m.state == chatView {
 		m.msgInput, cmd = m.msgInput.Update(msg)
 		cmds = append(cmds, cmd)
+		m.flashAtLimit(msg)
 		m.viewport, cmd = m.viewport.Update(msg)
 		cmds = append(cmds, cmd)
+		m.followScroll()
 
 		// Dynamic height adjustment for textarea (like WhatsApp)
 		// Count lines in current input
@@ -375,29 +903,96 @@ func (m mainModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			lines = 1
 		}
 		m.msgInput.SetHeight(lines)
+
+		// Let others know we're typing, at most once per second
+		if _, isKey := msg.(tea.KeyMsg); isKey && m.msgInput.Value() != "" &&
+			time.Since(m.lastTypingSent) >= typingSendInterval {
+			m.lastTypingSent = time.Now()
+			cmds = append(cmds, m.sendTypingCmd())
+		}
 	}
 
 	return m, tea.Batch(cmds...)
 }
 
+// submitInput sends the composed message, saves an edit, or runs a command
+func (m mainModel) submitInput() (mainModel, tea.Cmd) {
+	if strings.TrimSpace(m.msgInput.Value()) == "" {
+		return m, nil
+	}
+	msgToSend := m.msgInput.Value()
+	m.msgInput.Reset()
+	m.msgInput.SetHeight(1) // Reset to 1 line
+	m.jumpToBottom()        // Sending means we're following the chat again
+
+	if m.config.EmojiExpand && !strings.HasPrefix(msgToSend, "/") {
+		msgToSend = expandShortcodes(msgToSend)
+	}
+
+	if m.editingID != "" {
+		id := m.editingID
+		m.editingID = ""
+		return m, m.sendMessageCmd("EDIT:" + id + ":" + msgToSend)
+	}
+
+	// Slash commands are handled locally instead of being sent as chat
+	if name, args, isCmd := parseCommand(msgToSend); isCmd {
+		return m.handleCommand(name, args)
+	}
+	m.setDraft(m.currentChannel, "")
+	if m.replyToID != "" {
+		replyTo := m.replyToID
+		if m.thread == nil {
+			m.cancelReply() // Everything typed with a thread open replies to it
+		}
+		return m, m.sendPending(msgToSend, replyTo)
+	}
+	if isLegacyWhisper(msgToSend) {
+		return m, m.sendMessageCmd(msgToSend) // Whispers aren't shown in the channel
+	}
+	return m, m.sendPending(msgToSend, "")
+}
+
 func (m *mainModel) updateFocus() tea.Cmd {
-	inputs := []*textinput.Model{&m.serverInput, &m.userInput, &m.passInput}
+	inputs := map[int]*textinput.Model{
+		focusServer: &m.serverInput,
+		focusUser:   &m.userInput,
+		focusPass:   &m.passInput,
+		focusEmail:  &m.emailInput,
+	}
 
+	var cmd tea.Cmd
 	for i, input := range inputs {
 		if i == m.focusIndex {
-			return input.Focus()
+			cmd = input.Focus()
+			continue
 		}
 		input.Blur()
 	}
-	return nil
+	return cmd
 }
 
 func (m mainModel) View() string {
+	if len(m.tabs) < 2 {
+		return m.tabView()
+	}
+	m.height -= m.tabBarHeight()
+	return lipgloss.JoinVertical(lipgloss.Left, m.tabBar(), m.tabView())
+}
+
+// tabView renders the active tab
+func (m mainModel) tabView() string {
 	switch m.state {
 	case loginView:
 		return m.loginView()
+	case serverSelectView:
+		return m.serverSelectView()
 	case connectingView:
 		return m.connectingView()
+	case totpView:
+		return m.totpView()
+	case wizardView:
+		return m.wizardView()
 	default:
 		return m.chatViewRender()
 	}
@@ -433,7 +1028,7 @@ func (m mainModel) loginView() string {
 	}
 
 	// Animated subtitle with pulse
-	pulse := pulseFrames[m.pulseFrame]
+	pulse := m.pulseDot()
 	subtitleStyle := lipgloss.NewStyle().
 		Foreground(lipgloss.Color("#6B7280")).
 		Italic(true).
@@ -451,33 +1046,33 @@ func (m mainModel) loginView() string {
 
 	// Server field
 	serverIndicator := "  "
-	if m.focusIndex == 0 {
+	if m.focusIndex == focusServer {
 		serverIndicator = "> "
 	}
 	serverLabel := labelStyle.Render(serverIndicator + IconServer + " Server")
-	serverBorder := m.getInputStyle(0)
+	serverBorder := m.getInputStyle(focusServer)
 	b.WriteString(serverLabel + "\n")
 	b.WriteString(serverBorder.Render(m.serverInput.View()))
 	b.WriteString("\n\n")
 
 	// Username field
 	userIndicator := "  "
-	if m.focusIndex == 1 {
+	if m.focusIndex == focusUser {
 		userIndicator = "> "
 	}
 	userLabel := labelStyle.Render(userIndicator + IconUser + " Username")
-	userBorder := m.getInputStyle(1)
+	userBorder := m.getInputStyle(focusUser)
 	b.WriteString(userLabel + "\n")
 	b.WriteString(userBorder.Render(m.userInput.View()))
 	b.WriteString("\n\n")
 
 	// Password field
 	passIndicator := "  "
-	if m.focusIndex == 2 {
+	if m.focusIndex == focusPass {
 		passIndicator = "> "
 	}
 	passLabel := labelStyle.Render(passIndicator + IconLock + " Password")
-	passBorder := m.getInputStyle(2)
+	passBorder := m.getInputStyle(focusPass)
 	b.WriteString(passLabel + "\n")
 	b.WriteString(passBorder.Render(m.passInput.View()))
 	b.WriteString("\n")
@@ -487,7 +1082,7 @@ func (m mainModel) loginView() string {
 		Foreground(lipgloss.Color("#6B7280")).
 		Width(50).
 		Align(lipgloss.Center)
-	if m.focusIndex == 3 {
+	if m.focusIndex == focusToggle {
 		toggleStyle = toggleStyle.
 			Foreground(lipgloss.Color("#00D9FF")).
 			Bold(true)
@@ -500,6 +1095,17 @@ func (m mainModel) loginView() string {
 	b.WriteString(toggleStyle.Render(toggleText))
 	b.WriteString("\n\n")
 
+	// Email field - optional, used when registering
+	emailIndicator := "  "
+	if m.focusIndex == focusEmail {
+		emailIndicator = "> "
+	}
+	emailLabel := labelStyle.Render(emailIndicator + IconMail + " Email (optional)")
+	emailBorder := m.getInputStyle(focusEmail)
+	b.WriteString(emailLabel + "\n")
+	b.WriteString(emailBorder.Render(m.emailInput.View()))
+	b.WriteString("\n\n")
+
 	// Fancy Connect Button with animation
 	button := m.renderConnectButton()
 	buttonContainer := lipgloss.NewStyle().
@@ -552,9 +1158,9 @@ func (m mainModel) loginView() string {
 
 func (m mainModel) renderConnectButton() string {
 	// Create fancy multi-line button with border art
-	if m.focusIndex == 4 {
+	if m.focusIndex == focusConnect {
 		// Focused state - animated and colorful
-		pulse := pulseFrames[m.pulseFrame]
+		pulse := m.pulseDot()
 
 		topBorder := lipgloss.NewStyle().
 			Foreground(m.styles.SecondaryColor).
@@ -608,7 +1214,7 @@ func (m mainModel) connectingView() string {
 	var b strings.Builder
 
 	// Enhanced animated connecting view
-	frame := connectFrames[m.animFrame]
+	frame := m.connectFrame()
 
 	// Animated title with gradient
 	titleStyle := lipgloss.NewStyle().
@@ -622,7 +1228,7 @@ func (m mainModel) connectingView() string {
 		Bold(true)
 	animation := animationStyle.Render(frame)
 
-	spinnerView := m.spinner.View()
+	spinnerView := m.spinnerView()
 
 	// Enhanced connection info display
 	infoStyle := lipgloss.NewStyle().
@@ -633,9 +1239,13 @@ func (m mainModel) connectingView() string {
 		Foreground(m.styles.PrimaryColor).
 		Bold(true).
 		Render("Server:")
+	serverText := m.serverInput.Value()
+	if m.usesTLS() {
+		serverText = IconLock + " " + serverText
+	}
 	serverValue := lipgloss.NewStyle().
 		Foreground(lipgloss.Color("#E5E7EB")).
-		Render(m.serverInput.Value())
+		Render(serverText)
 
 	userLabel := lipgloss.NewStyle().
 		Foreground(m.styles.PrimaryColor).
@@ -645,6 +1255,19 @@ func (m mainModel) connectingView() string {
 		Foreground(lipgloss.Color("#E5E7EB")).
 		Render(m.userInput.Value())
 
+	info := "Establishing secure connection..."
+	if m.restarting {
+		info = "Server restarting…"
+		if wait := time.Until(m.retryAt).Round(time.Second); wait > 0 {
+			info = fmt.Sprintf("Server restarting… reconnecting in %s", wait)
+		}
+	} else if m.retryCount > 0 {
+		info = fmt.Sprintf("Retrying… (attempt %d/%d)", m.retryCount, m.config.MaxRetries)
+		if wait := time.Until(m.retryAt).Round(time.Second); wait > 0 {
+			info = fmt.Sprintf("Retrying in %s… (attempt %d/%d)", wait, m.retryCount, m.config.MaxRetries)
+		}
+	}
+
 	content := fmt.Sprintf(`
     %s %s
 
@@ -657,7 +1280,7 @@ func (m mainModel) connectingView() string {
 		spinnerView,
 		title,
 		animation,
-		infoStyle.Render("Establishing secure connection..."),
+		infoStyle.Render(info),
 		serverLabel, serverValue,
 		userLabel, userValue,
 	)
@@ -675,9 +1298,21 @@ func (m mainModel) connectingView() string {
 	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, b.String())
 }
 
+// usesTLS reports whether the server address will be dialed with wss://
+func (m mainModel) usesTLS() bool {
+	return serverEndpoint(m.serverInput.Value(), m.config.TLS).Scheme == "wss"
+}
+
 func (m mainModel) chatViewRender() string {
 	var b strings.Builder
 
+	if m.reconnecting {
+		b.WriteString(m.reconnectBanner() + "\n")
+	}
+	if m.maintenance != "" {
+		b.WriteString(m.maintenanceBanner() + "\n")
+	}
+
 	// Clean, modern header with dark background
 	accentColor := m.styles.PrimaryColor
 	headerBg := lipgloss.Color("#0D1117") // Dark background
@@ -708,8 +1343,15 @@ func (m mainModel) chatViewRender() string {
 	statusTextStyle := lipgloss.NewStyle().
 		Foreground(lipgloss.Color("#00FF88"))
 
-	onlineDot := statusDotStyle.Render(pulseFrames[m.pulseFrame])
-	statusText := statusTextStyle.Render("ONLINE")
+	statusLabel := "ONLINE"
+	if m.reconnecting {
+		statusDotStyle = statusDotStyle.Foreground(errorColor)
+		statusTextStyle = statusTextStyle.Foreground(errorColor)
+		statusLabel = "OFFLINE"
+	}
+
+	onlineDot := statusDotStyle.Render(m.pulseDot())
+	statusText := statusTextStyle.Render(statusLabel)
 	statusSection := onlineDot + " " + statusText
 
 	// User info - right side
@@ -728,6 +1370,15 @@ func (m mainModel) chatViewRender() string {
 	centerPart := statusSection
 	rightPart := username + sessionInfo
 
+	// Channel and its topic after the status, in whatever room is left
+	centerPart += "   " + appNameStyle.Render("#"+m.currentChannel)
+	if topic := m.channelTopics[m.currentChannel]; topic != "" {
+		room := m.width - 4 - lipgloss.Width(leftPart+centerPart+rightPart) - 8 - 3
+		if room >= 10 {
+			centerPart += lipgloss.NewStyle().Foreground(dimFg).Render(" | " + m.topicMarquee(topic, min(room, topicWidth)))
+		}
+	}
+
 	// Calculate widths
 	leftWidth := lipgloss.Width(leftPart)
 	centerWidth := lipgloss.Width(centerPart)
@@ -778,35 +1429,67 @@ func (m mainModel) chatViewRender() string {
 	var bottomIndicator string
 
 	// Check if scrolled from top
-	if m.viewport.YOffset > 0 {
+	if m.historyFetching > 0 {
+		topIndicator = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("#6B7280")).
+			Italic(true).
+			Width(m.width - 4 - m.sidebarWidth()).
+			Render(" " + m.spinnerView() + " Loading older messages…")
+	} else if m.viewport.YOffset > 0 {
 		topIndicator = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("#6B7280")).
 			Italic(true).
 			Align(lipgloss.Center).
-			Width(m.width - 4).
+			Width(m.width - 4 - m.sidebarWidth()).
 			Render("↑ More messages above")
 	}
 
 	// Check if not at bottom (simplified - if there's more content)
 	totalLines := len(strings.Split(m.renderMessages(), "\n"))
 	visibleLines := m.viewport.Height
-	if m.viewport.YOffset+visibleLines < totalLines-2 {
+	if m.unreadSinceScroll > 0 {
+		label := fmt.Sprintf("↓ %d new messages", m.unreadSinceScroll)
+		if m.unreadSinceScroll == 1 {
+			label = "↓ 1 new message"
+		}
+		badge := lipgloss.NewStyle().
+			Foreground(lipgloss.Color("#FFFFFF")).
+			Background(m.styles.PrimaryColor).
+			Bold(true).
+			Padding(0, 1).
+			Render(label)
+		bottomIndicator = lipgloss.Place(m.width-4-m.sidebarWidth(), 1, lipgloss.Center, lipgloss.Bottom, badge)
+	} else if m.viewport.YOffset+visibleLines < totalLines-2 {
 		bottomIndicator = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("#6B7280")).
 			Italic(true).
 			Align(lipgloss.Center).
-			Width(m.width - 4).
+			Width(m.width - 4 - m.sidebarWidth()).
 			Render("↓ More messages below")
 	}
 
+	var chatBorderColor lipgloss.TerminalColor = lipgloss.Color("#3B4252")
+	if m.alertFlash > 0 {
+		chatBorderColor = m.styles.ButtonFocus.GetBackground() // Lit by a notify rule
+	}
 	chatBorder := lipgloss.NewStyle().
 		Border(lipgloss.RoundedBorder()).
-		BorderForeground(lipgloss.Color("#3B4252")).
-		Width(m.width-4).
+		BorderForeground(chatBorderColor).
+		Width(m.width-4-m.sidebarWidth()).
 		Height(m.viewport.Height+2).
 		Padding(0, 1)
 
 	chatBox := chatBorder.Render(chatContent)
+	if len(m.completions) > 0 {
+		// Float the candidates just above the input box
+		popup := m.renderCompletionPopup()
+		chatBox = overlay(chatBox, popup, 2, lipgloss.Height(chatBox)-lipgloss.Height(popup)-1)
+	}
+	if m.thread != nil {
+		chatBox = lipgloss.JoinHorizontal(lipgloss.Top, chatBox, m.renderThreadPanel(m.viewport.Height+4))
+	} else if m.sidebarWidth() > 0 {
+		chatBox = lipgloss.JoinHorizontal(lipgloss.Top, chatBox, m.renderSidebar(m.viewport.Height+4))
+	}
 
 	// Add indicators if present
 	if topIndicator != "" {
@@ -838,6 +1521,9 @@ func (m mainModel) chatViewRender() string {
 			inputBorderColor = "#3B4252"
 		}
 	}
+	if m.limitFlash > 0 {
+		inputBorderColor = string(errorColor)
+	}
 
 	inputStyle := lipgloss.NewStyle().
 		Border(lipgloss.RoundedBorder()).
@@ -845,37 +1531,201 @@ func (m mainModel) chatViewRender() string {
 		Width(m.width-4).
 		Padding(0, 1)
 
-	b.WriteString(inputStyle.Render(m.msgInput.View()))
+	input := m.msgInput.View()
+	if m.export != nil {
+		input = m.exportProgressView(m.width - 8)
+	} else {
+		input = m.withCounter(input, m.width-6)
+	}
+	if m.replyToID != "" {
+		b.WriteString(m.replyBanner() + "\n")
+	}
+	b.WriteString(inputStyle.Render(input))
+	b.WriteString("\n")
+
+	// Typing indicator line, kept even when empty so the layout doesn't jump
+	status := m.typingText()
+	if m.editingID != "" {
+		status = "Editing your message - [Enter] Save | [Ctrl+U] Cancel"
+	}
+	if m.savePrompt {
+		status = "Save this server? [y/N]"
+	}
+	if m.pastePath != "" {
+		status = "Send file? [y/N] " + m.pastePath
+	}
+	if status == "" && m.pasteNotice != "" && time.Now().Before(m.pasteNoticeUntil) {
+		b.WriteString(" " + m.styles.InlineHint(m.pasteNotice))
+	} else {
+		b.WriteString(m.styles.Subtitle.Render(" " + status))
+	}
 	b.WriteString("\n")
 
 	// Enhanced footer with better styling
-	footerContent := " [Enter] Send | [Alt+Enter] New Line | [PgUp/PgDn] Scroll | [Ctrl+U] Clear | [Esc] Quit"
+	keys := m.config.Keys
+	scroll := keyLabel(keys.KeyScrollUp) + "/" + keyLabel(keys.KeyScrollDown)
+	quit := keyLabel(keys.KeyQuit)
+	if m.config.VimMode && keys.KeyQuit == "esc" {
+		quit = "Ctrl+C" // Esc enters normal mode instead
+	}
+	footerContent := fmt.Sprintf(" [%s] Send | [Alt+Enter] New Line | [%s] Scroll | [Ctrl+U] Clear | [%s] Quit",
+		keyLabel(keys.KeySend), scroll, quit)
+	if m.vimMode {
+		footerContent = " [N] [j/k] Scroll | [gg/G] Top/Bottom | [r] Reply | [y] Copy | [Ctrl+B] Bookmark | [/] Search | [i] Insert"
+	}
+	if m.statusMsg != "" && time.Now().Before(m.statusUntil) {
+		footerContent = " " + m.statusMsg
+		if m.vimMode {
+			footerContent = " [N] " + m.statusMsg
+		}
+	}
+	if m.state == searchView {
+		footerContent = fmt.Sprintf(" [↑/↓] Select | [Enter] Jump to message | [%s] Scroll | [Esc] Back to chat", scroll)
+	}
+	if m.state == pinboardView {
+		footerContent = fmt.Sprintf(" [↑/↓] Select | [u] Unpin | [%s] Scroll | [Esc] Back to chat", scroll)
+	}
+	if m.state == bookmarkView {
+		footerContent = fmt.Sprintf(" [↑/↓] Select | [Enter] Go to message | [d] Delete | [%s] Scroll | [Esc] Back to chat", scroll)
+	}
+	if m.statusMsg != "" && time.Now().Before(m.statusUntil) && m.state == bookmarkView {
+		footerContent = " " + m.statusMsg
+	}
+	if m.sidebarFocused && m.state == chatView {
+		footerContent = " [↑/↓] Select | [Enter] Join channel or fold category | [Esc/Ctrl+B] Back to typing"
+	}
 	footerStyle := lipgloss.NewStyle().
 		Foreground(lipgloss.Color("#6B7280")).
 		Italic(true).
 		Background(lipgloss.Color("#0D1117")).
 		Padding(0, 1)
-	b.WriteString(footerStyle.Render(footerContent))
+	b.WriteString(m.latencyIndicator() + footerStyle.Render(footerContent))
 
 	return b.String()
 }
 
-func (m mainModel) getInputStyle(index int) lipgloss.Style {
-	baseWidth := 50
-	if m.focusIndex == index {
-		// Enhanced animated glow effect with theme colors
-		glowColors := []string{
-			string(m.styles.SecondaryColor),
-			string(m.styles.PrimaryColor),
-			string(m.styles.SecondaryColor),
+// followScroll turns following new messages off when the user scrolls up,
+// and back on once they are at the bottom again
+func (m *mainModel) followScroll() {
+	m.autoScroll = m.viewport.AtBottom()
+	if m.autoScroll {
+		m.unreadSinceScroll = 0
+	}
+}
+
+// jumpToBottom scrolls to the newest message and follows new ones again
+func (m *mainModel) jumpToBottom() {
+	m.viewport.GotoBottom()
+	m.autoScroll = true
+	m.unreadSinceScroll = 0
+}
+
+// pruneTyping forgets users we haven't heard typing from in a while
+func (m *mainModel) pruneTyping() {
+	for name, at := range m.typingUsers {
+		if time.Since(at) > typingTimeout {
+			delete(m.typingUsers, name)
 		}
-		colorIdx := m.animFrame % len(glowColors)
-		return lipgloss.NewStyle().
-			Border(lipgloss.RoundedBorder()).
-			BorderForeground(lipgloss.Color(glowColors[colorIdx])).
-			Background(lipgloss.Color("#0D1117")).
-			Width(baseWidth).
-			Padding(0, 1)
+	}
+}
+
+// typingText describes who is typing, e.g. "alice, bob are typing…"
+func (m mainModel) typingText() string {
+	names := make([]string, 0, len(m.typingUsers))
+	for name := range m.typingUsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	switch {
+	case len(names) == 0:
+		return ""
+	case len(names) == 1:
+		return names[0] + " is typing…"
+	case len(names) == 2:
+		return strings.Join(names, ", ") + " are typing…"
+	default:
+		return fmt.Sprintf("%d users are typing…", len(names))
+	}
+}
+
+// resize fits the chat to the window, leaving room for the tab bar
+func (m *mainModel) resize() {
+	headerHeight := 3
+	inputHeight := 6  // Allow up to 5 lines for input
+	typingHeight := 1 // "alice is typing…" line under the input
+	chatHeight := m.height - m.tabBarHeight() - m.reconnectBannerHeight() - m.maintenanceBannerHeight() - m.replyBannerHeight() - headerHeight - inputHeight - typingHeight - 4
+
+	m.viewport.Width = m.width - 4 - m.sidebarWidth()
+	m.viewport.Height = chatHeight
+	m.msgInput.SetWidth(m.width - 10 - m.counterWidth())
+
+	// The panel's title and parent take two lines
+	if m.thread != nil {
+		m.thread.viewport.Width = m.threadPanelWidth() - 4
+		m.thread.viewport.Height = chatHeight
+		m.refreshThread()
+	}
+}
+
+// sidebarWidth is the width taken by the right sidebar, or the thread panel
+// in its place, 0 when it is hidden
+func (m mainModel) sidebarWidth() int {
+	if m.thread != nil {
+		return m.threadPanelWidth()
+	}
+	if !m.config.ShowSidebar || m.width < sidebarMinTermSize {
+		return 0
+	}
+	return sidebarWidth
+}
+
+// renderSidebar stacks the sidebar panels to the given total height
+func (m mainModel) renderSidebar(height int) string {
+	channels := m.renderChannels()
+	users := m.renderOnlineUsers(max(height-lipgloss.Height(channels), 3))
+	return lipgloss.JoinVertical(lipgloss.Left, channels, users)
+}
+
+// renderOnlineUsers renders the bordered "Online Users" panel
+func (m mainModel) renderOnlineUsers(height int) string {
+	innerWidth := sidebarWidth - 4 // Border and padding
+
+	var b strings.Builder
+	b.WriteString(m.styles.User.Render(fmt.Sprintf("Online Users (%d)", len(m.onlineUsers))))
+	for _, name := range m.onlineUsers {
+		row := m.statusIcon(name) + " " + name
+		if message := m.userStatuses[name].message; message != "" {
+			row += " " + m.styles.InlineHint(message)
+		}
+		b.WriteString("\n" + lipgloss.NewStyle().MaxWidth(innerWidth).Render(row))
+	}
+
+	return lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(lipgloss.Color("#3B4252")).
+		Width(sidebarWidth-2).
+		Height(height-2).
+		Padding(0, 1).
+		Render(b.String())
+}
+
+func (m mainModel) getInputStyle(index int) lipgloss.Style {
+	baseWidth := 50
+	if m.focusIndex == index {
+		// Enhanced animated glow effect with theme colors
+		glowColors := []string{
+			string(m.styles.SecondaryColor),
+			string(m.styles.PrimaryColor),
+			string(m.styles.SecondaryColor),
+		}
+		colorIdx := m.animFrame % len(glowColors)
+		return lipgloss.NewStyle().
+			Border(lipgloss.RoundedBorder()).
+			BorderForeground(lipgloss.Color(glowColors[colorIdx])).
+			Background(lipgloss.Color("#0D1117")).
+			Width(baseWidth).
+			Padding(0, 1)
 	}
 	return lipgloss.NewStyle().
 		Border(lipgloss.RoundedBorder()).
@@ -885,7 +1735,14 @@ func (m mainModel) getInputStyle(index int) lipgloss.Style {
 }
 
 func (m mainModel) renderMessages() string {
-	var lines []string
+	lines, _ := m.renderMessageLines()
+	return m.render.join(lines)
+}
+
+// renderMessageLines renders the chat as blocks of text, along with the index
+// of the first block belonging to each message, or -1 for replies collapsed
+// into their ancestor's "[+N nested replies]"
+func (m mainModel) renderMessageLines() (lines []string, starts []int) {
 
 	// Warn: viewport.Width might be 0 initially
 	width := m.viewport.Width
@@ -896,90 +1753,680 @@ func (m mainModel) renderMessages() string {
 	if wrapWidth < 20 {
 		wrapWidth = 20
 	}
+
+	// Relative times change as messages age, so nothing stays rendered
+	if m.config.RelativeTime {
+		m.render.reset()
+	}
+	m.render.prepare(renderSettings{width, m.username, m.config.ThemeConfig, m.config.LayoutConfig}, len(m.messages))
+	defer m.render.done(len(m.messages))
+
+	order, depths := threadOrder(m.messages)
+	lines = make([]string, 0, len(m.messages))
+	starts = make([]int, len(m.messages))
+	for pos, i := range order {
+		msg := &m.messages[i]
+		key := renderKey{
+			id:        msg.ID,
+			clientID:  msg.ClientID,
+			timestamp: msg.Timestamp,
+			content:   msg.Content,
+			edited:    msg.Edited,
+			deleted:   msg.Deleted,
+			mention:   msg.HasMention,
+			delivery:  msg.Delivery,
+			expanded:  len(m.expandedBlocks) > 0 && m.blocksExpanded(*msg),
+			depth:     depths[i],
+		}
+		if key.depth > maxReplyDepth {
+			starts[i] = -1
+			continue
+		}
+		if key.depth == maxReplyDepth {
+			key.nested = nestedBelow(order, depths, pos)
+		}
+		if m.config.CompactMode && pos > 0 {
+			prev := m.messages[order[pos-1]]
+			key.gap = msg.Time.Sub(prev.Time) > compactGapSeparator && !prev.Time.IsZero()
+			key.continued = depths[order[pos-1]] == key.depth && isContinuation(prev, *msg)
+		}
+
+		entry, ok := m.render.lookup(i, &key)
+		if !ok {
+			entry = m.render.store(i, m.renderEntry(i, key, wrapWidth))
+		}
+		starts[i] = len(lines) + entry.start
+		lines = append(lines, entry.lines...)
+	}
+
+	return lines, starts
+}
+
+// renderEntry renders message i as its blocks of text, placed as key says
+func (m mainModel) renderEntry(i int, key renderKey, wrapWidth int) renderEntry {
+	entry := renderEntry{key: key}
+	if key.gap {
+		entry.lines = append(entry.lines, m.styles.Separator.
+			Width(wrapWidth).
+			Align(lipgloss.Center).
+			Render("── "+m.messages[i].Time.Local().Format("15:04")+" ──"))
+		entry.start = 1
+	}
+
+	blocks := m.renderMessage(i, max(wrapWidth-2*key.depth, 20), key.continued)
+	if key.depth == 0 {
+		entry.lines = append(entry.lines, blocks...)
+		return entry
+	}
+
+	// Replies are indented under their parent behind a bar per level
+	bar := m.styles.Separator.Render(strings.Repeat("│ ", key.depth))
+	for _, block := range blocks {
+		blockLines := strings.Split(block, "\n")
+		for j := range blockLines {
+			blockLines[j] = bar + blockLines[j]
+		}
+		entry.lines = append(entry.lines, strings.Join(blockLines, "\n"))
+	}
+	if key.nested > 0 {
+		entry.lines = append(entry.lines, bar+m.styles.InlineHint(fmt.Sprintf("[+%d nested replies]", key.nested)))
+	}
+	return entry
+}
+
+// renderMessage renders message i as blocks of text wrapped to wrapWidth.
+// Continued messages leave out the time and name, lined up under the
+// message before.
+func (m mainModel) renderMessage(i int, wrapWidth int, continued bool) (lines []string) {
+	msg := m.messages[i]
 	wrapper := lipgloss.NewStyle().Width(wrapWidth)
+	header := func(timestamp, user string) string {
+		if continued {
+			return strings.Repeat(" ", lipgloss.Width(timestamp)+2+lipgloss.Width(user))
+		}
+		return timestamp + "  " + user
+	}
 
-	for i, msg := range m.messages {
-		if msg.IsSystem {
-			// Clean system message styling
-			prefix := "◆"
-			if i == len(m.messages)-1 {
-				prefix = pulseFrames[m.pulseFrame]
-			}
+	if msg.IsSeparator {
+		separator := m.styles.Separator.
+			Width(wrapWidth).
+			Align(lipgloss.Center).
+			Render(msg.Content)
+		lines = append(lines, separator)
+	} else if msg.IsSystem {
+		// Clean system message styling
+		prefix := "◆"
+		if i == len(m.messages)-1 {
+			prefix = m.pulseDot()
+		}
 
-			sysStyle := lipgloss.NewStyle().
-				Foreground(lipgloss.Color("#00FF88")).
-				Italic(true)
-
-			var line string
-			if msg.User != "" {
-				// User-specific system message
-				userStyle := lipgloss.NewStyle().
-					Foreground(m.styles.PrimaryColor).
-					Bold(true)
-				// Check if it's a welcome message or join/leave
-				if msg.Content == "You can start chatting now." {
-					// Format: ◎ Welcome, Alice! You can start chatting now.
-					line = sysStyle.Render("  "+prefix+" Welcome, ") + userStyle.Render(msg.User+"!") + sysStyle.Render(" "+msg.Content)
-				} else {
-					// Join/leave messages
-					line = sysStyle.Render("  "+prefix+" ") + userStyle.Render(msg.User) + sysStyle.Render(" "+msg.Content)
-				}
+		sysStyle := lipgloss.NewStyle().
+			Foreground(lipgloss.Color("#00FF88")).
+			Italic(true)
+		switch msg.Outcome {
+		case outcomeSuccess:
+			sysStyle = m.styles.Success
+		case outcomeError:
+			sysStyle = m.styles.Error.UnsetPadding()
+		}
+
+		var line string
+		if msg.User != "" {
+			// User-specific system message
+			userStyle := lipgloss.NewStyle().
+				Foreground(m.styles.PrimaryColor).
+				Bold(true)
+			// Check if it's a welcome message or join/leave
+			if msg.Content == "You can start chatting now." {
+				// Format: ◎ Welcome, Alice! You can start chatting now.
+				line = sysStyle.Render("  "+prefix+" Welcome, ") + userStyle.Render(msg.User+"!") + sysStyle.Render(" "+msg.Content)
 			} else {
-				line = sysStyle.Render("  " + prefix + " " + msg.Content)
+				// Join/leave messages
+				line = sysStyle.Render("  "+prefix+" ") + userStyle.Render(msg.User) + sysStyle.Render(" "+msg.Content)
 			}
+		} else {
+			line = sysStyle.Render("  " + prefix + " " + msg.Content)
+		}
 
-			lines = append(lines, wrapper.Render(line))
-		} else if msg.IsPrivate {
-			// Private/whisper message - use distinct styling
-			privStyle := lipgloss.NewStyle().
-				Foreground(m.styles.PrivMsgColor).
-				Italic(true)
+		lines = append(lines, wrapper.Render(line))
+	} else if msg.IsMotd {
+		box := lipgloss.NewStyle().
+			Border(lipgloss.DoubleBorder()).
+			BorderForeground(successColor).
+			Inherit(m.styles.Success).
+			Padding(0, 1).
+			Width(wrapWidth - 2).
+			Align(lipgloss.Center).
+			Render(msg.Content)
+		lines = append(lines, box)
+	} else if msg.IsAnnouncement {
+		// Width excludes the border, so the box spans the wrap width
+		box := lipgloss.NewStyle().
+			Border(lipgloss.DoubleBorder()).
+			BorderForeground(errorColor).
+			Foreground(errorColor).
+			Bold(true).
+			Padding(0, 1).
+			Width(wrapWidth - 2).
+			Render("📢 " + msg.Content)
+		lines = append(lines, box)
+	} else if msg.Poll != nil {
+		lines = append(lines, m.renderPoll(msg.Poll, wrapWidth-2))
+	} else if msg.FileURL != "" {
+		timestamp := m.styles.DateTime.Render(fmt.Sprintf("[%s]", m.displayTime(msg)))
+		link := m.styles.Msg.Render(hyperlink(msg.FileURL, IconFile+" "+msg.Content))
+		size := m.styles.InlineHint("(" + formatBytes(msg.FileSize) + ")")
+		lines = append(lines, wrapper.Render(fmt.Sprintf("%s  %s %s", timestamp, link, size)))
+	} else if msg.IsPrivate {
+		// Private/whisper message - use distinct styling
+		timestamp := m.styles.DateTime.Render(fmt.Sprintf("[%s]", m.displayTime(msg)))
+		label := "[DM from " + msg.User + "]"
+		if msg.To != "" {
+			label = "[DM to " + msg.To + "]"
+		}
+		whisperLabel := lipgloss.NewStyle().
+			Foreground(m.styles.PrivMsgColor).
+			Bold(true).
+			Render(label)
+		if msg.Encrypted {
+			whisperLabel += " [" + IconLock + "]"
+		}
+		content := m.renderText(msg.Content, m.styles.PrivMsg) + m.deliveryMark(msg)
 
-			timestamp := m.styles.DateTime.Render(fmt.Sprintf("[%s]", msg.Timestamp))
-			whisperLabel := privStyle.Render("[WHISPER]")
+		messageLine := fmt.Sprintf("%s %s %s", timestamp, whisperLabel, content)
+		lines = append(lines, wrapper.Render(messageLine))
+	} else {
+		// Regular chat message formatting
+		isOwnMessage := msg.User == m.username
+
+		// Format components with proper styling
+		timestamp := m.styles.DateTime.Render(fmt.Sprintf("[%s]", m.displayTime(msg)))
+		var guestTag string
+		if isGuestName(msg.User) {
+			guestTag = m.styles.InlineHint("[guest]") + " "
+		}
+		name := msg.User
+		if msg.User == webhookSender {
+			guestTag = m.styles.InlineHint("[BOT]") + " "
+			if msg.Bot != "" {
+				name = msg.Bot
+			}
+		}
+		if msg.Ephemeral && m.config.ShowEphemeralBadge {
+			guestTag += m.styles.InlineHint("[ephemeral]") + " "
+		}
+		user := guestTag + m.userStyle(msg.User).Render(name+":")
+		content := m.renderText(msg.Content, m.styles.Msg)
+
+		if msg.Edited {
+			content += " " + m.styles.InlineHint("(edited)")
+		}
+		if msg.Streaming && msg.Content == "" {
+			content = m.streamingPlaceholder()
+		} else if msg.Streaming {
+			content += " " + m.streamingPlaceholder()
+		}
+		if msg.Deleted {
+			lines = append(lines, wrapper.Render(header(timestamp, user)+" "+m.styles.InlineHint("[message deleted]")))
+			return lines
+		}
+
+		if m.config.Markdown && hasMarkdown(msg.Content) && !msg.Streaming {
+			if isOwnMessage {
+				user = guestTag + lipgloss.NewStyle().Foreground(m.styles.PrimaryColor).Bold(true).Render(msg.User+":")
+			}
+			lines = append(lines, m.markdownMessage(timestamp, user, i, wrapWidth))
+			if len(msg.Reactions) > 0 {
+				lines = append(lines, wrapper.Render("        "+m.styles.InlineHint(reactionBar(msg.Reactions))))
+			}
+			return lines
+		}
+
+		// Create clean message line
+		if isOwnMessage {
+			// Own message - use primary color for user, white for content
 			userStyle := lipgloss.NewStyle().
-				Foreground(m.styles.PrivMsgColor).
+				Foreground(m.styles.PrimaryColor).
 				Bold(true)
-			user := userStyle.Render(msg.User + ":")
-			content := privStyle.Render(msg.Content)
+			user = guestTag + userStyle.Render(msg.User+":")
+			contentStyle := lipgloss.NewStyle().
+				Foreground(lipgloss.Color("#E5E7EB"))
+			content = m.renderText(msg.Content, contentStyle)
+			if msg.Edited {
+				content += " " + m.styles.InlineHint("(edited)")
+			}
+			content += m.deliveryMark(msg)
 
-			messageLine := fmt.Sprintf("%s %s  %s %s", timestamp, whisperLabel, user, content)
+			messageLine := header(timestamp, user) + " " + content
 			lines = append(lines, wrapper.Render(messageLine))
 		} else {
-			// Regular chat message formatting
-			isOwnMessage := msg.User == m.username
+			// Other user's message - use theme colors
+			if msg.HasMention {
+				content = m.highlightMentions(msg.Content)
+				if msg.Edited {
+					content += " " + m.styles.InlineHint("(edited)")
+				}
+			}
+			messageLine := header(timestamp, user) + " " + content
+			lines = append(lines, wrapper.Render(messageLine))
+		}
 
-			// Format components with proper styling
-			timestamp := m.styles.DateTime.Render(fmt.Sprintf("[%s]", msg.Timestamp))
-			user := m.styles.User.Render(msg.User + ":")
-			content := m.styles.Msg.Render(msg.Content)
+		if len(msg.Reactions) > 0 {
+			lines = append(lines, wrapper.Render("        "+m.styles.InlineHint(reactionBar(msg.Reactions))))
+		}
+	}
 
-			// Create clean message line
-			if isOwnMessage {
-				// Own message - use primary color for user, white for content
-				userStyle := lipgloss.NewStyle().
-					Foreground(m.styles.PrimaryColor).
-					Bold(true)
-				user = userStyle.Render(msg.User + ":")
-				contentStyle := lipgloss.NewStyle().
-					Foreground(lipgloss.Color("#E5E7EB"))
-				content = contentStyle.Render(msg.Content)
-
-				messageLine := fmt.Sprintf("%s  %s %s", timestamp, user, content)
-				lines = append(lines, wrapper.Render(messageLine))
-			} else {
-				// Other user's message - use theme colors
-				messageLine := fmt.Sprintf("%s  %s %s", timestamp, user, content)
-				lines = append(lines, wrapper.Render(messageLine))
-			}
+	return lines
+}
+
+// In compact mode, messages this soon after the author's previous one leave
+// out the name, and gaps longer than compactGapSeparator get the time
+// between them
+const (
+	compactRunWindow    = 5 * time.Minute
+	compactGapSeparator = 30 * time.Minute
+)
+
+// isContinuation reports whether msg carries on prev's run of messages in
+// compact mode
+func isContinuation(prev, msg ChatMessage) bool {
+	plain := func(c ChatMessage) bool {
+		return !c.IsSystem && !c.IsPrivate && !c.IsSeparator && !c.IsAnnouncement && !c.IsMotd && c.Poll == nil && c.FileURL == "" && !c.Time.IsZero()
+	}
+	gap := msg.Time.Sub(prev.Time)
+	return plain(prev) && plain(msg) && msg.User == prev.User && gap >= 0 && gap <= compactRunWindow
+}
+
+// markdownIndent is how far Markdown bodies below the header are indented
+const markdownIndent = 4
+
+// markdownPattern spots the formatting renderMarkdown handles, so plain
+// messages skip the Markdown renderer
+var markdownPattern = regexp.MustCompile("[*_`]|(?m)^>")
+
+func hasMarkdown(s string) bool {
+	return markdownPattern.MatchString(s)
+}
+
+// markdownRenderers holds a renderer per theme and width, as creating one
+// is much slower than rendering with it
+var markdownRenderers = map[string]*glamour.TermRenderer{}
+
+// withThemeColors styles Markdown with the theme's colors, without the
+// margins glamour puts around documents and code blocks
+func withThemeColors(styles Styles) glamour.TermRendererOption {
+	primary := string(styles.PrimaryColor)
+	secondary := string(styles.SecondaryColor)
+	dim := string(dimColor)
+	noMargin := uint(0)
+
+	cfg := glamourstyles.DarkStyleConfig
+	cfg.Document = glamouransi.StyleBlock{Margin: &noMargin}
+	cfg.Paragraph = glamouransi.StyleBlock{}
+	cfg.Strong = glamouransi.StylePrimitive{Color: &primary, Bold: cfg.Strong.Bold}
+	cfg.Emph = glamouransi.StylePrimitive{Color: &secondary, Italic: cfg.Emph.Italic}
+	cfg.Code.Color = &secondary
+	cfg.BlockQuote.Color = &dim
+	return glamour.WithStyles(cfg)
+}
+
+// fencedCodePattern finds ``` code blocks, which are highlighted separately
+var fencedCodePattern = regexp.MustCompile("(?s)```.*?(```|$)")
+
+// collapsedCodeLines is how much of a long code block shows until expanded
+const collapsedCodeLines = 20
+
+// renderMarkdown renders bold, italic, inline code, fenced code blocks and
+// blockquotes in s, wrapping prose at width. Long code blocks are cut to
+// collapsedCodeLines unless expanded. Falls back to s if it can't be rendered.
+func renderMarkdown(s string, styles Styles, width int, expanded bool) string {
+	var parts []string
+	last := 0
+	for _, span := range fencedCodePattern.FindAllStringIndex(s, -1) {
+		if prose := strings.TrimSpace(s[last:span[0]]); prose != "" {
+			parts = append(parts, renderMarkdownPart(prose, styles, width))
+		}
+		parts = append(parts, renderCodeBlock(s[span[0]:span[1]], styles, width, expanded))
+		last = span[1]
+	}
+	if prose := strings.TrimSpace(s[last:]); prose != "" {
+		parts = append(parts, renderMarkdownPart(prose, styles, width))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// renderCodeBlock highlights a fenced block for its language hint, labelled
+// with the language on the right. Lines too wide to fit are cut off with
+// a "→".
+func renderCodeBlock(block string, styles Styles, width int, expanded bool) string {
+	body := strings.TrimSuffix(strings.TrimRight(strings.TrimPrefix(block, "```"), " \n"), "```")
+	lang, code, _ := strings.Cut(body, "\n")
+	lang = strings.TrimSpace(lang)
+
+	lines := strings.Split(strings.TrimRight(code, "\n"), "\n")
+	hidden := 0
+	if !expanded && len(lines) > collapsedCodeLines {
+		hidden = len(lines) - collapsedCodeLines
+		lines = lines[:collapsedCodeLines]
+	}
+	code = strings.Join(lines, "\n")
+
+	var out []string
+	if lang != "" {
+		out = append(out, lipgloss.PlaceHorizontal(width, lipgloss.Right, styles.InlineHint(lang)))
+		var b strings.Builder
+		if err := quick.Highlight(&b, code, lang, "terminal256", styles.CodeStyle); err == nil {
+			code = strings.TrimRight(b.String(), "\n")
+		}
+	} else {
+		code = styles.Msg.Render(code)
+	}
+	for _, line := range strings.Split(code, "\n") {
+		if ansi.StringWidth(line) > width {
+			line = ansi.Truncate(line, width-1, "→")
+		}
+		out = append(out, line)
+	}
+	if hidden > 0 {
+		out = append(out, styles.InlineHint(fmt.Sprintf("… (%d more lines, press e to expand)", hidden)))
+	}
+	return strings.Join(out, "\n")
+}
+
+// renderMarkdownPart renders Markdown without code blocks, wrapped at width
+func renderMarkdownPart(s string, styles Styles, width int) string {
+	key := fmt.Sprintf("%s/%s/%d", styles.PrimaryColor, styles.SecondaryColor, width)
+	r, ok := markdownRenderers[key]
+	if !ok {
+		var err error
+		r, err = glamour.NewTermRenderer(withThemeColors(styles), glamour.WithWordWrap(width))
+		if err != nil {
+			return s
 		}
+		markdownRenderers[key] = r
 	}
 
+	out, err := r.Render(s)
+	if err != nil {
+		return s
+	}
+	lines := strings.Split(out, "\n")
+	for i, line := range lines {
+		// glamour pads lines out to the wrap width
+		lines[i] = ansi.Truncate(line, ansi.StringWidth(strings.TrimRight(ansi.Strip(line), " ")), "")
+	}
+	// and adds blank lines around blocks
+	for len(lines) > 0 && ansi.Strip(lines[0]) == "" {
+		lines = lines[1:]
+	}
+	for len(lines) > 0 && ansi.Strip(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
 	return strings.Join(lines, "\n")
 }
 
+// markdownCacheLimit is how many rendered messages markdownCache holds
+// before it's emptied, to stay small however long the client runs
+const markdownCacheLimit = 1000
+
+// markdownMessage lays out a message rendered as Markdown: inline on the
+// header line when it fits on one line, otherwise below it, indented
+func (m mainModel) markdownMessage(timestamp, user string, index int, width int) string {
+	msg := m.messages[index]
+	expanded := m.blocksExpanded(msg)
+	key := fmt.Sprintf("%d:%t:%s", width, expanded, msg.Content)
+	body, ok := m.markdownCache[key]
+	if !ok {
+		body = renderMarkdown(msg.Content, m.styles, width-markdownIndent, expanded)
+		if len(m.markdownCache) >= markdownCacheLimit {
+			clear(m.markdownCache) // Cheaper than tracking what's still shown
+		}
+		m.markdownCache[key] = body
+	}
+	if msg.Edited {
+		body += " " + m.styles.InlineHint("(edited)")
+	}
+	body += m.deliveryMark(msg)
+
+	header := fmt.Sprintf("%s  %s", timestamp, user)
+	if !strings.Contains(body, "\n") && ansi.StringWidth(header)+1+ansi.StringWidth(body) <= width {
+		return header + " " + body
+	}
+	indent := strings.Repeat(" ", markdownIndent)
+	return header + "\n" + indent + strings.ReplaceAll(body, "\n", "\n"+indent)
+}
+
+// mentionPattern matches an @mention the way the server picks them out
+var mentionPattern = regexp.MustCompile(`@([\w-]+)`)
+
+// mentionSpans finds each @<our username> in content, in any case, that
+// isn't just the start of a longer name
+func (m mainModel) mentionSpans(content string) [][]int {
+	var spans [][]int
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(content, -1) {
+		if strings.EqualFold(content[match[2]:match[3]], m.username) {
+			spans = append(spans, match[:2])
+		}
+	}
+	return spans
+}
+
+// mentionsMe reports whether msg is someone else's message that
+// @mentions us
+func (m mainModel) mentionsMe(msg ChatMessage) bool {
+	if m.username == "" || msg.User == m.username || msg.IsSystem {
+		return false
+	}
+	return len(m.mentionSpans(msg.Content)) > 0
+}
+
+// highlightMentions renders content with each @mention of us picked out
+func (m mainModel) highlightMentions(content string) string {
+	highlight := m.styles.ButtonFocus.UnsetPadding().UnsetMargins()
+
+	var b strings.Builder
+	last := 0
+	for _, span := range m.mentionSpans(content) {
+		b.WriteString(m.renderText(content[last:span[0]], m.styles.Msg))
+		b.WriteString(highlight.Render(content[span[0]:span[1]]))
+		last = span[1]
+	}
+	b.WriteString(m.renderText(content[last:], m.styles.Msg))
+	return b.String()
+}
+
+// expandKey is what expandedBlocks knows msg by: its server ID, or our
+// client ID until the server has acknowledged it. Unlike its index, it
+// stays the same as older messages are loaded above it.
+func expandKey(msg ChatMessage) string {
+	if msg.ID != "" {
+		return msg.ID
+	}
+	if msg.ClientID != "" {
+		return "client:" + msg.ClientID
+	}
+	return ""
+}
+
+// blocksExpanded reports whether msg's long code blocks are shown in full
+func (m mainModel) blocksExpanded(msg ChatMessage) bool {
+	key := expandKey(msg)
+	return key != "" && m.expandedBlocks[key]
+}
+
+// hasCollapsedCode reports whether msg shows a shortened code block
+func (m mainModel) hasCollapsedCode(index int) bool {
+	if !m.config.Markdown || m.blocksExpanded(m.messages[index]) {
+		return false
+	}
+	for _, block := range fencedCodePattern.FindAllString(m.messages[index].Content, -1) {
+		if strings.Count(strings.TrimRight(block, "`\n "), "\n") > collapsedCodeLines {
+			return true
+		}
+	}
+	return false
+}
+
+// expandCodeBlock shows the full code of the lowest message on screen with
+// a collapsed block, reporting whether there was one
+func (m *mainModel) expandCodeBlock() bool {
+	for line := m.viewport.YOffset + m.viewport.Height - 1; line >= m.viewport.YOffset; line-- {
+		if i, ok := m.messageIndexAtLine(line); ok && m.hasCollapsedCode(i) {
+			m.expandedBlocks[expandKey(m.messages[i])] = true
+			offset := m.viewport.YOffset
+			m.viewport.SetContent(m.renderMessages())
+			m.viewport.SetYOffset(offset)
+			return true
+		}
+	}
+	return false
+}
+
+// messageAtLine finds the message drawn on the given line of the chat
+func (m mainModel) messageAtLine(line int) (ChatMessage, bool) {
+	if i, ok := m.messageIndexAtLine(line); ok {
+		return m.messages[i], true
+	}
+	return ChatMessage{}, false
+}
+
+func (m mainModel) messageIndexAtLine(line int) (int, bool) {
+	blocks, starts := m.renderMessageLines()
+
+	block, row := -1, 0
+	for i, b := range blocks {
+		row += strings.Count(b, "\n") + 1
+		if line < row {
+			block = i
+			break
+		}
+	}
+	if block < 0 || line < 0 {
+		return 0, false
+	}
+
+	// Replies are drawn after their parent rather than in order, so this is
+	// the message starting closest above block
+	found := -1
+	for i, start := range starts {
+		if start >= 0 && start <= block && (found < 0 || start > starts[found]) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return 0, false
+	}
+	return found, true
+}
+
+// userStyle is the style for name's label in chat, colored per user unless
+// that is turned off in the config
+func (m mainModel) userStyle(name string) lipgloss.Style {
+	if !m.config.UserColors {
+		return m.styles.User
+	}
+	if color, ok := m.displayColors[name]; ok {
+		return m.styles.User.Foreground(color)
+	}
+	color, ok := m.userColors[name]
+	if !ok {
+		color = usernameColor(name)
+		m.userColors[name] = color
+	}
+	return m.styles.User.Foreground(color)
+}
+
+// guestNamePattern matches the names servers give guests, which members
+// can't register
+var guestNamePattern = regexp.MustCompile(`^guest_[0-9a-f]{6}$`)
+
+func isGuestName(name string) bool {
+	return guestNamePattern.MatchString(name)
+}
+
+// webhookSender is who servers say sent messages from incoming webhooks
+const webhookSender = "[webhook]"
+
+// displayTime is a message's time as shown in the chat, relative when
+// configured and known
+func (m mainModel) displayTime(msg ChatMessage) string {
+	if m.config.RelativeTime && !msg.Time.IsZero() {
+		return formatRelativeTime(msg.Time)
+	}
+	return msg.Timestamp
+}
+
+// formatRelativeTime describes t relative to now, e.g. "2m ago" or "yesterday"
+func formatRelativeTime(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	}
+
+	now := time.Now()
+	yesterday := time.Date(now.Year(), now.Month(), now.Day()-1, 0, 0, 0, 0, now.Location())
+	switch {
+	case !t.Before(yesterday):
+		return "yesterday"
+	case d < 7*24*time.Hour:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
+	return t.Format("Jan 2")
+}
+
+// reactionBar formats reaction counts compactly, e.g. "👍 3  ❤️ 1"
+func reactionBar(reactions map[string]int) string {
+	emojis := make([]string, 0, len(reactions))
+	for emoji := range reactions {
+		emojis = append(emojis, emoji)
+	}
+	sort.Strings(emojis)
+
+	parts := make([]string, 0, len(emojis))
+	for _, emoji := range emojis {
+		parts = append(parts, fmt.Sprintf("%s %d", emoji, reactions[emoji]))
+	}
+	return strings.Join(parts, "  ")
+}
+
 func parseMessage(raw string) ChatMessage {
-	// Parse system messages (user joined/left)
+	// JSON frames carry stored messages with their server-assigned ID
+	if frame, ok := parseServerFrame(raw); ok {
+		switch frame.Type {
+		case "message":
+			return wireToChatMessage(frame.wireMessage)
+		case "system":
+			return ChatMessage{
+				Timestamp: time.Now().Format("15:04"),
+				Content:   frame.Msg,
+				IsSystem:  true,
+			}
+		}
+	}
+
+	// Users joining and leaving: JOINED:<user> and LEFT:<user> in echo-v2,
+	// and "<user> has joined" and "<user> has left" in echo-v1
+	if username, ok := strings.CutPrefix(raw, "JOINED:"); ok {
+		return ChatMessage{
+			Timestamp: time.Now().Format("15:04"),
+			User:      username,
+			Content:   "joined the chat",
+			IsSystem:  true,
+		}
+	}
+	if username, ok := strings.CutPrefix(raw, "LEFT:"); ok {
+		return ChatMessage{
+			Timestamp: time.Now().Format("15:04"),
+			User:      username,
+			Content:   "left the chat",
+			IsSystem:  true,
+		}
+	}
 	if strings.Contains(raw, " has joined") {
 		username := strings.TrimSuffix(raw, " has joined")
 		return ChatMessage{
@@ -999,6 +2446,85 @@ func parseMessage(raw string) ChatMessage {
 		}
 	}
 
+	if file, ok := parseFileRef(raw); ok {
+		return file
+	}
+
+	// Encrypted direct messages: E2E:<from>:<nonce>:<ciphertext>, decrypted
+	// once parsed
+	if rest, ok := strings.CutPrefix(raw, "E2E:"); ok {
+		if from, payload, ok := strings.Cut(rest, ":"); ok {
+			return ChatMessage{
+				Timestamp: time.Now().Format("15:04"),
+				User:      from,
+				Content:   payload,
+				IsPrivate: true,
+				Encrypted: true,
+			}
+		}
+	}
+
+	// Direct messages: WHISPER:<from>:<text>
+	if rest, ok := strings.CutPrefix(raw, "WHISPER:"); ok {
+		if from, text, ok := strings.Cut(rest, ":"); ok {
+			return ChatMessage{
+				Timestamp: time.Now().Format("15:04"),
+				User:      from,
+				Content:   text,
+				IsPrivate: true,
+			}
+		}
+	}
+
+	// Errors meant for us only: ERR:<code>[:<clientID>]
+	if code, ok := strings.CutPrefix(raw, "ERR:"); ok {
+		code, _, _ = strings.Cut(code, ":")
+		return ChatMessage{
+			Timestamp: time.Now().Format("15:04"),
+			Content:   serverErrorText(code),
+			IsSystem:  true,
+		}
+	}
+
+	// Posts or joins the channel's permissions refused:
+	// PERMISSION_DENIED:<channel>:<reason>[:<clientID>]
+	if rest, ok := strings.CutPrefix(raw, "PERMISSION_DENIED:"); ok {
+		channel, reason, _ := strings.Cut(rest, ":")
+		reason, _, _ = strings.Cut(reason, ":")
+		return ChatMessage{
+			Timestamp: time.Now().Format("15:04"),
+			Content:   permissionDeniedText(channel, reason),
+			IsSystem:  true,
+		}
+	}
+
+	// Admin announcements for everyone: ANNOUNCE:<text>
+	if text, ok := strings.CutPrefix(raw, "ANNOUNCE:"); ok {
+		return ChatMessage{
+			Timestamp:      time.Now().Format("15:04"),
+			Content:        text,
+			IsAnnouncement: true,
+		}
+	}
+
+	// Word filter rejections: FILTERED:<text>
+	if text, ok := strings.CutPrefix(raw, "FILTERED:"); ok {
+		return ChatMessage{
+			Timestamp: time.Now().Format("15:04"),
+			Content:   text,
+			IsSystem:  true,
+		}
+	}
+
+	// Flood control notices: RATELIMIT:<text>
+	if text, ok := strings.CutPrefix(raw, "RATELIMIT:"); ok {
+		return ChatMessage{
+			Timestamp: time.Now().Format("15:04"),
+			Content:   text,
+			IsSystem:  true,
+		}
+	}
+
 	// Check for whisper error message
 	if raw == "Sorry, that user is not online!" {
 		return ChatMessage{
@@ -1014,9 +2540,10 @@ func parseMessage(raw string) ChatMessage {
 		// Check if it matches the pattern "timestamp: username privately said: message"
 		if strings.HasSuffix(parts[1], " privately said") {
 			username := strings.TrimSuffix(parts[1], " privately said")
-			displayTime := extractTime(parts[0])
+			sent := parseServerTime(parts[0])
 			return ChatMessage{
-				Timestamp: displayTime,
+				Time:      sent,
+				Timestamp: sent.Format("15:04"),
 				User:      username,
 				Content:   parts[2],
 				IsSystem:  false,
@@ -1026,9 +2553,10 @@ func parseMessage(raw string) ChatMessage {
 		// Check if it matches the pattern "timestamp: username said: message"
 		if strings.HasSuffix(parts[1], " said") {
 			username := strings.TrimSuffix(parts[1], " said")
-			displayTime := extractTime(parts[0])
+			sent := parseServerTime(parts[0])
 			return ChatMessage{
-				Timestamp: displayTime,
+				Time:      sent,
+				Timestamp: sent.Format("15:04"),
 				User:      username,
 				Content:   parts[2],
 				IsSystem:  false,
@@ -1046,75 +2574,337 @@ func parseMessage(raw string) ChatMessage {
 	}
 }
 
-// extractTime extracts display time from full timestamp
-func extractTime(fullTimestamp string) string {
-	timeParts := strings.Split(fullTimestamp, ", ")
-	if len(timeParts) > 1 {
-		timeOnly := timeParts[1]
-		timeOnlyParts := strings.Split(timeOnly, ":")
-		if len(timeOnlyParts) >= 2 {
-			displayTime := timeOnlyParts[0] + ":" + timeOnlyParts[1]
-			if len(timeOnlyParts) == 3 {
-				secondsAndAmPm := strings.TrimSpace(timeOnlyParts[2])
-				amPmParts := strings.Fields(secondsAndAmPm)
-				if len(amPmParts) > 1 {
-					displayTime += " " + amPmParts[1]
-				}
-			}
-			return displayTime
+// wireToChatMessage converts a server message into a renderable ChatMessage
+func wireToChatMessage(w wireMessage) ChatMessage {
+	displayTime := time.Now().Format("15:04")
+	if t, err := time.Parse(time.RFC3339, w.Timestamp); err == nil {
+		displayTime = t.Local().Format("15:04")
+	}
+	sent, _ := time.Parse(time.RFC3339, w.Timestamp)
+	return ChatMessage{
+		ID:           w.ID,
+		Time:         sent,
+		Timestamp:    displayTime,
+		User:         w.Sender,
+		Content:      w.Content,
+		Edited:       w.Edited,
+		Reactions:    w.Reactions,
+		Bot:          w.Bot,
+		ReplyTo:      w.ReplyTo,
+		ClientID:     w.ClientID,
+		DisplayColor: w.DisplayColor,
+		Ephemeral:    w.Ephemeral,
+		Streaming:    w.Streaming,
+		// Announcements are saved to history under the reserved "system" name
+		IsAnnouncement: w.Sender == "system",
+	}
+}
+
+// lastOwnMessage finds the most recent message we sent that the server stored
+func (m mainModel) lastOwnMessage() (ChatMessage, bool) {
+	for i := len(m.messages) - 1; i >= 0; i-- {
+		msg := m.messages[i]
+		if msg.ID != "" && msg.User == m.username && !msg.IsPrivate && !msg.IsSystem && !msg.Deleted {
+			return msg, true
+		}
+	}
+	return ChatMessage{}, false
+}
+
+// applyEdit replaces the body of the message with the given ID
+func (m *mainModel) applyEdit(id string, body string) {
+	for i := range m.messages {
+		if m.messages[i].ID == id {
+			m.messages[i].Content = body
+			m.messages[i].Edited = true
+			return
+		}
+	}
+}
+
+// applyDelete turns the message with the given ID into a tombstone
+func (m *mainModel) applyDelete(id string) {
+	for i := range m.messages {
+		if m.messages[i].ID == id {
+			m.messages[i].Content = ""
+			m.messages[i].Deleted = true
+			return
+		}
+	}
+}
+
+// applyReaction sets the count for one emoji on the message with the given ID
+func (m *mainModel) applyReaction(id string, emoji string, count int) {
+	for i := range m.messages {
+		if m.messages[i].ID != id {
+			continue
+		}
+		if m.messages[i].Reactions == nil {
+			m.messages[i].Reactions = map[string]int{}
+		}
+		if count > 0 {
+			m.messages[i].Reactions[emoji] = count
+		} else {
+			delete(m.messages[i].Reactions, emoji)
+		}
+		m.render.invalidate(i)
+		return
+	}
+}
+
+// addSystemMessage appends a local notice to the chat
+func (m *mainModel) addSystemMessage(text string) {
+	m.addOutcomeMessage(text, outcomeNone)
+}
+
+// addOutcomeMessage adds a system message shown in the success or error style
+func (m *mainModel) addOutcomeMessage(text string, result outcome) {
+	m.messages = append(m.messages, ChatMessage{
+		Timestamp: time.Now().Format("15:04"),
+		Time:      time.Now(),
+		Content:   text,
+		IsSystem:  true,
+		Outcome:   result,
+	})
+}
+
+// trackReceived remembers the newest server message for the replay on
+// reconnecting, and that it's been shown
+func (m *mainModel) trackReceived(msg ChatMessage) {
+	if msg.ID == "" {
+		return
+	}
+	m.lastReceivedMsgID = msg.ID
+	m.lastReceivedAt = time.Now()
+	m.seenMsgIDs[msg.ID] = struct{}{}
+}
+
+// insertBackfill places the messages replayed on reconnecting just before
+// the "connected" system message
+func (m *mainModel) insertBackfill(missed []wireMessage) {
+	m.insertReplay(missed)
+	m.replaying = false
+}
+
+// insertHistory places a channel's replayed messages above the live ones
+func (m *mainModel) insertHistory(history []wireMessage) {
+	m.insertReplay(history)
+}
+
+// insertReplay puts the messages of a HISTORY or backfill replay we haven't
+// shown yet above the "connected" message, under a separator. Whichever
+// replay comes first after reconnecting carries what we missed.
+func (m *mainModel) insertReplay(wire []wireMessage) {
+	block := m.unseen(wire)
+	if len(block) == 0 {
+		return
+	}
+
+	separator := ChatMessage{
+		Content:     "─── Channel History ───",
+		IsSeparator: true,
+	}
+	if m.replaying {
+		// One block, however many replays it takes
+		if m.replaySeparated {
+			m.insertBeforeWelcome(block)
+			return
+		}
+		separator.Content = "─── Missed messages replayed ───"
+		m.replaySeparated = true
+	}
+	m.insertBeforeWelcome(append([]ChatMessage{separator}, block...))
+}
+
+// unseen converts server messages, skipping any that are already displayed
+func (m *mainModel) unseen(wire []wireMessage) []ChatMessage {
+	var block []ChatMessage
+	for _, w := range wire {
+		if _, seen := m.seenMsgIDs[w.ID]; seen {
+			continue
 		}
-		return timeOnly
+		chatMsg := wireToChatMessage(w)
+		chatMsg.HasMention = m.mentionsMe(chatMsg)
+		m.trackReceived(chatMsg)
+		block = append(block, chatMsg)
+	}
+	return block
+}
+
+// insertBeforeWelcome inserts older messages above the latest "connected"
+// system message, keeping later inserts in arrival order
+func (m *mainModel) insertBeforeWelcome(block []ChatMessage) {
+	if len(block) == 0 {
+		return
 	}
-	return time.Now().Format("15:04")
+
+	idx := m.connectedMsgIndex
+	if idx < 0 || idx > len(m.messages) {
+		idx = len(m.messages)
+	}
+	rest := append(block, m.messages[idx:]...)
+	m.messages = append(m.messages[:idx], rest...)
+	m.connectedMsgIndex = idx + len(block)
+}
+
+// serverTimeLayouts are the timestamps the server may put on a message,
+// tried in order. Older servers send the time in their own locale, so
+// both day-first and month-first dates are accepted.
+var serverTimeLayouts = []string{
+	time.RFC3339,
+	"2/1/2006, 3:04:05 pm",
+	"1/2/2006, 3:04:05 pm",
+	"2/1/2006, 15:04:05",
+	"1/2/2006, 15:04:05",
+	"2.1.2006, 15:04:05",
+	"2006-01-02 15:04:05",
+	"15:04:05",
+	"3:04:05 pm",
+}
+
+// parseServerTime reads a message's timestamp in any of serverTimeLayouts,
+// or as Unix seconds or milliseconds. A time of day alone is taken to be
+// today. Anything else is logged and counts as now.
+func parseServerTime(timestamp string) time.Time {
+	// Some locales put a narrow no-break space before AM/PM
+	value := strings.NewReplacer("\u202f", " ", "\u00a0", " ").Replace(strings.TrimSpace(timestamp))
+	value = strings.NewReplacer(" AM", " am", " PM", " pm").Replace(value)
+
+	for _, layout := range serverTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err != nil {
+			continue
+		}
+		if t.Year() == 0 {
+			now := time.Now()
+			t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+		}
+		return t.Local()
+	}
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+		if n >= 1e12 {
+			return time.UnixMilli(n)
+		}
+		return time.Unix(n, 0)
+	}
+	slog.Warn("unrecognized message timestamp, using the current time", "timestamp", timestamp)
+	return time.Now()
 }
 
 // Commands and Messages
 
 type connectedMsg struct {
-	conn *websocket.Conn
+	conn   ChatTransport
+	server string
 }
 
 func tickCmd() tea.Cmd {
-	return tea.Tick(time.Millisecond*500, func(t time.Time) tea.Msg {
+	return tea.Tick(30*time.Second, func(t time.Time) tea.Msg {
 		return tickMsg(t)
 	})
 }
 
 func (m mainModel) connectCmd() tea.Cmd {
-	return func() tea.Msg {
+	return forTab(m.id, func() tea.Msg {
 		server := m.serverInput.Value()
 		if server == "" {
 			server = "localhost:8080"
 		}
 
-		conn, err := connectWebsocket(server, m.userInput.Value(), m.passInput.Value())
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		creds := Credentials{
+			Username: m.userInput.Value(),
+			Password: m.passInput.Value(),
+			Email:    strings.TrimSpace(m.emailInput.Value()),
+			TOTP:     strings.TrimSpace(m.totpInput.Value()),
+		}
+		// No password typed in - try to resume a saved session instead
+		if creds.Password == "" {
+			creds.Token = loadSessionToken(server, creds.Username)
+		}
+
+		opts := DialOptions{TLS: m.config.TLS, InsecureSkipVerify: m.config.InsecureSkipVerify, Transport: m.config.Transport}
+		conn, err := connectServer(ctx, server, creds, opts)
 		if err != nil {
+			cause := err
+			// Shown on the login screen, so in plain words
+			err = connectError{err}
+			if creds.Token != "" && !isRetryable(err) {
+				// The saved session was refused, so fall back to the password next time
+				clearSessionToken(server, creds.Username)
+			}
+			if isRetryable(err) && m.retryCount < m.config.MaxRetries {
+				delay := retryDelay(m.retryCount)
+				if errors.Is(err, ErrMaintenance) {
+					delay = maintenanceRetryDelay
+				}
+				slog.Warn("connecting failed, retrying", "server", server, "attempt", m.retryCount+1, "delay", delay, "err", cause)
+				return progressMsg{
+					attempt: m.retryCount + 1,
+					delay:   delay,
+					err:     err,
+				}
+			}
+			slog.Warn("connecting failed", "server", server, "username", creds.Username, "err", cause)
 			return errMsg(err)
 		}
 
-		return connectedMsg{conn: conn}
+		return connectedMsg{conn: conn, server: server}
+	})
+}
+
+func (m mainModel) sendTypingCmd() tea.Cmd {
+	return func() tea.Msg {
+		if m.conn == nil {
+			return nil
+		}
+		// Best effort - a lost typing notice isn't worth an error
+		m.conn.Send("TYPING:" + m.username)
+		return nil
 	}
 }
 
 func (m mainModel) sendMessageCmd(msg string) tea.Cmd {
-	return func() tea.Msg {
+	return forTab(m.id, func() tea.Msg {
 		if m.conn == nil {
-			return errMsg(fmt.Errorf("not connected"))
+			return errMsg(ErrNotConnected)
 		}
-		err := m.conn.WriteMessage(websocket.TextMessage, []byte(msg))
+		err := m.conn.Send(msg)
 		if err != nil {
 			return errMsg(err)
 		}
+		slog.Debug("sent frame", "tab", m.id, "frame", loggedFrame(msg))
 		return nil
+	})
+}
+
+// reconnectCmd asks for the messages we missed while disconnected. Logging
+// in again puts us in the default channel, so we go back to ours first.
+func (m mainModel) reconnectCmd() tea.Cmd {
+	replay := m.sendMessageCmd("RECONNECT:" + m.lastReceivedMsgID)
+	if m.currentChannel == defaultChannel {
+		return replay
 	}
+	return tea.Sequence(m.sendMessageCmd("JOIN:"+m.currentChannel), replay)
 }
 
-func waitForIncomingMessage(conn *websocket.Conn) tea.Cmd {
-	return func() tea.Msg {
-		_, data, err := conn.ReadMessage()
+// waitForIncomingMessage reads the next frame from the tab's connection
+func waitForIncomingMessage(tab int, conn ChatTransport) tea.Cmd {
+	return forTab(tab, func() tea.Msg {
+		frame, err := conn.Recv()
+		if errors.Is(err, ErrServerRestarting) {
+			return goingAwayMsg{}
+		}
+		var kicked kickedError
+		if errors.As(err, &kicked) {
+			return kickedMsg{reason: kicked.reason}
+		}
 		if err != nil {
-			return errMsg(err)
+			return connectionLostMsg{err: err}
 		}
-		return wsMsg(string(data))
-	}
+		slog.Debug("received frame", "tab", tab, "frame", loggedFrame(frame))
+		return wsMsg(frame)
+	})
 }
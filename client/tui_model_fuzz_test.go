@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzParseMessage(f *testing.F) {
+	for _, seed := range []string{
+		"2026-01-02T15:04:05Z: alice said: hello",
+		"2026-01-02 15:04:05: bob privately said: psst",
+		"15:04: carol said: a: b: c",
+		"alice has joined",
+		"bob has left",
+		"JOINED:alice",
+		"LEFT:bob",
+		`{"type":"message","id":"m1","sender":"alice","content":"hi","timestamp":"2026-01-02T15:04:05Z","channel":"general"}`,
+		`{"type":"system","msg":"Server restarting"}`,
+		`{"type":"message","timestamp":"not a time"}`,
+		"FILEREF:https://chat.example.com/files/a-b.png:b.png:2048",
+		"FILEREF::",
+		"E2E:alice:nonce:ciphertext",
+		"WHISPER:alice:are you there?",
+		"ERR:user_not_found",
+		"PERMISSION_DENIED:announcements:read_only:abc123",
+		"ANNOUNCE:Maintenance at noon",
+		"FILTERED:***",
+		"RATELIMIT:Slow down",
+		": said: ",
+		"",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, raw string) {
+		msg := parseMessage(raw)
+		if len(msg.Timestamp) != len("15:04") {
+			t.Errorf("parseMessage(%q) timestamp = %q, want HH:MM", raw, msg.Timestamp)
+		}
+		// Chat lines keep the text after the sender as it came
+		if !msg.IsSystem && !msg.IsPrivate && msg.User != "" && !strings.HasPrefix(raw, "{") {
+			if !strings.HasSuffix(raw, ": "+msg.Content) {
+				t.Errorf("parseMessage(%q) content = %q, not what followed the sender", raw, msg.Content)
+			}
+		}
+	})
+}
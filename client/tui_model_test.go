@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseMessageTimestamps(t *testing.T) {
+	now := time.Now()
+	today := func(hour, min, sec int) time.Time {
+		return time.Date(now.Year(), now.Month(), now.Day(), hour, min, sec, 0, time.Local)
+	}
+	local := func(year int, month time.Month, day, hour, min, sec int) time.Time {
+		return time.Date(year, month, day, hour, min, sec, 0, time.Local)
+	}
+	ist := time.FixedZone("", 5*60*60+30*60)
+	pst := time.FixedZone("", -8*60*60)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		want      time.Time // Zero for a timestamp taken as now
+	}{
+		{"rfc3339 utc", "2026-03-04T05:06:07Z", time.Date(2026, 3, 4, 5, 6, 7, 0, time.UTC)},
+		{"rfc3339 milliseconds", "2026-03-04T05:06:07.123Z", time.Date(2026, 3, 4, 5, 6, 7, 123e6, time.UTC)},
+		{"rfc3339 microseconds", "2026-03-04T05:06:07.123456Z", time.Date(2026, 3, 4, 5, 6, 7, 123456e3, time.UTC)},
+		{"rfc3339 nanoseconds", "2026-03-04T05:06:07.123456789Z", time.Date(2026, 3, 4, 5, 6, 7, 123456789, time.UTC)},
+		{"positive offset", "2026-03-04T10:36:07+05:30", time.Date(2026, 3, 4, 10, 36, 7, 0, ist)},
+		{"negative offset", "2026-03-03T21:06:07-08:00", time.Date(2026, 3, 3, 21, 6, 7, 0, pst)},
+		{"offset with milliseconds", "2026-03-04T10:36:07.5+05:30", time.Date(2026, 3, 4, 10, 36, 7, 5e8, ist)},
+		{"day first, 12 hour", "25/12/2026, 3:04:05 pm", local(2026, 12, 25, 15, 4, 5)},
+		{"day first, upper case pm", "25/12/2026, 3:04:05 PM", local(2026, 12, 25, 15, 4, 5)},
+		{"day first, narrow space", "25/12/2026, 9:04:05\u202fAM", local(2026, 12, 25, 9, 4, 5)},
+		{"month first, 12 hour", "12/25/2026, 3:04:05 pm", local(2026, 12, 25, 15, 4, 5)},
+		{"day first, 24 hour", "25/12/2026, 15:04:05", local(2026, 12, 25, 15, 4, 5)},
+		{"month first, 24 hour", "12/25/2026, 15:04:05", local(2026, 12, 25, 15, 4, 5)},
+		{"ambiguous date is day first", "3/4/2026, 15:04:05", local(2026, 4, 3, 15, 4, 5)},
+		{"dotted date", "25.12.2026, 15:04:05", local(2026, 12, 25, 15, 4, 5)},
+		{"iso without zone", "2026-03-04 05:06:07", local(2026, 3, 4, 5, 6, 7)},
+		{"bare time, 24 hour", "15:04:05", today(15, 4, 5)},
+		{"bare time, 12 hour", "3:04:05 pm", today(15, 4, 5)},
+		{"bare time, midnight", "12:00:00 am", today(0, 0, 0)},
+		{"surrounding spaces", "  15:04:05  ", today(15, 4, 5)},
+		{"unix seconds", "1767225600", time.Unix(1767225600, 0)},
+		{"unix milliseconds", "1767225600123", time.UnixMilli(1767225600123)},
+		{"malformed", "yesterday", time.Time{}},
+		{"empty", "", time.Time{}},
+		{"out of range", "2026-13-45T25:61:61Z", time.Time{}},
+		{"bare time without seconds", "15:04", time.Time{}},
+		{"negative unix time", "-5", time.Time{}},
+		{"zero unix time", "0", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := parseMessage(tt.timestamp + ": alice said: hi")
+			if msg.User != "alice" || msg.Content != "hi" {
+				t.Fatalf("parsed as %+v, want alice saying hi", msg)
+			}
+
+			if tt.want.IsZero() {
+				if since := time.Since(msg.Time); since < 0 || since > time.Minute {
+					t.Errorf("time = %v, want about now", msg.Time)
+				}
+				return
+			}
+			if !msg.Time.Equal(tt.want) {
+				t.Errorf("time = %v, want %v", msg.Time, tt.want)
+			}
+			if got, want := msg.Timestamp, tt.want.Local().Format("15:04"); got != want {
+				t.Errorf("timestamp = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestMentionSpans(t *testing.T) {
+	m := mainModel{}
+	m.username = "alice"
+	tests := []struct {
+		content string
+		want    int
+	}{
+		{"hi @alice", 1},
+		{"@ALICE, and @Alice.", 2},
+		{"@alice-bob and @alice_2 are someone else", 0},
+		{"alice without the @", 0},
+		{"mail alice@example.com", 0},
+	}
+	for _, tt := range tests {
+		if got := len(m.mentionSpans(tt.content)); got != tt.want {
+			t.Errorf("mentionSpans(%q) found %d, want %d", tt.content, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// totpCodePattern matches a six-digit code or a recovery code like k3f9-x2mq
+var totpCodePattern = regexp.MustCompile(`^(\d{6}|[a-z2-7]{4}-[a-z2-7]{4})$`)
+
+// totpSetup is the TOTP_SETUP:{json} reply to /enable2fa
+type totpSetup struct {
+	Secret        string   `json:"secret"`
+	URI           string   `json:"uri"`
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// submitTotp logs in again with the code typed into the two-factor prompt
+func (m mainModel) submitTotp() (mainModel, tea.Cmd) {
+	code := strings.ToLower(strings.TrimSpace(m.totpInput.Value()))
+	if !totpCodePattern.MatchString(code) {
+		m.err = fmt.Errorf("enter the 6-digit code from your authenticator app, or a recovery code")
+		return m, nil
+	}
+	m.totpInput.SetValue(code)
+	m.err = nil
+	m.state = connectingView
+	m.isConnecting = true
+	m.retryCount = 0
+	return m, tea.Batch(m.connectCmd(), m.animTick())
+}
+
+func (m mainModel) totpView() string {
+	titleStyle := lipgloss.NewStyle().
+		Foreground(m.styles.PrimaryColor).
+		Bold(true)
+	infoStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("#6B7280")).
+		Italic(true)
+	inputBorder := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(m.styles.SecondaryColor).
+		Padding(0, 1)
+
+	parts := []string{
+		titleStyle.Render(IconLock + " TWO-FACTOR AUTHENTICATION"),
+		"",
+		infoStyle.Render("Enter the 6-digit code from your authenticator app,"),
+		infoStyle.Render("or one of your recovery codes."),
+		"",
+		inputBorder.Render(m.totpInput.View()),
+	}
+	if m.err != nil {
+		parts = append(parts, "", m.styles.Error.Render(m.err.Error()))
+	}
+	parts = append(parts, "", m.styles.InlineHint("Enter to verify • Esc to go back"))
+	content := lipgloss.JoinVertical(lipgloss.Center, parts...)
+
+	box := lipgloss.NewStyle().
+		Border(lipgloss.DoubleBorder()).
+		BorderForeground(m.styles.PrimaryColor).
+		Background(lipgloss.Color("#0D1117")).
+		Padding(2, 4).
+		Align(lipgloss.Center).
+		Render(content)
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, box)
+}
+
+func enable2faCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	return m, m.sendMessageCmd("ENABLE2FA")
+}
+
+func disable2faCommand(m mainModel, args string) (mainModel, tea.Cmd) {
+	if args == "" {
+		m.addSystemMessage("Usage: /disable2fa <password>")
+		return m, nil
+	}
+	return m, m.sendMessageCmd("DISABLE2FA:" + args)
+}
+
+// showTotpSetup shows the QR code and recovery codes from TOTP_SETUP. The
+// server never sends them again.
+func (m *mainModel) showTotpSetup(payload string) {
+	var setup totpSetup
+	if err := json.Unmarshal([]byte(payload), &setup); err != nil {
+		return
+	}
+
+	lines := []string{"Two-factor authentication is on. Scan this with your authenticator app:", ""}
+	if qr, err := qrcode.New(setup.URI, qrcode.Low); err == nil {
+		lines = append(lines, strings.TrimRight(qr.ToSmallString(false), "\n"))
+	}
+	lines = append(lines,
+		"",
+		"Or enter this key by hand: "+setup.Secret,
+		"",
+		"Recovery codes, each usable once if you lose your device. Save them now, they won't be shown again:",
+	)
+	for _, code := range setup.RecoveryCodes {
+		lines = append(lines, "    "+code)
+	}
+	m.addSystemMessage(strings.Join(lines, "\n"))
+}
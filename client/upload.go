@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// fileChunkSize is how many bytes of the file go into each FILECHUNK frame
+const fileChunkSize = 4096
+
+// The server's upload limits, for servers that don't send them in SERVERCFG
+const (
+	defaultMaxUploadBytes     = 10 * 1024 * 1024
+	defaultUploadChunksPerSec = 100
+)
+
+// ErrFileTooLarge is returned for a file over the server's upload limit
+var ErrFileTooLarge = errors.New("file too large to upload")
+
+// uploadTooLargeMsg reports a file found over the upload limit once the
+// upload started, say because it grew after /file looked at it
+type uploadTooLargeMsg struct{}
+
+func newUploadID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// maxUploadBytes is the largest file the server takes
+func (m mainModel) maxUploadBytes() int64 {
+	if m.serverCaps.MaxUploadBytes > 0 {
+		return m.serverCaps.MaxUploadBytes
+	}
+	return defaultMaxUploadBytes
+}
+
+// sendFileChunks reads the file at path a chunk at a time and passes each
+// on to send as FILECHUNK:<uploadID>:<total>:<index>:<filename>:<b64>,
+// waiting interval between chunks. Files over limit bytes aren't sent.
+func sendFileChunks(path string, limit int64, interval time.Duration, send func(string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > limit {
+		return ErrFileTooLarge
+	}
+
+	id := newUploadID()
+	name := filepath.Base(path)
+	total := int((info.Size() + fileChunkSize - 1) / fileChunkSize)
+
+	buf := make([]byte, fileChunkSize)
+	for i := 0; i < total; i++ {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && !(errors.Is(err, io.ErrUnexpectedEOF) && i == total-1) {
+			return err // The file shrank, or couldn't be read
+		}
+		frame := fmt.Sprintf("FILECHUNK:%s:%d:%d:%s:%s",
+			id, total, i, name, base64.StdEncoding.EncodeToString(buf[:n]))
+		if err := send(frame); err != nil {
+			return err
+		}
+		if i < total-1 {
+			time.Sleep(interval)
+		}
+	}
+	return nil
+}
+
+// sendFileCmd uploads the file at path chunk by chunk, no faster than the
+// server takes them
+func (m mainModel) sendFileCmd(path string) tea.Cmd {
+	perSec := m.serverCaps.UploadChunksPerSec
+	if perSec <= 0 {
+		perSec = defaultUploadChunksPerSec
+	}
+	interval := time.Duration(float64(time.Second) / perSec)
+	limit := m.maxUploadBytes()
+	return forTab(m.id, func() tea.Msg {
+		if m.conn == nil {
+			return errMsg(ErrNotConnected)
+		}
+		if err := sendFileChunks(path, limit, interval, m.conn.Send); err != nil {
+			if errors.Is(err, ErrFileTooLarge) {
+				return uploadTooLargeMsg{}
+			}
+			return errMsg(err)
+		}
+		return nil
+	})
+}
+
+func (m mainModel) uploadTooLarge() (mainModel, tea.Cmd) {
+	m.addSystemMessage(serverErrors["upload_too_large"])
+	m.viewport.SetContent(m.renderMessages())
+	if m.autoScroll {
+		m.viewport.GotoBottom()
+	}
+	return m, nil
+}
+
+// parseFileRef turns FILEREF:<url>:<filename>:<size_bytes> into a message.
+// The URL contains colons itself, so the fields are split off from the right.
+func parseFileRef(raw string) (ChatMessage, bool) {
+	rest, ok := strings.CutPrefix(raw, "FILEREF:")
+	if !ok {
+		return ChatMessage{}, false
+	}
+	sep := strings.LastIndex(rest, ":")
+	if sep == -1 {
+		return ChatMessage{}, false
+	}
+	size, err := strconv.ParseInt(rest[sep+1:], 10, 64)
+	if err != nil {
+		return ChatMessage{}, false
+	}
+	rest = rest[:sep]
+	sep = strings.LastIndex(rest, ":")
+	if sep == -1 {
+		return ChatMessage{}, false
+	}
+
+	return ChatMessage{
+		Timestamp: time.Now().Format("15:04"),
+		Content:   rest[sep+1:],
+		FileURL:   rest[:sep],
+		FileSize:  size,
+	}, true
+}
+
+// hyperlink wraps text in an OSC-8 link on terminals known to support it
+func hyperlink(url string, text string) string {
+	if !supportsHyperlinks() {
+		return text + " <" + url + ">"
+	}
+	return "\x1b]8;;" + url + "\x1b\\" + text + "\x1b]8;;\x1b\\"
+}
+
+func supportsHyperlinks() bool {
+	if os.Getenv("WT_SESSION") != "" || os.Getenv("VTE_VERSION") != "" {
+		return true
+	}
+	switch os.Getenv("TERM_PROGRAM") {
+	case "iTerm.app", "WezTerm", "vscode", "ghostty":
+		return true
+	}
+	switch os.Getenv("TERM") {
+	case "xterm-kitty", "alacritty", "foot", "xterm-ghostty":
+		return true
+	}
+	return false
+}
+
+// formatBytes renders a size like "512 B", "4.2 KB" or "1.3 MB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGT"[exp])
+}
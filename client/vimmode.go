@@ -0,0 +1,78 @@
+package main
+
+import (
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// vimStatusDuration is how long a normal mode error stays in the footer
+const vimStatusDuration = 1500 * time.Millisecond
+
+// enterNormalMode leaves the input so keys move around the chat instead
+func (m *mainModel) enterNormalMode() {
+	m.vimMode = true
+	m.vimPending = ""
+	m.msgInput.Blur()
+}
+
+// handleVimKey runs a normal mode key: j/k scroll a line, gg/G jump to the
+// top/bottom, r replies to the bottom message (or sends it again if it
+// failed to), y copies it, / starts a search and i goes back to typing
+func handleVimKey(m mainModel, key tea.KeyMsg) (mainModel, tea.Cmd) {
+	pending := m.vimPending
+	m.vimPending = ""
+
+	switch key.String() {
+	case "j":
+		m.viewport.ScrollDown(1)
+		m.followScroll()
+	case "k":
+		m.viewport.ScrollUp(1)
+		m.followScroll()
+	case "G":
+		m.jumpToBottom()
+	case "g":
+		if pending == "g" {
+			m.viewport.GotoTop()
+			m.followScroll()
+		} else {
+			m.vimPending = "g"
+		}
+	case "r":
+		msg, ok := m.bottomMessage()
+		if !ok {
+			m.statusMsg = "No message to reply to"
+			m.statusUntil = time.Now().Add(vimStatusDuration)
+			return m, nil
+		}
+		if msg.Delivery == deliveryFailed {
+			return m, m.retrySend(m.sentIndex(msg.ClientID))
+		}
+		m.startReply(msg)
+		m.vimMode = false
+		return m, m.msgInput.Focus()
+	case "y":
+		msg, ok := m.bottomCopyable()
+		if !ok {
+			m.statusMsg = "No message to copy"
+			m.statusUntil = time.Now().Add(vimStatusDuration)
+			return m, nil
+		}
+		return m, copyMessageCmd(msg)
+	case "/":
+		m.vimMode = false
+		m.msgInput.SetValue("/search ")
+		m.msgInput.CursorEnd()
+		return m, m.msgInput.Focus()
+	case "i":
+		m.vimMode = false
+		return m, m.msgInput.Focus()
+	default:
+		if key.Type == tea.KeyRunes {
+			m.statusMsg = "Unknown command"
+			m.statusUntil = time.Now().Add(vimStatusDuration)
+		}
+	}
+	return m, nil
+}
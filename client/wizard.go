@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// The first run, with no config file yet, starts with a setup wizard
+// instead of the login form: pick a username and theme, check a server,
+// then save. Enter on each step is all the defaults need.
+type wizardStep int
+
+const (
+	wizardProfile wizardStep = iota // Username, and a theme chosen with ↑/↓
+	wizardServer                    // Address, checked before moving on
+	wizardConfirm                   // Summary, saved to the config with Enter
+)
+
+// How long the server check waits for an answer
+const probeTimeout = 5 * time.Second
+
+// setupWizard is the wizard's progress
+type setupWizard struct {
+	step    wizardStep
+	preset  int   // themePresets entry being previewed
+	probing bool  // Waiting for probeServerCmd
+	err     error // Why the server check or saving failed
+}
+
+// probeResultMsg reports whether the server accepted a connection
+type probeResultMsg struct {
+	err error
+}
+
+// startWizard shows the setup wizard in place of the login form
+func (m *mainModel) startWizard() {
+	m.state = wizardView
+	m.wizard = setupWizard{step: wizardProfile, preset: max(m.config.Preset, 1)}
+	m.serverInput.Blur()
+	m.userInput.Focus()
+}
+
+// previewTheme recolors the whole client with a preset as it's picked
+func (m *mainModel) previewTheme(preset int) {
+	m.wizard.preset = preset
+	m.setTheme(preset)
+}
+
+// probeServerCmd checks that a websocket can be opened to address,
+// without logging in
+func probeServerCmd(address string, opts DialOptions) tea.Cmd {
+	return func() tea.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		defer cancel()
+		c, err := dialServer(ctx, address, opts)
+		if err != nil {
+			return probeResultMsg{err: err}
+		}
+		c.Close()
+		return probeResultMsg{}
+	}
+}
+
+// wizardKey handles a key on any step of the wizard
+func (m mainModel) wizardKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.String() {
+	case "ctrl+c":
+		m.disconnectAll()
+		return m, tea.Quit
+	case "ctrl+s":
+		return m.skipWizard()
+	}
+	if m.wizard.probing {
+		return m, nil
+	}
+
+	switch m.wizard.step {
+	case wizardProfile:
+		switch msg.Type {
+		case tea.KeyUp:
+			m.previewTheme((m.wizard.preset+len(themePresets)-2)%len(themePresets) + 1)
+			return m, nil
+		case tea.KeyDown:
+			m.previewTheme(m.wizard.preset%len(themePresets) + 1)
+			return m, nil
+		case tea.KeyEnter:
+			m.userInput.SetValue(strings.TrimSpace(m.userInput.Value()))
+			m.wizard.step = wizardServer
+			m.userInput.Blur()
+			return m, m.serverInput.Focus()
+		}
+		var cmd tea.Cmd
+		m.userInput, cmd = m.userInput.Update(msg)
+		return m, cmd
+
+	case wizardServer:
+		switch msg.Type {
+		case tea.KeyEsc:
+			m.wizard.step = wizardProfile
+			m.wizard.err = nil
+			m.serverInput.Blur()
+			return m, m.userInput.Focus()
+		case tea.KeyEnter:
+			address := strings.TrimSpace(m.serverInput.Value())
+			if address == "" {
+				address = m.serverInput.Placeholder
+			}
+			m.serverInput.SetValue(address)
+			m.wizard.probing = true
+			m.wizard.err = nil
+			opts := DialOptions{TLS: m.config.TLS, InsecureSkipVerify: m.config.InsecureSkipVerify}
+			return m, forTab(m.id, probeServerCmd(address, opts))
+		}
+		var cmd tea.Cmd
+		m.serverInput, cmd = m.serverInput.Update(msg)
+		return m, cmd
+
+	default:
+		switch msg.Type {
+		case tea.KeyEsc:
+			m.wizard.step = wizardServer
+			m.wizard.err = nil
+			return m, m.serverInput.Focus()
+		case tea.KeyEnter:
+			return m.finishWizard()
+		}
+		return m, nil
+	}
+}
+
+// probed moves on to the summary once the server has answered
+func (m mainModel) probed(msg probeResultMsg) (mainModel, tea.Cmd) {
+	if m.state != wizardView {
+		return m, nil
+	}
+	m.wizard.probing = false
+	m.wizard.err = msg.err
+	if msg.err == nil {
+		m.wizard.step = wizardConfirm
+		m.serverInput.Blur()
+	}
+	return m, nil
+}
+
+// finishWizard saves the choices, with the server in the address book, and
+// opens the login form with everything but the password filled in
+func (m mainModel) finishWizard() (mainModel, tea.Cmd) {
+	cfg := m.config
+	address, useTLS := splitScheme(m.serverInput.Value(), cfg.TLS)
+	cfg.Servers = append(cfg.Servers, SavedServer{
+		Name:     address,
+		Address:  address,
+		Username: m.userInput.Value(),
+		TLS:      useTLS,
+	})
+	if err := SaveConfig(configPath(), cfg); err != nil {
+		m.wizard.err = fmt.Errorf("couldn't save %s: %v", configPath(), err)
+		return m, nil
+	}
+	m.config = cfg
+	m.saveOffered = true // It's saved already
+
+	m.state = loginView
+	m.focusIndex = focusPass
+	if m.userInput.Value() == "" {
+		m.focusIndex = focusUser
+	}
+	return m, m.updateFocus()
+}
+
+// skipWizard saves the default settings, so the wizard doesn't come back,
+// and goes to the login form
+func (m mainModel) skipWizard() (mainModel, tea.Cmd) {
+	defaults := DefaultConfig()
+	m.config.ThemeConfig = defaults.ThemeConfig
+	m.styles = InitStyles(m.config)
+	if err := SaveConfig(configPath(), m.config); err != nil {
+		m.err = fmt.Errorf("couldn't save %s: %v", configPath(), err)
+	}
+	m.state = loginView
+	m.focusIndex = focusServer
+	return m, m.updateFocus()
+}
+
+func (m mainModel) wizardView() string {
+	titleStyle := lipgloss.NewStyle().
+		Foreground(m.styles.PrimaryColor).
+		Bold(true)
+	labelStyle := lipgloss.NewStyle().
+		Foreground(m.styles.SecondaryColor).
+		Bold(true)
+	infoStyle := lipgloss.NewStyle().
+		Foreground(lipgloss.Color("#6B7280")).
+		Italic(true)
+	inputBorder := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(m.styles.SecondaryColor).
+		Padding(0, 1)
+
+	parts := []string{
+		titleStyle.Render(fmt.Sprintf("WELCOME TO ECHO  %d/3", m.wizard.step+1)),
+		"",
+	}
+	var hint string
+	switch m.wizard.step {
+	case wizardProfile:
+		parts = append(parts,
+			labelStyle.Render(IconUser+" Username"),
+			inputBorder.Render(m.userInput.View()),
+			"",
+			labelStyle.Render(fmt.Sprintf("Theme  ↑ %s ↓", themeNames[m.wizard.preset])),
+			m.themeSwatch(),
+		)
+		hint = "↑/↓: Theme | Enter: Next | Ctrl+S: Skip setup"
+
+	case wizardServer:
+		parts = append(parts,
+			labelStyle.Render(IconServer+" Server"),
+			inputBorder.Render(m.serverInput.View()),
+		)
+		if m.wizard.probing {
+			parts = append(parts, "", m.spinnerView()+infoStyle.Render(" Checking the server..."))
+		}
+		hint = "Enter: Check server | Esc: Back | Ctrl+S: Skip setup"
+
+	default:
+		username := m.userInput.Value()
+		if username == "" {
+			username = "(asked when logging in)"
+		}
+		parts = append(parts,
+			labelStyle.Render("Username  ")+username,
+			labelStyle.Render("Theme     ")+themeNames[m.wizard.preset],
+			labelStyle.Render("Server    ")+m.serverInput.Value(),
+			"",
+			infoStyle.Render("Saved to "+configPath()+", which you can edit later"),
+		)
+		hint = "Enter: Save and log in | Esc: Back"
+	}
+	if m.wizard.err != nil {
+		parts = append(parts, "", m.styles.Error.Render(m.wizard.err.Error()))
+	}
+	parts = append(parts, "", m.styles.InlineHint(hint))
+	content := lipgloss.JoinVertical(lipgloss.Left, parts...)
+
+	box := lipgloss.NewStyle().
+		Border(lipgloss.DoubleBorder()).
+		BorderForeground(m.styles.PrimaryColor).
+		Padding(1, 4).
+		Render(content)
+
+	return lipgloss.Place(m.width, m.height, lipgloss.Center, lipgloss.Center, box)
+}
+
+// themeSwatch shows the previewed theme's colors side by side
+func (m mainModel) themeSwatch() string {
+	theme := themePresets[m.wizard.preset]
+	var cells []string
+	for _, color := range []struct{ name, hex string }{
+		{"window", theme.WindowColor},
+		{"user", theme.UserColor},
+		{"time", theme.DateTimeColor},
+		{"msg", theme.MsgColor},
+		{"text", theme.TextColor},
+		{"whisper", theme.PrivMsgColor},
+	} {
+		block := lipgloss.NewStyle().Foreground(lipgloss.Color(color.hex)).Render("████████")
+		label := lipgloss.NewStyle().Foreground(lipgloss.Color("#6B7280")).Width(8).Render(color.name)
+		cells = append(cells, lipgloss.JoinVertical(lipgloss.Left, block, label))
+	}
+	return lipgloss.JoinHorizontal(lipgloss.Top, cells...)
+}
@@ -0,0 +1,277 @@
+const crypto = require("crypto");
+const fs = require("fs");
+const os = require("os");
+const path = require("path");
+
+// Minimal ACME (RFC 8555) client for getting the server's certificate from
+// Let's Encrypt, answering HTTP-01 challenges on port 80
+const DIRECTORY_URL = "https://acme-v02.api.letsencrypt.org/directory";
+const STAGING_DIRECTORY_URL = "https://acme-staging-v02.api.letsencrypt.org/directory";
+const CHALLENGE_PREFIX = "/.well-known/acme-challenge/";
+// The account key and certificates, kept between restarts
+const CERT_DIR = path.join(os.homedir(), ".echo", "certs");
+// Let's Encrypt certificates last 90 days. They're renewed with 30 left,
+// checking daily, and failures warn once there are 14 left.
+const DAY_MS = 24 * 60 * 60 * 1000;
+const RENEW_BEFORE_MS = 30 * DAY_MS;
+const WARN_BEFORE_MS = 14 * DAY_MS;
+// How often and how long to wait on Let's Encrypt validating a challenge
+// or issuing the certificate
+const POLL_INTERVAL_MS = 2000;
+const POLL_ATTEMPTS = 30;
+
+const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms));
+
+// DER encoding, just enough for a certificate signing request
+function der(tag, ...contents) {
+  const body = Buffer.concat(contents);
+  if (body.length < 0x80) return Buffer.concat([Buffer.from([tag, body.length]), body]);
+  const length = [];
+  for (let n = body.length; n > 0; n = Math.floor(n / 256)) length.unshift(n % 256);
+  return Buffer.concat([Buffer.from([tag, 0x80 | length.length, ...length]), body]);
+}
+
+function oid(dotted) {
+  const [first, second, ...rest] = dotted.split(".").map(Number);
+  const bytes = [first * 40 + second];
+  for (const n of rest) {
+    const chunk = [n & 0x7f];
+    for (let v = n >> 7; v > 0; v >>= 7) chunk.unshift((v & 0x7f) | 0x80);
+    bytes.push(...chunk);
+  }
+  return der(0x06, Buffer.from(bytes));
+}
+
+// A PKCS#10 request for a certificate for domain, signed with its EC key
+function csr(domain, key) {
+  const name = Buffer.from(domain);
+  const subject = der(0x30, der(0x31, der(0x30, oid("2.5.4.3"), der(0x0c, name))));
+  const altNames = der(0x30, oid("2.5.29.17"), der(0x04, der(0x30, der(0x82, name))));
+  const extensionRequest = der(0x30, oid("1.2.840.113549.1.9.14"), der(0x31, der(0x30, altNames)));
+  const info = der(
+    0x30,
+    der(0x02, Buffer.from([0])),
+    subject,
+    crypto.createPublicKey(key).export({ type: "spki", format: "der" }),
+    der(0xa0, extensionRequest)
+  );
+  const signature = crypto.sign("sha256", info, key);
+  return der(0x30, info, der(0x30, oid("1.2.840.10045.4.3.2")), der(0x03, Buffer.from([0]), signature));
+}
+
+// The account key's public half as a JWK, members in the order RFC 7638
+// thumbprints need
+function jwk(key) {
+  const { crv, kty, x, y } = crypto.createPublicKey(key).export({ format: "jwk" });
+  return { crv, kty, x, y };
+}
+
+function thumbprint(key) {
+  return crypto.createHash("sha256").update(JSON.stringify(jwk(key))).digest("base64url");
+}
+
+function newKey() {
+  return crypto.generateKeyPairSync("ec", { namedCurve: "P-256" }).privateKey;
+}
+
+// The account key from CERT_DIR, made on first use
+function accountKey() {
+  const file = path.join(CERT_DIR, "account.key");
+  try {
+    return crypto.createPrivateKey(fs.readFileSync(file));
+  } catch (error) {
+    if (error.code !== "ENOENT") throw error;
+  }
+  const key = newKey();
+  fs.writeFileSync(file, key.export({ type: "pkcs8", format: "pem" }), { mode: 0o600 });
+  return key;
+}
+
+// A problem document's explanation, or the status if there isn't one
+async function problem(res) {
+  const body = await res.json().catch(() => ({}));
+  return { type: body.type, detail: body.detail || `HTTP ${res.status}` };
+}
+
+async function nonce(account) {
+  if (account.nonce) {
+    const next = account.nonce;
+    account.nonce = null;
+    return next;
+  }
+  const res = await fetch(account.directory.newNonce, { method: "HEAD" });
+  return res.headers.get("replay-nonce");
+}
+
+// POST a JWS-signed payload to url; without a payload it's a POST-as-GET.
+// A stale nonce is retried once with the fresh one the error came with.
+async function post(account, url, payload) {
+  const body = payload === undefined ? "" : Buffer.from(JSON.stringify(payload)).toString("base64url");
+  for (let attempt = 0; ; attempt++) {
+    const header = { alg: "ES256", nonce: await nonce(account), url };
+    if (account.kid) header.kid = account.kid;
+    else header.jwk = jwk(account.key);
+    const protectedHeader = Buffer.from(JSON.stringify(header)).toString("base64url");
+    const signature = crypto.sign("sha256", Buffer.from(`${protectedHeader}.${body}`), {
+      key: account.key,
+      dsaEncoding: "ieee-p1363",
+    });
+
+    const res = await fetch(url, {
+      method: "POST",
+      headers: { "Content-Type": "application/jose+json" },
+      body: JSON.stringify({
+        protected: protectedHeader,
+        payload: body,
+        signature: signature.toString("base64url"),
+      }),
+    });
+    account.nonce = res.headers.get("replay-nonce");
+    if (res.ok) return res;
+    const { type, detail } = await problem(res);
+    if (type !== "urn:ietf:params:acme:error:badNonce" || attempt > 0) {
+      throw new Error(`${url}: ${detail}`);
+    }
+  }
+}
+
+// POST-as-GET url until what it describes is valid
+async function poll(account, url, what) {
+  for (let i = 0; i < POLL_ATTEMPTS; i++) {
+    const resource = await (await post(account, url)).json();
+    if (resource.status === "valid") return resource;
+    if (resource.status === "invalid") {
+      const failed = (resource.challenges || []).find((challenge) => challenge.error);
+      throw new Error(`${what} failed: ${failed ? failed.error.detail : "invalid"}`);
+    }
+    await sleep(POLL_INTERVAL_MS);
+  }
+  throw new Error(`${what} still pending after ${(POLL_ATTEMPTS * POLL_INTERVAL_MS) / 1000}s`);
+}
+
+// Find or make the account for the account key
+async function login(staging) {
+  const res = await fetch(staging ? STAGING_DIRECTORY_URL : DIRECTORY_URL);
+  if (!res.ok) throw new Error(`ACME directory: HTTP ${res.status}`);
+  const account = { directory: await res.json(), key: accountKey(), kid: null, nonce: null };
+  const created = await post(account, account.directory.newAccount, { termsOfServiceAgreed: true });
+  account.kid = created.headers.get("location");
+  return account;
+}
+
+// Prove control of the authorization's domain with its HTTP-01 challenge,
+// served from challenges while Let's Encrypt checks it
+async function authorize(account, url, challenges) {
+  const authorization = await (await post(account, url)).json();
+  if (authorization.status === "valid") return;
+  const domain = authorization.identifier.value;
+  const challenge = authorization.challenges.find((c) => c.type === "http-01");
+  if (!challenge) throw new Error(`no http-01 challenge offered for ${domain}`);
+
+  challenges.set(challenge.token, `${challenge.token}.${thumbprint(account.key)}`);
+  try {
+    await post(account, challenge.url, {});
+    await poll(account, url, `validating ${domain}`);
+  } finally {
+    challenges.delete(challenge.token);
+  }
+}
+
+// Get a new certificate for domain, as { cert, key } PEMs
+async function issue(domain, { staging, challenges }) {
+  const account = await login(staging);
+  const created = await post(account, account.directory.newOrder, {
+    identifiers: [{ type: "dns", value: domain }],
+  });
+  const orderUrl = created.headers.get("location");
+  const order = await created.json();
+  for (const url of order.authorizations) await authorize(account, url, challenges);
+
+  const key = newKey();
+  await post(account, order.finalize, { csr: csr(domain, key).toString("base64url") });
+  const issued = await poll(account, orderUrl, `issuing the certificate for ${domain}`);
+  const cert = await (await post(account, issued.certificate)).text();
+  return { cert, key: key.export({ type: "pkcs8", format: "pem" }) };
+}
+
+function certFiles(domain, staging) {
+  const base = path.join(CERT_DIR, staging ? `${domain}.staging` : domain);
+  return { cert: `${base}.crt`, key: `${base}.key` };
+}
+
+// The certificate for domain saved from before, or null
+function load(domain, staging) {
+  const files = certFiles(domain, staging);
+  try {
+    return { cert: fs.readFileSync(files.cert, "utf8"), key: fs.readFileSync(files.key, "utf8") };
+  } catch (error) {
+    return null;
+  }
+}
+
+function save(domain, staging, { cert, key }) {
+  const files = certFiles(domain, staging);
+  fs.writeFileSync(files.key, key, { mode: 0o600 });
+  fs.writeFileSync(files.cert, cert);
+}
+
+function expiry(cert) {
+  return new Date(new crypto.X509Certificate(cert).validTo);
+}
+
+// Answer the challenges Let's Encrypt fetches over plain HTTP, and send
+// everything else to the same address over https
+function httpHandler(challenges) {
+  return (req, res) => {
+    if (req.url.startsWith(CHALLENGE_PREFIX)) {
+      const answer = challenges.get(req.url.slice(CHALLENGE_PREFIX.length));
+      res.writeHead(answer ? 200 : 404, { "Content-Type": "text/plain" });
+      res.end(answer || "Not found");
+      return;
+    }
+    const host = (req.headers.host || "").replace(/:\d+$/, "");
+    res.writeHead(301, { Location: `https://${host}${req.url}` });
+    res.end();
+  };
+}
+
+// Keep a certificate for domain: the one saved in CERT_DIR, or a new one
+// from Let's Encrypt when there's none or it's due for renewal, checked
+// again daily. Resolves with the first; later ones go to hooks.renewed.
+// hooks.event(name, details) hears of cert_issued, cert_renewed and
+// cert_expiring, and hooks.log of failed renewals.
+async function manageCertificate(domain, { staging, challenges, renewed, event, log }) {
+  fs.mkdirSync(CERT_DIR, { recursive: true, mode: 0o700 });
+  let current = load(domain, staging);
+
+  const refresh = async () => {
+    const expires = current ? expiry(current.cert) : null;
+    if (expires && expires - Date.now() > RENEW_BEFORE_MS) return false;
+    try {
+      const next = await issue(domain, { staging, challenges });
+      save(domain, staging, next);
+      event(current ? "cert_renewed" : "cert_issued", {
+        domain,
+        staging,
+        expires: expiry(next.cert).toISOString(),
+      });
+      current = next;
+      return true;
+    } catch (error) {
+      if (!current) throw error;
+      log(`Couldn't renew the certificate for ${domain}: ${error.message}`);
+      if (expires - Date.now() < WARN_BEFORE_MS) {
+        event("cert_expiring", { domain, staging, expires: expires.toISOString(), error: error.message });
+      }
+      return false;
+    }
+  };
+
+  await refresh();
+  setInterval(async () => {
+    if (await refresh()) renewed(current);
+  }, DAY_MS).unref();
+  return current;
+}
+
+module.exports = { CERT_DIR, httpHandler, manageCertificate };
@@ -0,0 +1,125 @@
+const fs = require("fs");
+const AuditLog = require("./models/AuditLog");
+
+const AUDIT_EVENTS = [
+  "connect",
+  "disconnect",
+  "auth_success",
+  "auth_failure",
+  "message",
+  "kick",
+  "ban",
+  "edit",
+  "delete",
+  "channel_create",
+  "pin",
+  "unpin",
+  "channel_mode",
+  "channel_invite",
+  "poll",
+  "filter",
+  "cert_issued",
+  "cert_renewed",
+  "cert_expiring",
+];
+const LOG_LEVELS = ["debug", "info", "warn", "error"];
+// Every message is only worth keeping while debugging; attacks and
+// moderation always are
+const EVENT_LEVELS = {
+  message: "debug",
+  auth_failure: "warn",
+  kick: "warn",
+  ban: "warn",
+  filter: "warn",
+  cert_expiring: "warn",
+};
+// The log file is rotated to <file>.1 ... <file>.5 as it reaches 100 MB
+const MAX_FILE_BYTES = 100 * 1024 * 1024;
+const MAX_ROTATIONS = 5;
+const SEARCH_LIMIT = 200;
+
+let file = "";
+let stream = null;
+let size = 0;
+let level = "info";
+
+// Write entries to path from now on; an empty path only keeps the
+// database copy
+function openFile(path) {
+  if (path === file && stream) return;
+  if (stream) stream.end();
+  file = path;
+  stream = null;
+  if (!file) return;
+  try {
+    size = fs.statSync(file).size;
+  } catch (error) {
+    size = 0;
+  }
+  stream = fs.createWriteStream(file, { flags: "a" });
+  stream.on("error", (error) => {
+    console.error(`Audit log ${file} failed:`, error.message);
+    stream = null;
+  });
+}
+
+function setLevel(next) {
+  level = next;
+}
+
+// Shift <file>.N up by one, dropping the oldest, and start a new file
+function rotate() {
+  stream.end();
+  for (let i = MAX_ROTATIONS - 1; i >= 1; i--) {
+    try {
+      fs.renameSync(`${file}.${i}`, `${file}.${i + 1}`);
+    } catch (error) {
+      // That rotation doesn't exist yet
+    }
+  }
+  try {
+    fs.renameSync(file, `${file}.1`);
+  } catch (error) {
+    console.error(`Couldn't rotate audit log ${file}:`, error.message);
+  }
+  size = 0;
+  stream = null;
+  openFile(file);
+}
+
+// Log event as a JSON line and save a copy in the database. Events below
+// the configured log level are dropped.
+function record(
+  event,
+  { user = null, channel = null, ip = null, details = {} } = {}
+) {
+  const eventLevel = EVENT_LEVELS[event] || "info";
+  if (LOG_LEVELS.indexOf(eventLevel) < LOG_LEVELS.indexOf(level)) return;
+
+  const entry = { time: new Date(), event, user, channel, ip, details };
+  if (stream) {
+    const line = JSON.stringify(entry) + "\n";
+    if (size > 0 && size + Buffer.byteLength(line) > MAX_FILE_BYTES) rotate();
+    if (stream) {
+      stream.write(line);
+      size += Buffer.byteLength(line);
+    }
+  }
+  AuditLog.create(entry).catch((error) => {
+    console.error("Error saving audit log entry:", error.message);
+  });
+}
+
+// The latest entries matching the filters, newest first
+async function search({ event, user, since, limit }) {
+  const query = {};
+  if (event) query.event = event;
+  if (user) query.user = user;
+  if (since) query.time = { $gte: since };
+  return await AuditLog.find(query, { _id: 0, __v: 0 })
+    .sort({ time: -1 })
+    .limit(Math.min(Math.max(limit || SEARCH_LIMIT, 1), SEARCH_LIMIT))
+    .lean();
+}
+
+module.exports = { AUDIT_EVENTS, openFile, setLevel, record, search };
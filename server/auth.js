@@ -0,0 +1,45 @@
+const bcrypt = require("bcrypt");
+const crypto = require("crypto");
+
+// bcrypt_cost below this is warned about at startup
+const RECOMMENDED_BCRYPT_COST = 12;
+
+let cost = RECOMMENDED_BCRYPT_COST;
+
+// Hash new passwords with this bcrypt cost from now on
+function setCost(next) {
+  cost = next;
+}
+
+async function hashPassword(password) {
+  return await bcrypt.hash(password, cost);
+}
+
+// A hash no password matches, for accounts whose password lives in the
+// LDAP directory instead
+async function unusableHash() {
+  return await bcrypt.hash(crypto.randomBytes(32).toString("hex"), cost);
+}
+
+async function verifyPassword(password, hashedPassword) {
+  return await bcrypt.compare(password, hashedPassword);
+}
+
+// Whether hashedPassword was made with a lower cost than passwords get now,
+// so it should be redone next time the password is at hand
+function needsRehash(hashedPassword) {
+  try {
+    return bcrypt.getRounds(hashedPassword) < cost;
+  } catch (error) {
+    return false;
+  }
+}
+
+module.exports = {
+  RECOMMENDED_BCRYPT_COST,
+  setCost,
+  hashPassword,
+  unusableHash,
+  verifyPassword,
+  needsRehash,
+};
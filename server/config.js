@@ -0,0 +1,405 @@
+const fs = require("fs");
+const ldap = require("./ldap");
+const pipeline = require("./pipeline");
+
+const DEFAULT_CONFIG_PATH = "server.toml";
+const LOG_LEVELS = ["debug", "info", "warn", "error"];
+const FILTER_MODES = ["block", "replace"];
+const WEBHOOK_EVENTS = ["message", "join", "leave", "mention"];
+const MIN_BCRYPT_COST = 10;
+const MAX_BCRYPT_COST = 15;
+const ROLES = ["user", "mod", "admin"];
+const MIME_TYPE_PATTERN = /^[\w.+-]+\/[\w.+-]+$/;
+
+// Settings read from the config file, falling back to the environment
+// variables used before the file existed
+function defaults() {
+  return {
+    port: parseInt(process.env.PORT, 10) || 8080,
+    max_connections: parseInt(process.env.MAX_CONNECTIONS, 10) || 1000,
+    mongodb_uri: process.env.MONGODB_URI,
+    log_level: process.env.LOG_LEVEL || "info",
+    rate_limit_rps: parseFloat(process.env.RATE_LIMIT_PER_SEC) || 5,
+    rate_limit_burst: parseInt(process.env.RATE_LIMIT_BURST, 10) || 10,
+    rate_limit_mute_ms: parseInt(process.env.RATE_LIMIT_MUTE_MS, 10) || 60000,
+    max_message_size: parseInt(process.env.MAX_MESSAGE_SIZE, 10) || 2000,
+    history_limit: parseInt(process.env.HISTORY_LIMIT, 10) || 50,
+    idle_timeout_seconds: parseInt(process.env.IDLE_TIMEOUT_SECONDS, 10) || 0,
+    shutdown_timeout_ms: parseInt(process.env.SHUTDOWN_TIMEOUT_MS, 10) || 30000,
+    metrics_enabled: process.env.METRICS_ENABLED === "true",
+    metrics_port: parseInt(process.env.METRICS_PORT, 10) || 9090,
+    filter_file: process.env.FILTER_FILE || "filters.txt",
+    filter_mode: process.env.FILTER_MODE || "block",
+    allow_guests: process.env.ALLOW_GUESTS === "true",
+    max_guests: parseInt(process.env.MAX_GUESTS, 10) || 10,
+    min_password_length: parseInt(process.env.MIN_PASSWORD_LENGTH, 10) || 8,
+    max_login_attempts: parseInt(process.env.MAX_LOGIN_ATTEMPTS, 10) || 5,
+    login_lockout_ms: parseInt(process.env.LOGIN_LOCKOUT_MS, 10) || 15 * 60 * 1000,
+    max_ip_login_failures: parseInt(process.env.MAX_IP_LOGIN_FAILURES, 10) || 20,
+    bcrypt_cost: parseInt(process.env.BCRYPT_COST, 10) || 12,
+    admin_token: process.env.ADMIN_TOKEN || "",
+    max_upload_bytes: parseInt(process.env.MAX_UPLOAD_BYTES, 10) || 10 * 1024 * 1024,
+    allowed_mime_types: (
+      process.env.ALLOWED_MIME_TYPES || "image/png,image/jpeg,image/gif,text/plain,application/pdf"
+    )
+      .split(",")
+      .map((type) => type.trim())
+      .filter(Boolean),
+    public_url: process.env.PUBLIC_URL || "",
+    require_email_verify: process.env.REQUIRE_EMAIL_VERIFY === "true",
+    smtp_host: process.env.SMTP_HOST || "localhost",
+    smtp_port: parseInt(process.env.SMTP_PORT, 10) || 25,
+    smtp_secure: process.env.SMTP_SECURE === "true",
+    smtp_user: process.env.SMTP_USER || "",
+    smtp_pass: process.env.SMTP_PASS || "",
+    smtp_from: process.env.SMTP_FROM || "echo@localhost",
+    audit_file: process.env.AUDIT_FILE ?? "audit.log",
+    irc_enabled: process.env.IRC_ENABLED === "true",
+    irc_port: parseInt(process.env.IRC_PORT, 10) || 6667,
+    grpc_enabled: process.env.GRPC_ENABLED === "true",
+    grpc_port: parseInt(process.env.GRPC_PORT, 10) || 50051,
+    motd_file: process.env.MOTD_FILE || "motd.txt",
+    presence_enabled: process.env.PRESENCE_ENABLED !== "false",
+    presence_interval_seconds: parseInt(process.env.PRESENCE_INTERVAL_SECONDS, 10) || 30,
+    poll_expiry_hours: parseFloat(process.env.POLL_EXPIRY_HOURS) || 24,
+    dedup_enabled: process.env.DEDUP_ENABLED !== "false",
+    dedup_window_size: parseInt(process.env.DEDUP_WINDOW_SIZE, 10) || 20,
+    dedup_expiry_seconds: parseInt(process.env.DEDUP_EXPIRY_SECONDS, 10) || 60,
+    tls_auto: process.env.TLS_AUTO === "true",
+    tls_domain: process.env.TLS_DOMAIN || "",
+    ldap_enabled: process.env.LDAP_ENABLED === "true",
+    ldap_url: process.env.LDAP_URL || "",
+    ldap_base_dn: process.env.LDAP_BASE_DN || "",
+    ldap_bind_dn: process.env.LDAP_BIND_DN || "",
+    ldap_bind_pass: process.env.LDAP_BIND_PASS || "",
+    ldap_user_filter: process.env.LDAP_USER_FILTER || "(uid={username})",
+    ldap_fallback: process.env.LDAP_FALLBACK === "true",
+    ldap_group_role: [],
+    otel_enabled: process.env.OTEL_ENABLED === "true",
+    otel_exporter_otlp_endpoint: process.env.OTEL_EXPORTER_OTLP_ENDPOINT || "http://localhost:4317",
+    message_pipeline: [...pipeline.STEPS],
+    webhooks: [],
+  };
+}
+
+// The value given with --<name> <value> or --<name>=<value>, or undefined
+function flagValue(argv, name) {
+  for (let i = 0; i < argv.length; i++) {
+    if (argv[i] === `--${name}` && argv[i + 1]) return argv[i + 1];
+    if (argv[i].startsWith(`--${name}=`)) return argv[i].slice(name.length + 3);
+  }
+  return undefined;
+}
+
+// The path given with --config <path> or --config=<path>
+function configPath(argv = process.argv.slice(2)) {
+  return flagValue(argv, "config") ?? DEFAULT_CONFIG_PATH;
+}
+
+// Whether --acme-staging asks for certificates from Let's Encrypt's
+// staging environment, which isn't trusted but has generous rate limits
+function acmeStaging(argv = process.argv.slice(2)) {
+  return argv.includes("--acme-staging");
+}
+
+// The service name traces are exported as: --otel-service-name <name>,
+// --otel-service-name=<name>, $OTEL_SERVICE_NAME or echo-server
+function otelServiceName(argv = process.argv.slice(2)) {
+  return flagValue(argv, "otel-service-name") ?? (process.env.OTEL_SERVICE_NAME || "echo-server");
+}
+
+// The certificate and key files to serve wss:// with, from --cert and --key
+// or $TLS_CERT and $TLS_KEY. Either both are given or neither.
+function tlsFiles(argv = process.argv.slice(2)) {
+  const cert = flagValue(argv, "cert") ?? process.env.TLS_CERT ?? "";
+  const key = flagValue(argv, "key") ?? process.env.TLS_KEY ?? "";
+  if (!cert !== !key) throw new Error("--cert and --key must be given together");
+  return { cert, key };
+}
+
+// How long shutdown waits for running handlers: --shutdown-timeout <ms>,
+// or shutdown_timeout_ms from the config
+function shutdownTimeoutMs(config, argv = process.argv.slice(2)) {
+  const flag = flagValue(argv, "shutdown-timeout");
+  if (flag === undefined) return config.shutdown_timeout_ms;
+  const ms = Number(flag);
+  if (!Number.isInteger(ms) || ms < 0) {
+    throw new Error("--shutdown-timeout must be a whole number of milliseconds");
+  }
+  return ms;
+}
+
+// Parse the subset of TOML the config needs: key = value lines with
+// strings, numbers, booleans and arrays of strings, [[name]] headers
+// starting another table in an array, and # comments
+function parseToml(text) {
+  const values = {};
+  let table = values;
+  text.split(/\r?\n/).forEach((line, i) => {
+    line = line.replace(/^\s+|\s+$/g, "");
+    if (!line || line.startsWith("#")) return;
+
+    const header = line.match(/^\[\[\s*([A-Za-z0-9_-]+)\s*\]\]\s*(#.*)?$/);
+    if (header) {
+      const name = header[1];
+      if (!(name in values)) values[name] = [];
+      if (!Array.isArray(values[name])) {
+        throw new Error(`line ${i + 1}: ${name} is already a setting`);
+      }
+      table = {};
+      values[name].push(table);
+      return;
+    }
+
+    const match = line.match(
+      /^([A-Za-z0-9_-]+)\s*=\s*("(?:[^"\\]|\\.)*"|[^#]*?)\s*(#.*)?$/
+    );
+    if (!match) throw new Error(`line ${i + 1}: expected key = value`);
+
+    const [, key, raw] = match;
+    if (raw.startsWith('"')) {
+      table[key] = JSON.parse(raw);
+    } else if (raw.startsWith("[")) {
+      table[key] = parseStringArray(raw, i, key);
+    } else if (raw === "true" || raw === "false") {
+      table[key] = raw === "true";
+    } else if (raw !== "" && !isNaN(Number(raw.replace(/_/g, "")))) {
+      table[key] = Number(raw.replace(/_/g, ""));
+    } else {
+      throw new Error(`line ${i + 1}: invalid value for ${key}`);
+    }
+  });
+  return values;
+}
+
+// Parse ["a", "b"], the only kind of array the config has
+function parseStringArray(raw, i, key) {
+  let array;
+  try {
+    array = JSON.parse(raw);
+  } catch (error) {
+    throw new Error(`line ${i + 1}: invalid value for ${key}`);
+  }
+  if (!array.every((item) => typeof item === "string")) {
+    throw new Error(`line ${i + 1}: ${key} must be an array of strings`);
+  }
+  return array;
+}
+
+// Check a [[webhooks]] table, filling in defaults. Without a name it is
+// known by its URL's host. It needs a secret, as requests signed with an
+// empty one could come from anyone.
+function parseWebhook(hook, index) {
+  const where = `webhook ${index + 1}`;
+  for (const key of Object.keys(hook)) {
+    if (!["name", "url", "channel", "events", "secret"].includes(key)) {
+      throw new Error(`${where}: unknown setting ${key}`);
+    }
+  }
+  let url;
+  try {
+    url = new URL(hook.url);
+  } catch (error) {
+    throw new Error(`${where}: url must be an http:// or https:// URL`);
+  }
+  if (url.protocol !== "http:" && url.protocol !== "https:") {
+    throw new Error(`${where}: url must be an http:// or https:// URL`);
+  }
+
+  const webhook = {
+    name: hook.name ?? url.host,
+    url: hook.url,
+    channel: hook.channel ?? "*",
+    events: hook.events ?? ["message"],
+    secret: hook.secret ?? "",
+  };
+  for (const key of ["name", "channel", "secret"]) {
+    if (typeof webhook[key] !== "string") {
+      throw new Error(`${where}: ${key} must be a string`);
+    }
+  }
+  if (!webhook.secret) {
+    throw new Error(`${where}: secret is needed to sign requests`);
+  }
+  webhook.channel = webhook.channel.replace(/^#/, "");
+  for (const event of webhook.events) {
+    if (!WEBHOOK_EVENTS.includes(event)) {
+      throw new Error(`${where}: events must be among ${WEBHOOK_EVENTS.join(", ")}`);
+    }
+  }
+  return webhook;
+}
+
+// Check a [[ldap_group_role]] table, giving members of an LDAP group
+// (a DN in their memberOf) a role
+function parseGroupRole(mapping, index) {
+  const where = `ldap_group_role ${index + 1}`;
+  for (const key of Object.keys(mapping)) {
+    if (!["group", "role"].includes(key)) {
+      throw new Error(`${where}: unknown setting ${key}`);
+    }
+  }
+  if (typeof mapping.group !== "string" || !mapping.group) {
+    throw new Error(`${where}: group must be the group's DN`);
+  }
+  if (!ROLES.includes(mapping.role)) {
+    throw new Error(`${where}: role must be one of ${ROLES.join(", ")}`);
+  }
+  return { group: mapping.group, role: mapping.role };
+}
+
+// Check the LDAP settings once ldap_enabled is on
+function validateLdap(config) {
+  if (!/^ldaps?:\/\/[^/]/.test(config.ldap_url)) {
+    throw new Error("ldap_url must be an ldap:// or ldaps:// URL");
+  }
+  if (!config.ldap_base_dn) throw new Error("ldap_base_dn is needed to search for users");
+  if (!config.ldap_user_filter.includes("{username}")) {
+    throw new Error("ldap_user_filter must contain {username}");
+  }
+  try {
+    ldap.encodeFilter(config.ldap_user_filter.replaceAll("{username}", "user"));
+  } catch (error) {
+    throw new Error(`ldap_user_filter is invalid: ${error.message}`);
+  }
+}
+
+// Load the config file at path over the defaults. A missing file just
+// means defaults; a malformed one throws.
+function loadConfig(path) {
+  const config = defaults();
+  let text;
+  try {
+    text = fs.readFileSync(path, "utf8");
+  } catch (error) {
+    if (error.code === "ENOENT") return config;
+    throw error;
+  }
+
+  for (const [key, value] of Object.entries(parseToml(text))) {
+    if (!(key in config)) throw new Error(`unknown setting ${key}`);
+    if (key === "webhooks") {
+      if (!Array.isArray(value)) throw new Error("webhooks must be [[webhooks]] tables");
+      config.webhooks = value.map(parseWebhook);
+      continue;
+    }
+    if (key === "ldap_group_role") {
+      if (!Array.isArray(value)) throw new Error("ldap_group_role must be [[ldap_group_role]] tables");
+      config.ldap_group_role = value.map(parseGroupRole);
+      continue;
+    }
+    const expected = key === "mongodb_uri" ? "string" : typeof config[key];
+    if (typeof value !== expected) {
+      throw new Error(`${key} must be a ${expected}`);
+    }
+    config[key] = value;
+  }
+  if (!LOG_LEVELS.includes(config.log_level)) {
+    throw new Error(`log_level must be one of ${LOG_LEVELS.join(", ")}`);
+  }
+  if (!FILTER_MODES.includes(config.filter_mode)) {
+    throw new Error(`filter_mode must be one of ${FILTER_MODES.join(", ")}`);
+  }
+  if (
+    !Number.isInteger(config.bcrypt_cost) ||
+    config.bcrypt_cost < MIN_BCRYPT_COST ||
+    config.bcrypt_cost > MAX_BCRYPT_COST
+  ) {
+    throw new Error(`bcrypt_cost must be from ${MIN_BCRYPT_COST} to ${MAX_BCRYPT_COST}`);
+  }
+  if (!Number.isInteger(config.rate_limit_mute_ms) || config.rate_limit_mute_ms < 1) {
+    throw new Error("rate_limit_mute_ms must be a whole number of milliseconds, at least 1");
+  }
+  if (!Number.isInteger(config.shutdown_timeout_ms) || config.shutdown_timeout_ms < 0) {
+    throw new Error("shutdown_timeout_ms must be a whole number of milliseconds");
+  }
+  if (!Number.isInteger(config.history_limit) || config.history_limit < 1) {
+    throw new Error("history_limit must be a whole number of messages, at least 1");
+  }
+  if (!Number.isInteger(config.presence_interval_seconds) || config.presence_interval_seconds < 1) {
+    throw new Error("presence_interval_seconds must be a whole number of seconds, at least 1");
+  }
+  if (!(config.poll_expiry_hours > 0)) {
+    throw new Error("poll_expiry_hours must be more than 0");
+  }
+  if (!Number.isInteger(config.dedup_window_size) || config.dedup_window_size < 1) {
+    throw new Error("dedup_window_size must be a whole number, at least 1");
+  }
+  if (!Number.isInteger(config.dedup_expiry_seconds) || config.dedup_expiry_seconds < 1) {
+    throw new Error("dedup_expiry_seconds must be a whole number of seconds, at least 1");
+  }
+  for (const key of ["max_login_attempts", "login_lockout_ms", "max_ip_login_failures"]) {
+    if (!Number.isInteger(config[key]) || config[key] < 1) {
+      throw new Error(`${key} must be a whole number, at least 1`);
+    }
+  }
+  if (!Number.isInteger(config.max_upload_bytes) || config.max_upload_bytes < 1) {
+    throw new Error("max_upload_bytes must be a whole number of bytes, at least 1");
+  }
+  if (
+    !Array.isArray(config.allowed_mime_types) ||
+    !config.allowed_mime_types.every((type) => MIME_TYPE_PATTERN.test(type))
+  ) {
+    throw new Error('allowed_mime_types must be an array of types like "image/png"');
+  }
+  if (!Number.isInteger(config.smtp_port) || config.smtp_port < 1 || config.smtp_port > 65535) {
+    throw new Error("smtp_port must be a port number");
+  }
+  if (config.public_url && !/^https?:\/\/[^/]/.test(config.public_url)) {
+    throw new Error("public_url must be an http:// or https:// URL");
+  }
+  if (config.tls_auto && !config.tls_domain) {
+    throw new Error("tls_auto needs tls_domain, the name the certificate is for");
+  }
+  if (config.ldap_enabled) validateLdap(config);
+  if (config.otel_enabled && !config.otel_exporter_otlp_endpoint) {
+    throw new Error("otel_enabled needs otel_exporter_otlp_endpoint, the collector to send traces to");
+  }
+  pipeline.validate(config.message_pipeline);
+  return config;
+}
+
+// Silence console output below the configured level
+const consoleMethods = {
+  debug: console.debug,
+  log: console.log,
+  warn: console.warn,
+};
+function applyLogLevel(level) {
+  const rank = LOG_LEVELS.indexOf(level);
+  const noop = () => {};
+  console.debug = rank <= 0 ? consoleMethods.debug : noop;
+  console.log = rank <= 1 ? consoleMethods.log : noop;
+  console.warn = rank <= 2 ? consoleMethods.warn : noop;
+}
+
+// Settings left out of the summary, as they hold credentials
+const SECRET_SETTINGS = ["mongodb_uri", "admin_token", "ldap_bind_pass", "smtp_pass"];
+
+// One line per active setting, leaving out the secrets
+function summary(config) {
+  return Object.entries(config)
+    .filter(([key]) => !SECRET_SETTINGS.includes(key))
+    .map(([key, value]) => {
+      if (key === "webhooks") {
+        return `  ${key} = ${value.map((hook) => hook.name).join(", ") || "none"}`;
+      }
+      if (key === "ldap_group_role") {
+        return `  ${key} = ${value.map(({ group, role }) => `${group} -> ${role}`).join(", ") || "none"}`;
+      }
+      return `  ${key} = ${value}`;
+    })
+    .join("\n");
+}
+
+module.exports = {
+  WEBHOOK_EVENTS,
+  configPath,
+  acmeStaging,
+  otelServiceName,
+  tlsFiles,
+  shutdownTimeoutMs,
+  loadConfig,
+  applyLogLevel,
+  summary,
+};
@@ -0,0 +1,40 @@
+// WCAG 2.1 contrast between display colors and the clients' dark
+// background, which messages have to stay readable against
+const BACKGROUND = "#0D1117";
+const MIN_CONTRAST = 4.5;
+
+// Relative luminance of a #RRGGBB color, from 0 for black to 1 for white
+function relativeLuminance(hex) {
+  const [r, g, b] = [1, 3, 5].map((i) => {
+    const c = parseInt(hex.slice(i, i + 2), 16) / 255;
+    return c <= 0.03928 ? c / 12.92 : ((c + 0.055) / 1.055) ** 2.4;
+  });
+  return 0.2126 * r + 0.7152 * g + 0.0722 * b;
+}
+
+// Contrast ratio of two colors, from 1 for the same color to 21 for
+// black on white
+function contrastRatio(a, b) {
+  const [light, dark] = [relativeLuminance(a), relativeLuminance(b)].sort((x, y) => y - x);
+  return (light + 0.05) / (dark + 0.05);
+}
+
+// The color lightened just enough to read on the background, or as it is
+// if it already does
+function readableColor(hex, background = BACKGROUND) {
+  const rgb = [1, 3, 5].map((i) => parseInt(hex.slice(i, i + 2), 16));
+  for (let step = 0; step <= 20; step++) {
+    const mixed = rgb.map((c) => Math.round(c + ((255 - c) * step) / 20));
+    const candidate = "#" + mixed.map((c) => c.toString(16).padStart(2, "0")).join("").toUpperCase();
+    if (contrastRatio(candidate, background) >= MIN_CONTRAST) return candidate;
+  }
+  return "#FFFFFF";
+}
+
+module.exports = {
+  BACKGROUND,
+  MIN_CONTRAST,
+  relativeLuminance,
+  contrastRatio,
+  readableColor,
+};
@@ -0,0 +1,52 @@
+// Messages are duplicates when the same user sends the same body within
+// the same BUCKET_SECONDS slice of time
+const BUCKET_SECONDS = 30;
+
+const FNV_OFFSET = 0xcbf29ce484222325n;
+const FNV_PRIME = 0x100000001b3n;
+const MASK_64 = 0xffffffffffffffffn;
+
+// 64-bit FNV-1a of text's UTF-8 bytes, as hex
+function fnv64(text) {
+  let hash = FNV_OFFSET;
+  for (const byte of Buffer.from(text, "utf8")) {
+    hash ^= BigInt(byte);
+    hash = (hash * FNV_PRIME) & MASK_64;
+  }
+  return hash.toString(16);
+}
+
+// The last few message hashes of each user. Each hash is forgotten after
+// expiryMs, and past size the oldest goes first.
+class DuplicateWindow {
+  constructor() {
+    this.windows = new Map();
+  }
+
+  // Note a message, reporting whether it duplicates one still remembered
+  check(username, text, size, expiryMs) {
+    const bucket = Math.floor(Date.now() / 1000 / BUCKET_SECONDS);
+    const hash = fnv64(`${username}\n${text}\n${bucket}`);
+    let window = this.windows.get(username);
+    if (window && window.includes(hash)) return true;
+
+    if (!window) {
+      window = [];
+      this.windows.set(username, window);
+    }
+    window.push(hash);
+    if (window.length > size) window.splice(0, window.length - size);
+    setTimeout(() => this.forget(username, hash), expiryMs).unref();
+    return false;
+  }
+
+  forget(username, hash) {
+    const window = this.windows.get(username);
+    if (!window) return;
+    const at = window.indexOf(hash);
+    if (at !== -1) window.splice(at, 1);
+    if (window.length === 0) this.windows.delete(username);
+  }
+}
+
+module.exports = { DuplicateWindow, fnv64 };
@@ -0,0 +1,49 @@
+const fs = require("fs");
+
+const REPLACEMENT = "***";
+
+// Turn one filters.txt line into a case-insensitive pattern; * matches
+// any run of non-space characters, so "darn*" also catches "darned". The
+// line is kept as the pattern's rule, for the audit log.
+function compilePattern(line) {
+  const source = line
+    .split("*")
+    .map((part) => part.replace(/[.+?^${}()|[\]\\]/g, "\\$&"))
+    .join("\\S*");
+  const pattern = new RegExp(source, "gi");
+  pattern.rule = line;
+  return pattern;
+}
+
+// Read the filter list, one pattern per line, skipping blanks and
+// # comments. A missing file means nothing is filtered.
+function loadFilters(path) {
+  let text;
+  try {
+    text = fs.readFileSync(path, "utf8");
+  } catch (error) {
+    if (error.code === "ENOENT") return [];
+    throw error;
+  }
+  return text
+    .split(/\r?\n/)
+    .map((line) => line.trim())
+    .filter((line) => line && !line.startsWith("#") && line !== "*")
+    .map(compilePattern);
+}
+
+// Check text against the filters, returning whether anything matched, the
+// rules that did, and the text with every match replaced
+function applyFilters(filters, text) {
+  const rules = [];
+  let cleaned = text;
+  for (const pattern of filters) {
+    cleaned = cleaned.replace(pattern, () => {
+      if (!rules.includes(pattern.rule)) rules.push(pattern.rule);
+      return REPLACEMENT;
+    });
+  }
+  return { matched: rules.length > 0, rules, cleaned };
+}
+
+module.exports = { loadFilters, applyFilters };
@@ -0,0 +1,198 @@
+const crypto = require("crypto");
+const path = require("path");
+const { EventEmitter } = require("events");
+const grpc = require("@grpc/grpc-js");
+const protoLoader = require("@grpc/proto-loader");
+
+// The ChatService in proto/chat.proto, for clients that would rather speak
+// gRPC than websockets. Each gRPC session stands in for a websocket, so
+// the server logs it in and handles its frames exactly as it does theirs.
+const PROTO_PATH = path.join(__dirname, "proto", "chat.proto");
+// How long Login waits on each answer from the server, and how long a
+// session that logged in but never called ReceiveMessages is kept
+const LOGIN_TIMEOUT_MS = 15000;
+const SUBSCRIBE_TIMEOUT_MS = 30000;
+// The websocket readyStates the server checks
+const OPEN = 1;
+const CLOSED = 3;
+// Websocket close codes that end the stream with an error status
+const CLOSE_GOING_AWAY = 1001;
+const CLOSE_KICKED = 4000;
+
+// A gRPC client's connection, looking enough like a websocket for the
+// server: frames it sends arrive as "message" events, and what the server
+// sends it goes to ReceiveMessages' stream, or waits for one
+class Session extends EventEmitter {
+  constructor() {
+    super();
+    this.id = crypto.randomBytes(16).toString("hex");
+    this.readyState = OPEN;
+    this.protocol = "echo-v1";
+    this.bufferedAmount = 0;
+    this.queue = [];
+    this.stream = null;
+    this.waiting = null;
+  }
+
+  send(frame) {
+    if (this.readyState !== OPEN) return;
+    if (this.waiting) {
+      this.waiting(frame);
+    } else if (this.stream) {
+      this.stream.write({ frame });
+    } else {
+      this.queue.push(frame);
+    }
+  }
+
+  // Send frame as the client, resolving with the server's next frame, or
+  // null if the session ends or the server stays quiet
+  request(frame) {
+    return new Promise((resolve) => {
+      const finish = (reply) => {
+        clearTimeout(timer);
+        this.off("close", onClose);
+        this.waiting = null;
+        resolve(reply);
+      };
+      const onClose = () => finish(null);
+      const timer = setTimeout(() => finish(null), LOGIN_TIMEOUT_MS);
+      this.waiting = finish;
+      this.on("close", onClose);
+      this.emit("message", frame);
+    });
+  }
+
+  // Take over stream, sending it what the server sent since logging in
+  subscribe(stream) {
+    this.stream = stream;
+    for (const frame of this.queue.splice(0)) stream.write({ frame });
+  }
+
+  // End the session the way the server would close a websocket
+  close(code = 1000, reason = "") {
+    if (this.readyState !== OPEN) return;
+    this.readyState = CLOSED;
+    if (this.stream) {
+      if (code === CLOSE_GOING_AWAY) {
+        this.stream.emit("error", { code: grpc.status.UNAVAILABLE, details: reason });
+      } else if (code === CLOSE_KICKED) {
+        this.stream.emit("error", { code: grpc.status.PERMISSION_DENIED, details: reason });
+      } else {
+        this.stream.end();
+      }
+    }
+    this.emit("close", code, Buffer.from(reason));
+  }
+}
+
+// The client's address from a peer like 1.2.3.4:5678 or [::1]:5678
+function peerAddress(call) {
+  return call.getPeer().replace(/:\d+$/, "").replace(/^\[|\]$/g, "");
+}
+
+// The first frame a websocket client sends: its credentials, or the token
+// of a session to resume
+function credentialsFrame(request) {
+  if (request.token && !request.password) return `TOKEN:${request.token}`;
+  const creds = { username: request.username, password: request.password };
+  if (request.email) creds.email = request.email;
+  return JSON.stringify(creds);
+}
+
+// Serve the ChatService on port with credentials. handlers.admit(ip)
+// resolves with why a connection is refused, or null; handlers.connect
+// (session, ip) hands a session to the server like a new websocket.
+function startGrpcServer(port, credentials, handlers) {
+  const definition = protoLoader.loadSync(PROTO_PATH, { keepCase: true, defaults: true });
+  const { ChatService } = grpc.loadPackageDefinition(definition).echo.v1;
+  const sessions = new Map();
+
+  // The open session a request names, or null after failing call with
+  // NOT_FOUND
+  function find(id, fail) {
+    const session = sessions.get(id);
+    if (session && session.readyState === OPEN) return session;
+    fail({ code: grpc.status.NOT_FOUND, details: "no such session, log in again" });
+    return null;
+  }
+
+  async function login(call, callback) {
+    const ip = peerAddress(call);
+    const refusal = await handlers.admit(ip);
+    if (refusal) {
+      callback({ code: grpc.status.UNAVAILABLE, details: refusal });
+      return;
+    }
+
+    const session = new Session();
+    handlers.connect(session, ip);
+    let reply = await session.request(credentialsFrame(call.request));
+    if (reply === "TOTP_REQUIRED") {
+      if (!call.request.totp) {
+        session.close();
+        callback({ code: grpc.status.FAILED_PRECONDITION, details: "TOTP_REQUIRED" });
+        return;
+      }
+      reply = await session.request(`TOTP:${call.request.totp}`);
+    }
+    if (reply === null || reply.startsWith("ERROR:")) {
+      session.close();
+      callback({ code: grpc.status.UNAUTHENTICATED, details: reply || "ERROR: No answer from the server" });
+      return;
+    }
+
+    // The reply was the join announcement, which websocket clients skip too
+    sessions.set(session.id, session);
+    session.on("close", () => sessions.delete(session.id));
+    setTimeout(() => {
+      if (!session.stream) session.close();
+    }, SUBSCRIBE_TIMEOUT_MS).unref();
+    callback(null, { session: session.id });
+  }
+
+  function sendMessage(call, callback) {
+    const session = find(call.request.session, callback);
+    if (!session) return;
+    session.emit("message", call.request.frame);
+    callback(null, {});
+  }
+
+  function receiveMessages(call) {
+    const session = find(call.request.session, (error) => call.emit("error", error));
+    if (!session) return;
+    session.subscribe(call);
+    // The client hung up, so there's no stream left to end
+    call.on("cancelled", () => {
+      session.stream = null;
+      session.close();
+    });
+  }
+
+  const server = new grpc.Server();
+  server.addService(ChatService.service, {
+    Login: login,
+    SendMessage: sendMessage,
+    ReceiveMessages: receiveMessages,
+  });
+  server.bindAsync(`0.0.0.0:${port}`, credentials, (error) => {
+    if (error) handlers.log(`gRPC server couldn't listen on port ${port}: ${error.message}`);
+  });
+
+  return {
+    close() {
+      server.tryShutdown(() => {});
+    },
+  };
+}
+
+// Credentials for serving over TLS with the websocket's certificate, or in
+// the clear without one
+function serverCredentials(tlsOptions) {
+  if (!tlsOptions) return grpc.ServerCredentials.createInsecure();
+  return grpc.ServerCredentials.createSsl(null, [
+    { cert_chain: Buffer.from(tlsOptions.cert), private_key: Buffer.from(tlsOptions.key) },
+  ]);
+}
+
+module.exports = { startGrpcServer, serverCredentials };
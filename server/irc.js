@@ -0,0 +1,266 @@
+const net = require("net");
+
+// A minimal RFC 1459 server so IRC clients can chat in Echo channels:
+// PASS, NICK, USER, JOIN, PART, PRIVMSG, PING and QUIT. Each IRC user logs
+// in as their Echo account, giving its password with PASS.
+const SERVER_NAME = "echo";
+const MAX_LINE_LENGTH = 512;
+// Clients sending this much without a line break are disconnected
+const MAX_BUFFERED = 8 * 1024;
+
+// Split a line into its command and parameters, dropping any prefix
+function parseLine(line) {
+  let rest = line;
+  if (rest.startsWith(":")) {
+    const space = rest.indexOf(" ");
+    rest = space === -1 ? "" : rest.slice(space + 1);
+  }
+  let trailing = null;
+  const colon = rest.indexOf(" :");
+  if (colon !== -1) {
+    trailing = rest.slice(colon + 2);
+    rest = rest.slice(0, colon);
+  } else if (rest.startsWith(":")) {
+    trailing = rest.slice(1);
+    rest = "";
+  }
+  const params = rest.split(" ").filter(Boolean);
+  const command = (params.shift() || "").toUpperCase();
+  if (trailing !== null) params.push(trailing);
+  return { command, params };
+}
+
+// IRC's #general is Echo's general
+function toEchoChannel(name) {
+  return name.replace(/^#/, "");
+}
+
+class IrcClient {
+  constructor(socket) {
+    this.socket = socket;
+    this.nick = null;
+    this.user = null;
+    this.password = null;
+    this.registered = false;
+    this.channels = new Set();
+    this.buffer = "";
+  }
+
+  get mask() {
+    return `${this.nick}!${this.user || this.nick}@${SERVER_NAME}`;
+  }
+
+  send(line) {
+    if (!this.socket.destroyed) {
+      this.socket.write(line.slice(0, MAX_LINE_LENGTH - 2) + "\r\n");
+    }
+  }
+
+  // A numeric reply such as 001, addressed to this client
+  reply(code, text) {
+    this.send(`:${SERVER_NAME} ${code} ${this.nick || "*"} ${text}`);
+  }
+}
+
+// Listen on port, calling into the chat server through handlers:
+//   login(nick, password, ip) resolves to an error message, or null
+//   channel(nick, name) resolves to { topic, names }, or null if it doesn't
+//     exist or nick may not enter it
+//   message(nick, channel, text) resolves to an error message, or null
+//   log(text) reports connections and failures
+// The returned bridge delivers Echo messages to IRC clients in a channel.
+function startIrcBridge(port, handlers) {
+  const clients = new Set();
+
+  // Send line to every IRC client in channel, except one
+  function toChannel(channel, line, except = null) {
+    for (const client of clients) {
+      if (client !== except && client.channels.has(channel)) client.send(line);
+    }
+  }
+
+  async function register(client) {
+    if (!client.nick || !client.user || client.registered) return;
+    const error = await handlers.login(
+      client.nick,
+      client.password || "",
+      client.socket.remoteAddress
+    );
+    if (error) {
+      client.reply("464", `:${error}`);
+      client.send(`ERROR :${error}`);
+      client.socket.end();
+      return;
+    }
+    for (const other of clients) {
+      if (other !== client && other.registered && other.nick === client.nick) {
+        client.reply("433", `${client.nick} :Nickname is already in use`);
+        client.socket.end();
+        return;
+      }
+    }
+    client.registered = true;
+    client.reply("001", `:Welcome to Echo, ${client.nick}`);
+    client.reply("422", ":MOTD File is missing");
+    handlers.log(`${client.nick} connected over IRC`);
+  }
+
+  async function join(client, names) {
+    for (const name of names.split(",").filter(Boolean)) {
+      const channel = toEchoChannel(name);
+      const info = await handlers.channel(client.nick, channel);
+      if (!info) {
+        client.reply("403", `#${channel} :No such channel`);
+        continue;
+      }
+      client.channels.add(channel);
+      toChannel(channel, `:${client.mask} JOIN #${channel}`);
+      if (info.topic) client.reply("332", `#${channel} :${info.topic}`);
+      const members = new Set(info.names);
+      for (const other of clients) {
+        if (other.channels.has(channel)) members.add(other.nick);
+      }
+      client.reply("353", `= #${channel} :${[...members].join(" ")}`);
+      client.reply("366", `#${channel} :End of /NAMES list`);
+    }
+  }
+
+  function part(client, names) {
+    for (const name of names.split(",").filter(Boolean)) {
+      const channel = toEchoChannel(name);
+      if (!client.channels.has(channel)) {
+        client.reply("442", `#${channel} :You're not on that channel`);
+        continue;
+      }
+      toChannel(channel, `:${client.mask} PART #${channel}`);
+      client.channels.delete(channel);
+    }
+  }
+
+  async function privmsg(client, target, text) {
+    if (!target.startsWith("#")) {
+      client.reply("401", `${target} :Only channels can be messaged from IRC`);
+      return;
+    }
+    const channel = toEchoChannel(target);
+    if (!client.channels.has(channel)) {
+      client.reply("404", `#${channel} :Cannot send to channel`);
+      return;
+    }
+    const error = await handlers.message(client.nick, channel, text);
+    if (error) {
+      client.send(`:${SERVER_NAME} NOTICE ${client.nick} :${error}`);
+      return;
+    }
+    toChannel(channel, `:${client.mask} PRIVMSG #${channel} :${text}`, client);
+  }
+
+  async function handleLine(client, line) {
+    const { command, params } = parseLine(line);
+    if (!command) return;
+
+    switch (command) {
+      case "PASS":
+        client.password = params[0] || "";
+        return;
+      case "NICK":
+        if (client.registered) {
+          client.reply("484", ":Your nick is your Echo username");
+          return;
+        }
+        client.nick = params[0] || null;
+        await register(client);
+        return;
+      case "USER":
+        client.user = params[0] || null;
+        await register(client);
+        return;
+      case "PING":
+        client.send(`:${SERVER_NAME} PONG ${SERVER_NAME} :${params[0] || ""}`);
+        return;
+      case "QUIT":
+        client.send("ERROR :Closing link");
+        client.socket.end();
+        return;
+    }
+
+    if (!client.registered) {
+      client.reply("451", ":You have not registered");
+      return;
+    }
+    switch (command) {
+      case "JOIN":
+        await join(client, params[0] || "");
+        return;
+      case "PART":
+        part(client, params[0] || "");
+        return;
+      case "PRIVMSG":
+        if (params.length < 2) {
+          client.reply("412", ":No text to send");
+          return;
+        }
+        await privmsg(client, params[0], params[1]);
+        return;
+      case "PONG":
+        return;
+      default:
+        client.reply("421", `${command} :Unknown command`);
+    }
+  }
+
+  const server = net.createServer((socket) => {
+    const client = new IrcClient(socket);
+    clients.add(client);
+    socket.setEncoding("utf8");
+
+    // Lines are handled one at a time, in order
+    let queue = Promise.resolve();
+    socket.on("data", (data) => {
+      client.buffer += data;
+      if (client.buffer.length > MAX_BUFFERED) {
+        socket.destroy();
+        return;
+      }
+      const lines = client.buffer.split(/\r?\n/);
+      client.buffer = lines.pop();
+      for (const line of lines) {
+        queue = queue
+          .then(() => handleLine(client, line.slice(0, MAX_LINE_LENGTH)))
+          .catch((error) =>
+            handlers.log(`IRC error from ${client.nick}: ${error.message}`)
+          );
+      }
+    });
+
+    socket.on("error", () => {});
+    socket.on("close", () => {
+      clients.delete(client);
+      if (!client.registered) return;
+      for (const channel of client.channels) {
+        toChannel(channel, `:${client.mask} QUIT :Connection closed`, client);
+      }
+      handlers.log(`${client.nick} disconnected from IRC`);
+    });
+  });
+  server.on("error", (error) =>
+    handlers.log(`IRC bridge failed: ${error.message}`)
+  );
+  server.listen(port);
+
+  return {
+    // Forward an Echo message to IRC clients in channel, a line at a time
+    deliver(channel, sender, text) {
+      const prefix = `:${sender}!${sender}@${SERVER_NAME} PRIVMSG #${channel} :`;
+      for (const line of text.split(/\r?\n/)) {
+        if (line) toChannel(channel, prefix + line);
+      }
+    },
+    close() {
+      server.close();
+      for (const client of clients) client.socket.destroy();
+    },
+  };
+}
+
+module.exports = { startIrcBridge };
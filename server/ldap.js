@@ -0,0 +1,383 @@
+const net = require("net");
+const tls = require("tls");
+
+// Minimal LDAPv3 (RFC 4511) client for checking passwords against a
+// directory: simple binds and subtree searches, over ldap:// or ldaps://
+const LDAP_TIMEOUT_MS = 10000;
+// Logins share this many connections, waiting for one beyond that
+const POOL_SIZE = 5;
+const DEFAULT_PORTS = { "ldap:": 389, "ldaps:": 636 };
+
+// Result codes worth telling apart
+const SUCCESS = 0;
+const SIZE_LIMIT_EXCEEDED = 4;
+const INVALID_CREDENTIALS = 49;
+
+// Protocol operations, as BER tags
+const BIND_REQUEST = 0x60;
+const UNBIND_REQUEST = 0x42;
+const SEARCH_REQUEST = 0x63;
+const SEARCH_RESULT_ENTRY = 0x64;
+const SEARCH_RESULT_DONE = 0x65;
+
+// BER encoding, just enough for LDAP requests
+function ber(tag, ...contents) {
+  const body = Buffer.concat(contents);
+  if (body.length < 0x80) return Buffer.concat([Buffer.from([tag, body.length]), body]);
+  const length = [];
+  for (let n = body.length; n > 0; n = Math.floor(n / 256)) length.unshift(n % 256);
+  return Buffer.concat([Buffer.from([tag, 0x80 | length.length, ...length]), body]);
+}
+
+function integer(tag, n) {
+  const bytes = [];
+  do {
+    bytes.unshift(n % 256);
+    n = Math.floor(n / 256);
+  } while (n > 0);
+  if (bytes[0] & 0x80) bytes.unshift(0);
+  return ber(tag, Buffer.from(bytes));
+}
+
+function octets(tag, value) {
+  return ber(tag, Buffer.from(value));
+}
+
+// The element at offset in buf as { tag, content, end }, or null if buf
+// doesn't hold all of it yet
+function readElement(buf, offset = 0) {
+  if (buf.length < offset + 2) return null;
+  const tag = buf[offset];
+  let length = buf[offset + 1];
+  let start = offset + 2;
+  if (length & 0x80) {
+    const size = length & 0x7f;
+    if (size === 0 || size > 4) throw new Error("unsupported BER length");
+    if (buf.length < start + size) return null;
+    length = 0;
+    for (let i = 0; i < size; i++) length = length * 256 + buf[start + i];
+    start += size;
+  }
+  if (buf.length < start + length) return null;
+  return { tag, content: buf.subarray(start, start + length), end: start + length };
+}
+
+// The elements of a constructed element's content
+function children(content) {
+  const elements = [];
+  for (let offset = 0; offset < content.length; ) {
+    const element = readElement(content, offset);
+    if (!element) throw new Error("truncated BER element");
+    elements.push(element);
+    offset = element.end;
+  }
+  return elements;
+}
+
+function readInteger(content) {
+  return content.reduce((n, byte) => n * 256 + byte, 0);
+}
+
+// Escape a value for use in a filter, so a username can't change it
+function escapeFilterValue(value) {
+  return value.replace(/[*()\\\0]/g, (c) => `\\${c.charCodeAt(0).toString(16).padStart(2, "0")}`);
+}
+
+// A filter value's bytes, with \XX escapes undone
+function unescapeFilterValue(value) {
+  const bytes = [];
+  for (let i = 0; i < value.length; ) {
+    if (value[i] === "\\") {
+      const hex = value.slice(i + 1, i + 3);
+      if (!/^[0-9A-Fa-f]{2}$/.test(hex)) throw new Error(`filter: bad escape \\${hex}`);
+      bytes.push(parseInt(hex, 16));
+      i += 3;
+    } else {
+      const char = String.fromCodePoint(value.codePointAt(i));
+      bytes.push(...Buffer.from(char));
+      i += char.length;
+    }
+  }
+  return Buffer.from(bytes);
+}
+
+// One (attribute op value) comparison of a filter
+function encodeItem(text) {
+  const match = text.match(/^([A-Za-z0-9.;-]+)(=|~=|>=|<=)(.*)$/);
+  if (!match) throw new Error(`filter: can't read (${text})`);
+  const [, attribute, op, value] = match;
+  const tags = { "=": 0xa3, ">=": 0xa5, "<=": 0xa6, "~=": 0xa8 };
+  if (op !== "=" || !value.includes("*")) {
+    return ber(tags[op], octets(0x04, attribute), ber(0x04, unescapeFilterValue(value)));
+  }
+  if (value === "*") return octets(0x87, attribute);
+
+  // Substrings: initial*any*...*final, each part optional
+  const parts = value.split("*");
+  const substrings = parts
+    .map((part, i) => {
+      if (!part) return null;
+      const tag = i === 0 ? 0x80 : i === parts.length - 1 ? 0x82 : 0x81;
+      return ber(tag, unescapeFilterValue(part));
+    })
+    .filter(Boolean);
+  return ber(0xa4, octets(0x04, attribute), ber(0x30, ...substrings));
+}
+
+// Encode an RFC 4515 filter like (&(objectClass=person)(uid=alice))
+function encodeFilter(text) {
+  let pos = 0;
+  const expect = (char) => {
+    if (text[pos] !== char) throw new Error(`filter: expected ${char} at position ${pos + 1}`);
+    pos++;
+  };
+  const parse = () => {
+    expect("(");
+    let filter;
+    const op = text[pos];
+    if (op === "&" || op === "|") {
+      pos++;
+      const parts = [];
+      while (text[pos] === "(") parts.push(parse());
+      filter = ber(op === "&" ? 0xa0 : 0xa1, ...parts);
+    } else if (op === "!") {
+      pos++;
+      filter = ber(0xa2, parse());
+    } else {
+      // Values escape their parentheses, so the next ) ends this one
+      const end = text.indexOf(")", pos);
+      if (end === -1) throw new Error("filter: missing )");
+      filter = encodeItem(text.slice(pos, end));
+      pos = end;
+    }
+    expect(")");
+    return filter;
+  };
+
+  const filter = parse();
+  if (pos !== text.length) throw new Error("filter: unexpected text after the end");
+  return filter;
+}
+
+// An LDAPResult's code and diagnostic message
+function readResult(op) {
+  const [code, , message] = children(op.content);
+  return { code: readInteger(code.content), message: message ? message.content.toString() : "" };
+}
+
+function readEntry(op) {
+  const [name, list] = children(op.content);
+  const attributes = {};
+  for (const attribute of children(list.content)) {
+    const [type, values] = children(attribute.content);
+    attributes[type.content.toString().toLowerCase()] = children(values.content).map((value) =>
+      value.content.toString()
+    );
+  }
+  return { dn: name.content.toString(), attributes };
+}
+
+// One connection to the directory, which can carry several requests at once
+class Connection {
+  constructor(url) {
+    const { protocol, hostname, port } = new URL(url);
+    const portNumber = Number(port) || DEFAULT_PORTS[protocol];
+    this.socket =
+      protocol === "ldaps:"
+        ? tls.connect({ host: hostname, port: portNumber, servername: hostname })
+        : net.connect(portNumber, hostname);
+    this.socket.setKeepAlive(true);
+    this.nextId = 1;
+    this.pending = new Map();
+    this.buffer = Buffer.alloc(0);
+    this.closed = false;
+
+    this.socket.on("data", (chunk) => this.receive(chunk));
+    this.socket.on("error", (error) => this.fail(error));
+    this.socket.on("close", () => this.fail(new Error("LDAP connection closed")));
+  }
+
+  receive(chunk) {
+    this.buffer = Buffer.concat([this.buffer, chunk]);
+    try {
+      let message;
+      while ((message = readElement(this.buffer))) {
+        this.buffer = this.buffer.subarray(message.end);
+        const [id, op] = children(message.content);
+        const request = this.pending.get(readInteger(id.content));
+        if (request) request.reply(op);
+      }
+    } catch (error) {
+      this.socket.destroy();
+      this.fail(error);
+    }
+  }
+
+  // Fail every request waiting on the connection, which is of no more use
+  fail(error) {
+    this.closed = true;
+    for (const request of [...this.pending.values()]) request.reject(error);
+  }
+
+  // Send op, passing each reply to handle until it returns the result
+  request(op, handle) {
+    if (this.closed) return Promise.reject(new Error("LDAP connection closed"));
+    const id = this.nextId++;
+    return new Promise((resolve, reject) => {
+      const timer = setTimeout(() => {
+        this.socket.destroy();
+        this.fail(new Error("LDAP server took too long to answer"));
+      }, LDAP_TIMEOUT_MS);
+      const finish = () => {
+        clearTimeout(timer);
+        this.pending.delete(id);
+      };
+      this.pending.set(id, {
+        reply: (reply) => {
+          try {
+            const result = handle(reply);
+            if (result === undefined) return;
+            finish();
+            resolve(result);
+          } catch (error) {
+            finish();
+            reject(error);
+          }
+        },
+        reject: (error) => {
+          finish();
+          reject(error);
+        },
+      });
+      this.socket.write(ber(0x30, integer(0x02, id), op));
+    });
+  }
+
+  // Simple bind as dn, resolving with the result code
+  bind(dn, password) {
+    const op = ber(BIND_REQUEST, integer(0x02, 3), octets(0x04, dn), octets(0x80, password));
+    return this.request(op, (reply) => readResult(reply).code);
+  }
+
+  // Entries under base matching filter, with the attributes asked for.
+  // Only two are asked for, enough to tell a match from an ambiguous one.
+  search(base, filter, attributes) {
+    const op = ber(
+      SEARCH_REQUEST,
+      octets(0x04, base),
+      integer(0x0a, 2), // wholeSubtree
+      integer(0x0a, 0), // neverDerefAliases
+      integer(0x02, 2), // sizeLimit
+      integer(0x02, LDAP_TIMEOUT_MS / 1000),
+      Buffer.from([0x01, 0x01, 0x00]), // typesOnly: false
+      filter,
+      ber(0x30, ...attributes.map((attribute) => octets(0x04, attribute)))
+    );
+    const entries = [];
+    return this.request(op, (reply) => {
+      if (reply.tag === SEARCH_RESULT_ENTRY) {
+        entries.push(readEntry(reply));
+      } else if (reply.tag === SEARCH_RESULT_DONE) {
+        const { code, message } = readResult(reply);
+        if (code !== SUCCESS && code !== SIZE_LIMIT_EXCEEDED) {
+          throw new Error(`LDAP search failed: ${message || `result code ${code}`}`);
+        }
+        return entries;
+      }
+      return undefined; // Referrals aren't followed
+    });
+  }
+
+  close() {
+    if (this.closed) return;
+    this.closed = true;
+    this.socket.end(ber(0x30, integer(0x02, this.nextId++), Buffer.from([UNBIND_REQUEST, 0])));
+  }
+}
+
+// Up to POOL_SIZE connections to url, reused between logins
+class Pool {
+  constructor(url) {
+    this.url = url;
+    this.idle = [];
+    this.open = 0;
+    this.waiting = [];
+    this.closed = false;
+  }
+
+  acquire() {
+    while (this.idle.length > 0) {
+      const conn = this.idle.pop();
+      if (!conn.closed) return Promise.resolve(conn);
+      this.open--;
+    }
+    if (this.open < POOL_SIZE) {
+      this.open++;
+      return Promise.resolve(new Connection(this.url));
+    }
+    return new Promise((resolve) => this.waiting.push(resolve));
+  }
+
+  // Hand conn to the next login waiting for one, replacing it if it broke
+  release(conn) {
+    if (conn.closed) {
+      this.open--;
+      conn = null;
+    }
+    const next = this.waiting.shift();
+    if (next) {
+      if (!conn) {
+        this.open++;
+        conn = new Connection(this.url);
+      }
+      next(conn);
+    } else if (conn && this.closed) {
+      conn.close();
+    } else if (conn) {
+      this.idle.push(conn);
+    }
+  }
+
+  close() {
+    this.closed = true;
+    for (const conn of this.idle.splice(0)) conn.close();
+  }
+}
+
+// A directory to check passwords against. settings has the url, baseDn,
+// the bindDn and bindPass to search as (anonymous when empty), and the
+// userFilter finding a user, with {username} standing for their name.
+function createDirectory(settings) {
+  const pool = new Pool(settings.url);
+
+  // Check username's password, resolving with their entry's DN and the
+  // groups in its memberOf, or null if the directory turns them down.
+  // Rejects when the directory can't be asked.
+  async function authenticate(username, password) {
+    // An empty password would be an anonymous bind, which always succeeds
+    if (!password) return null;
+    const filter = encodeFilter(settings.userFilter.replaceAll("{username}", escapeFilterValue(username)));
+
+    const conn = await pool.acquire();
+    try {
+      const bound = await conn.bind(settings.bindDn, settings.bindPass);
+      if (bound !== SUCCESS) {
+        throw new Error(`LDAP bind as ${settings.bindDn || "anonymous"} failed with result code ${bound}`);
+      }
+      const entries = await conn.search(settings.baseDn, filter, ["memberOf"]);
+      if (entries.length !== 1) return null;
+
+      const [entry] = entries;
+      const code = await conn.bind(entry.dn, password);
+      if (code === INVALID_CREDENTIALS) return null;
+      if (code !== SUCCESS) throw new Error(`LDAP bind as ${entry.dn} failed with result code ${code}`);
+      return { dn: entry.dn, groups: entry.attributes.memberof || [] };
+    } finally {
+      pool.release(conn);
+    }
+  }
+
+  return { authenticate, close: () => pool.close() };
+}
+
+module.exports = { createDirectory, encodeFilter, escapeFilterValue };
@@ -0,0 +1,95 @@
+const net = require("net");
+const tls = require("tls");
+
+const SMTP_TIMEOUT_MS = 10000;
+
+// Build the DATA section, dot-stuffing lines that start with "."
+function buildMessage({ from, to, subject, text }) {
+  const headers = [
+    `From: ${from}`,
+    `To: ${to}`,
+    `Subject: ${subject}`,
+    `Date: ${new Date().toUTCString()}`,
+    "MIME-Version: 1.0",
+    "Content-Type: text/plain; charset=utf-8",
+  ];
+  const body = text
+    .split(/\r?\n/)
+    .map((line) => (line.startsWith(".") ? `.${line}` : line))
+    .join("\r\n");
+  return `${headers.join("\r\n")}\r\n\r\n${body}\r\n.`;
+}
+
+// Minimal SMTP client: sends one plain text mail and resolves once the
+// server has accepted it. Supports implicit TLS and AUTH PLAIN. A quiet
+// server is given up on after smtp.timeoutMs, 10 seconds by default. Addresses
+// and the subject go into commands and headers as they are, so a line
+// break in one is refused rather than letting it add its own.
+function sendMail(smtp, mail) {
+  return new Promise((resolve, reject) => {
+    if ([smtp.from, mail.to, mail.subject].some((value) => /[\r\n]/.test(value))) {
+      reject(new Error("line break in an address or the subject"));
+      return;
+    }
+    const socket = smtp.secure
+      ? tls.connect(smtp.port, smtp.host, { servername: smtp.host })
+      : net.connect(smtp.port, smtp.host);
+
+    const commands = ["EHLO echo"];
+    if (smtp.user) {
+      const auth = Buffer.from(`\0${smtp.user}\0${smtp.pass}`).toString(
+        "base64"
+      );
+      commands.push(`AUTH PLAIN ${auth}`);
+    }
+    commands.push(
+      `MAIL FROM:<${smtp.from}>`,
+      `RCPT TO:<${mail.to}>`,
+      "DATA",
+      buildMessage({ from: smtp.from, ...mail }),
+      "QUIT"
+    );
+
+    // -1 while waiting for the server greeting
+    let step = -1;
+    let buffer = "";
+
+    const fail = (error) => {
+      socket.destroy();
+      reject(error);
+    };
+
+    socket.setEncoding("utf8");
+    socket.setTimeout(smtp.timeoutMs || SMTP_TIMEOUT_MS, () => fail(new Error("SMTP timeout")));
+    socket.on("error", fail);
+
+    socket.on("data", (chunk) => {
+      buffer += chunk;
+
+      let idx;
+      while ((idx = buffer.indexOf("\r\n")) !== -1) {
+        const line = buffer.slice(0, idx);
+        buffer = buffer.slice(idx + 2);
+
+        // Multi-line replies continue with "250-", the last one is "250 "
+        if (line[3] === "-") continue;
+
+        const code = parseInt(line.slice(0, 3), 10);
+        if (!(code < 400)) {
+          fail(new Error(`SMTP error: ${line}`));
+          return;
+        }
+
+        step++;
+        if (step < commands.length) {
+          socket.write(`${commands[step]}\r\n`);
+        } else {
+          socket.end();
+          resolve();
+        }
+      }
+    });
+  });
+}
+
+module.exports = { sendMail };
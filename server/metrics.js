@@ -0,0 +1,90 @@
+const http = require("http");
+
+// Upper bounds of the message latency histogram buckets, in seconds
+const LATENCY_BUCKETS = [0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1];
+
+const messagesByChannel = new Map();
+let authFailures = 0;
+const latency = {
+  buckets: LATENCY_BUCKETS.map(() => 0),
+  sum: 0,
+  count: 0,
+};
+
+function countMessage(channel) {
+  messagesByChannel.set(channel, (messagesByChannel.get(channel) || 0) + 1);
+}
+
+function countAuthFailure() {
+  authFailures++;
+}
+
+// Record the time from receiving a message to handing it to the last client
+function observeLatency(startedAt) {
+  const [seconds, nanos] = process.hrtime(startedAt);
+  const elapsed = seconds + nanos / 1e9;
+  LATENCY_BUCKETS.forEach((bound, i) => {
+    if (elapsed <= bound) latency.buckets[i]++;
+  });
+  latency.sum += elapsed;
+  latency.count++;
+}
+
+// All metrics in Prometheus text format, with the live gauge values
+// passed in by the server
+function render({ connectedClients, inFlightHandlers }) {
+  const lines = [
+    "# HELP echo_connected_clients Open WebSocket connections.",
+    "# TYPE echo_connected_clients gauge",
+    `echo_connected_clients ${connectedClients}`,
+    "# HELP echo_messages_total Chat messages broadcast, by channel.",
+    "# TYPE echo_messages_total counter",
+  ];
+  for (const [channel, count] of messagesByChannel) {
+    const label = channel.replace(/["\\\n]/g, "_");
+    lines.push(`echo_messages_total{channel="${label}"} ${count}`);
+  }
+  lines.push(
+    "# HELP echo_auth_failures_total Rejected login attempts.",
+    "# TYPE echo_auth_failures_total counter",
+    `echo_auth_failures_total ${authFailures}`,
+    "# HELP echo_message_latency_seconds Time from receiving a message to sending it to the last recipient.",
+    "# TYPE echo_message_latency_seconds histogram"
+  );
+  LATENCY_BUCKETS.forEach((bound, i) => {
+    lines.push(
+      `echo_message_latency_seconds_bucket{le="${bound}"} ${latency.buckets[i]}`
+    );
+  });
+  lines.push(
+    `echo_message_latency_seconds_bucket{le="+Inf"} ${latency.count}`,
+    `echo_message_latency_seconds_sum ${latency.sum}`,
+    `echo_message_latency_seconds_count ${latency.count}`,
+    "# HELP echo_inflight_handlers Socket event handlers currently running.",
+    "# TYPE echo_inflight_handlers gauge",
+    `echo_inflight_handlers ${inFlightHandlers}`
+  );
+  return lines.join("\n") + "\n";
+}
+
+// Serve GET /metrics on its own port, apart from the chat server
+function startMetricsServer(port, gauges) {
+  const server = http.createServer((req, res) => {
+    if (req.method !== "GET" || req.url !== "/metrics") {
+      res.writeHead(404, { "Content-Type": "text/plain" });
+      res.end("Not found\n");
+      return;
+    }
+    res.writeHead(200, { "Content-Type": "text/plain; version=0.0.4" });
+    res.end(render(gauges()));
+  });
+  server.listen(port);
+  return server;
+}
+
+module.exports = {
+  countMessage,
+  countAuthFailure,
+  observeLatency,
+  startMetricsServer,
+};
@@ -0,0 +1,35 @@
+const mongoose = require("mongoose");
+
+// A copy of each audit log entry, for GET /api/audit
+const auditLogSchema = new mongoose.Schema({
+  time: {
+    type: Date,
+    default: Date.now,
+  },
+  event: {
+    type: String,
+    required: true,
+  },
+  user: {
+    type: String,
+    default: null,
+  },
+  channel: {
+    type: String,
+    default: null,
+  },
+  ip: {
+    type: String,
+    default: null,
+  },
+  details: {
+    type: mongoose.Schema.Types.Mixed,
+    default: {},
+  },
+});
+
+auditLogSchema.index({ time: -1 });
+auditLogSchema.index({ event: 1, time: -1 });
+auditLogSchema.index({ user: 1, time: -1 });
+
+module.exports = mongoose.model("AuditLog", auditLogSchema, "audit_log");
@@ -0,0 +1,34 @@
+const mongoose = require("mongoose");
+
+const banSchema = new mongoose.Schema({
+  username: {
+    type: String,
+    required: true,
+  },
+  ip: {
+    type: String,
+    default: null,
+  },
+  // null bans for good
+  expiresAt: {
+    type: Date,
+    default: null,
+  },
+  reason: {
+    type: String,
+    default: "",
+  },
+  bannedBy: {
+    type: String,
+    required: true,
+  },
+  createdAt: {
+    type: Date,
+    default: Date.now,
+  },
+});
+
+banSchema.index({ username: 1 });
+banSchema.index({ ip: 1 });
+
+module.exports = mongoose.model("Ban", banSchema);
@@ -0,0 +1,21 @@
+const mongoose = require("mongoose");
+
+// A named group of channels, shown as a collapsible section of the sidebar
+const categorySchema = new mongoose.Schema({
+  name: {
+    type: String,
+    required: true,
+    unique: true,
+    trim: true,
+  },
+  channels: {
+    type: [String],
+    default: [],
+  },
+  createdAt: {
+    type: Date,
+    default: Date.now,
+  },
+});
+
+module.exports = mongoose.model("Category", categorySchema);
@@ -0,0 +1,30 @@
+const mongoose = require("mongoose");
+
+const channelSchema = new mongoose.Schema({
+  name: {
+    type: String,
+    required: true,
+    unique: true,
+    trim: true,
+  },
+  topic: {
+    type: String,
+    default: "",
+  },
+  // Who may post: everyone, only invited users, or only admins
+  permissions: {
+    type: String,
+    enum: ["public", "invite-only", "read-only"],
+    default: "public",
+  },
+  createdBy: {
+    type: String,
+    default: null,
+  },
+  createdAt: {
+    type: Date,
+    default: Date.now,
+  },
+});
+
+module.exports = mongoose.model("Channel", channelSchema);
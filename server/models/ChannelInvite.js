@@ -0,0 +1,29 @@
+const mongoose = require("mongoose");
+
+// Lets username into an invite-only channel, given by a mod or admin
+const channelInviteSchema = new mongoose.Schema(
+  {
+    channel: {
+      type: String,
+      required: true,
+    },
+    username: {
+      type: String,
+      required: true,
+    },
+    invitedBy: {
+      type: String,
+      required: true,
+    },
+    createdAt: {
+      type: Date,
+      default: Date.now,
+    },
+  },
+  { collection: "channel_invites" }
+);
+
+// Each user is invited to a channel at most once
+channelInviteSchema.index({ channel: 1, username: 1 }, { unique: true });
+
+module.exports = mongoose.model("ChannelInvite", channelInviteSchema);
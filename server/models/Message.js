@@ -14,6 +14,34 @@ const messageSchema = new mongoose.Schema({
     type: Date,
     default: Date.now,
   },
+  channel: {
+    type: String,
+    default: "general",
+    trim: true,
+  },
+  recipient: {
+    type: String,
+    default: null,
+  },
+  editedAt: {
+    type: Date,
+    default: null,
+  },
+  // Id of the message this one replies to
+  replyTo: {
+    type: String,
+    default: null,
+  },
+  // Name an incoming webhook posted as; the sender is then "[webhook]"
+  botName: {
+    type: String,
+    default: null,
+  },
 });
 
+// Full-text index used by /search
+messageSchema.index({ content: "text" });
+// Finds a message's replies for the thread panel
+messageSchema.index({ replyTo: 1 });
+
 module.exports = mongoose.model("Message", messageSchema);
@@ -0,0 +1,27 @@
+const mongoose = require("mongoose");
+
+// A message pinned to its channel's pinboard by a mod or admin
+const pinSchema = new mongoose.Schema({
+  channel: {
+    type: String,
+    required: true,
+  },
+  msgId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: "Message",
+    required: true,
+  },
+  pinnedBy: {
+    type: String,
+    required: true,
+  },
+  pinnedAt: {
+    type: Date,
+    default: Date.now,
+  },
+});
+
+// Each message is pinned at most once
+pinSchema.index({ channel: 1, msgId: 1 }, { unique: true });
+
+module.exports = mongoose.model("Pin", pinSchema);
@@ -0,0 +1,46 @@
+const mongoose = require("mongoose");
+
+// A question put to a channel, open for votes until expiresAt
+const pollSchema = new mongoose.Schema({
+  // Short id people type with /vote
+  pollId: {
+    type: String,
+    required: true,
+    unique: true,
+  },
+  channel: {
+    type: String,
+    required: true,
+  },
+  question: {
+    type: String,
+    required: true,
+  },
+  options: {
+    type: [String],
+    required: true,
+  },
+  creator: {
+    type: String,
+    required: true,
+  },
+  createdAt: {
+    type: Date,
+    default: Date.now,
+  },
+  expiresAt: {
+    type: Date,
+    required: true,
+  },
+  // Set once everyone has been sent the final tallies
+  closed: {
+    type: Boolean,
+    default: false,
+  },
+});
+
+// Open polls are looked up by channel on join, and by expiry to close them
+pollSchema.index({ channel: 1, closed: 1 });
+pollSchema.index({ closed: 1, expiresAt: 1 });
+
+module.exports = mongoose.model("Poll", pollSchema);
@@ -0,0 +1,22 @@
+const mongoose = require("mongoose");
+
+const reactionSchema = new mongoose.Schema({
+  msgId: {
+    type: mongoose.Schema.Types.ObjectId,
+    ref: "Message",
+    required: true,
+  },
+  emoji: {
+    type: String,
+    required: true,
+  },
+  username: {
+    type: String,
+    required: true,
+  },
+});
+
+// One reaction per user per emoji on a message
+reactionSchema.index({ msgId: 1, emoji: 1, username: 1 }, { unique: true });
+
+module.exports = mongoose.model("Reaction", reactionSchema);
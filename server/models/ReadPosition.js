@@ -0,0 +1,21 @@
+const mongoose = require("mongoose");
+
+// When a user last caught up with a channel, for unread counts
+const readPositionSchema = new mongoose.Schema({
+  username: {
+    type: String,
+    required: true,
+  },
+  channel: {
+    type: String,
+    required: true,
+  },
+  readAt: {
+    type: Date,
+    default: Date.now,
+  },
+});
+
+readPositionSchema.index({ username: 1, channel: 1 }, { unique: true });
+
+module.exports = mongoose.model("ReadPosition", readPositionSchema);
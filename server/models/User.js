@@ -19,6 +19,69 @@ const userSchema = new mongoose.Schema({
     type: Boolean,
     default: true,
   },
+  role: {
+    type: String,
+    enum: ["user", "mod", "admin"],
+    default: "user",
+  },
+  email: {
+    type: String,
+    trim: true,
+    default: null,
+  },
+  emailVerified: {
+    type: Boolean,
+    default: true,
+  },
+  verifyToken: {
+    type: String,
+    default: null,
+  },
+  // Base32 TOTP secret, set while two-factor auth is on
+  totpSecret: {
+    type: String,
+    default: null,
+  },
+  // SHA-256 hashes of unused recovery codes
+  recoveryCodes: {
+    type: [String],
+    default: [],
+  },
+  failedLogins: {
+    type: Number,
+    default: 0,
+  },
+  lockedUntil: {
+    type: Date,
+    default: null,
+  },
+  // Session tokens carry this; bumping it revokes the ones handed out
+  tokenVersion: {
+    type: Number,
+    default: 0,
+  },
+  // Last status set with /away, /dnd or /setstatus, restored on login
+  status: {
+    type: String,
+    enum: ["online", "away", "dnd"],
+    default: "online",
+  },
+  statusMsg: {
+    type: String,
+    default: "",
+  },
+  // #RRGGBB set with /setcolor for this user's messages; null lets
+  // clients pick one from the name
+  displayColor: {
+    type: String,
+    default: null,
+  },
+  // Off with /privacy store off: their messages are delivered but never
+  // saved, so they're left out of history, search and exports
+  storeMessages: {
+    type: Boolean,
+    default: true,
+  },
 });
 
 module.exports = mongoose.model("User", userSchema);
@@ -0,0 +1,26 @@
+const mongoose = require("mongoose");
+
+// One person's choice in a poll, option being the index into its options
+const voteSchema = new mongoose.Schema({
+  pollId: {
+    type: String,
+    required: true,
+  },
+  username: {
+    type: String,
+    required: true,
+  },
+  option: {
+    type: Number,
+    required: true,
+  },
+  votedAt: {
+    type: Date,
+    default: Date.now,
+  },
+});
+
+// One vote each; voting again replaces it
+voteSchema.index({ pollId: 1, username: 1 }, { unique: true });
+
+module.exports = mongoose.model("Vote", voteSchema);
@@ -0,0 +1,25 @@
+const mongoose = require("mongoose");
+
+// Incoming webhook: anyone holding the token may post to channel over HTTP
+const webhookSchema = new mongoose.Schema({
+  token: {
+    type: String,
+    required: true,
+    unique: true,
+  },
+  channel: {
+    type: String,
+    required: true,
+    trim: true,
+  },
+  createdBy: {
+    type: String,
+    required: true,
+  },
+  createdAt: {
+    type: Date,
+    default: Date.now,
+  },
+});
+
+module.exports = mongoose.model("Webhook", webhookSchema, "webhooks");
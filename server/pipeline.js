@@ -0,0 +1,98 @@
+// The steps a chat message goes through once it's been parsed, in their
+// default order. server.toml's message_pipeline may reorder or leave out
+// steps; the steps themselves are defined in server.js.
+const STEPS = [
+  "auth",
+  "ratelimit",
+  "size",
+  "dedup",
+  "spam",
+  "filter",
+  "transform",
+  "persist",
+  "broadcast",
+  "webhook",
+];
+
+// A step returns HALT to stop the message without a reply, having dealt
+// with it or told the sender itself
+const HALT = Symbol("halt");
+
+// Check a message_pipeline setting: known step names, each at most once
+function validate(order) {
+  const seen = new Set();
+  for (const name of order) {
+    if (!STEPS.includes(name)) {
+      throw new Error(`message_pipeline: unknown step ${name}, steps are ${STEPS.join(", ")}`);
+    }
+    if (seen.has(name)) throw new Error(`message_pipeline: ${name} is listed twice`);
+    seen.add(name);
+  }
+}
+
+// Build a pipeline running the named steps in order over a message
+// context. Each step is an async function of the context; returning a
+// string stops the message there and sends the string to the sender as a
+// frame, and returning HALT stops it silently. With tracing on, each
+// message is a chat.message span with a child span per step.
+function build(order, steps, tracer = null) {
+  validate(order);
+  const chain = order.map((name) => ({ name, step: steps[name] }));
+  if (!tracer || !tracer.enabled) {
+    return async function run(ctx) {
+      for (const { step } of chain) {
+        const result = await step(ctx);
+        if (result === HALT) return;
+        if (typeof result === "string") {
+          ctx.ws.send(result);
+          return;
+        }
+      }
+    };
+  }
+
+  return async function run(ctx) {
+    const span = tracer.startSpan(
+      "chat.message",
+      {
+        channel: ctx.ws.channel,
+        username: ctx.username,
+        body_size_bytes: Buffer.byteLength(ctx.text),
+      },
+      "server"
+    );
+    try {
+      await tracer.withSpan(span, async () => {
+        for (const { name, step } of chain) {
+          const result = await traceStep(tracer, name, () => step(ctx));
+          if (result === HALT || typeof result === "string") {
+            span.setAttribute("stopped_at", name);
+            if (result !== HALT) ctx.ws.send(result);
+            return;
+          }
+        }
+      });
+    } catch (error) {
+      span.recordError(error);
+      throw error;
+    } finally {
+      span.end();
+    }
+  };
+}
+
+// Run a step in a span of its own, named after it. The async work it
+// starts, like persisting or broadcasting, happens in that span too.
+async function traceStep(tracer, name, fn) {
+  const span = tracer.startSpan(`chat.step.${name}`);
+  try {
+    return await tracer.withSpan(span, fn);
+  } catch (error) {
+    span.recordError(error);
+    throw error;
+  } finally {
+    span.end();
+  }
+}
+
+module.exports = { STEPS, HALT, validate, build };
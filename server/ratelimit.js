@@ -0,0 +1,25 @@
+// Token bucket: up to `burst` messages at once, refilled at `rate` per second
+class RateLimiter {
+  constructor(rate, burst) {
+    this.rate = rate;
+    this.burst = burst;
+    this.tokens = burst;
+    this.last = Date.now();
+  }
+
+  // Spend a token, reporting false if the bucket is empty
+  take() {
+    const now = Date.now();
+    this.tokens = Math.min(
+      this.burst,
+      this.tokens + ((now - this.last) / 1000) * this.rate
+    );
+    this.last = now;
+
+    if (this.tokens < 1) return false;
+    this.tokens--;
+    return true;
+  }
+}
+
+module.exports = { RateLimiter };
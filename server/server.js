@@ -1,92 +1,3014 @@
 require("dotenv").config();
+const fs = require("fs");
+const http = require("http");
+const https = require("https");
+const crypto = require("crypto");
 const WebSocket = require("ws");
 const mongoose = require("mongoose");
-const bcrypt = require("bcrypt");
 const User = require("./models/User");
-const Message = require("./models/Message");
+const storage = require("./storage");
+const uploads = require("./uploads");
+const { RateLimiter } = require("./ratelimit");
+const serverConfig = require("./config");
+const metrics = require("./metrics");
+const totp = require("./totp");
+const wordFilters = require("./filters");
+const { sendMail } = require("./mailer");
+const webhooks = require("./webhooks");
+const audit = require("./audit");
+const auth = require("./auth");
+const irc = require("./irc");
+const pipeline = require("./pipeline");
+const contrast = require("./contrast");
+const acme = require("./acme");
+const grpcTransport = require("./grpc");
+const ldap = require("./ldap");
+const tracing = require("./tracing");
+const { DuplicateWindow } = require("./dedup");
+const {
+  hasConfiguredSecret,
+  issueSessionToken,
+  verifySessionToken,
+} = require("./session");
 
-const PORT = process.env.PORT || 8080;
-const MONGODB_URI = process.env.MONGODB_URI;
+const { toWireMessage } = storage;
+
+// Settings from server.toml (or --config); SIGHUP reloads the ones that
+// can change while running
+const CONFIG_PATH = serverConfig.configPath();
+let config;
+try {
+  config = serverConfig.loadConfig(CONFIG_PATH);
+} catch (error) {
+  console.error(`Invalid config ${CONFIG_PATH}:`, error.message);
+  process.exit(1);
+}
+// Serve wss:// when both a certificate and its key are given (--cert and
+// --key), or with tls_auto on 443 with a certificate from Let's Encrypt,
+// answering its challenges on 80
+let tlsFiles;
+try {
+  tlsFiles = serverConfig.tlsFiles();
+  serverConfig.shutdownTimeoutMs(config);
+} catch (error) {
+  console.error(error.message);
+  process.exit(1);
+}
+const { cert: TLS_CERT, key: TLS_KEY } = tlsFiles;
+const USE_TLS = config.tls_auto || !!(TLS_CERT && TLS_KEY);
+// Traces of the message pipeline, exported with otel_enabled; otherwise
+// a tracer that does nothing
+const tracer = tracing.createTracer({
+  enabled: config.otel_enabled,
+  endpoint: config.otel_exporter_otlp_endpoint,
+  serviceName: serverConfig.otelServiceName(),
+  log: (text) => console.error(`[${getTimestamp()}] ${text}`),
+});
+const ACME_HTTPS_PORT = 443;
+const ACME_HTTP_PORT = 80;
+const PORT = config.tls_auto ? ACME_HTTPS_PORT : config.port;
+const TYPING_RELAY_INTERVAL_MS = 1000;
+const EDIT_WINDOW_MS = 5 * 60 * 1000;
+const MAX_TOPIC_LENGTH = 200;
+// Category names can't hold the separators of CHANNELCATEGORY frames, and
+// "Other" is where clients list uncategorized channels
+const CATEGORY_NAME_PATTERN = /^[^:,]{1,32}$/;
+const RESERVED_CATEGORY = "other";
+const MAX_MOTD_LENGTH = 2000;
+const EXPORT_CHUNK_SIZE = 100;
+// Exports pause while this much is still waiting to go out to the client
+const EXPORT_MAX_BUFFERED = 1024 * 1024;
+const EXPORT_FORMATS = ["json", "md"];
+const BASE64_PATTERN = /^[A-Za-z0-9+/]+={0,2}$/;
+// Author of announcements saved to channel history; nobody may register it
+const SYSTEM_SENDER = "system";
+// Logging in as "guest" gets a guest_<hex> name; nobody may register those
+const GUEST_USERNAME = "guest";
+const GUEST_NAME_PATTERN = /^guest_/i;
+const GUEST_SESSION_MS = 24 * 60 * 60 * 1000;
+// Users are online, away or dnd (do not disturb), with an optional message
+const STATUSES = ["online", "away", "dnd"];
+// Roles from least to most trusted
+const ROLE_ORDER = ["user", "mod", "admin"];
+const MAX_STATUS_LENGTH = 100;
+// Author of messages posted through incoming webhooks; nobody may register
+// it, and the name each webhook posts as is shown alongside
+const WEBHOOK_SENDER = "[webhook]";
+const WEBHOOK_NAME_PATTERN = /^[\w-]{1,32}$/;
+// Each incoming webhook token may post this many messages a minute
+const WEBHOOK_RATE_PER_MIN = 100;
+const WEBHOOK_MAX_BODY = 16 * 1024;
+// A streamed webhook message is finished once its body pauses this long
+const WEBHOOK_STREAM_IDLE_MS = 30 * 1000;
+// Clients tag messages with an ID of their own, which ACK:<clientID> confirms
+// once the message is stored and broadcast
+const CLIENT_ID_PATTERN = /^[\w-]{1,64}$/;
+// Most messages replayed to a client catching up after a reconnect
+const BACKFILL_LIMIT = 200;
+
+// Per-connection flood control; repeat offenders are muted for
+// rate_limit_mute_ms
+const RATE_LIMIT_STRIKES = 3;
+const RATE_LIMIT_STRIKE_WINDOW_MS = 30000;
+// The same message sent more than SPAM_REPEATS times in a row, each within
+// SPAM_WINDOW_MS of the last, is turned away
+const SPAM_REPEATS = 3;
+const SPAM_WINDOW_MS = 30000;
+// Whisper command: /whisper <user> <msg>, /w, or the legacy !whisper / !w
+const WHISPER_PATTERN = /^[!/](?:whisper|w)\s+(\S+)\s+(.+)$/is;
+
+// How long login waits for a two-factor code, and the name apps show for it
+const TOTP_TIMEOUT_MS = 2 * 60 * 1000;
+const TOTP_ISSUER = "Echo";
+
+// Uptime for /api/health, and how long /api/stats waits on the database
+const SERVER_STARTED_AT = Date.now();
+const STATS_TIMEOUT_MS = 80;
+// Seconds connections refused during maintenance are told to wait
+const MAINTENANCE_RETRY_AFTER_S = 300;
+const MAX_MAINTENANCE_LENGTH = 500;
+// Websocket subprotocols naming the versions of the frames spoken, most
+// preferred first. Clients from before versioning ask for none, and are
+// spoken to in echo-v1.
+const SUBPROTOCOLS = ["echo-v2", "echo-v1"];
+// The frames that differ between versions. echo-v2 announces joins and
+// leaves as JOINED:<user> and LEFT:<user>, which unlike echo-v1's text
+// can't be taken for anything else.
+const PROTOCOL_FRAMES = {
+  "echo-v1": {
+    joined: (username) => `${username} has joined`,
+    left: (username) => `${username} has left`,
+  },
+  "echo-v2": {
+    joined: (username) => `JOINED:${username}`,
+    left: (username) => `LEFT:${username}`,
+  },
+};
+
+// What a registration's email address has to look like: one @, no spaces,
+// angle brackets or line breaks, as it ends up in SMTP commands
+const EMAIL_PATTERN = /^[^\s@<>]{1,64}@[^\s@<>]{1,255}$/;
 
 const clients = new Map();
+const rateLimits = new WeakMap();
+// File chunks have a limiter of their own, as they come far faster than chat
+const chunkLimits = new WeakMap();
+const webhookLimits = new Map();
+// Recent messages of each user, for the dedup step
+const recentMessages = new DuplicateWindow();
+const ircRateLimits = new Map();
+let ircBridge = null;
+let grpcServer = null;
+// The LDAP directory passwords are checked against, with ldap_enabled
+let directory = null;
+// Failed logins per address: { count, lastAt }
+const ipLoginFailures = new Map();
+let filters = [];
+// Message of the day from motd_file, sent on login; empty sends nothing.
+// The file is read again at login whenever its modification time changes.
+let motd = "";
+let motdModifiedAt = 0;
+// Set by MAINTENANCE:on, the message shown to clients; null when off
+let maintenance = null;
+let shuttingDown = false;
+let inFlight = 0;
 
 function getTimestamp() {
   return new Date().toLocaleString();
 }
 
+// The address links to the server start with: public_url, or where it
+// listens when that's unset
+function publicUrl() {
+  if (config.public_url) return config.public_url.replace(/\/+$/, "");
+  return config.tls_auto ? `https://${config.tls_domain}` : `${USE_TLS ? "https" : "http"}://localhost:${PORT}`;
+}
+
+// The server verification emails are sent through, from the smtp_ settings
+function smtpSettings() {
+  return {
+    host: config.smtp_host,
+    port: config.smtp_port,
+    secure: config.smtp_secure,
+    user: config.smtp_user,
+    pass: config.smtp_pass,
+    from: config.smtp_from,
+  };
+}
+
 async function connectDB() {
   try {
-    await mongoose.connect(MONGODB_URI);
-    console.log(`[${getTimestamp()}] Connected to MongoDB`);
+    await mongoose.connect(config.mongodb_uri);
+    console.log(`[${getTimestamp()}] Connected to MongoDB`);
+  } catch (error) {
+    console.error(
+      `[${getTimestamp()}] MongoDB connection error:`,
+      error.message
+    );
+    process.exit(1);
+  }
+}
+
+async function logUserConnection(username) {
+  try {
+    await User.findOneAndUpdate(
+      { username },
+      { connectedAt: new Date(), isOnline: true },
+      { upsert: true, new: true }
+    );
+    console.log(`[${getTimestamp()}] User "${username}" logged to database`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error logging user:`, error.message);
+  }
+}
+
+async function findUser(username) {
+  return await User.findOne({ username });
+}
+
+async function createUser(username, hashedPassword, email = null, role = "user") {
+  const needsVerify = config.require_email_verify && !!email;
+  return await User.create({
+    username,
+    password: hashedPassword,
+    role,
+    connectedAt: new Date(),
+    isOnline: true,
+    email,
+    emailVerified: !needsVerify,
+    verifyToken: needsVerify ? crypto.randomBytes(24).toString("hex") : null,
+  });
+}
+
+// Count a wrong password or code, locking the account for
+// login_lockout_ms once there are max_login_attempts in a row. The count is kept in the database, so
+// attempts made side by side all add to it.
+async function recordLoginFailure(user) {
+  const counted = await User.findOneAndUpdate(
+    { _id: user._id },
+    { $inc: { failedLogins: 1 } },
+    { new: true }
+  );
+  if (!counted || counted.failedLogins < config.max_login_attempts) return;
+  await User.updateOne(
+    { _id: user._id, failedLogins: { $gte: config.max_login_attempts } },
+    { failedLogins: 0, lockedUntil: new Date(Date.now() + config.login_lockout_ms) }
+  );
+}
+
+// The error for a locked account, or null if it isn't locked
+function lockoutError(user) {
+  const remaining = user.lockedUntil ? user.lockedUntil - Date.now() : 0;
+  if (remaining <= 0) return null;
+  const minutes = Math.ceil(remaining / 60000);
+  return `ERROR: Too many failed attempts, try again in ${minutes} minute${minutes === 1 ? "" : "s"}`;
+}
+
+// Count a refused login in the metrics, the audit log and against the
+// address it came from
+function recordAuthFailure(ws, username, reason) {
+  metrics.countAuthFailure();
+  audit.record("auth_failure", {
+    user: username || null,
+    ip: ws.ip,
+    details: { reason },
+  });
+
+  const now = Date.now();
+  const failures = ipLoginFailures.get(ws.ip);
+  if (failures && now - failures.lastAt < config.login_lockout_ms) {
+    failures.count++;
+    failures.lastAt = now;
+  } else {
+    ipLoginFailures.set(ws.ip, { count: 1, lastAt: now });
+  }
+}
+
+// Whether ip has failed to log in max_ip_login_failures times lately,
+// whichever accounts it tried; it's refused for login_lockout_ms
+function ipLockedOut(ip) {
+  const failures = ipLoginFailures.get(ip);
+  return (
+    !!failures &&
+    failures.count >= config.max_ip_login_failures &&
+    Date.now() - failures.lastAt < config.login_lockout_ms
+  );
+}
+
+// Forget addresses that haven't failed to log in for a while
+function expireLoginFailures() {
+  const now = Date.now();
+  for (const [ip, failures] of ipLoginFailures) {
+    if (now - failures.lastAt >= config.login_lockout_ms) ipLoginFailures.delete(ip);
+  }
+}
+
+// Resolve with the next message from ws, or null if it closes or stays
+// quiet for timeoutMs
+function nextMessage(ws, timeoutMs) {
+  return new Promise((resolve) => {
+    const finish = (value) => {
+      clearTimeout(timer);
+      ws.off("message", onMessage);
+      ws.off("close", onClose);
+      resolve(value);
+    };
+    const onMessage = (message) => finish(message.toString().trim());
+    const onClose = () => finish(null);
+    const timer = setTimeout(() => finish(null), timeoutMs);
+    ws.on("message", onMessage);
+    ws.on("close", onClose);
+  });
+}
+
+// Check a two-factor code, which may also be one of the user's recovery
+// codes; those only work once
+async function checkTotpCode(user, code) {
+  if (totp.verifyCode(user.totpSecret, code)) return true;
+  const hash = totp.hashRecoveryCode(code);
+  if (!user.recoveryCodes.includes(hash)) return false;
+  await User.updateOne({ _id: user._id }, { $pull: { recoveryCodes: hash } });
+  console.log(`[${getTimestamp()}] ${user.username} used a recovery code`);
+  return true;
+}
+
+// ENABLE2FA turns on two-factor auth, replying with the secret and recovery
+// codes as TOTP_SETUP:{json}. That is the only time they are sent.
+async function handleEnable2fa(ws, username) {
+  try {
+    const user = await findUser(username);
+    if (!user) return;
+    if (user.totpSecret) {
+      ws.send("ERR:2fa_enabled");
+      return;
+    }
+
+    const secret = totp.generateSecret();
+    const recoveryCodes = totp.generateRecoveryCodes();
+    await User.updateOne(
+      { _id: user._id },
+      {
+        totpSecret: secret,
+        recoveryCodes: recoveryCodes.map(totp.hashRecoveryCode),
+      }
+    );
+    ws.send(
+      `TOTP_SETUP:${JSON.stringify({
+        secret,
+        uri: totp.otpauthUri(secret, username, TOTP_ISSUER),
+        recoveryCodes,
+      })}`
+    );
+    console.log(`[${getTimestamp()}] ${username} enabled two-factor auth`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error enabling 2FA:`, error.message);
+  }
+}
+
+// DISABLE2FA:<password> turns two-factor auth off again
+async function handleDisable2fa(ws, username, password) {
+  try {
+    const user = await findUser(username);
+    if (!user) return;
+    if (!user.totpSecret) {
+      ws.send("ERR:2fa_not_enabled");
+      return;
+    }
+    if (!(await checkPassword(user, password)).ok) {
+      await recordLoginFailure(user);
+      ws.send("ERR:wrong_password");
+      return;
+    }
+
+    await User.updateOne(
+      { _id: user._id },
+      { totpSecret: null, recoveryCodes: [] }
+    );
+    sendSystem(ws, "Two-factor authentication is off");
+    console.log(`[${getTimestamp()}] ${username} disabled two-factor auth`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error disabling 2FA:`, error.message);
+  }
+}
+
+// PASSWD:{"old":<old>,"new":<new>} changes the password; clients from
+// before it was JSON send PASSWD:<old>:<new>, the old password holding no
+// colon. Other sessions' tokens stop working; this connection gets a new
+// one.
+async function handlePasswd(ws, username, payload) {
+  let oldPassword = "";
+  let newPassword = "";
+  if (payload.startsWith("{")) {
+    try {
+      const change = JSON.parse(payload);
+      if (typeof change.old === "string" && typeof change.new === "string") {
+        oldPassword = change.old;
+        newPassword = change.new;
+      }
+    } catch (error) {
+      // Answered with the usage below
+    }
+  } else {
+    const sep = payload.indexOf(":");
+    oldPassword = sep === -1 ? "" : payload.slice(0, sep);
+    newPassword = sep === -1 ? "" : payload.slice(sep + 1);
+  }
+  if (!oldPassword || !newPassword) {
+    ws.send("PASSWD_ERR:Usage: /passwd <old> <new>");
+    return;
+  }
+
+  try {
+    const user = await findUser(username);
+    if (!user) {
+      ws.send("PASSWD_ERR:Guests have no password to change");
+      return;
+    }
+    if (directory && !config.ldap_fallback) {
+      ws.send("PASSWD_ERR:Passwords are managed in the LDAP directory");
+      return;
+    }
+    const locked = lockoutError(user);
+    if (locked) {
+      ws.send(`PASSWD_ERR:${locked.slice("ERROR: ".length)}`);
+      return;
+    }
+    if (!(await auth.verifyPassword(oldPassword, user.password))) {
+      await recordLoginFailure(user);
+      ws.send("PASSWD_ERR:Current password is wrong");
+      return;
+    }
+    if (newPassword.length < config.min_password_length) {
+      ws.send(
+        `PASSWD_ERR:New password must be at least ${config.min_password_length} characters`
+      );
+      return;
+    }
+
+    const updated = await User.findOneAndUpdate(
+      { _id: user._id },
+      {
+        password: await auth.hashPassword(newPassword),
+        failedLogins: 0,
+        $inc: { tokenVersion: 1 },
+      },
+      { new: true }
+    );
+    ws.tokenVersion = updated.tokenVersion;
+    ws.send(`SESSION:${issueSessionToken(username, updated.tokenVersion)}`);
+    ws.send("PASSWD_OK");
+    console.log(`[${getTimestamp()}] ${username} changed their password`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error changing password:`, error.message);
+    ws.send("PASSWD_ERR:Couldn't change the password, try again later");
+  }
+}
+
+async function sendVerificationEmail(user) {
+  const link = `${publicUrl()}/verify?verify_token=${user.verifyToken}`;
+  try {
+    await sendMail(smtpSettings(), {
+      to: user.email,
+      subject: "Verify your Echo account",
+      text: `Hi ${user.username},\n\nConfirm your email to start chatting on Echo:\n${link}\n`,
+    });
+    console.log(
+      `[${getTimestamp()}] Verification email sent to ${user.email}`
+    );
+  } catch (error) {
+    console.error(
+      `[${getTimestamp()}] Error sending verification email:`,
+      error.message
+    );
+  }
+}
+
+function sendSystem(ws, msg) {
+  if (ws.readyState === WebSocket.OPEN) {
+    ws.send(JSON.stringify({ type: "system", msg }));
+  }
+}
+
+function broadcast(wss, text) {
+  wss.clients.forEach((client) => {
+    if (client.readyState === WebSocket.OPEN) {
+      client.send(text);
+    }
+  });
+}
+
+// Send a live message to a channel member, holding it back while their
+// history replay is still loading so the replay always arrives first
+function sendLive(client, text) {
+  if (client.readyState !== WebSocket.OPEN) return;
+  if (client.pendingLive) {
+    client.pendingLive.push(text);
+    return;
+  }
+  client.send(text);
+}
+
+// Send text to everyone in channel
+function broadcastToChannel(wss, channel, text) {
+  wss.clients.forEach((client) => {
+    if (client.channel === channel) sendLive(client, text);
+  });
+}
+
+// Tell the channel's members in other channels there's a new message in
+// it, so their sidebars can count it as unread
+async function broadcastActivity(channel) {
+  for (const client of await channelMembers(channel)) {
+    if (client.channel !== channel) sendLive(client, `ACTIVITY:${channel}`);
+  }
+}
+
+// TOPIC:<channel>:<text> - anyone who may post in a channel may set its
+// topic; its members are sent the new one in a TOPIC frame of the same shape
+async function handleTopic(wss, ws, username, payload) {
+  const sep = payload.indexOf(":");
+  const name = storage.normalizeChannel(sep === -1 ? "" : payload.slice(0, sep));
+  const topic = payload.slice(sep + 1).trim();
+  if (sep === -1 || topic.length > MAX_TOPIC_LENGTH) {
+    ws.send("ERR:topic_invalid");
+    return;
+  }
+
+  try {
+    if (!(await storage.findChannel(name))) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    if (await postDenied(ws, username, name)) {
+      ws.send("ERR:permission_denied");
+      return;
+    }
+    const channel = await storage.setChannelTopic(name, topic);
+    if (!channel) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    await broadcastToMembers(channel.name, `TOPIC:${channel.name}:${channel.topic}`);
+    console.log(
+      `[${getTimestamp()}] ${username} set the topic of #${channel.name}: ${topic}`
+    );
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error setting topic:`, error.message);
+  }
+}
+
+// READ:<channel> - the user has caught up with channel
+async function handleRead(ws, username, channel) {
+  // Guests start fresh each time, so their positions aren't kept
+  if (ws.isGuest) return;
+  try {
+    await storage.markRead(username, channel);
+  } catch (error) {
+    console.error(
+      `[${getTimestamp()}] Error saving read position:`,
+      error.message
+    );
+  }
+}
+
+// Send MENTION:<channel>:<from> to each online member @mentioned in text,
+// so their client can badge the channel without reading every message
+async function notifyMentions(channel, from, text) {
+  const mentioned = new Set(
+    [...text.matchAll(/@([\w-]+)/g)].map((match) => match[1].toLowerCase())
+  );
+  if (!mentioned.size) return;
+  const entered = await storage.findChannel(channel);
+  for (const name of mentioned) {
+    const target = findClientSocketInsensitive(name);
+    if (
+      target &&
+      clients.get(target) !== from &&
+      target.status !== "dnd" &&
+      (await mayEnter(target, clients.get(target), entered))
+    ) {
+      sendLive(target, `MENTION:${channel}:${from}`);
+    }
+  }
+}
+
+// Tell the [[webhooks]] that want it about event; failures are only logged
+function fireWebhooks(event, details) {
+  webhooks.fire(config.webhooks, event, details, (hook, error) => {
+    console.error(
+      `[${getTimestamp()}] Webhook ${hook.name} failed for ${event}:`,
+      error.message
+    );
+  });
+}
+
+// WEBHOOKTEST:<name> pings a webhook so admins can check it's reachable
+async function handleWebhookTest(ws, username, name) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  const hook = config.webhooks.find((candidate) => candidate.name === name);
+  if (!hook) {
+    ws.send("ERR:webhook_not_found");
+    return;
+  }
+  const error = await webhooks.ping(hook, username);
+  if (error) {
+    sendSystem(ws, `Webhook ${name} failed: ${error.message}`);
+    console.error(`[${getTimestamp()}] Webhook ${name} test failed:`, error.message);
+  } else {
+    sendSystem(ws, `Webhook ${name} answered the ping`);
+  }
+}
+
+// WEBHOOKCREATE:<channel> - admins only. Replies with the URL external
+// services POST to.
+async function handleWebhookCreate(ws, username, name) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  try {
+    const channel = await storage.findChannel(name);
+    if (!channel) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    const webhook = await storage.addWebhook({
+      token: crypto.randomBytes(24).toString("hex"),
+      channel: channel.name,
+      createdBy: username,
+    });
+    sendSystem(
+      ws,
+      `Webhook for #${channel.name}: POST ${publicUrl()}/webhook/incoming/${webhook.token}`
+    );
+    console.log(
+      `[${getTimestamp()}] ${username} created an incoming webhook for #${channel.name}`
+    );
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error creating webhook:`, error.message);
+  }
+}
+
+// WEBHOOKREVOKE:<token> - admins only
+async function handleWebhookRevoke(ws, username, token) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  token = token.trim();
+  try {
+    if (!(await storage.deleteWebhook(token))) {
+      ws.send("ERR:webhook_not_found");
+      return;
+    }
+    webhookLimits.delete(token);
+    sendSystem(ws, "Webhook revoked");
+    console.log(`[${getTimestamp()}] ${username} revoked an incoming webhook`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error revoking webhook:`, error.message);
+  }
+}
+
+// Connect to the LDAP directory the config names, if any, in place of the
+// one before
+function startDirectory() {
+  if (directory) directory.close();
+  directory = config.ldap_enabled
+    ? ldap.createDirectory({
+        url: config.ldap_url,
+        baseDn: config.ldap_base_dn,
+        bindDn: config.ldap_bind_dn,
+        bindPass: config.ldap_bind_pass,
+        userFilter: config.ldap_user_filter,
+      })
+    : null;
+}
+
+// The highest role LDAP groups map to with [[ldap_group_role]], "user" if
+// none do, or undefined when there are no mappings and roles are left as
+// they are in Echo
+function ldapRole(groups) {
+  if (config.ldap_group_role.length === 0) return undefined;
+  const memberOf = new Set(groups.map((group) => group.toLowerCase()));
+  let role = "user";
+  for (const mapping of config.ldap_group_role) {
+    const member = memberOf.has(mapping.group.toLowerCase());
+    if (member && ROLE_ORDER.indexOf(mapping.role) > ROLE_ORDER.indexOf(role)) {
+      role = mapping.role;
+    }
+  }
+  return role;
+}
+
+// Ask the directory whether username's password is right, resolving with
+// { role } if so, or null if it said no or couldn't be reached
+async function directoryLogin(username, password) {
+  try {
+    const entry = await directory.authenticate(username, password);
+    if (entry) return { role: ldapRole(entry.groups) };
+  } catch (error) {
+    console.error(`[${getTimestamp()}] LDAP login for "${username}" failed:`, error.message);
+  }
+  return null;
+}
+
+// Check an account's password: with the directory when LDAP is on, and
+// the local hash otherwise or, with ldap_fallback, when the directory
+// turns it down. Resolves with { ok, ldap, role }, role being what the
+// directory's groups map to.
+async function checkPassword(user, password) {
+  if (directory) {
+    const result = await directoryLogin(user.username, password);
+    if (result) return { ok: true, ldap: true, role: result.role };
+    if (!config.ldap_fallback) return { ok: false, ldap: false };
+  }
+  return { ok: await auth.verifyPassword(password, user.password), ldap: false };
+}
+
+// Check an IRC client's nick and server password as if logging in. Returns
+// why they can't, or null.
+async function ircLogin(nick, password, ip) {
+  if (ipLockedOut(ip)) return "Too many failed logins from your address";
+  const ban = await storage.findActiveBan({ username: nick, ip });
+  if (ban) return describeBan(ban);
+
+  const user = await findUser(nick);
+  const locked = user && lockoutError(user);
+  if (locked) return locked.replace(/^ERROR: /, "");
+  if (!user || !(await checkPassword(user, password)).ok) {
+    recordAuthFailure({ ip }, nick, "wrong_password");
+    if (user) await recordLoginFailure(user);
+    return "Wrong username or password - send your Echo password with PASS";
+  }
+  if (user.totpSecret) {
+    return "Accounts with two-factor authentication can't use IRC";
+  }
+  if (!user.emailVerified) return "Verify your email before using IRC";
+
+  audit.record("auth_success", { user: nick, ip, details: { method: "irc" } });
+  return null;
+}
+
+// The role an IRC user has, standing in for the websocket that holds it
+// when checking what they may read and post
+async function ircUser(nick) {
+  const user = await findUser(nick);
+  return { role: user ? user.role : "user" };
+}
+
+// The topic and online members of channel for an IRC JOIN, or null if it
+// doesn't exist or nick may not enter it
+async function ircChannel(nick, name) {
+  const channel = await storage.findChannel(name);
+  if (!channel || channel.name !== name) return null;
+  if (!(await mayEnter(await ircUser(nick), nick, channel))) return null;
+  const names = [];
+  for (const [clientWs, username] of clients.entries()) {
+    if (clientWs.channel === channel.name) names.push(username);
+  }
+  return { topic: channel.topic, names };
+}
+
+// Post a message from IRC to channel like one sent from Echo. Returns why
+// it was refused, or null.
+async function relayIrcMessage(wss, username, channel, text) {
+  let limiter = ircRateLimits.get(username);
+  if (!limiter) {
+    limiter = new RateLimiter(config.rate_limit_rps, config.rate_limit_burst);
+    ircRateLimits.set(username, limiter);
+  }
+  if (!limiter.take()) return "You're sending messages too fast";
+  const denied = await postDenied(await ircUser(username), username, channel);
+  if (denied) return permissionDeniedText(channel, denied);
+  if (text.length > config.max_message_size) {
+    return "That message is too long for this server";
+  }
+  const { matched, rules, cleaned } = wordFilters.applyFilters(filters, text);
+  if (matched) {
+    audit.record("filter", {
+      user: username,
+      channel,
+      details: { rules, mode: config.filter_mode, via: "irc" },
+    });
+  }
+  if (matched && config.filter_mode === "block") {
+    return "Your message contains disallowed content";
+  }
+  if (matched) text = cleaned;
+
+  const user = await findUser(username);
+  const ephemeral = user && user.storeMessages === false;
+  const stored = ephemeral ? null : await logMessage(username, text, null, channel);
+  broadcastToChannel(
+    wss,
+    channel,
+    stored || ephemeral
+      ? JSON.stringify({
+          type: "message",
+          ...(stored ? toWireMessage(stored) : ephemeralMessage(username, channel, text)),
+        })
+      : `${getTimestamp()}: ${username} said: ${text}`
+  );
+  await broadcastActivity(channel);
+  await notifyMentions(channel, username, text);
+  fireWebhooks("message", { channel, username, body: text });
+  metrics.countMessage(channel);
+  audit.record("message", {
+    user: username,
+    channel,
+    details: { id: stored ? stored._id.toString() : null, via: "irc" },
+  });
+  return null;
+}
+
+function statusFrame(ws, username) {
+  return `STATUS:${username}:${ws.status}:${ws.statusMsg}`;
+}
+
+function hasStatus(ws) {
+  return ws.status !== "online" || ws.statusMsg !== "";
+}
+
+// Tell someone who just joined who is away or busy and who picked a
+// display color, and everyone else if they have themselves
+function sendStatuses(wss, ws, username) {
+  for (const [clientWs, name] of clients.entries()) {
+    if (clientWs === ws) continue;
+    if (hasStatus(clientWs)) ws.send(statusFrame(clientWs, name));
+    if (clientWs.displayColor) ws.send(`COLOR:${name}:${clientWs.displayColor}`);
+  }
+  if (hasStatus(ws)) broadcast(wss, statusFrame(ws, username));
+  if (ws.displayColor) broadcast(wss, `COLOR:${username}:${ws.displayColor}`);
+}
+
+// STATUS:<status>:<message> - status is online, away or dnd, or empty to
+// keep the current one. Everyone is sent STATUS:<username>:<status>:<message>.
+async function handleStatus(wss, ws, username, payload) {
+  const sep = payload.indexOf(":");
+  const status = (sep === -1 ? payload : payload.slice(0, sep)).trim() || ws.status;
+  const message = sep === -1 ? "" : payload.slice(sep + 1).trim();
+  if (!STATUSES.includes(status) || message.length > MAX_STATUS_LENGTH) {
+    ws.send("ERR:status_invalid");
+    return;
+  }
+
+  ws.status = status;
+  ws.statusMsg = message;
+  broadcast(wss, statusFrame(ws, username));
+  if (ws.isGuest) return;
+  try {
+    await User.updateOne({ username }, { status, statusMsg: message });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error saving status:`, error.message);
+  }
+}
+
+// SETCOLOR:<#RRGGBB|auto> - the color this user's messages are shown in,
+// or auto to go back to the one clients pick from the name. Colors too
+// dark to read are lightened. The sender gets COLOR_SET:<#RRGGBB>, or
+// COLOR_REJECTED:<#RRGGBB> with the lightened color, and everyone is sent
+// COLOR:<username>:<#RRGGBB>; both are empty for auto.
+async function handleSetColor(wss, ws, username, payload) {
+  let color = payload.trim();
+  if (color.toLowerCase() === "auto") {
+    color = null;
+    ws.send("COLOR_SET:");
+  } else if (!/^#[0-9a-fA-F]{6}$/.test(color)) {
+    ws.send("ERR:color_invalid");
+    return;
+  } else {
+    const readable = contrast.readableColor(color);
+    ws.send(readable === color.toUpperCase() ? `COLOR_SET:${readable}` : `COLOR_REJECTED:${readable}`);
+    color = readable;
+  }
+
+  ws.displayColor = color;
+  broadcast(wss, `COLOR:${username}:${color || ""}`);
+  if (ws.isGuest) return;
+  try {
+    await User.updateOne({ username }, { displayColor: color });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error saving display color:`, error.message);
+  }
+}
+
+// A message from someone who opted out of storage, shaped like a stored
+// one but without an id
+function ephemeralMessage(username, channel, text) {
+  return {
+    sender: username,
+    content: text,
+    timestamp: new Date().toISOString(),
+    channel,
+    ephemeral: true,
+  };
+}
+
+// PRIVACY:store:on|off - whether this user's messages are saved. Off, they
+// still reach everyone but skip the persist step, and go out marked
+// ephemeral. The sender gets PRIVACY:store:on|off, as they also do for a
+// bare PRIVACY: asking what it is.
+async function handlePrivacy(ws, username, payload) {
+  const [setting, value] = payload.trim().split(":");
+  if (setting && (setting !== "store" || !["on", "off"].includes(value))) {
+    ws.send("ERR:privacy_invalid");
+    return;
+  }
+  if (setting) ws.storeMessages = value === "on";
+  ws.send(`PRIVACY:store:${ws.storeMessages === false ? "off" : "on"}`);
+  if (!setting || ws.isGuest) return;
+  try {
+    await User.updateOne({ username }, { storeMessages: ws.storeMessages });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error saving privacy setting:`, error.message);
+  }
+}
+
+// Send everyone the current online users as USERLIST:<csv>
+function broadcastUserList(wss) {
+  broadcast(wss, `USERLIST:${[...clients.values()].join(",")}`);
+}
+
+// Whether ws has sent nothing, pings included, for two presence intervals,
+// as if its connection were gone
+function isStale(ws) {
+  return Date.now() - ws.lastSeen > 2 * config.presence_interval_seconds * 1000;
+}
+
+// Send everyone PRESENCE:<json>, the users online and their status, with
+// stale connections left out. Takes the interval afresh each time, so a
+// reload changes it.
+function schedulePresence(wss) {
+  const interval = config.presence_interval_seconds * 1000;
+  setTimeout(() => {
+    if (config.presence_enabled) {
+      const presence = new Map();
+      for (const [clientWs, name] of clients.entries()) {
+        if (!isStale(clientWs) && !presence.has(name)) {
+          presence.set(name, { username: name, status: clientWs.status });
+        }
+      }
+      const frame = `PRESENCE:${JSON.stringify([...presence.values()])}`;
+      for (const clientWs of clients.keys()) {
+        if (clientWs.readyState === WebSocket.OPEN) clientWs.send(frame);
+      }
+    }
+    schedulePresence(wss);
+  }, interval).unref();
+}
+
+// Shape a channel for CHANNELLIST / CHANNELADD frames, with how many of
+// its messages are pinned. isPrivate is kept for older clients.
+function toWireChannel(channel, pins = 0) {
+  let memberCount = 0;
+  for (const ws of clients.keys()) {
+    if (ws.channel === channel.name) memberCount++;
+  }
+  return {
+    name: channel.name,
+    topic: channel.topic,
+    memberCount,
+    permissions: channel.permissions,
+    isPrivate: channel.permissions === "invite-only",
+    pins,
+  };
+}
+
+async function handleListChannels(ws) {
+  try {
+    const channels = await storage.listChannels();
+    const pins = await storage.pinCounts();
+    ws.send(
+      `CHANNELLIST:${JSON.stringify(
+        channels.map((channel) => toWireChannel(channel, pins[channel.name]))
+      )}`
+    );
+    const unread = await storage.unreadCounts(clients.get(ws));
+    ws.send(`UNREADCOUNTS:${JSON.stringify(unread)}`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error listing channels:`, error.message);
+  }
+}
+
+// CREATECHANNEL:<name> - anyone may create a channel
+async function handleCreateChannel(wss, ws, username, name) {
+  name = storage.normalizeChannel(name);
+  if (!storage.validateChannelName(name)) {
+    ws.send("ERR:channel_invalid");
+    return;
+  }
+
+  try {
+    const channel = await storage.createChannel(name, username);
+    if (!channel) {
+      ws.send("ERR:channel_exists");
+      return;
+    }
+    broadcast(wss, `CHANNELADD:${JSON.stringify(toWireChannel(channel))}`);
+    console.log(`[${getTimestamp()}] ${username} created #${name}`);
+    audit.record("channel_create", { user: username, channel: name, ip: ws.ip });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error creating channel:`, error.message);
+  }
+}
+
+// DELETECHANNEL:<name> - only its creator or an admin, never the default
+async function handleDeleteChannel(wss, ws, username, name) {
+  name = storage.normalizeChannel(name);
+  try {
+    const channel = await storage.findChannel(name);
+    if (!channel) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    if (
+      name === storage.DEFAULT_CHANNEL ||
+      (channel.createdBy !== username && !isAdmin(ws))
+    ) {
+      ws.send("ERR:channel_denied");
+      return;
+    }
+
+    await storage.deleteChannel(name);
+    for (const client of clients.keys()) {
+      if (client.channel === name) client.channel = storage.DEFAULT_CHANNEL;
+    }
+    broadcast(wss, `CHANNELDEL:${name}`);
+    broadcastCategories(wss, await storage.uncategorize(name));
+    console.log(`[${getTimestamp()}] ${username} deleted #${name}`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error deleting channel:`, error.message);
+  }
+}
+
+// CHANNELMODE:<channel>:<public|invite-only|read-only> - mods and admins;
+// everyone is sent the channel again as CHANNELADD
+async function handleChannelMode(wss, ws, username, payload) {
+  if (!isMod(ws)) {
+    ws.send("ERR:mod_only");
+    return;
+  }
+  const sep = payload.lastIndexOf(":");
+  const mode = payload.slice(sep + 1);
+  if (sep === -1 || !storage.CHANNEL_PERMISSIONS.includes(mode)) {
+    ws.send("ERR:mode_invalid");
+    return;
+  }
+  try {
+    const channel = await storage.setChannelPermissions(payload.slice(0, sep), mode);
+    if (!channel) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    const pins = await storage.pinCounts();
+    broadcast(wss, `CHANNELADD:${JSON.stringify(toWireChannel(channel, pins[channel.name]))}`);
+    console.log(`[${getTimestamp()}] ${username} made #${channel.name} ${mode}`);
+    audit.record("channel_mode", {
+      user: username,
+      channel: channel.name,
+      ip: ws.ip,
+      details: { permissions: mode },
+    });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error changing channel mode:`, error.message);
+  }
+}
+
+// INVITE:<channel>:<username> - mods and admins let someone into an
+// invite-only channel, who hears about it if they're online
+async function handleInvite(ws, username, payload) {
+  if (!isMod(ws)) {
+    ws.send("ERR:mod_only");
+    return;
+  }
+  const sep = payload.indexOf(":");
+  const name = storage.normalizeChannel(payload.slice(0, sep));
+  const target = payload.slice(sep + 1).trim();
+  try {
+    if (sep === -1 || !(await storage.findChannel(name))) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    if (!target || !(await findUser(target))) {
+      ws.send("ERR:user_not_found");
+      return;
+    }
+    if (!(await storage.addInvite(name, target, username))) {
+      sendSystem(ws, `${target} is already invited to #${name}`);
+      return;
+    }
+
+    sendSystem(ws, `Invited ${target} to #${name}`);
+    const targetWs = findClientSocket(target);
+    if (targetWs) sendSystem(targetWs, `${username} invited you to #${name}`);
+    audit.record("channel_invite", {
+      user: username,
+      channel: name,
+      ip: ws.ip,
+      details: { invited: target },
+    });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error inviting user:`, error.message);
+  }
+}
+
+// Invite-only channels let in their creator, mods and admins, and whoever
+// was invited
+async function mayEnter(ws, username, channel) {
+  if (!channel || channel.permissions !== "invite-only") return true;
+  if (channel.createdBy === username || isMod(ws)) return true;
+  return await storage.isInvited(channel.name, username);
+}
+
+// Whether username may read the named channel
+async function mayRead(ws, username, name) {
+  return mayEnter(ws, username, await storage.findChannel(name));
+}
+
+// Everyone online who may enter the named channel, which is everyone
+// unless it's invite-only
+async function channelMembers(name) {
+  const channel = await storage.findChannel(name);
+  const members = [];
+  for (const [clientWs, username] of clients.entries()) {
+    if (await mayEnter(clientWs, username, channel)) members.push(clientWs);
+  }
+  return members;
+}
+
+// Send text to everyone online who may enter the named channel
+async function broadcastToMembers(name, text) {
+  for (const client of await channelMembers(name)) sendLive(client, text);
+}
+
+// What an IRC user is told when postDenied refuses their message
+function permissionDeniedText(channel, reason) {
+  return reason === "read_only"
+    ? `#${channel} is read-only`
+    : `#${channel} is invite-only`;
+}
+
+// Why username may not post in the named channel - read_only for anyone
+// but admins, invite_only for those not let in - or null if they may
+async function postDenied(ws, username, name) {
+  const channel = await storage.findChannel(name);
+  if (channel && channel.permissions === "read-only" && !isAdmin(ws)) return "read_only";
+  if (!(await mayEnter(ws, username, channel))) return "invite_only";
+  return null;
+}
+
+// Shape a category as CHANNELCATEGORY:<category>:<channels_csv>
+function categoryFrame(category) {
+  return `CHANNELCATEGORY:${category.name}:${category.channels.join(",")}`;
+}
+
+function broadcastCategories(wss, categories) {
+  for (const category of categories) broadcast(wss, categoryFrame(category));
+}
+
+// Send ws every category, one frame each, for its sidebar
+async function sendCategories(ws) {
+  try {
+    for (const category of await storage.listCategories()) {
+      ws.send(categoryFrame(category));
+    }
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error loading categories:`, error.message);
+  }
+}
+
+// CATEGORY:create:<name>, CATEGORY:add:<channel>:<name> or
+// CATEGORY:remove:<channel> - admins only. Changed categories are sent to
+// everyone.
+async function handleCategory(wss, ws, username, payload) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  const [action, ...args] = payload.split(":");
+  try {
+    if (action === "create") {
+      const name = args.join(":").trim();
+      if (!CATEGORY_NAME_PATTERN.test(name) || name.toLowerCase() === RESERVED_CATEGORY) {
+        ws.send("ERR:category_invalid");
+        return;
+      }
+      const category = await storage.createCategory(name);
+      if (!category) {
+        ws.send("ERR:category_exists");
+        return;
+      }
+      broadcastCategories(wss, [category]);
+      console.log(`[${getTimestamp()}] ${username} created category ${name}`);
+      return;
+    }
+
+    const channel = storage.normalizeChannel(args[0]);
+    if (!(await storage.findChannel(channel)) && channel !== storage.DEFAULT_CHANNEL) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    if (action === "add") {
+      const changed = await storage.categorize(channel, args.slice(1).join(":").trim());
+      if (!changed) {
+        ws.send("ERR:category_not_found");
+        return;
+      }
+      broadcastCategories(wss, changed);
+    } else if (action === "remove") {
+      broadcastCategories(wss, await storage.uncategorize(channel));
+    } else {
+      ws.send("ERR:category_invalid");
+    }
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error updating categories:`, error.message);
+  }
+}
+
+// Whether ws may send another message right now. Throttled senders are told
+// to slow down; more than RATE_LIMIT_STRIKES throttles within the strike
+// window mutes them for rate_limit_mute_ms.
+function allowMessage(ws) {
+  const now = Date.now();
+  let limit = rateLimits.get(ws);
+  if (!limit) {
+    limit = {
+      bucket: new RateLimiter(config.rate_limit_rps, config.rate_limit_burst),
+      strikes: [],
+      mutedUntil: 0,
+    };
+    rateLimits.set(ws, limit);
+  }
+
+  if (limit.mutedUntil > now) {
+    const seconds = Math.ceil((limit.mutedUntil - now) / 1000);
+    ws.send(`RATELIMIT:You are muted for ${seconds}s for flooding`);
+    return false;
+  }
+  if (limit.bucket.take()) return true;
+
+  limit.strikes = limit.strikes.filter(
+    (at) => now - at < RATE_LIMIT_STRIKE_WINDOW_MS
+  );
+  limit.strikes.push(now);
+  if (limit.strikes.length > RATE_LIMIT_STRIKES) {
+    limit.strikes = [];
+    limit.mutedUntil = now + config.rate_limit_mute_ms;
+    ws.send(
+      `RATELIMIT:You are muted for ${config.rate_limit_mute_ms / 1000}s for flooding`
+    );
+    console.log(`[${getTimestamp()}] ${clients.get(ws)} muted for flooding`);
+    return false;
+  }
+  ws.send("RATELIMIT:Slow down, you are sending messages too fast");
+  return false;
+}
+
+// Pass typing notices on to everyone else, at most once per second per sender
+function relayTyping(wss, senderWs, username) {
+  const now = Date.now();
+  if (now - (senderWs.lastTypingRelay || 0) < TYPING_RELAY_INTERVAL_MS) return;
+  senderWs.lastTypingRelay = now;
+
+  wss.clients.forEach((client) => {
+    if (
+      client !== senderWs &&
+      client.status !== "dnd" &&
+      client.readyState === WebSocket.OPEN
+    ) {
+      client.send(`TYPING:${username}`);
+    }
+  });
+}
+
+// EDIT:<msgID>:<newBody> - authors may fix their messages for a few minutes
+async function handleEdit(wss, ws, username, payload) {
+  const sep = payload.indexOf(":");
+  const msgId = sep === -1 ? "" : payload.slice(0, sep);
+  const body = filterMessage(
+    ws,
+    username,
+    sep === -1 ? "" : payload.slice(sep + 1).trim()
+  );
+  if (body === null) return;
+
+  let edited = null;
+  if (msgId && body) {
+    try {
+      edited = await storage.editMessage(msgId, username, body, EDIT_WINDOW_MS);
+    } catch (error) {
+      console.error(`[${getTimestamp()}] Error editing message:`, error.message);
+    }
+  }
+
+  if (!edited) {
+    ws.send("ERR:edit_denied");
+    return;
+  }
+
+  await broadcastToMembers(edited.channel, `EDIT:${msgId}:${edited.content}`);
+  ws.send("ACK_EDIT");
+  audit.record("edit", {
+    user: username,
+    channel: edited.channel,
+    ip: ws.ip,
+    details: { id: msgId },
+  });
+}
+
+// Read the word filter list from filter_file, keeping the current list if
+// the file can't be read. Returns whether it loaded.
+function loadWordFilters() {
+  try {
+    filters = wordFilters.loadFilters(config.filter_file);
+  } catch (error) {
+    console.error(
+      `[${getTimestamp()}] Keeping current filters, can't read ${config.filter_file}:`,
+      error.message
+    );
+    return false;
+  }
+  console.log(
+    `[${getTimestamp()}] Loaded ${filters.length} word filters from ${config.filter_file}`
+  );
+  return true;
+}
+
+// Read the message of the day from motd_file. A missing file just means
+// there's no MOTD.
+function loadMotd() {
+  try {
+    motdModifiedAt = fs.statSync(config.motd_file).mtimeMs;
+    motd = fs.readFileSync(config.motd_file, "utf8").trim();
+  } catch (error) {
+    motd = "";
+    motdModifiedAt = 0;
+    if (error.code !== "ENOENT") {
+      console.error(
+        `[${getTimestamp()}] Can't read ${config.motd_file}:`,
+        error.message
+      );
+    }
+  }
+}
+
+// The message of the day, reading motd_file again if it changed since,
+// so edits to it show without a reload
+async function currentMotd() {
+  let modifiedAt = 0;
+  try {
+    modifiedAt = (await fs.promises.stat(config.motd_file)).mtimeMs;
+  } catch (error) {
+    if (error.code !== "ENOENT") return motd;
+  }
+  if (modifiedAt !== motdModifiedAt) loadMotd();
+  return motd;
+}
+
+// MOTD:<text> - admins only. Replaces the message of the day and rewrites
+// motd_file; empty text removes it.
+async function handleMotd(ws, username, text) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  text = text.trim();
+  if (text.length > MAX_MOTD_LENGTH) {
+    ws.send("ERR:motd_invalid");
+    return;
+  }
+
+  try {
+    await fs.promises.writeFile(config.motd_file, text ? text + "\n" : "");
+  } catch (error) {
+    console.error(
+      `[${getTimestamp()}] Error writing ${config.motd_file}:`,
+      error.message
+    );
+    sendSystem(ws, `Couldn't save ${config.motd_file}, the MOTD is unchanged`);
+    return;
+  }
+  motd = text;
+  console.log(`[${getTimestamp()}] ${username} changed the MOTD`);
+  sendSystem(ws, text ? "Message of the day updated" : "Message of the day removed");
+}
+
+// The steps of the message pipeline, run over a context of { wss, ws,
+// username, text, replyTo, clientID, time, receivedAt } in the order
+// message_pipeline lists them
+const messageSteps = {
+  // Still logged in, and allowed to post in the channel
+  async auth(ctx) {
+    if (!clients.has(ctx.ws)) return pipeline.HALT;
+    if (WHISPER_PATTERN.test(ctx.text)) return;
+    // Sent with the clientID so the sender can mark what it showed
+    const denied = await postDenied(ctx.ws, ctx.username, ctx.ws.channel);
+    if (denied) {
+      return `PERMISSION_DENIED:${ctx.ws.channel}:${denied}${ctx.clientID ? `:${ctx.clientID}` : ""}`;
+    }
+  },
+
+  // Only chat messages and whispers count against the limit; typing,
+  // pings and the other commands never reach here
+  async ratelimit(ctx) {
+    if (!allowMessage(ctx.ws)) return pipeline.HALT;
+  },
+
+  async size(ctx) {
+    if (ctx.text.length > config.max_message_size) return "ERR:message_too_long";
+  },
+
+  // The same message sent twice in quick succession, say by a client
+  // retrying, goes out once
+  async dedup(ctx) {
+    if (!config.dedup_enabled) return;
+    const { username, text } = ctx;
+    if (!recentMessages.check(username, text, config.dedup_window_size, config.dedup_expiry_seconds * 1000)) {
+      return;
+    }
+    console.debug(`[${getTimestamp()}] Duplicate message from ${username} in #${ctx.ws.channel}: ${text}`);
+    return `DUPLICATE${ctx.clientID ? `:${ctx.clientID}` : ""}`;
+  },
+
+  async spam(ctx) {
+    const now = Date.now();
+    const last = ctx.ws.lastMessage;
+    if (last && last.text === ctx.text && now - last.at < SPAM_WINDOW_MS) {
+      last.count++;
+      last.at = now;
+    } else {
+      ctx.ws.lastMessage = { text: ctx.text, at: now, count: 1 };
+    }
+    if (ctx.ws.lastMessage.count > SPAM_REPEATS) {
+      return "FILTERED:Please don't send the same message over and over";
+    }
+  },
+
+  async filter(ctx) {
+    ctx.text = filterMessage(ctx.ws, ctx.username, ctx.text);
+    if (ctx.text === null) return pipeline.HALT;
+  },
+
+  // Picks out whispers, which guests can't send. Unverified users'
+  // messages are only ever shown to themselves, whispers included.
+  async transform(ctx) {
+    const match = ctx.ws.emailVerified && ctx.text.match(WHISPER_PATTERN);
+    if (!match) return;
+    if (ctx.ws.isGuest) return "ERR:guest_denied";
+    ctx.whisper = { target: match[1], body: match[2] };
+  },
+
+  // Whispers are stored as they're delivered. Nothing is stored for people
+  // who turned it off with /privacy.
+  async persist(ctx) {
+    if (ctx.whisper || ctx.ws.storeMessages === false) return;
+    ctx.stored = ctx.ws.emailVerified
+      ? await logMessage(ctx.username, ctx.text, null, ctx.ws.channel, ctx.replyTo)
+      : await logMessage(ctx.username, ctx.text, ctx.username, ctx.ws.channel);
+  },
+
+  async broadcast(ctx) {
+    const { wss, ws, username, text, stored, clientID } = ctx;
+    if (ctx.whisper) {
+      await handleWhisper(ws, username, ctx.whisper.target, ctx.whisper.body, clientID);
+      return;
+    }
+
+    // Stored messages carry their id so clients can back-fill later, the
+    // clientID so the sender can match up what it showed, and the sender's
+    // display color. Those of people who opted out of storage go the same
+    // way without an id, marked ephemeral.
+    const ephemeral = !stored && ws.storeMessages === false;
+    const finalMessage = stored || ephemeral
+      ? JSON.stringify({
+          type: "message",
+          ...(stored ? toWireMessage(stored) : ephemeralMessage(username, ws.channel, text)),
+          ...(clientID && { clientID }),
+          ...(ws.displayColor && { displayColor: ws.displayColor }),
+        })
+      : `${ctx.time}: ${username} said: ${text}`;
+    const acknowledged = (stored || ephemeral) && clientID;
+    if (!ws.emailVerified) {
+      ws.send(finalMessage);
+      if (acknowledged) ws.send(`ACK:${clientID}`);
+      return;
+    }
+
+    broadcastToChannel(wss, ws.channel, finalMessage);
+    if (acknowledged) ws.send(`ACK:${clientID}`);
+    if (stored && ctx.replyTo) broadcastReply(wss, ws.channel, stored);
+    if (ircBridge) ircBridge.deliver(ws.channel, username, text);
+    await broadcastActivity(ws.channel);
+    await notifyMentions(ws.channel, username, text);
+    audit.record("message", {
+      user: username,
+      channel: ws.channel,
+      ip: ws.ip,
+      details: { id: stored ? stored._id.toString() : null },
+    });
+    metrics.countMessage(ws.channel);
+    metrics.observeLatency(ctx.receivedAt);
+  },
+
+  async webhook(ctx) {
+    if (ctx.whisper || !ctx.ws.emailVerified) return;
+    const event = { channel: ctx.ws.channel, username: ctx.username, body: ctx.text };
+    fireWebhooks("message", event);
+    if (/@[\w-]+/.test(ctx.text)) fireWebhooks("mention", event);
+  },
+};
+
+// Rebuilt when the config is reloaded
+let runMessagePipeline = pipeline.build(config.message_pipeline, messageSteps, tracer);
+
+// Run a message body through the word filters. Returns the text to send, or
+// null if it was blocked; the sender hears why. Matches are logged with the
+// original body for moderators, and audited with the rules that matched.
+function filterMessage(ws, username, text) {
+  const { matched, rules, cleaned } = wordFilters.applyFilters(filters, text);
+  if (!matched) return text;
+
+  console.warn(
+    `[${getTimestamp()}] Filtered message from ${username} in #${ws.channel} (${config.filter_mode}): ${text}`
+  );
+  audit.record("filter", {
+    user: username,
+    channel: ws.channel,
+    ip: ws.ip,
+    details: { rules, mode: config.filter_mode },
+  });
+  if (config.filter_mode === "block") {
+    ws.send("FILTERED:Your message contains disallowed content");
+    return null;
+  }
+  return cleaned;
+}
+
+// ANNOUNCE:<text> - admins only. Goes to everyone connected and into every
+// channel's history.
+async function handleAnnounce(wss, ws, username, text) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:permission_denied");
+    return;
+  }
+  text = text.trim();
+  if (!text) return;
+
+  broadcast(wss, `ANNOUNCE:${text}`);
+  console.log(`[${getTimestamp()}] ${username} announced: ${text}`);
+  try {
+    const channels = await storage.listChannels();
+    await Promise.all(
+      channels.map((channel) =>
+        logMessage(SYSTEM_SENDER, text, null, channel.name)
+      )
+    );
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error saving announcement:`, error.message);
+  }
+}
+
+// MAINTENANCE:on:<message> or MAINTENANCE:off - admins only. While it's
+// on, everyone connected sees the message in a banner and new connections
+// are refused until it's turned off.
+function handleMaintenance(wss, ws, username, payload) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  const sep = payload.indexOf(":");
+  const action = sep === -1 ? payload : payload.slice(0, sep);
+  const text = sep === -1 ? "" : payload.slice(sep + 1).trim();
+
+  if (action === "on") {
+    if (text.length > MAX_MAINTENANCE_LENGTH) {
+      ws.send("ERR:maintenance_invalid");
+      return;
+    }
+    maintenance = text || "The server is down for maintenance";
+    broadcast(wss, `MAINTENANCE:${maintenance}`);
+    console.log(`[${getTimestamp()}] ${username} started maintenance: ${maintenance}`);
+  } else if (action === "off") {
+    if (maintenance === null) {
+      sendSystem(ws, "Maintenance mode is already off");
+      return;
+    }
+    maintenance = null;
+    broadcast(wss, "MAINTENANCE_END");
+    console.log(`[${getTimestamp()}] ${username} ended maintenance`);
+  } else {
+    ws.send("ERR:maintenance_invalid");
+  }
+}
+
+// RELOADFILTERS - admins only
+function handleReloadFilters(ws) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  sendSystem(
+    ws,
+    loadWordFilters()
+      ? `Reloaded ${filters.length} word filters`
+      : `Couldn't read ${config.filter_file}, keeping the current filters`
+  );
+}
+
+function isAdmin(ws) {
+  return ws.role === "admin";
+}
+
+function isMod(ws) {
+  return ws.role === "mod" || isAdmin(ws);
+}
+
+// Split a <channel>:<msgID> payload, as sent with PIN and UNPIN
+function parsePinTarget(payload) {
+  const sep = payload.indexOf(":");
+  if (sep === -1) return null;
+  return {
+    channel: storage.normalizeChannel(payload.slice(0, sep)),
+    msgId: payload.slice(sep + 1).trim(),
+  };
+}
+
+// PIN:<channel>:<msgID> - mods and admins pin up to MAX_PINS messages per
+// channel; its members are sent PINNED:<channel>:<json> for their sidebars
+async function handlePin(wss, ws, username, payload) {
+  if (!isMod(ws)) {
+    ws.send("ERR:mod_only");
+    return;
+  }
+  const target = parsePinTarget(payload);
+  try {
+    const message = target && (await storage.findMessage(target.msgId));
+    if (!message || message.recipient !== null || message.channel !== target.channel) {
+      ws.send("ERR:message_not_found");
+      return;
+    }
+    if ((await storage.countPins(target.channel)) >= storage.MAX_PINS) {
+      ws.send("ERR:pin_limit");
+      return;
+    }
+    const pin = await storage.addPin(target.channel, message, username);
+    if (!pin) {
+      ws.send("ERR:already_pinned");
+      return;
+    }
+
+    await broadcastToMembers(target.channel, `PINNED:${target.channel}:${JSON.stringify(pin)}`);
+    audit.record("pin", {
+      user: username,
+      channel: target.channel,
+      ip: ws.ip,
+      details: { id: target.msgId },
+    });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error pinning message:`, error.message);
+  }
+}
+
+// UNPIN:<channel>:<msgID> - mods and admins; the channel's members are sent
+// UNPINNED:<channel>:<msgID>
+async function handleUnpin(wss, ws, username, payload) {
+  if (!isMod(ws)) {
+    ws.send("ERR:mod_only");
+    return;
+  }
+  const target = parsePinTarget(payload);
+  try {
+    if (!target || !(await storage.removePin(target.channel, target.msgId))) {
+      ws.send("ERR:pin_not_found");
+      return;
+    }
+
+    await broadcastToMembers(target.channel, `UNPINNED:${target.channel}:${target.msgId}`);
+    audit.record("unpin", {
+      user: username,
+      channel: target.channel,
+      ip: ws.ip,
+      details: { id: target.msgId },
+    });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error unpinning message:`, error.message);
+  }
+}
+
+// The frames describing poll: POLLCREATED:<id>:<question>:<options> with
+// the options as a JSON array, then POLLUPDATE:<id>:<tallies> with the
+// votes for each option, comma-separated
+function pollFrames(poll, tallies) {
+  return [
+    `POLLCREATED:${poll.pollId}:${poll.question}:${JSON.stringify(poll.options)}`,
+    `POLLUPDATE:${poll.pollId}:${tallies.join(",")}`,
+  ];
+}
+
+// Questions and options are one line of text each
+function pollText(value, max) {
+  if (typeof value !== "string") return null;
+  const text = value.replace(/\s+/g, " ").trim();
+  return text && text.length <= max ? text : null;
+}
+
+// POLL:{"question":...,"options":[...]} - ask the current channel a
+// question with 2 to 10 options, open for poll_expiry_hours; everyone in it
+// is sent POLLCREATED:<id>:<question>:<options>
+async function handlePoll(wss, ws, username, payload) {
+  let request;
+  try {
+    request = JSON.parse(payload);
+  } catch {
+    request = null;
+  }
+  const question = pollText(request?.question, storage.MAX_POLL_QUESTION);
+  const options = Array.isArray(request?.options)
+    ? request.options.map((option) => pollText(option, storage.MAX_POLL_OPTION))
+    : [];
+  if (
+    !question ||
+    options.length < storage.MIN_POLL_OPTIONS ||
+    options.length > storage.MAX_POLL_OPTIONS ||
+    options.includes(null)
+  ) {
+    ws.send("ERR:poll_invalid");
+    return;
+  }
+
+  const channel = ws.channel;
+  try {
+    const denied = await postDenied(ws, username, channel);
+    if (denied) {
+      ws.send(`ERR:${denied}`);
+      return;
+    }
+    const expiresAt = new Date(Date.now() + config.poll_expiry_hours * 3600 * 1000);
+    const poll = await storage.createPoll(channel, question, options, username, expiresAt);
+
+    broadcastToChannel(wss, channel, pollFrames(poll, [])[0]);
+    audit.record("poll", {
+      user: username,
+      channel,
+      ip: ws.ip,
+      details: { id: poll.pollId, question },
+    });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error creating poll:`, error.message);
+  }
+}
+
+// VOTE:<pollID>:<option> - vote for an option, numbered from 1, in an open
+// poll in the current channel, replacing any earlier vote; everyone in it
+// is sent POLLUPDATE:<id>:<tallies>
+async function handleVote(wss, ws, username, payload) {
+  const [pollId, number] = payload.split(":");
+  try {
+    const poll = await storage.findPoll(pollId);
+    if (!poll || poll.channel !== ws.channel) {
+      ws.send("ERR:poll_not_found");
+      return;
+    }
+    const option = parseInt(number, 10) - 1;
+    if (!(option >= 0 && option < poll.options.length)) {
+      ws.send("ERR:poll_invalid");
+      return;
+    }
+    if (poll.closed || poll.expiresAt <= new Date()) {
+      ws.send("ERR:poll_closed");
+      return;
+    }
+    const denied = await postDenied(ws, username, poll.channel);
+    if (denied) {
+      ws.send(`ERR:${denied}`);
+      return;
+    }
+
+    await storage.castVote(poll.pollId, username, option);
+    const tallies = await storage.pollTallies(poll);
+    broadcastToChannel(wss, poll.channel, pollFrames(poll, tallies)[1]);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error recording vote:`, error.message);
+  }
+}
+
+// Send ws a channel's open polls and their tallies so far
+async function sendPolls(ws, channel) {
+  for (const poll of await storage.openPolls(channel)) {
+    const tallies = await storage.pollTallies(poll);
+    pollFrames(poll, tallies).forEach((text) => ws.send(text));
+  }
+}
+
+// Close polls that have run their time, sending everyone in their channel
+// the final tallies as POLLCLOSED:<id>:<tallies>
+async function closeExpiredPolls(wss) {
+  try {
+    for (const poll of await storage.closeExpiredPolls()) {
+      const tallies = await storage.pollTallies(poll);
+      broadcastToChannel(wss, poll.channel, `POLLCLOSED:${poll.pollId}:${tallies.join(",")}`);
+    }
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error closing polls:`, error.message);
+  }
+}
+
+// DELETE:<msgID> - authors may delete their own messages, admins any message
+async function handleDelete(wss, ws, username, msgId) {
+  msgId = msgId.trim();
+  try {
+    const message = await storage.findMessage(msgId);
+    if (!message || message.recipient !== null) {
+      ws.send("ERR:message_not_found");
+      return;
+    }
+    if (message.sender !== username && !isAdmin(ws)) {
+      ws.send("ERR:delete_denied");
+      return;
+    }
+
+    const pinned = await storage.removePin(message.channel, msgId);
+    await storage.deleteMessage(msgId);
+    broadcast(wss, `DELETE:${msgId}`);
+    if (pinned) await broadcastToMembers(message.channel, `UNPINNED:${message.channel}:${msgId}`);
+    audit.record("delete", {
+      user: username,
+      channel: message.channel,
+      ip: ws.ip,
+      details: { id: msgId, sender: message.sender },
+    });
+    console.log(
+      `[${getTimestamp()}] ${username} deleted message ${msgId} by ${message.sender}`
+    );
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error deleting message:`, error.message);
+  }
+}
+
+// Close reasons are limited to 123 bytes of UTF-8
+const MAX_CLOSE_REASON_BYTES = 123;
+
+// text cut to fit in a close reason, between characters
+function closeReason(text) {
+  let reason = "";
+  let bytes = 0;
+  for (const char of text) {
+    bytes += Buffer.byteLength(char);
+    if (bytes > MAX_CLOSE_REASON_BYTES) break;
+    reason += char;
+  }
+  return reason;
+}
+
+// Close ws with a KICKED:<reason> close frame; the close handler then
+// drops it from the clients map like any other disconnect. Should the
+// close fail, the socket is dropped without one.
+function kickClient(ws, reason) {
+  try {
+    ws.close(4000, closeReason(`KICKED:${reason}`));
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error kicking ${clients.get(ws)}:`, error.message);
+    ws.terminate?.();
+  }
+}
+
+// How a ban reads to the banned user
+function describeBan(ban) {
+  const until = ban.expiresAt
+    ? `until ${ban.expiresAt.toLocaleString()}`
+    : "permanently";
+  return `You are banned ${until}${ban.reason ? `: ${ban.reason}` : ""}`;
+}
+
+// KICK:<username>:<reason> - admins only
+function handleKick(wss, ws, username, payload) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  const sep = payload.indexOf(":");
+  const target = (sep === -1 ? payload : payload.slice(0, sep)).trim();
+  const reason = sep === -1 ? "" : payload.slice(sep + 1).trim();
+
+  const targetWs = target === WEBHOOK_SENDER ? null : findClientSocket(target);
+  if (!targetWs) {
+    ws.send("ERR:user_not_found");
+    return;
+  }
+  kickClient(targetWs, reason || `Kicked by ${username}`);
+  broadcast(
+    wss,
+    `${target} was kicked by ${username}${reason ? `: ${reason}` : ""}`
+  );
+  console.log(`[${getTimestamp()}] ${username} kicked ${target}: ${reason}`);
+  audit.record("kick", {
+    user: username,
+    channel: targetWs.channel,
+    ip: ws.ip,
+    details: { target, reason },
+  });
+}
+
+// BAN:<username>:<seconds>:<reason> - admins only; 0 seconds bans for good.
+// The target needn't be online; if they are, their address is banned too.
+async function handleBan(wss, ws, username, payload) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  const [rawTarget = "", seconds = "", ...rest] = payload.split(":");
+  const target = rawTarget.trim();
+  const reason = rest.join(":").trim();
+  const duration = Number(seconds);
+  if (
+    !target ||
+    target === username ||
+    target === WEBHOOK_SENDER ||
+    !Number.isInteger(duration) ||
+    duration < 0
+  ) {
+    ws.send("ERR:ban_invalid");
+    return;
+  }
+
+  try {
+    const targetWs = findClientSocket(target);
+    const ban = await storage.addBan({
+      username: target,
+      ip: targetWs ? targetWs.ip : null,
+      expiresAt: duration > 0 ? new Date(Date.now() + duration * 1000) : null,
+      reason,
+      bannedBy: username,
+    });
+    if (targetWs) kickClient(targetWs, describeBan(ban));
+    broadcast(
+      wss,
+      `${target} was banned by ${username}${reason ? `: ${reason}` : ""}`
+    );
+    console.log(
+      `[${getTimestamp()}] ${username} banned ${target} for ${duration ? `${duration}s` : "good"}: ${reason}`
+    );
+    audit.record("ban", {
+      user: username,
+      ip: ws.ip,
+      details: { target, seconds: duration, reason },
+    });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error banning user:`, error.message);
+  }
+}
+
+// REACT:<msgID>:<emoji> toggles a reaction on a message in a channel the
+// user may enter, and sends its members the new tally
+async function handleReact(wss, ws, username, payload) {
+  const sep = payload.indexOf(":");
+  const msgId = sep === -1 ? "" : payload.slice(0, sep);
+  const emoji = sep === -1 ? "" : payload.slice(sep + 1).trim();
+  if (!msgId || !emoji || emoji.length > 16) {
+    ws.send("ERR:react_denied");
+    return;
+  }
+
+  try {
+    const message = await storage.findMessage(msgId);
+    if (!message || !(await mayRead(ws, username, message.channel))) {
+      ws.send("ERR:react_denied");
+      return;
+    }
+    const count = await storage.toggleReaction(msgId, emoji, username);
+    if (count === null) {
+      ws.send("ERR:react_denied");
+      return;
+    }
+    await broadcastToMembers(message.channel, `REACT:${msgId}:${emoji}:${count}`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error saving reaction:`, error.message);
+  }
+}
+
+// FILECHUNK:<uploadID>:<total>:<index>:<filename>:<b64> - once every chunk
+// has arrived the file is announced as FILEREF:<url>:<filename>:<size_bytes>.
+// A chunk over the connection's chunk rate fails its upload.
+async function handleFileChunk(wss, ws, username, payload) {
+  let limiter = chunkLimits.get(ws);
+  if (!limiter) {
+    limiter = new RateLimiter(uploads.UPLOAD_CHUNKS_PER_SEC, uploads.UPLOAD_CHUNK_BURST);
+    chunkLimits.set(ws, limiter);
+  }
+  if (!limiter.take()) {
+    if (uploads.dropUpload(payload.split(":")[0], username)) {
+      ws.send("ERR:upload_rate_limited");
+    }
+    return;
+  }
+
+  try {
+    const file = await uploads.addChunk(username, payload);
+    if (!file) return;
+
+    const url = `${publicUrl()}/files/${encodeURIComponent(file.name)}`;
+    broadcast(wss, `FILEREF:${url}:${file.filename}:${file.size}`);
+    console.log(
+      `[${getTimestamp()}] ${username} uploaded ${file.filename} (${file.size} bytes)`
+    );
+  } catch (error) {
+    if (error instanceof uploads.UploadError) {
+      ws.send(`ERR:${error.code}`);
+      return;
+    }
+    console.error(`[${getTimestamp()}] Error saving upload:`, error.message);
+  }
+}
+
+// SEARCH:<channel>:<query>:<limit> - the query may itself contain colons
+async function handleSearch(ws, username, payload) {
+  const first = payload.indexOf(":");
+  const last = payload.lastIndexOf(":");
+  if (first === -1 || last === first) {
+    ws.send("ERR:search_invalid");
+    return;
+  }
+
+  const channel = payload.slice(0, first);
+  const query = payload.slice(first + 1, last).trim();
+  const limit = parseInt(payload.slice(last + 1), 10);
+  if (!query) {
+    ws.send("ERR:search_invalid");
+    return;
+  }
+
+  try {
+    if (!(await mayRead(ws, username, channel))) {
+      ws.send("ERR:permission_denied");
+      return;
+    }
+    const results = await storage.searchMessages(channel, query, limit);
+    ws.send(`SEARCHRESULTS:${JSON.stringify(results)}`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error searching messages:`, error.message);
+    ws.send("ERR:search_invalid");
+  }
+}
+
+// EXPORT:<channel>:<from>:<to>:<format> streams a channel's messages sent
+// between two unix times (empty or 0 for no limit) as EXPORTCHUNK:{json}
+// frames of EXPORT_CHUNK_SIZE, then EXPORTDONE:<filename>. Clients do the
+// formatting; the format only names the file.
+async function handleExport(ws, username, payload) {
+  const [rawChannel = "", from = "", to = "", format = ""] = payload.split(":");
+  const channel = storage.normalizeChannel(rawChannel);
+  if (
+    ws.exporting ||
+    !EXPORT_FORMATS.includes(format) ||
+    !/^\d*$/.test(from) ||
+    !/^\d*$/.test(to)
+  ) {
+    ws.send("ERR:export_invalid");
+    return;
+  }
+
+  const exporting = { cancelled: false };
+  ws.exporting = exporting;
+  try {
+    if (
+      channel !== storage.DEFAULT_CHANNEL &&
+      !(await storage.findChannel(channel))
+    ) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    if (!(await mayRead(ws, username, channel))) {
+      ws.send("ERR:permission_denied");
+      return;
+    }
+
+    const fromDate = Number(from) ? new Date(Number(from) * 1000) : null;
+    const toDate = Number(to) ? new Date(Number(to) * 1000) : null;
+    const total = await storage.countExport(channel, fromDate, toDate);
+    let sent = 0;
+    let batch = [];
+    const sendBatch = async () => {
+      sent += batch.length;
+      ws.send(`EXPORTCHUNK:${JSON.stringify({ total, sent, messages: batch })}`);
+      batch = [];
+      // Don't read faster than the client takes the chunks
+      while (ws.bufferedAmount > EXPORT_MAX_BUFFERED && !exporting.cancelled) {
+        await new Promise((resolve) => setTimeout(resolve, 50));
+      }
+    };
+
+    for await (const message of storage.exportCursor(channel, fromDate, toDate)) {
+      if (exporting.cancelled || ws.readyState !== WebSocket.OPEN) return;
+      batch.push(toWireMessage(message));
+      if (batch.length === EXPORT_CHUNK_SIZE) await sendBatch();
+    }
+    if (exporting.cancelled) return;
+    if (batch.length) await sendBatch();
+
+    const date = new Date().toISOString().slice(0, 10);
+    ws.send(`EXPORTDONE:echo-export-${channel}-${date}.${format}`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error exporting messages:`, error.message);
+    ws.send("ERR:export_failed");
+  } finally {
+    ws.exporting = null;
+  }
+}
+
+function findClientSocket(username) {
+  for (const [clientWs, clientUsername] of clients.entries()) {
+    if (clientUsername === username) return clientWs;
+  }
+  return null;
+}
+
+function findClientSocketInsensitive(username) {
+  const wanted = username.toLowerCase();
+  for (const [clientWs, clientUsername] of clients.entries()) {
+    if (clientUsername.toLowerCase() === wanted) return clientWs;
+  }
+  return null;
+}
+
+async function handleVerify(req, res, url) {
+  const token = url.searchParams.get("verify_token") || url.searchParams.get("token");
+  const user = token ? await User.findOne({ verifyToken: token }) : null;
+
+  if (!user) {
+    res.writeHead(400, { "Content-Type": "text/plain" });
+    res.end("Invalid or expired verification link\n");
+    return;
+  }
+
+  user.emailVerified = true;
+  user.verifyToken = null;
+  await user.save();
+  console.log(`[${getTimestamp()}] ${user.username} verified ${user.email}`);
+
+  const activeWs = findClientSocket(user.username);
+  if (activeWs) {
+    activeWs.emailVerified = true;
+    sendSystem(activeWs, "Email verified, your messages are now visible to everyone");
+  }
+
+  res.writeHead(200, { "Content-Type": "text/plain" });
+  res.end("Email verified, you can return to Echo\n");
+}
+
+// GET /api/health, for load balancers and container healthchecks
+function handleApiHealth(req, res) {
+  sendJson(res, 200, {
+    status: "ok",
+    uptime_s: Math.floor((Date.now() - SERVER_STARTED_AT) / 1000),
+  });
+}
+
+// GET /api/stats, for admins with the X-Admin-Token from the config.
+// Database figures are null if the database is slow to answer.
+async function handleApiStats(req, res) {
+  if (!hasAdminToken(req)) {
+    sendJson(res, 401, { error: "invalid admin token" });
+    return;
+  }
+
+  const timeout = new Promise((resolve) =>
+    setTimeout(resolve, STATS_TIMEOUT_MS, { totalMessages: null, dbSizeBytes: null })
+  );
+  const db = await Promise.race([storage.databaseStats(), timeout]).catch((error) => {
+    console.error(`[${getTimestamp()}] Error reading database stats:`, error.message);
+    return { totalMessages: null, dbSizeBytes: null };
+  });
+  const channels = new Set();
+  for (const clientWs of clients.keys()) channels.add(clientWs.channel);
+
+  sendJson(res, 200, {
+    connectedClients: clients.size,
+    totalMessages: db.totalMessages,
+    channelsActive: channels.size,
+    dbSizeBytes: db.dbSizeBytes,
+    maintenance,
+  });
+}
+
+// The request body, rejecting anything over limit bytes
+function readBody(req, limit) {
+  return new Promise((resolve, reject) => {
+    const chunks = [];
+    let size = 0;
+    req.on("data", (chunk) => {
+      size += chunk.length;
+      if (size > limit) {
+        reject(new Error("body too large"));
+        req.destroy();
+        return;
+      }
+      chunks.push(chunk);
+    });
+    req.on("end", () => resolve(Buffer.concat(chunks).toString("utf8")));
+    req.on("error", reject);
+  });
+}
+
+// The webhook token belongs to, if it's known and within its rate limit;
+// otherwise the request is answered and this returns null
+async function acceptWebhook(res, token) {
+  const webhook = await storage.findWebhook(token);
+  if (!webhook) {
+    sendJson(res, 404, { error: "unknown webhook" });
+    return null;
+  }
+
+  let limiter = webhookLimits.get(token);
+  if (!limiter) {
+    limiter = new RateLimiter(WEBHOOK_RATE_PER_MIN / 60, WEBHOOK_RATE_PER_MIN);
+    webhookLimits.set(token, limiter);
+  }
+  if (!limiter.take()) {
+    sendJson(res, 429, { error: "rate limited" });
+    return null;
+  }
+  return webhook;
+}
+
+// POST /webhook/incoming/<token> with {channel, username, body} posts body
+// to the webhook's channel as [webhook]. channel may be left out, and
+// username names the service in place of [webhook].
+async function handleIncomingWebhook(wss, req, res, token) {
+  const webhook = await acceptWebhook(res, token);
+  if (!webhook) return;
+
+  let payload;
+  try {
+    payload = JSON.parse(await readBody(req, WEBHOOK_MAX_BODY));
+  } catch (error) {
+    sendJson(res, 400, { error: "expected a JSON body" });
+    return;
+  }
+  const { channel, username, body } = payload || {};
+  if (typeof body !== "string" || !body.trim()) {
+    sendJson(res, 400, { error: "body is required" });
+    return;
+  }
+  if (body.length > config.max_message_size) {
+    sendJson(res, 400, { error: "body is too long" });
+    return;
+  }
+  if (username != null && !WEBHOOK_NAME_PATTERN.test(username)) {
+    sendJson(res, 400, { error: "invalid username" });
+    return;
+  }
+  if (channel != null && storage.normalizeChannel(channel) !== webhook.channel) {
+    sendJson(res, 403, { error: `this webhook posts to #${webhook.channel}` });
+    return;
+  }
+
+  const stored = await storage.saveMessage({
+    sender: WEBHOOK_SENDER,
+    content: body.trim(),
+    channel: webhook.channel,
+    botName: username || null,
+  });
+  // Outgoing webhooks aren't told, so the two can't feed each other
+  broadcastToChannel(
+    wss,
+    webhook.channel,
+    JSON.stringify({ type: "message", ...toWireMessage(stored) })
+  );
+  await broadcastActivity(webhook.channel);
+  await notifyMentions(webhook.channel, WEBHOOK_SENDER, stored.content);
+  metrics.countMessage(webhook.channel);
+  sendJson(res, 200, { id: stored._id.toString() });
+}
+
+// POST /webhook/incoming/<token>/stream?username= posts the request body,
+// plain text, to the webhook's channel as it arrives, for bots that write
+// their replies a piece at a time. The message goes out with streaming set
+// and no content, then each piece as STREAM:<id>:<n>:0:<text> and, once the
+// body ends, STREAM:<id>:<n>:1: closes it. Only then is it stored, and so
+// searchable, and sent whole as STREAM_COMPLETE:<message> for clients that
+// missed pieces. Past max_message_size the rest of the body is dropped.
+async function handleIncomingWebhookStream(wss, req, res, token, username) {
+  const webhook = await acceptWebhook(res, token);
+  if (!webhook) return;
+  if (username != null && !WEBHOOK_NAME_PATTERN.test(username)) {
+    sendJson(res, 400, { error: "invalid username" });
+    return;
+  }
+
+  const message = {
+    _id: storage.newMessageId(),
+    timestamp: new Date(),
+    sender: WEBHOOK_SENDER,
+    content: "",
+    channel: webhook.channel,
+    botName: username || null,
+  };
+  let chunks = 0;
+  let tooLong = false;
+  const send = (text, last) => {
+    broadcastToChannel(wss, webhook.channel, `STREAM:${message._id}:${chunks++}:${last ? 1 : 0}:${text}`);
+  };
+
+  await new Promise((resolve) => {
+    req.setEncoding("utf8");
+    req.setTimeout(WEBHOOK_STREAM_IDLE_MS, () => req.destroy());
+    req.on("data", (chunk) => {
+      const room = config.max_message_size - message.content.length;
+      if (chunk.length > room) {
+        chunk = chunk.slice(0, room);
+        tooLong = true;
+      }
+      // Leading blank lines wait until there's something to show
+      const started = !!message.content.trim();
+      message.content += chunk;
+      if (!message.content.trim()) return;
+      if (!started) {
+        broadcastToChannel(
+          wss,
+          webhook.channel,
+          JSON.stringify({ type: "message", ...toWireMessage(message), content: "", streaming: true })
+        );
+        chunk = message.content.trimStart();
+      }
+      if (chunk) send(chunk, false);
+    });
+    req.on("end", resolve);
+    req.on("close", resolve);
+  });
+
+  // Even a bot that went away mid-reply has its message finished
+  if (!message.content.trim()) {
+    if (req.complete) sendJson(res, 400, { error: "body is required" });
+    return;
+  }
+  send("", true);
+  const stored = await storage.saveMessage({
+    id: message._id,
+    timestamp: message.timestamp,
+    sender: message.sender,
+    content: message.content.trim(),
+    channel: message.channel,
+    botName: message.botName,
+  });
+  broadcastToChannel(wss, webhook.channel, "STREAM_COMPLETE:" + JSON.stringify(toWireMessage(stored)));
+  await broadcastActivity(webhook.channel);
+  await notifyMentions(webhook.channel, WEBHOOK_SENDER, stored.content);
+  metrics.countMessage(webhook.channel);
+  if (!req.complete) return;
+  if (tooLong) {
+    sendJson(res, 400, { error: "body is too long", id: stored._id.toString() });
+    return;
+  }
+  sendJson(res, 200, { id: stored._id.toString() });
+}
+
+// GET /api/audit?event=&user=&since=&limit= searches the audit log, newest
+// first, for admins with the X-Admin-Token. since is an ISO date.
+async function handleApiAudit(req, res, url) {
+  if (!hasAdminToken(req)) {
+    sendJson(res, 401, { error: "invalid admin token" });
+    return;
+  }
+  const event = url.searchParams.get("event");
+  const since = url.searchParams.get("since");
+  if (event && !audit.AUDIT_EVENTS.includes(event)) {
+    sendJson(res, 400, { error: `event must be one of ${audit.AUDIT_EVENTS.join(", ")}` });
+    return;
+  }
+  if (since && isNaN(Date.parse(since))) {
+    sendJson(res, 400, { error: "since must be a date" });
+    return;
+  }
+
+  const entries = await audit.search({
+    event,
+    user: url.searchParams.get("user"),
+    since: since ? new Date(since) : null,
+    limit: parseInt(url.searchParams.get("limit"), 10),
+  });
+  sendJson(res, 200, entries);
+}
+
+// Whether the request carries the admin_token from the config, which is
+// never the case while it's unset
+function hasAdminToken(req) {
+  const token = Buffer.from(String(req.headers["x-admin-token"] || ""));
+  const expected = Buffer.from(config.admin_token);
+  return (
+    !!config.admin_token &&
+    token.length === expected.length &&
+    crypto.timingSafeEqual(token, expected)
+  );
+}
+
+function sendJson(res, status, body) {
+  res.writeHead(status, { "Content-Type": "application/json" });
+  res.end(JSON.stringify(body) + "\n");
+}
+
+async function handleHttpRequest(wss, req, res) {
+  const url = new URL(req.url, publicUrl());
+  try {
+    if (
+      req.method === "POST" &&
+      url.pathname.startsWith("/webhook/incoming/") &&
+      url.pathname.endsWith("/stream")
+    ) {
+      await handleIncomingWebhookStream(
+        wss,
+        req,
+        res,
+        url.pathname.slice("/webhook/incoming/".length, -"/stream".length),
+        url.searchParams.get("username")
+      );
+      return;
+    }
+    if (req.method === "POST" && url.pathname.startsWith("/webhook/incoming/")) {
+      await handleIncomingWebhook(
+        wss,
+        req,
+        res,
+        url.pathname.slice("/webhook/incoming/".length)
+      );
+      return;
+    }
+    if (req.method === "GET" && url.pathname === "/api/health") {
+      handleApiHealth(req, res);
+      return;
+    }
+    if (req.method === "GET" && url.pathname === "/api/stats") {
+      await handleApiStats(req, res);
+      return;
+    }
+    if (req.method === "GET" && url.pathname === "/api/audit") {
+      await handleApiAudit(req, res, url);
+      return;
+    }
+    if (req.method === "GET" && url.pathname === "/verify") {
+      await handleVerify(req, res, url);
+      return;
+    }
+    if (req.method === "GET" && url.pathname.startsWith("/files/")) {
+      await uploads.serveUpload(
+        res,
+        decodeURIComponent(url.pathname.slice("/files/".length))
+      );
+      return;
+    }
+    res.writeHead(404, { "Content-Type": "text/plain" });
+    res.end("Not found\n");
+  } catch (error) {
+    console.error(`[${getTimestamp()}] HTTP error:`, error.message);
+    res.writeHead(500, { "Content-Type": "text/plain" });
+    res.end("Internal server error\n");
+  }
+}
+
+async function isUsernameTaken(username) {
+  const user = await User.findOne({ username, isOnline: true });
+  return !!user;
+}
+
+async function markUserOffline(username) {
+  try {
+    await User.findOneAndUpdate({ username }, { isOnline: false });
+  } catch (error) {
+    console.error(
+      `[${getTimestamp()}] Error marking user offline:`,
+      error.message
+    );
+  }
+}
+
+async function logMessage(
+  sender,
+  content,
+  recipient = null,
+  channel,
+  replyTo = null
+) {
+  try {
+    return await storage.saveMessage({
+      sender,
+      content,
+      recipient,
+      channel,
+      replyTo,
+    });
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error logging message:`, error.message);
+    return null;
+  }
+}
+
+// The id of the message a reply is to, if it's a public one in channel
+async function replyParent(channel, id) {
+  if (typeof id !== "string") return null;
+  try {
+    const parent = await storage.findMessage(id);
+    return parent && parent.recipient === null && parent.channel === channel
+      ? id
+      : null;
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error finding reply parent:`, error.message);
+    return null;
+  }
+}
+
+// THREAD:<msgID> - send every reply under a public message as
+// THREADREPLIES:<msgID>:<json>, then new replies in the channel as
+// REPLY:<parentID>:<json> until THREAD: with no id closes the thread
+async function handleThread(ws, username, msgId) {
+  msgId = msgId.trim();
+  if (!msgId) {
+    ws.thread = null;
+    return;
+  }
+  try {
+    const parent = await storage.findMessage(msgId);
+    if (!parent || parent.recipient !== null) {
+      ws.send("ERR:message_not_found");
+      return;
+    }
+    if (!(await mayRead(ws, username, parent.channel))) {
+      ws.send("ERR:permission_denied");
+      return;
+    }
+    const replies = await storage.withReactions(
+      await storage.threadReplies(msgId)
+    );
+    ws.thread = msgId;
+    ws.send(`THREADREPLIES:${msgId}:${JSON.stringify(replies)}`);
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error loading thread:`, error.message);
+  }
+}
+
+// Send a new reply to everyone in channel with a thread open; their
+// clients tell whether it belongs to that thread
+function broadcastReply(wss, channel, message) {
+  const frame = `REPLY:${message.replyTo}:${JSON.stringify(toWireMessage(message))}`;
+  wss.clients.forEach((client) => {
+    if (client.channel === channel && client.thread) sendLive(client, frame);
+  });
+}
+
+// Control frames are JSON objects with a string "type" field
+function parseControlFrame(text) {
+  if (!text.startsWith("{")) return null;
+  try {
+    const frame = JSON.parse(text);
+    return frame && typeof frame.type === "string" ? frame : null;
+  } catch (error) {
+    return null;
+  }
+}
+
+// {"type":"backfill_req","since_id":<msgID>,"channel":<name>} - what the
+// channel, by default the one ws is in, got after since_id
+async function handleBackfillRequest(ws, username, frame) {
+  const name = typeof frame.channel === "string" && frame.channel ? frame.channel : ws.channel;
+  try {
+    const channel = await storage.findChannel(name);
+    if (!channel && storage.normalizeChannel(name) !== storage.DEFAULT_CHANNEL) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    if (!(await mayEnter(ws, username, channel))) {
+      ws.send("ERR:permission_denied");
+      return;
+    }
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error loading backfill:`, error.message);
+    return;
+  }
+  await sendBackfill(ws, name, frame.since_id);
+}
+
+// RECONNECT:<lastMsgID> - sent after logging in again, replays what ws's
+// channel got after the last message the client saw, ahead of anything live
+async function handleReconnect(ws, lastMsgId) {
+  await holdingLive(ws, () => sendBackfill(ws, ws.channel, lastMsgId));
+}
+
+// Send channel's messages after sinceId as {"type":"backfill","messages":[...]}
+async function sendBackfill(ws, channel, sinceId) {
+  try {
+    const missed = await storage.messagesSince(channel, sinceId, BACKFILL_LIMIT);
+    if (ws.readyState === WebSocket.OPEN) {
+      ws.send(
+        JSON.stringify({
+          type: "backfill",
+          messages: await storage.withReactions(missed),
+        })
+      );
+    }
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error loading backfill:`, error.message);
+  }
+}
+
+// Run send with live messages for ws queued, flushing them once it's done,
+// so a replay reaches the client before anything newer
+async function holdingLive(ws, send) {
+  ws.pendingLive = ws.pendingLive || [];
+  try {
+    await send();
+  } finally {
+    const queued = ws.pendingLive;
+    ws.pendingLive = null;
+    queued.forEach((text) => sendLive(ws, text));
+  }
+}
+
+// Replay recent channel messages and the channel's pins as
+// HISTORY:<channel>:{"messages":[...],"pins":[...]}, then its open polls,
+// ahead of anything live
+async function sendHistory(ws, channel) {
+  await holdingLive(ws, async () => {
+    try {
+      const messages = await storage.withReactions(
+        await storage.recentMessages(channel, config.history_limit)
+      );
+      const pins = await storage.channelPins(channel);
+      if (ws.readyState === WebSocket.OPEN) {
+        ws.send(
+          `HISTORY:${storage.normalizeChannel(channel)}:${JSON.stringify({ messages, pins })}`
+        );
+        await sendPolls(ws, channel);
+      }
+    } catch (error) {
+      console.error(`[${getTimestamp()}] Error loading history:`, error.message);
+    }
+  });
+}
+
+// HISTORY:<channel>:<n>:<beforeID> - page back through a channel, answered
+// with HISTORYPAGE:<channel>:{"before":<beforeID>,"messages":[...]} holding
+// the n messages before beforeID, fewer once the start is reached
+async function handleHistoryPage(ws, username, payload) {
+  const [name, count, beforeId] = payload.split(":");
+  const limit = parseInt(count, 10);
+  if (!name || !beforeId || !(limit >= 1 && limit <= storage.HISTORY_PAGE_MAX)) {
+    ws.send("ERR:history_invalid");
+    return;
+  }
+  try {
+    const channel = await storage.findChannel(name);
+    if (!channel && storage.normalizeChannel(name) !== storage.DEFAULT_CHANNEL) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    if (!(await mayEnter(ws, username, channel))) {
+      ws.send("ERR:permission_denied");
+      return;
+    }
+    const messages = await storage.withReactions(
+      await storage.recentMessages(name, limit, beforeId)
+    );
+    ws.send(
+      `HISTORYPAGE:${storage.normalizeChannel(name)}:${JSON.stringify({ before: beforeId, messages })}`
+    );
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error loading history page:`, error.message);
+  }
+}
+
+// JOIN:<channel> - move ws to another channel and replay its history
+async function handleJoin(wss, ws, username, name) {
+  name = storage.normalizeChannel(name);
+  try {
+    const channel = await storage.findChannel(name);
+    if (!channel && name !== storage.DEFAULT_CHANNEL) {
+      ws.send("ERR:channel_not_found");
+      return;
+    }
+    // They stay where they were
+    if (!(await mayEnter(ws, username, channel))) {
+      ws.send(`PERMISSION_DENIED:${name}:invite_only`);
+      return;
+    }
+
+    const previous = ws.channel;
+    ws.channel = name;
+    ws.thread = null;
+    console.log(`[${getTimestamp()}] ${username} joined #${name}`);
+    if (previous !== name) {
+      fireWebhooks("leave", { channel: previous, username });
+      fireWebhooks("join", { channel: name, username });
+    }
+    // Everything that arrived while they were in the old channel was seen
+    await handleRead(ws, username, previous);
+    ws.send(`TOPIC:${name}:${channel ? channel.topic : ""}`);
+    await sendHistory(ws, name);
+
+    // Refresh member counts of both channels in everyone's sidebar
+    const pins = await storage.pinCounts();
+    for (const changed of await storage.listChannels()) {
+      if (changed.name === previous || changed.name === name) {
+        broadcast(
+          wss,
+          `CHANNELADD:${JSON.stringify(toWireChannel(changed, pins[changed.name]))}`
+        );
+      }
+    }
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error joining channel:`, error.message);
+  }
+}
+
+// Deliver a private message straight to the target's connection only. A
+// whisper sent with a clientID is acknowledged, or refused with the
+// clientID after the error so the sender can take back what it showed.
+async function handleWhisper(senderWs, sender, target, text, clientID) {
+  const targetWs = findClientSocketInsensitive(target);
+
+  if (!targetWs || targetWs.readyState !== WebSocket.OPEN) {
+    senderWs.send(`ERR:user_not_found${clientID ? `:${clientID}` : ""}`);
+    return;
+  }
+
+  targetWs.send(`WHISPER:${sender}:${text}`);
+  if (clientID) senderWs.send(`ACK:${clientID}`);
+  if (senderWs.storeMessages !== false) {
+    await logMessage(sender, `[PRIVATE to ${target}] ${text}`, clients.get(targetWs));
+  }
+  console.log(`[${getTimestamp()}] ${sender} whispered to ${target}: ${text}`);
+}
+
+// E2EKEY:<target>:<publicKey> hands our whisper key to target, who gets
+// E2EKEY:<sender>:<publicKey>
+function handleE2EKey(ws, username, payload) {
+  const sep = payload.indexOf(":");
+  const key = payload.slice(sep + 1);
+  const targetWs =
+    sep > 0 ? findClientSocketInsensitive(payload.slice(0, sep)) : null;
+  if (!targetWs || targetWs.readyState !== WebSocket.OPEN) {
+    ws.send("ERR:user_not_found");
+    return;
+  }
+  if (!BASE64_PATTERN.test(key)) return;
+  targetWs.send(`E2EKEY:${username}:${key}`);
+}
+
+// E2E:<target>:<nonce>:<ciphertext> is a whisper only the two clients can
+// read; it is relayed and stored as E2E:<nonce>:<ciphertext>
+async function handleEncryptedWhisper(ws, username, payload) {
+  const [target = "", nonce = "", ciphertext = "", ...extra] =
+    payload.split(":");
+  if (
+    extra.length ||
+    !BASE64_PATTERN.test(nonce) ||
+    !BASE64_PATTERN.test(ciphertext)
+  ) {
+    return;
+  }
+  // Base64 of UTF-8 runs to four characters per UTF-16 code unit
+  if (ciphertext.length > config.max_message_size * 4 + 64) {
+    ws.send("ERR:message_too_long");
+    return;
+  }
+
+  const targetWs = findClientSocketInsensitive(target);
+  if (!targetWs || targetWs.readyState !== WebSocket.OPEN) {
+    ws.send("ERR:user_not_found");
+    return;
+  }
+  targetWs.send(`E2E:${username}:${nonce}:${ciphertext}`);
+  await logMessage(username, `E2E:${nonce}:${ciphertext}`, clients.get(targetWs));
+}
+
+// The frames the version ws negotiated speaks, echo-v1's if it picked none
+function protocolFrames(ws) {
+  return PROTOCOL_FRAMES[ws.protocol] || PROTOCOL_FRAMES["echo-v1"];
+}
+
+// Wrap a socket event handler so shutdown can wait for it to finish
+function tracked(handler) {
+  return async (...args) => {
+    inFlight++;
+    try {
+      await handler(...args);
+    } finally {
+      inFlight--;
+    }
+  };
+}
+
+// Stop taking connections, tell clients we're going away, let running
+// handlers finish and close the database before exiting
+async function shutdown(server, wss, signal) {
+  if (shuttingDown) {
+    console.log(`[${getTimestamp()}] ${signal} again, exiting now`);
+    process.exit(1);
+  }
+  shuttingDown = true;
+  console.log(`[${getTimestamp()}] ${signal} received, shutting down`);
+
+  server.close();
+  if (ircBridge) ircBridge.close();
+  if (grpcServer) grpcServer.close();
+  wss.clients.forEach((client) => {
+    client.close(1001, "Server restarting");
+  });
+
+  // In-flight handlers get this long before exiting anyway
+  const deadline = Date.now() + serverConfig.shutdownTimeoutMs(config);
+  while (inFlight > 0 && Date.now() < deadline) {
+    await new Promise((resolve) => setTimeout(resolve, 100));
+  }
+  if (inFlight > 0) {
+    console.error(
+      `[${getTimestamp()}] Shutdown timed out with ${inFlight} handlers running`
+    );
+  }
+
+  await tracer.shutdown();
+  try {
+    await mongoose.connection.close();
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error closing MongoDB:`, error.message);
+  }
+  process.exit(0);
+}
+
+// What clients should know about the server's limits, sent after auth
+function serverCapabilities() {
+  return `SERVERCFG:${JSON.stringify({
+    maxMessageSize: config.max_message_size,
+    maxUploadBytes: config.max_upload_bytes,
+    uploadChunksPerSec: uploads.UPLOAD_CHUNKS_PER_SEC,
+    rateLimitPerSec: config.rate_limit_rps,
+    rateLimitBurst: config.rate_limit_burst,
+    idleTimeoutSeconds: config.idle_timeout_seconds,
+  })}`;
+}
+
+// Re-read the config file, applying new limits to open connections too.
+// The port and database only change on restart.
+function reloadConfig(wss) {
+  let next;
+  try {
+    next = serverConfig.loadConfig(CONFIG_PATH);
   } catch (error) {
     console.error(
-      `[${getTimestamp()}] MongoDB connection error:`,
+      `[${getTimestamp()}] Keeping current config, ${CONFIG_PATH} is invalid:`,
       error.message
     );
-    process.exit(1);
+    return;
   }
+  config = {
+    ...next,
+    port: config.port,
+    mongodb_uri: config.mongodb_uri,
+    tls_auto: config.tls_auto,
+    tls_domain: config.tls_domain,
+    otel_enabled: config.otel_enabled,
+    otel_exporter_otlp_endpoint: config.otel_exporter_otlp_endpoint,
+  };
+  serverConfig.applyLogLevel(config.log_level);
+  audit.setLevel(config.log_level);
+  audit.openFile(config.audit_file);
+  auth.setCost(config.bcrypt_cost);
+  uploads.setLimits(config.max_upload_bytes, config.allowed_mime_types);
+  startDirectory();
+  loadWordFilters();
+  loadMotd();
+  runMessagePipeline = pipeline.build(config.message_pipeline, messageSteps, tracer);
+
+  wss.clients.forEach((client) => {
+    const limit = rateLimits.get(client);
+    if (limit) {
+      limit.bucket.rate = config.rate_limit_rps;
+      limit.bucket.burst = config.rate_limit_burst;
+    }
+    if (clients.has(client)) client.send(serverCapabilities());
+  });
+  console.info(
+    `[${getTimestamp()}] Reloaded ${CONFIG_PATH}:\n${serverConfig.summary(config)}`
+  );
 }
 
-async function logUserConnection(username) {
-  try {
-    await User.findOneAndUpdate(
-      { username },
-      { connectedAt: new Date(), isOnline: true },
-      { upsert: true, new: true }
-    );
-    console.log(`[${getTimestamp()}] User "${username}" logged to database`);
-  } catch (error) {
-    console.error(`[${getTimestamp()}] Error logging user:`, error.message);
+function guestCount() {
+  let count = 0;
+  for (const clientWs of clients.keys()) {
+    if (clientWs.isGuest) count++;
   }
+  return count;
 }
 
-async function hashPassword(password) {
-  const saltRounds = 10;
-  return await bcrypt.hash(password, saltRounds);
+// Guests can chat and read, but not do anything that needs an account
+function guestDenied(ws) {
+  if (!ws.isGuest) return false;
+  ws.send("ERR:guest_denied");
+  return true;
 }
 
-async function verifyPassword(password, hashedPassword) {
-  return await bcrypt.compare(password, hashedPassword);
+// End guest sessions GUEST_SESSION_MS after they started
+function expireGuests() {
+  const now = Date.now();
+  for (const clientWs of clients.keys()) {
+    if (clientWs.isGuest && clientWs.guestExpiresAt <= now) {
+      kickClient(clientWs, "Guest session expired, register to keep chatting");
+    }
+  }
 }
 
-async function findUser(username) {
-  return await User.findOne({ username });
+// STATS - admins only
+async function handleStats(ws) {
+  if (!isAdmin(ws)) {
+    ws.send("ERR:admin_only");
+    return;
+  }
+  try {
+    const channels = await storage.listChannels();
+    const guests = guestCount();
+    const mode = maintenance === null ? "off" : `on (${maintenance})`;
+    sendSystem(
+      ws,
+      `${clients.size} online (${clients.size - guests} members, ${guests}/${config.max_guests} guests), ${channels.length} channels, maintenance ${mode}`
+    );
+  } catch (error) {
+    console.error(`[${getTimestamp()}] Error gathering stats:`, error.message);
+  }
 }
 
-async function createUser(username, hashedPassword) {
-  return await User.create({
-    username,
-    password: hashedPassword,
-    connectedAt: new Date(),
-    isOnline: true,
+// Close connections that have sent nothing for idle_timeout_seconds
+function closeIdleClients(wss) {
+  if (config.idle_timeout_seconds <= 0) return;
+  const cutoff = Date.now() - config.idle_timeout_seconds * 1000;
+  wss.clients.forEach((client) => {
+    if (client.lastActive < cutoff) client.close(1000, "Idle timeout");
   });
 }
 
-async function isUsernameTaken(username) {
-  const user = await User.findOne({ username, isOnline: true });
-  return !!user;
+// With tls_auto, answer Let's Encrypt's challenges on port 80, sending
+// everything else there to https, and get the certificate for tls_domain.
+// Renewed certificates go to renewed.
+function startAcme(renewed) {
+  const challenges = new Map();
+  http.createServer(acme.httpHandler(challenges)).listen(ACME_HTTP_PORT);
+  const staging = serverConfig.acmeStaging();
+  console.log(
+    `[${getTimestamp()}] Getting a certificate for ${config.tls_domain} from Let's Encrypt${
+      staging ? " staging" : ""
+    }, kept in ${acme.CERT_DIR}`
+  );
+  return acme.manageCertificate(config.tls_domain, {
+    staging,
+    challenges,
+    renewed,
+    event: (name, details) => audit.record(name, { details }),
+    log: (text) => console.error(`[${getTimestamp()}] ${text}`),
+  });
 }
 
-async function markUserOffline(username) {
+// Why a connection from ip is turned away, as { status, reason }, or null
+// to let it in. Banned addresses are refused before they can log in.
+async function refusal(wss, ip) {
+  if (shuttingDown) return { status: 503, reason: "Server shutting down" };
+  if (maintenance !== null) return { status: 503, reason: "Server under maintenance" };
+  if (wss.clients.size >= config.max_connections) {
+    return { status: 503, reason: "Server full" };
+  }
   try {
-    await User.findOneAndUpdate({ username }, { isOnline: false });
+    if (await storage.findActiveBan({ ip })) return { status: 403, reason: "Banned" };
   } catch (error) {
-    console.error(
-      `[${getTimestamp()}] Error marking user offline:`,
-      error.message
-    );
+    // Let them in rather than lock everyone out while the database is down
   }
+  return null;
 }
 
-async function logMessage(sender, content) {
-  try {
-    await Message.create({ sender, content, timestamp: new Date() });
-  } catch (error) {
-    console.error(`[${getTimestamp()}] Error logging message:`, error.message);
-  }
+// Handle a gRPC session like a websocket that just connected from ip
+function acceptSession(wss, session, ip) {
+  wss.clients.add(session);
+  session.on("close", () => wss.clients.delete(session));
+  wss.emit("connection", session, { socket: { remoteAddress: ip } });
 }
 
-async function startServer() {
+// Start listening on port, 0 for any free one, resolving to the HTTP server
+// and the websocket server once connections are taken
+async function startServer(port = PORT) {
+  serverConfig.applyLogLevel(config.log_level);
+  audit.setLevel(config.log_level);
+  audit.openFile(config.audit_file);
+  console.info(
+    `[${getTimestamp()}] Config from ${CONFIG_PATH}:\n${serverConfig.summary(config)}`
+  );
+  auth.setCost(config.bcrypt_cost);
+  uploads.setLimits(config.max_upload_bytes, config.allowed_mime_types);
+  if (config.bcrypt_cost < auth.RECOMMENDED_BCRYPT_COST) {
+    console.warn(
+      `[${getTimestamp()}] bcrypt_cost ${config.bcrypt_cost} is below the recommended ${auth.RECOMMENDED_BCRYPT_COST}`
+    );
+  }
+  loadWordFilters();
+  loadMotd();
+  startDirectory();
+
   await connectDB();
 
   // Reset online status for all users on server startup
@@ -97,122 +3019,583 @@ async function startServer() {
     console.error(`[${getTimestamp()}] Error resetting user status:`, error.message);
   }
 
-  const wss = new WebSocket.Server({ port: PORT });
+  // Incoming webhooks broadcast, so requests need wss once it exists
+  const onRequest = (req, res) => handleHttpRequest(wss, req, res);
+  let tlsOptions = null;
+  if (config.tls_auto) {
+    try {
+      tlsOptions = await startAcme((renewed) => server.setSecureContext(renewed));
+    } catch (error) {
+      console.error(`[${getTimestamp()}] Couldn't get a certificate for ${config.tls_domain}:`, error.message);
+      process.exit(1);
+    }
+  } else if (USE_TLS) {
+    tlsOptions = { cert: fs.readFileSync(TLS_CERT), key: fs.readFileSync(TLS_KEY) };
+  }
+  const server = tlsOptions
+    ? https.createServer(tlsOptions, onRequest)
+    : http.createServer(onRequest);
+  const wss = new WebSocket.Server({
+    server,
+    handleProtocols: (offered) => SUBPROTOCOLS.find((protocol) => offered.has(protocol)) ?? false,
+    verifyClient: (info, done) => {
+      refusal(wss, info.req.socket.remoteAddress).then((refused) => {
+        if (!refused) return done(true);
+        const headers = refused.status === 503 && maintenance !== null
+          ? { "Retry-After": String(MAINTENANCE_RETRY_AFTER_S) }
+          : undefined;
+        done(false, refused.status, refused.reason, headers);
+      });
+    },
+  });
 
-  wss.on("connection", (ws) => {
+  wss.on("connection", (ws, req) => {
+    ws.ip = req.socket.remoteAddress;
+    ws.lastActive = Date.now();
+    ws.lastSeen = ws.lastActive;
     let isAuthenticated = false;
     let currentUsername = null;
+    audit.record("connect", { ip: ws.ip });
+    if (ws.protocol) {
+      console.log(`[${getTimestamp()}] ${ws.ip} connected speaking ${ws.protocol}`);
+    } else {
+      console.warn(
+        `[${getTimestamp()}] ${ws.ip} connected without a protocol version, which is deprecated - assuming echo-v1`
+      );
+    }
 
-    ws.once("message", async (message) => {
+    ws.once("message", tracked(async (message) => {
       try {
-        const data = JSON.parse(message.toString().trim());
-        const { username, password } = data;
-
-        if (!username || !password) {
-          ws.send("ERROR: Username and password are required");
+        if (ipLockedOut(ws.ip)) {
+          ws.send("ERROR: Too many failed logins from your address, try again later");
           ws.close();
           return;
         }
 
-        const existingUser = await findUser(username);
+        const raw = message.toString().trim();
+        let username, password, email;
+        let tokenAuth = false;
+        let tokenVersion = 0;
+        let viaLdap = false; // The directory checked the password
 
-        if (existingUser) {
-          if (existingUser.isOnline) {
-            ws.send(`ERROR: User "${username}" is already online`);
+        // Returning clients may resume a session with TOKEN:<jwt>
+        if (raw.startsWith("TOKEN:")) {
+          const claims = verifySessionToken(raw.slice("TOKEN:".length));
+          if (!claims) {
+            recordAuthFailure(ws, username, "session_expired");
+            ws.send("ERROR: Session expired, please log in with your password");
+            ws.close();
+            return;
+          }
+          username = claims.sub;
+          tokenVersion = claims.ver || 0;
+          tokenAuth = true;
+        } else {
+          ({ username, password, email } = JSON.parse(raw));
+
+          if (!username || !password) {
+            recordAuthFailure(ws, username, "missing_credentials");
+            ws.send("ERROR: Username and password are required");
             ws.close();
-            console.log(
-              `[${getTimestamp()}] Rejected connection: user "${username}" is already online`
-            );
             return;
           }
+        }
+
+        // Guests skip registration and get a throwaway name
+        const isGuest =
+          config.allow_guests &&
+          !tokenAuth &&
+          username.toLowerCase() === GUEST_USERNAME;
 
-          const passwordMatch = await verifyPassword(
-            password,
-            existingUser.password
-          );
-          if (!passwordMatch) {
-            ws.send("ERROR: Wrong password");
+        if (isGuest) {
+          if (guestCount() >= config.max_guests) {
+            ws.send("ERROR: Too many guests online, please try again later");
+            ws.close();
+            return;
+          }
+          do {
+            username = `guest_${crypto.randomBytes(3).toString("hex")}`;
+          } while (findClientSocketInsensitive(username));
+          ws.isGuest = true;
+          ws.guestExpiresAt = Date.now() + GUEST_SESSION_MS;
+          ws.role = "user";
+          ws.emailVerified = true;
+        } else {
+          const ban = await storage.findActiveBan({ username });
+          if (ban) {
+            recordAuthFailure(ws, username, "banned");
+            ws.send(`ERROR: ${describeBan(ban)}`);
             ws.close();
             console.log(
-              `[${getTimestamp()}] Rejected connection: wrong password for "${username}"`
+              `[${getTimestamp()}] Rejected connection: "${username}" is banned`
             );
             return;
           }
 
-          await User.findOneAndUpdate(
-            { username },
-            { connectedAt: new Date(), isOnline: true }
-          );
-        } else {
-          const hashedPassword = await hashPassword(password);
-          await createUser(username, hashedPassword);
-          console.log(
-            `[${getTimestamp()}] New user "${username}" created and logged in`
-          );
+          const existingUser = await findUser(username);
+
+          if (existingUser) {
+            if (existingUser.isOnline) {
+              ws.send(`ERROR: User "${username}" is already online`);
+              ws.close();
+              console.log(
+                `[${getTimestamp()}] Rejected connection: user "${username}" is already online`
+              );
+              return;
+            }
+
+            // Tokens from before a password change no longer count
+            if (tokenAuth && tokenVersion !== existingUser.tokenVersion) {
+              recordAuthFailure(ws, username, "session_revoked");
+              ws.send("ERROR: Session expired, please log in with your password");
+              ws.close();
+              return;
+            }
+
+            const locked = tokenAuth ? null : lockoutError(existingUser);
+            if (locked) {
+              recordAuthFailure(ws, username, "locked");
+              ws.send(locked);
+              ws.close();
+              return;
+            }
+
+            const checked = tokenAuth
+              ? { ok: true, ldap: false }
+              : await checkPassword(existingUser, password);
+            viaLdap = checked.ldap;
+            if (!checked.ok) {
+              recordAuthFailure(ws, username, "wrong_password");
+              await recordLoginFailure(existingUser);
+              ws.send("ERROR: Wrong password");
+              ws.close();
+              console.log(
+                `[${getTimestamp()}] Rejected connection: wrong password for "${username}"`
+              );
+              return;
+            }
+
+            // Resumed sessions already passed two-factor auth at login
+            if (existingUser.totpSecret && !tokenAuth) {
+              ws.send("TOTP_REQUIRED");
+              const reply = await nextMessage(ws, TOTP_TIMEOUT_MS);
+              if (reply === null) {
+                ws.close();
+                return;
+              }
+              const code = reply.startsWith("TOTP:") ? reply.slice(5).trim() : "";
+              if (!(await checkTotpCode(existingUser, code))) {
+                recordAuthFailure(ws, username, "wrong_totp");
+                await recordLoginFailure(existingUser);
+                ws.send("ERROR: Invalid two-factor code");
+                ws.close();
+                console.log(
+                  `[${getTimestamp()}] Rejected connection: wrong two-factor code for "${username}"`
+                );
+                return;
+              }
+            }
+
+            const update = { connectedAt: new Date(), isOnline: true, failedLogins: 0 };
+            // The directory's groups decide the role of its users
+            if (checked.role) {
+              update.role = checked.role;
+              existingUser.role = checked.role;
+            }
+            // Hashes from before bcrypt_cost was raised are redone while
+            // the password is at hand
+            if (!tokenAuth && !checked.ldap && auth.needsRehash(existingUser.password)) {
+              update.password = await auth.hashPassword(password);
+              console.log(
+                `[${getTimestamp()}] Rehashed the password of "${username}" at cost ${config.bcrypt_cost}`
+              );
+            }
+            await User.findOneAndUpdate({ username }, update);
+            ws.emailVerified = existingUser.emailVerified;
+            ws.email = existingUser.email;
+            ws.role = existingUser.role;
+            ws.tokenVersion = existingUser.tokenVersion;
+            ws.status = existingUser.status;
+            ws.statusMsg = existingUser.statusMsg;
+            ws.displayColor = existingUser.displayColor;
+            ws.storeMessages = existingUser.storeMessages !== false;
+          } else {
+            if (tokenAuth) {
+              recordAuthFailure(ws, username, "account_deleted");
+              ws.send("ERROR: Account no longer exists");
+              ws.close();
+              return;
+            }
+
+            if (
+              username.toLowerCase() === SYSTEM_SENDER ||
+              username === WEBHOOK_SENDER ||
+              GUEST_NAME_PATTERN.test(username)
+            ) {
+              ws.send("ERROR: That username is reserved");
+              ws.close();
+              return;
+            }
+
+            // Directory users get an account on their first login, with a
+            // hash no password matches as theirs is checked in LDAP
+            const fromDirectory = directory ? await directoryLogin(username, password) : null;
+            if (fromDirectory) {
+              const newUser = await createUser(username, await auth.unusableHash(), null, fromDirectory.role);
+              console.log(
+                `[${getTimestamp()}] New user "${username}" created from LDAP and logged in`
+              );
+              viaLdap = true;
+              ws.emailVerified = true;
+              ws.email = null;
+              ws.role = newUser.role;
+            } else if (directory && !config.ldap_fallback) {
+              recordAuthFailure(ws, username, "wrong_password");
+              ws.send("ERROR: Wrong username or password");
+              ws.close();
+              return;
+            } else {
+              if (config.require_email_verify && !email) {
+                ws.send("ERROR: An email address is required to register");
+                ws.close();
+                return;
+              }
+              if (email != null && (typeof email !== "string" || !EMAIL_PATTERN.test(email))) {
+                ws.send("ERROR: That email address isn't valid");
+                ws.close();
+                return;
+              }
+
+              const hashedPassword = await auth.hashPassword(password);
+              const newUser = await createUser(username, hashedPassword, email);
+              console.log(
+                `[${getTimestamp()}] New user "${username}" created and logged in`
+              );
+              ws.emailVerified = newUser.emailVerified;
+              ws.email = newUser.email;
+              ws.role = newUser.role;
+              // Sent in the background; the SMTP server may take a while
+              if (!newUser.emailVerified) {
+                sendVerificationEmail(newUser);
+              }
+            }
+          }
         }
 
         isAuthenticated = true;
         currentUsername = username;
         clients.set(ws, username);
+        ws.channel = storage.DEFAULT_CHANNEL;
+        ws.pendingLive = []; // Until the history replay below is sent
+        ws.status = ws.status || "online";
+        ws.statusMsg = ws.statusMsg || "";
         console.log(`[${getTimestamp()}] ${username} joined`);
+        audit.record("auth_success", {
+          user: username,
+          channel: ws.channel,
+          ip: ws.ip,
+          details: {
+            method: ws.isGuest ? "guest" : tokenAuth ? "token" : viaLdap ? "ldap" : "password",
+          },
+        });
+        fireWebhooks("join", { channel: ws.channel, username });
 
         wss.clients.forEach((client) => {
           if (client.readyState === WebSocket.OPEN) {
-            client.send(`${username} has joined`);
+            client.send(protocolFrames(client).joined(username));
           }
         });
+        broadcastUserList(wss);
+        sendStatuses(wss, ws, username);
+
+        // A fresh session token lets the client reconnect without a password;
+        // guests are told their name instead, and start over each time
+        if (ws.isGuest) {
+          ws.send(`GUEST:${username}`);
+        } else {
+          ws.send(`SESSION:${issueSessionToken(username, ws.tokenVersion)}`);
+        }
+        ws.send(serverCapabilities());
+
+        if (!ws.emailVerified) {
+          sendSystem(ws, `Please verify your email — check ${ws.email}`);
+        }
 
-        ws.on("message", async (message) => {
+        ws.on("message", tracked(async (message) => {
           if (!isAuthenticated) return;
+          ws.lastSeen = Date.now();
 
-          const text = message.toString().trim();
+          // PING:<timestamp> measures the round trip, echoed as is; it
+          // keeps us in the presence list, but doesn't count as activity
+          const ping = message.toString().match(/^PING:(\d{1,20})$/);
+          if (ping) {
+            ws.send(`PONG:${ping[1]}`);
+            return;
+          }
+          ws.lastActive = Date.now();
+          const receivedAt = process.hrtime();
+
+          let text = message.toString().trim();
           const username = clients.get(ws);
           const time = getTimestamp();
 
-          // Check for whisper command: !whisper <user> <msg> or !w <user> <msg>
-          const whisperMatch = text.match(/^!(?:whisper|w)\s+(\S+)\s+(.+)$/i);
+          if (text.startsWith("TYPING:")) {
+            relayTyping(wss, ws, username);
+            return;
+          }
 
-          if (whisperMatch) {
-            const targetUser = whisperMatch[1];
-            const privateMsg = whisperMatch[2];
+          if (text.startsWith("KICK:")) {
+            handleKick(wss, ws, username, text.slice("KICK:".length));
+            return;
+          }
 
-            // Find target user's WebSocket connection
-            let targetWs = null;
-            for (const [clientWs, clientUsername] of clients.entries()) {
-              if (clientUsername.toLowerCase() === targetUser.toLowerCase()) {
-                targetWs = clientWs;
-                break;
-              }
-            }
+          // Encrypted whispers, new channels, uploads and changes to the
+          // account need one; plain whispers are refused in the pipeline
+          if (
+            /^(E2EKEY|E2E|CREATECHANNEL|FILECHUNK|PASSWD|DISABLE2FA):/.test(text) ||
+            text === "ENABLE2FA"
+          ) {
+            if (guestDenied(ws)) return;
+          }
 
-            if (targetWs && targetWs.readyState === WebSocket.OPEN) {
-              // Send private message to receiver
-              const privateMessage = `${time}: ${username} privately said: ${privateMsg}`;
-              targetWs.send(privateMessage);
+          if (text.startsWith("EXPORT:")) {
+            await handleExport(ws, username, text.slice("EXPORT:".length));
+            return;
+          }
 
-              // Also send to sender (so they see their own message)
-              if (ws !== targetWs && ws.readyState === WebSocket.OPEN) {
-                ws.send(privateMessage);
-              }
+          if (text.startsWith("EXPORTCANCEL:")) {
+            if (ws.exporting) ws.exporting.cancelled = true;
+            return;
+          }
 
-              await logMessage(username, `[PRIVATE to ${targetUser}] ${privateMsg}`);
-              console.log(`[${time}] ${username} whispered to ${targetUser}: ${privateMsg}`);
-            } else {
-              // Target user not online
-              ws.send(`Sorry, that user is not online!`);
-            }
-          } else {
-            // Regular broadcast message
-            await logMessage(username, text);
+          if (text === "STATS") {
+            await handleStats(ws);
+            return;
+          }
 
-            const finalMessage = `${time}: ${username} said: ${text}`;
-            wss.clients.forEach((client) => {
-              if (client.readyState === WebSocket.OPEN) {
-                client.send(finalMessage);
-              }
-            });
+          if (text.startsWith("E2EKEY:")) {
+            handleE2EKey(ws, username, text.slice("E2EKEY:".length));
+            return;
           }
-        });
+
+          if (text.startsWith("E2E:")) {
+            await handleEncryptedWhisper(ws, username, text.slice("E2E:".length));
+            return;
+          }
+
+          if (text.startsWith("MAINTENANCE:")) {
+            handleMaintenance(wss, ws, username, text.slice("MAINTENANCE:".length));
+            return;
+          }
+
+          if (text.startsWith("ANNOUNCE:")) {
+            await handleAnnounce(wss, ws, username, text.slice("ANNOUNCE:".length));
+            return;
+          }
+
+          if (text === "ENABLE2FA") {
+            await handleEnable2fa(ws, username);
+            return;
+          }
+
+          if (text.startsWith("DISABLE2FA:")) {
+            await handleDisable2fa(ws, username, text.slice("DISABLE2FA:".length));
+            return;
+          }
+
+          if (text.startsWith("WEBHOOKTEST:")) {
+            await handleWebhookTest(ws, username, text.slice("WEBHOOKTEST:".length));
+            return;
+          }
+
+          if (text.startsWith("STATUS:")) {
+            await handleStatus(wss, ws, username, text.slice("STATUS:".length));
+            return;
+          }
+
+          if (text.startsWith("SETCOLOR:")) {
+            await handleSetColor(wss, ws, username, text.slice("SETCOLOR:".length));
+            return;
+          }
+
+          if (text.startsWith("PRIVACY:")) {
+            await handlePrivacy(ws, username, text.slice("PRIVACY:".length));
+            return;
+          }
+
+          if (text.startsWith("WEBHOOKCREATE:")) {
+            await handleWebhookCreate(ws, username, text.slice("WEBHOOKCREATE:".length));
+            return;
+          }
+
+          if (text.startsWith("WEBHOOKREVOKE:")) {
+            await handleWebhookRevoke(ws, username, text.slice("WEBHOOKREVOKE:".length));
+            return;
+          }
+
+          if (text.startsWith("PASSWD:")) {
+            await handlePasswd(ws, username, text.slice("PASSWD:".length));
+            return;
+          }
+
+          if (text.startsWith("THREAD:")) {
+            await handleThread(ws, username, text.slice("THREAD:".length));
+            return;
+          }
+
+          if (text.startsWith("MOTD:")) {
+            await handleMotd(ws, username, text.slice("MOTD:".length));
+            return;
+          }
+
+          if (text === "RELOADFILTERS") {
+            handleReloadFilters(ws);
+            return;
+          }
+
+          if (text.startsWith("BAN:")) {
+            await handleBan(wss, ws, username, text.slice("BAN:".length));
+            return;
+          }
+
+          if (text.startsWith("DELETE:")) {
+            await handleDelete(wss, ws, username, text.slice("DELETE:".length));
+            return;
+          }
+
+          if (text.startsWith("PIN:")) {
+            await handlePin(wss, ws, username, text.slice("PIN:".length));
+            return;
+          }
+
+          if (text.startsWith("UNPIN:")) {
+            await handleUnpin(wss, ws, username, text.slice("UNPIN:".length));
+            return;
+          }
+
+          if (text.startsWith("POLL:")) {
+            await handlePoll(wss, ws, username, text.slice("POLL:".length));
+            return;
+          }
+
+          if (text.startsWith("VOTE:")) {
+            await handleVote(wss, ws, username, text.slice("VOTE:".length));
+            return;
+          }
+
+          if (text.startsWith("TOPIC:")) {
+            await handleTopic(wss, ws, username, text.slice("TOPIC:".length));
+            return;
+          }
+
+          if (text.startsWith("READ:")) {
+            await handleRead(ws, username, text.slice("READ:".length));
+            return;
+          }
+
+          if (text.startsWith("HISTORY:")) {
+            await handleHistoryPage(ws, username, text.slice("HISTORY:".length));
+            return;
+          }
+
+          if (text.startsWith("RECONNECT:")) {
+            await handleReconnect(ws, text.slice("RECONNECT:".length));
+            return;
+          }
+
+          if (text.startsWith("JOIN:")) {
+            await handleJoin(wss, ws, username, text.slice("JOIN:".length));
+            return;
+          }
+
+          if (text === "LISTCHANNELS") {
+            await handleListChannels(ws);
+            return;
+          }
+
+          if (text.startsWith("CREATECHANNEL:")) {
+            await handleCreateChannel(wss, ws, username, text.slice("CREATECHANNEL:".length));
+            return;
+          }
+
+          if (text.startsWith("DELETECHANNEL:")) {
+            await handleDeleteChannel(wss, ws, username, text.slice("DELETECHANNEL:".length));
+            return;
+          }
+
+          if (text.startsWith("CHANNELMODE:")) {
+            await handleChannelMode(wss, ws, username, text.slice("CHANNELMODE:".length));
+            return;
+          }
+
+          if (text.startsWith("INVITE:")) {
+            await handleInvite(ws, username, text.slice("INVITE:".length));
+            return;
+          }
+
+          if (text.startsWith("CATEGORY:")) {
+            await handleCategory(wss, ws, username, text.slice("CATEGORY:".length));
+            return;
+          }
+
+          if (text.startsWith("SEARCH:")) {
+            await handleSearch(ws, username, text.slice("SEARCH:".length));
+            return;
+          }
+
+          if (text.startsWith("FILECHUNK:")) {
+            await handleFileChunk(wss, ws, username, text.slice("FILECHUNK:".length));
+            return;
+          }
+
+          if (text.startsWith("REACT:")) {
+            await handleReact(wss, ws, username, text.slice("REACT:".length));
+            return;
+          }
+
+          if (text.startsWith("EDIT:")) {
+            await handleEdit(wss, ws, username, text.slice("EDIT:".length));
+            return;
+          }
+
+          // Replies come as {"type":"message","body":...,"replyTo":<msgID>},
+          // and messages the sender wants acknowledged carry a clientID
+          let replyTo = null;
+          let clientID = null;
+          const control = parseControlFrame(text);
+          if (control) {
+            if (control.type === "backfill_req") {
+              await handleBackfillRequest(ws, username, control);
+            }
+            if (control.type !== "message" || typeof control.body !== "string") {
+              return;
+            }
+            text = control.body.trim();
+            if (!text) return;
+            replyTo = await replyParent(ws.channel, control.replyTo);
+            if (typeof control.clientID === "string" && CLIENT_ID_PATTERN.test(control.clientID)) {
+              clientID = control.clientID;
+            }
+          }
+
+          await runMessagePipeline({
+            wss,
+            ws,
+            username,
+            text,
+            replyTo,
+            clientID,
+            time,
+            receivedAt,
+          });
+        }));
+
+        // The join broadcast doubles as the auth reply, so history follows
+        // it, after the message of the day and the sidebar's categories
+        const motdText = await currentMotd();
+        if (motdText) ws.send(`MOTD:${motdText}`);
+        await sendCategories(ws);
+        await sendHistory(ws, ws.channel);
       } catch (error) {
         console.error(
           `[${getTimestamp()}] Error parsing authentication data:`,
@@ -221,26 +3604,110 @@ async function startServer() {
         ws.send("ERROR: Invalid authentication data format");
         ws.close();
       }
-    });
+    }));
 
-    ws.on("close", async () => {
+    ws.on("close", tracked(async () => {
       const username = clients.get(ws);
+      audit.record("disconnect", {
+        user: username || null,
+        channel: username ? ws.channel : null,
+        ip: ws.ip,
+      });
       if (username) {
         console.log(`[${getTimestamp()}] ${username} disconnected`);
+        fireWebhooks("leave", { channel: ws.channel, username });
 
         await markUserOffline(username);
+        await handleRead(ws, username, ws.channel);
+        uploads.abandonUploads(username);
 
         wss.clients.forEach((client) => {
           if (client.readyState === WebSocket.OPEN) {
-            client.send(`${username} has left`);
+            client.send(protocolFrames(client).left(username));
           }
         });
         clients.delete(ws);
+        broadcastUserList(wss);
       }
-    });
+    }));
   });
 
-  console.log(`[${getTimestamp()}] WebSocket server running on port ${PORT}`);
+  for (const signal of ["SIGTERM", "SIGINT"]) {
+    process.on(signal, () => shutdown(server, wss, signal));
+  }
+  process.on("SIGHUP", () => reloadConfig(wss));
+
+  if (config.metrics_enabled) {
+    metrics.startMetricsServer(config.metrics_port, () => ({
+      connectedClients: wss.clients.size,
+      inFlightHandlers: inFlight,
+    }));
+    console.log(
+      `[${getTimestamp()}] Metrics served on port ${config.metrics_port}`
+    );
+  }
+  schedulePresence(wss);
+  setInterval(() => {
+    closeIdleClients(wss);
+    expireGuests();
+    expireLoginFailures();
+    closeExpiredPolls(wss);
+  }, 10000).unref();
+
+  await new Promise((resolve) => server.listen(port, resolve));
+  if (config.irc_enabled) {
+    ircBridge = irc.startIrcBridge(config.irc_port, {
+      login: ircLogin,
+      channel: ircChannel,
+      message: (nick, channel, text) => relayIrcMessage(wss, nick, channel, text),
+      log: (text) => console.log(`[${getTimestamp()}] ${text}`),
+    });
+    console.log(
+      `[${getTimestamp()}] IRC bridge running on port ${config.irc_port}`
+    );
+  }
+  if (config.grpc_enabled) {
+    grpcServer = grpcTransport.startGrpcServer(
+      config.grpc_port,
+      grpcTransport.serverCredentials(tlsOptions),
+      {
+        admit: async (ip) => (await refusal(wss, ip))?.reason ?? null,
+        connect: (session, ip) => acceptSession(wss, session, ip),
+        log: (text) => console.error(`[${getTimestamp()}] ${text}`),
+      }
+    );
+    console.log(
+      `[${getTimestamp()}] gRPC server running on port ${config.grpc_port}${
+        USE_TLS ? " (TLS)" : ""
+      }`
+    );
+  }
+  if (tracer.enabled) {
+    console.log(
+      `[${getTimestamp()}] Exporting message traces to ${config.otel_exporter_otlp_endpoint}`
+    );
+  }
+  if (!hasConfiguredSecret) {
+    console.log(
+      `[${getTimestamp()}] JWT_SECRET not set, sessions will end on restart`
+    );
+  }
+  console.log(
+    `[${getTimestamp()}] WebSocket server running on port ${server.address().port}${
+      USE_TLS ? " (TLS)" : ""
+    }`
+  );
+  if (config.require_email_verify) {
+    console.log(
+      `[${getTimestamp()}] Email verification required, mailing via ${config.smtp_host}:${config.smtp_port}`
+    );
+  }
+  return { server, wss };
+}
+
+// The tests start their own server
+if (require.main === module) {
+  startServer();
 }
 
-startServer();
+module.exports = { startServer };
@@ -0,0 +1,64 @@
+const crypto = require("crypto");
+
+const SESSION_TTL_SECONDS = 24 * 60 * 60;
+
+// Without a configured secret, tokens only survive until the server restarts
+const JWT_SECRET =
+  process.env.JWT_SECRET || crypto.randomBytes(32).toString("hex");
+
+function base64url(input) {
+  return Buffer.from(input).toString("base64url");
+}
+
+function sign(data) {
+  return crypto.createHmac("sha256", JWT_SECRET).update(data).digest("base64url");
+}
+
+// Issue an HS256 JWT for username, valid for 24 hours. version is the
+// user's tokenVersion, which changing the password bumps to revoke older
+// tokens.
+function issueSessionToken(username, version = 0) {
+  const now = Math.floor(Date.now() / 1000);
+  const header = base64url(JSON.stringify({ alg: "HS256", typ: "JWT" }));
+  const payload = base64url(
+    JSON.stringify({
+      sub: username,
+      ver: version,
+      iat: now,
+      exp: now + SESSION_TTL_SECONDS,
+    })
+  );
+  return `${header}.${payload}.${sign(`${header}.${payload}`)}`;
+}
+
+// Returns the token's claims, or null if the signature or expiry is invalid
+function verifySessionToken(token) {
+  const parts = (token || "").split(".");
+  if (parts.length !== 3) return null;
+
+  const [header, payload, signature] = parts;
+  const expected = Buffer.from(sign(`${header}.${payload}`));
+  const actual = Buffer.from(signature);
+  if (
+    expected.length !== actual.length ||
+    !crypto.timingSafeEqual(expected, actual)
+  ) {
+    return null;
+  }
+
+  try {
+    const { alg } = JSON.parse(Buffer.from(header, "base64url").toString());
+    const claims = JSON.parse(Buffer.from(payload, "base64url").toString());
+    if (alg !== "HS256" || typeof claims.sub !== "string") return null;
+    if (!claims.exp || claims.exp <= Math.floor(Date.now() / 1000)) return null;
+    return claims;
+  } catch (error) {
+    return null;
+  }
+}
+
+module.exports = {
+  hasConfiguredSecret: !!process.env.JWT_SECRET,
+  issueSessionToken,
+  verifySessionToken,
+};
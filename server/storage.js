@@ -0,0 +1,607 @@
+const crypto = require("crypto");
+const mongoose = require("mongoose");
+const Ban = require("./models/Ban");
+const Category = require("./models/Category");
+const Channel = require("./models/Channel");
+const ChannelInvite = require("./models/ChannelInvite");
+const Message = require("./models/Message");
+const Pin = require("./models/Pin");
+const Poll = require("./models/Poll");
+const Reaction = require("./models/Reaction");
+const ReadPosition = require("./models/ReadPosition");
+const Vote = require("./models/Vote");
+const Webhook = require("./models/Webhook");
+
+// Messages replayed on joining a channel, unless history_limit says otherwise
+const HISTORY_LIMIT = 50;
+// Most messages in one page of older history
+const HISTORY_PAGE_MAX = 200;
+const MAX_REACTION_EMOJI = 20;
+const SEARCH_LIMIT = 50;
+// Most replies sent for one thread
+const THREAD_LIMIT = 200;
+// Most messages pinned in one channel
+const MAX_PINS = 10;
+// Longest poll question and option, and how many options a poll may have
+const MAX_POLL_QUESTION = 200;
+const MAX_POLL_OPTION = 80;
+const MIN_POLL_OPTIONS = 2;
+const MAX_POLL_OPTIONS = 10;
+const SNIPPET_CONTEXT = 30;
+const DEFAULT_CHANNEL = "general";
+const CHANNEL_PERMISSIONS = ["public", "invite-only", "read-only"];
+
+function normalizeChannel(channel) {
+  return (channel || DEFAULT_CHANNEL).replace(/^#/, "").trim() || DEFAULT_CHANNEL;
+}
+
+// Channel names are letters, digits and hyphens, at most 32 characters
+function validateChannelName(name) {
+  return /^[A-Za-z0-9-]{1,32}$/.test(name || "");
+}
+
+// All channels, creating the default one on first use
+async function listChannels() {
+  await Channel.updateOne(
+    { name: DEFAULT_CHANNEL },
+    { $setOnInsert: { name: DEFAULT_CHANNEL, topic: "General chat" } },
+    { upsert: true }
+  );
+  return await Channel.find().sort({ createdAt: 1 });
+}
+
+async function findChannel(name) {
+  return await Channel.findOne({ name: normalizeChannel(name) });
+}
+
+// Returns the new channel, or null if the name is taken
+async function createChannel(name, createdBy) {
+  if (await findChannel(name)) return null;
+  return await Channel.create({ name: normalizeChannel(name), createdBy });
+}
+
+async function deleteChannel(name) {
+  await Channel.deleteOne({ name: normalizeChannel(name) });
+  await Pin.deleteMany({ channel: normalizeChannel(name) });
+  await ChannelInvite.deleteMany({ channel: normalizeChannel(name) });
+  const polls = await Poll.find({ channel: normalizeChannel(name) }, { pollId: 1 });
+  await Vote.deleteMany({ pollId: { $in: polls.map((poll) => poll.pollId) } });
+  await Poll.deleteMany({ channel: normalizeChannel(name) });
+}
+
+// Returns the updated channel, or null if it doesn't exist
+async function setChannelPermissions(name, permissions) {
+  return await Channel.findOneAndUpdate(
+    { name: normalizeChannel(name) },
+    { permissions },
+    { new: true }
+  );
+}
+
+// Let username into an invite-only channel, returning false if they
+// already were
+async function addInvite(channel, username, invitedBy) {
+  try {
+    await ChannelInvite.create({ channel: normalizeChannel(channel), username, invitedBy });
+    return true;
+  } catch (error) {
+    if (error.code === 11000) return false; // Duplicate key
+    throw error;
+  }
+}
+
+async function isInvited(channel, username) {
+  return !!(await ChannelInvite.exists({ channel: normalizeChannel(channel), username }));
+}
+
+// Sidebar categories, oldest first
+async function listCategories() {
+  return await Category.find().sort({ createdAt: 1 });
+}
+
+// Returns the new category, or null if the name is taken
+async function createCategory(name) {
+  if (await Category.findOne({ name })) return null;
+  return await Category.create({ name });
+}
+
+// Move channel out of any category, returning the categories it left
+async function uncategorize(channel) {
+  channel = normalizeChannel(channel);
+  const left = await Category.find({ channels: channel });
+  await Category.updateMany({ channels: channel }, { $pull: { channels: channel } });
+  return left.map((category) => {
+    category.channels = category.channels.filter((name) => name !== channel);
+    return category;
+  });
+}
+
+// Move channel into the named category, returning every category that
+// changed, or null if there's no such category
+async function categorize(channel, name) {
+  channel = normalizeChannel(channel);
+  if (!(await Category.findOne({ name }))) return null;
+  const left = (await uncategorize(channel)).filter((category) => category.name !== name);
+  const joined = await Category.findOneAndUpdate(
+    { name },
+    { $addToSet: { channels: channel } },
+    { new: true }
+  );
+  return [...left, joined];
+}
+
+// Returns the updated channel, or null if it doesn't exist
+async function setChannelTopic(name, topic) {
+  return await Channel.findOneAndUpdate(
+    { name: normalizeChannel(name) },
+    { topic },
+    { new: true }
+  );
+}
+
+// Shape a stored message for sending to clients
+function toWireMessage(message) {
+  return {
+    id: message._id.toString(),
+    sender: message.sender,
+    content: message.content,
+    timestamp: message.timestamp.toISOString(),
+    channel: message.channel,
+    edited: !!message.editedAt,
+    ...(message.botName ? { bot: message.botName } : {}),
+    ...(message.replyTo ? { replyTo: message.replyTo } : {}),
+  };
+}
+
+// An id for a message not stored yet, like one still being streamed
+function newMessageId() {
+  return new mongoose.Types.ObjectId();
+}
+
+// id and timestamp are for messages shown before they're stored, see
+// newMessageId
+async function saveMessage({
+  id = null,
+  timestamp = new Date(),
+  sender,
+  content,
+  channel,
+  recipient = null,
+  botName = null,
+  replyTo = null,
+}) {
+  return await Message.create({
+    ...(id ? { _id: id } : {}),
+    sender,
+    content,
+    channel: normalizeChannel(channel),
+    recipient,
+    botName,
+    replyTo,
+    timestamp,
+  });
+}
+
+// Public messages of a channel stored after sinceId, oldest first. Without
+// a sinceId, or with one the channel doesn't have, that's the latest limit
+// messages rather than the first ever sent.
+async function messagesSince(channel, sinceId, limit) {
+  const query = { channel: normalizeChannel(channel), recipient: null };
+  const known =
+    mongoose.Types.ObjectId.isValid(sinceId) &&
+    (await Message.exists({ ...query, _id: new mongoose.Types.ObjectId(sinceId) }));
+  if (!known) {
+    const latest = await Message.find(query).sort({ _id: -1 }).limit(limit);
+    return latest.reverse();
+  }
+  query._id = { $gt: new mongoose.Types.ObjectId(sinceId) };
+  return await Message.find(query).sort({ _id: 1 }).limit(limit);
+}
+
+// Every public reply under parentId, however deeply nested, oldest first
+async function threadReplies(parentId) {
+  const replies = [];
+  let parents = [parentId];
+  while (parents.length && replies.length < THREAD_LIMIT) {
+    const level = await Message.find({
+      replyTo: { $in: parents },
+      recipient: null,
+    }).limit(THREAD_LIMIT - replies.length);
+    replies.push(...level);
+    parents = level.map((message) => message._id.toString());
+  }
+  return replies.sort((a, b) => a.timestamp - b.timestamp);
+}
+
+// The latest public messages of a channel, oldest first, or the latest
+// sent before beforeId when paging back through history
+async function recentMessages(channel, limit = HISTORY_LIMIT, beforeId = null) {
+  const query = { channel: normalizeChannel(channel), recipient: null };
+  if (beforeId) {
+    if (!mongoose.Types.ObjectId.isValid(beforeId)) return [];
+    query._id = { $lt: new mongoose.Types.ObjectId(beforeId) };
+  }
+  const latest = await Message.find(query).sort({ _id: -1 }).limit(limit);
+  return latest.reverse();
+}
+
+// A channel's public messages sent between from and to, either of which
+// may be null for no limit
+function exportQuery(channel, from, to) {
+  const query = { channel: normalizeChannel(channel), recipient: null };
+  if (from || to) {
+    query.timestamp = {};
+    if (from) query.timestamp.$gte = from;
+    if (to) query.timestamp.$lte = to;
+  }
+  return query;
+}
+
+async function countExport(channel, from, to) {
+  return await Message.countDocuments(exportQuery(channel, from, to));
+}
+
+// Stream the messages for /export oldest first, without loading them all
+function exportCursor(channel, from, to) {
+  return Message.find(exportQuery(channel, from, to)).sort({ _id: 1 }).cursor();
+}
+
+// Excerpt of content around the first search term it contains
+function snippet(content, query) {
+  const lower = content.toLowerCase();
+  const at = query
+    .toLowerCase()
+    .split(/\s+/)
+    .filter(Boolean)
+    .map((term) => lower.indexOf(term.replace(/^[-"]+|"+$/g, "")))
+    .filter((idx) => idx !== -1)
+    .reduce((first, idx) => Math.min(first, idx), Infinity);
+
+  const start = at === Infinity ? 0 : Math.max(0, at - SNIPPET_CONTEXT);
+  const end = Math.min(content.length, start + SNIPPET_CONTEXT * 3);
+  return `${start > 0 ? "…" : ""}${content.slice(start, end)}${
+    end < content.length ? "…" : ""
+  }`.replace(/\s+/g, " ");
+}
+
+// Public messages in channel matching query, best matches first
+async function searchMessages(channel, query, limit) {
+  const matches = await Message.find(
+    {
+      $text: { $search: query },
+      channel: normalizeChannel(channel),
+      recipient: null,
+    },
+    { score: { $meta: "textScore" } }
+  )
+    .sort({ score: { $meta: "textScore" } })
+    .limit(Math.min(Math.max(limit || SEARCH_LIMIT, 1), SEARCH_LIMIT));
+
+  return matches.map((message) => ({
+    ...toWireMessage(message),
+    snippet: snippet(message.content, query),
+  }));
+}
+
+// Replace the body of a recent message, only if sender wrote it.
+// Returns the updated message, or null if the edit isn't allowed.
+async function editMessage(id, sender, content, maxAgeMs) {
+  if (!mongoose.Types.ObjectId.isValid(id)) return null;
+  return await Message.findOneAndUpdate(
+    {
+      _id: id,
+      sender,
+      recipient: null,
+      timestamp: { $gte: new Date(Date.now() - maxAgeMs) },
+    },
+    { content, editedAt: new Date() },
+    { new: true }
+  );
+}
+
+async function findMessage(id) {
+  if (!mongoose.Types.ObjectId.isValid(id)) return null;
+  return await Message.findById(id);
+}
+
+async function deleteMessage(id) {
+  await Message.deleteOne({ _id: id });
+  await Reaction.deleteMany({ msgId: id });
+  await Pin.deleteMany({ msgId: id });
+}
+
+// Add username's emoji reaction, or remove it if already there.
+// Returns the new count for that emoji, or null if the message is missing
+// or already has too many distinct emoji.
+async function toggleReaction(msgId, emoji, username) {
+  const message = await findMessage(msgId);
+  if (!message || message.recipient !== null) return null;
+
+  const removed = await Reaction.findOneAndDelete({ msgId, emoji, username });
+  if (!removed) {
+    const used = await Reaction.distinct("emoji", { msgId });
+    if (!used.includes(emoji) && used.length >= MAX_REACTION_EMOJI) {
+      return null;
+    }
+    await Reaction.create({ msgId, emoji, username });
+  }
+  return await Reaction.countDocuments({ msgId, emoji });
+}
+
+// Wire messages with their reaction tallies, e.g. { "👍": 3 }
+async function withReactions(messages) {
+  const counts = await Reaction.aggregate([
+    { $match: { msgId: { $in: messages.map((m) => m._id) } } },
+    { $group: { _id: { msgId: "$msgId", emoji: "$emoji" }, count: { $sum: 1 } } },
+  ]);
+
+  const byMessage = {};
+  for (const { _id, count } of counts) {
+    const id = _id.msgId.toString();
+    byMessage[id] = { ...byMessage[id], [_id.emoji]: count };
+  }
+  return messages.map((message) => {
+    const wire = toWireMessage(message);
+    if (byMessage[wire.id]) wire.reactions = byMessage[wire.id];
+    return wire;
+  });
+}
+
+// Shape a pin for PINNED frames and history replays: the message, and who
+// pinned it when
+function toWirePin(pin, message) {
+  return {
+    ...toWireMessage(message),
+    pinnedBy: pin.pinnedBy,
+    pinnedAt: pin.pinnedAt.toISOString(),
+  };
+}
+
+async function countPins(channel) {
+  return await Pin.countDocuments({ channel: normalizeChannel(channel) });
+}
+
+// Pin message to channel for pinnedBy. Returns the pin as sent to clients,
+// or null if it was already pinned.
+async function addPin(channel, message, pinnedBy) {
+  try {
+    const pin = await Pin.create({
+      channel: normalizeChannel(channel),
+      msgId: message._id,
+      pinnedBy,
+    });
+    return toWirePin(pin, message);
+  } catch (error) {
+    if (error.code === 11000) return null; // Duplicate key
+    throw error;
+  }
+}
+
+// Returns whether the message was pinned
+async function removePin(channel, msgId) {
+  if (!mongoose.Types.ObjectId.isValid(msgId)) return false;
+  const { deletedCount } = await Pin.deleteOne({
+    channel: normalizeChannel(channel),
+    msgId,
+  });
+  return deletedCount > 0;
+}
+
+// A channel's pins, in the order they were pinned
+async function channelPins(channel) {
+  const pins = await Pin.find({ channel: normalizeChannel(channel) })
+    .sort({ pinnedAt: 1 })
+    .populate("msgId");
+  return pins
+    .filter((pin) => pin.msgId)
+    .map((pin) => toWirePin(pin, pin.msgId));
+}
+
+// How many messages are pinned in each channel, as { channel: count }
+// leaving out channels with none
+async function pinCounts() {
+  const counts = {};
+  for (const { _id, count } of await Pin.aggregate([
+    { $group: { _id: "$channel", count: { $sum: 1 } } },
+  ])) {
+    counts[_id] = count;
+  }
+  return counts;
+}
+
+// Put question to channel with options, open until expiresAt. Ids are six
+// hex digits, drawn again in the rare case one is taken.
+async function createPoll(channel, question, options, creator, expiresAt) {
+  for (let attempt = 0; ; attempt++) {
+    try {
+      return await Poll.create({
+        pollId: crypto.randomBytes(3).toString("hex"),
+        channel: normalizeChannel(channel),
+        question,
+        options,
+        creator,
+        expiresAt,
+      });
+    } catch (error) {
+      if (error.code !== 11000 || attempt === 4) throw error;
+    }
+  }
+}
+
+async function findPoll(pollId) {
+  return await Poll.findOne({ pollId });
+}
+
+// Record username's vote for option, replacing any vote they already cast
+async function castVote(pollId, username, option) {
+  await Vote.updateOne(
+    { pollId, username },
+    { option, votedAt: new Date() },
+    { upsert: true }
+  );
+}
+
+// Votes for each of poll's options, in order
+async function pollTallies(poll) {
+  const tallies = poll.options.map(() => 0);
+  for (const { _id, count } of await Vote.aggregate([
+    { $match: { pollId: poll.pollId } },
+    { $group: { _id: "$option", count: { $sum: 1 } } },
+  ])) {
+    if (_id >= 0 && _id < tallies.length) tallies[_id] = count;
+  }
+  return tallies;
+}
+
+// A channel's open polls, oldest first
+async function openPolls(channel) {
+  return await Poll.find({ channel: normalizeChannel(channel), closed: false })
+    .sort({ createdAt: 1 });
+}
+
+// Close every poll past its expiry, returning them
+async function closeExpiredPolls() {
+  const closed = [];
+  for (;;) {
+    const poll = await Poll.findOneAndUpdate(
+      { closed: false, expiresAt: { $lte: new Date() } },
+      { closed: true },
+      { new: true }
+    );
+    if (!poll) return closed;
+    closed.push(poll);
+  }
+}
+
+// Record that username has read everything in channel up to now
+async function markRead(username, channel) {
+  await ReadPosition.updateOne(
+    { username, channel: normalizeChannel(channel) },
+    { readAt: new Date() },
+    { upsert: true }
+  );
+}
+
+// Public messages by others since username last read each channel, as
+// { channel: count } leaving out channels with nothing unread. Channels
+// never read before don't count, so new users don't start buried.
+async function unreadCounts(username) {
+  const counts = {};
+  for (const { channel, readAt } of await ReadPosition.find({ username })) {
+    const count = await Message.countDocuments({
+      channel,
+      recipient: null,
+      sender: { $ne: username },
+      timestamp: { $gt: readAt },
+    });
+    if (count > 0) counts[channel] = count;
+  }
+  return counts;
+}
+
+// Stored message count and database size, from collection metadata so it
+// stays fast however much history there is
+async function databaseStats() {
+  const [totalMessages, db] = await Promise.all([
+    Message.estimatedDocumentCount(),
+    mongoose.connection.db.stats(),
+  ]);
+  return { totalMessages, dbSizeBytes: db.dataSize };
+}
+
+// Ban username (and their address, if known) until expiresAt, or for good
+async function addBan({ username, ip, expiresAt, reason, bannedBy }) {
+  return await Ban.create({ username, ip, expiresAt, reason, bannedBy });
+}
+
+// The ban in force for username or ip, if any
+async function findActiveBan({ username, ip }) {
+  const who = [];
+  if (username) who.push({ username });
+  if (ip) who.push({ ip });
+  if (who.length === 0) return null;
+
+  return await Ban.findOne({
+    $and: [
+      { $or: who },
+      { $or: [{ expiresAt: null }, { expiresAt: { $gt: new Date() } }] },
+    ],
+  });
+}
+
+async function addWebhook({ token, channel, createdBy }) {
+  return await Webhook.create({
+    token,
+    channel: normalizeChannel(channel),
+    createdBy,
+  });
+}
+
+async function findWebhook(token) {
+  return await Webhook.findOne({ token });
+}
+
+// Returns whether there was such a webhook to delete
+async function deleteWebhook(token) {
+  const { deletedCount } = await Webhook.deleteOne({ token });
+  return deletedCount > 0;
+}
+
+module.exports = {
+  HISTORY_LIMIT,
+  HISTORY_PAGE_MAX,
+  MAX_PINS,
+  MAX_POLL_QUESTION,
+  MAX_POLL_OPTION,
+  MIN_POLL_OPTIONS,
+  MAX_POLL_OPTIONS,
+  DEFAULT_CHANNEL,
+  normalizeChannel,
+  validateChannelName,
+  listChannels,
+  databaseStats,
+  findChannel,
+  createChannel,
+  deleteChannel,
+  setChannelTopic,
+  CHANNEL_PERMISSIONS,
+  setChannelPermissions,
+  addInvite,
+  isInvited,
+  listCategories,
+  createCategory,
+  categorize,
+  uncategorize,
+  toWireMessage,
+  newMessageId,
+  saveMessage,
+  messagesSince,
+  recentMessages,
+  threadReplies,
+  countExport,
+  exportCursor,
+  editMessage,
+  findMessage,
+  deleteMessage,
+  toggleReaction,
+  searchMessages,
+  withReactions,
+  addBan,
+  findActiveBan,
+  addWebhook,
+  findWebhook,
+  deleteWebhook,
+  markRead,
+  unreadCounts,
+  countPins,
+  addPin,
+  removePin,
+  channelPins,
+  pinCounts,
+  createPoll,
+  findPoll,
+  castVote,
+  pollTallies,
+  openPolls,
+  closeExpiredPolls,
+};
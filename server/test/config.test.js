@@ -0,0 +1,133 @@
+const { describe, it } = require("node:test");
+const assert = require("node:assert");
+const fs = require("fs");
+const os = require("os");
+const path = require("path");
+const { loadConfig, configPath, tlsFiles, shutdownTimeoutMs } = require("../config");
+
+const dir = fs.mkdtempSync(path.join(os.tmpdir(), "echo-config-"));
+
+// Load a config file holding text
+function load(text) {
+  const file = path.join(dir, "server.toml");
+  fs.writeFileSync(file, text);
+  return loadConfig(file);
+}
+
+// Run fn with the environment variables in vars set, or unset where
+// undefined, then put them back
+function withEnv(vars, fn) {
+  const old = {};
+  for (const [key, value] of Object.entries(vars)) {
+    old[key] = process.env[key];
+    if (value === undefined) delete process.env[key];
+    else process.env[key] = value;
+  }
+  try {
+    return fn();
+  } finally {
+    for (const [key, value] of Object.entries(old)) {
+      if (value === undefined) delete process.env[key];
+      else process.env[key] = value;
+    }
+  }
+}
+
+describe("config", () => {
+  it("reads rate_limit_mute_ms, falling back to RATE_LIMIT_MUTE_MS", () => {
+    withEnv({ RATE_LIMIT_MUTE_MS: undefined }, () => {
+      assert.strictEqual(load("").rate_limit_mute_ms, 60000);
+    });
+    withEnv({ RATE_LIMIT_MUTE_MS: "5000" }, () => {
+      assert.strictEqual(load("").rate_limit_mute_ms, 5000);
+    });
+    assert.strictEqual(load("rate_limit_mute_ms = 120_000").rate_limit_mute_ms, 120000);
+    assert.throws(() => load("rate_limit_mute_ms = 0"), /rate_limit_mute_ms/);
+  });
+
+  it("reads history_limit, falling back to HISTORY_LIMIT", () => {
+    withEnv({ HISTORY_LIMIT: "25" }, () => {
+      assert.strictEqual(load("").history_limit, 25);
+    });
+    assert.strictEqual(load("history_limit = 100").history_limit, 100);
+    assert.throws(() => load("history_limit = 2.5"), /history_limit/);
+  });
+
+  it("reads the email verification settings, falling back to the environment", () => {
+    withEnv({ REQUIRE_EMAIL_VERIFY: "true", SMTP_HOST: "mail.example.com", SMTP_PORT: "465" }, () => {
+      const config = load('smtp_port = 587\nsmtp_user = "echo"');
+      assert.strictEqual(config.require_email_verify, true);
+      assert.strictEqual(config.smtp_host, "mail.example.com");
+      assert.strictEqual(config.smtp_port, 587);
+      assert.strictEqual(config.smtp_user, "echo");
+    });
+    assert.throws(() => load("smtp_port = 70000"), /smtp_port/);
+    assert.throws(() => load('public_url = "example.com"'), /public_url/);
+  });
+
+  it("reads the upload limits, falling back to the environment", () => {
+    withEnv({ MAX_UPLOAD_BYTES: "1024", ALLOWED_MIME_TYPES: "image/png, text/plain" }, () => {
+      const config = load("");
+      assert.strictEqual(config.max_upload_bytes, 1024);
+      assert.deepStrictEqual(config.allowed_mime_types, ["image/png", "text/plain"]);
+    });
+    const config = load('max_upload_bytes = 2048\nallowed_mime_types = ["application/pdf"]');
+    assert.strictEqual(config.max_upload_bytes, 2048);
+    assert.deepStrictEqual(config.allowed_mime_types, ["application/pdf"]);
+    assert.throws(() => load('allowed_mime_types = ["png"]'), /allowed_mime_types/);
+  });
+
+  it("reads the login lockout settings, falling back to the environment", () => {
+    withEnv({ MAX_LOGIN_ATTEMPTS: "3", LOGIN_LOCKOUT_MS: "60000" }, () => {
+      const config = load("max_ip_login_failures = 50");
+      assert.strictEqual(config.max_login_attempts, 3);
+      assert.strictEqual(config.login_lockout_ms, 60000);
+      assert.strictEqual(config.max_ip_login_failures, 50);
+    });
+    assert.strictEqual(load("max_login_attempts = 10").max_login_attempts, 10);
+    assert.throws(() => load("login_lockout_ms = -1"), /login_lockout_ms/);
+  });
+
+  it("refuses webhooks without a secret", () => {
+    const hook = '[[webhooks]]\nurl = "https://hooks.example.com/echo"\n';
+    assert.throws(() => load(hook), /webhook 1: secret/);
+    assert.throws(() => load(hook + 'secret = ""'), /webhook 1: secret/);
+    assert.deepStrictEqual(load(hook + 'secret = "s3cret"').webhooks, [
+      {
+        name: "hooks.example.com",
+        url: "https://hooks.example.com/echo",
+        channel: "*",
+        events: ["message"],
+        secret: "s3cret",
+      },
+    ]);
+  });
+
+  it("takes the shutdown timeout from --shutdown-timeout over the config", () => {
+    const config = load("shutdown_timeout_ms = 5000");
+    assert.strictEqual(shutdownTimeoutMs(config, []), 5000);
+    assert.strictEqual(shutdownTimeoutMs(config, ["--shutdown-timeout", "100"]), 100);
+    assert.strictEqual(shutdownTimeoutMs(config, ["--shutdown-timeout=0"]), 0);
+    assert.throws(() => shutdownTimeoutMs(config, ["--shutdown-timeout=soon"]), /--shutdown-timeout/);
+  });
+
+  it("takes the certificate from --cert and --key over the environment", () => {
+    withEnv({ TLS_CERT: "env.pem", TLS_KEY: "env.key" }, () => {
+      assert.deepStrictEqual(tlsFiles([]), { cert: "env.pem", key: "env.key" });
+      assert.deepStrictEqual(tlsFiles(["--cert", "a.pem", "--key=a.key"]), {
+        cert: "a.pem",
+        key: "a.key",
+      });
+    });
+    withEnv({ TLS_CERT: undefined, TLS_KEY: undefined }, () => {
+      assert.deepStrictEqual(tlsFiles([]), { cert: "", key: "" });
+      assert.throws(() => tlsFiles(["--cert", "a.pem"]), /together/);
+    });
+  });
+
+  it("reads --config in either form", () => {
+    assert.strictEqual(configPath([]), "server.toml");
+    assert.strictEqual(configPath(["--config", "a.toml"]), "a.toml");
+    assert.strictEqual(configPath(["--config=b.toml"]), "b.toml");
+  });
+});
@@ -0,0 +1,48 @@
+const { describe, it } = require("node:test");
+const assert = require("node:assert");
+const contrast = require("../contrast");
+
+describe("contrast", () => {
+  it("matches the WCAG ratios of known color pairs", () => {
+    // Ratios as published by the WebAIM contrast checker
+    const pairs = [
+      ["#000000", "#FFFFFF", 21],
+      ["#FFFFFF", "#FFFFFF", 1],
+      ["#777777", "#FFFFFF", 4.48],
+      ["#767676", "#FFFFFF", 4.54],
+      ["#595959", "#FFFFFF", 7],
+      ["#FF0000", "#FFFFFF", 4],
+      ["#0000FF", "#FFFFFF", 8.59],
+      ["#00FF00", "#000000", 15.3],
+      ["#FFFF00", "#000000", 19.56],
+      ["#808080", "#000000", 5.32],
+    ];
+    for (const [foreground, background, want] of pairs) {
+      const ratio = contrast.contrastRatio(foreground, background);
+      assert.strictEqual(Math.round(ratio * 100) / 100, want, `${foreground} on ${background}`);
+      // Which color is which doesn't matter
+      assert.strictEqual(contrast.contrastRatio(background, foreground), ratio);
+    }
+  });
+
+  it("keeps colors that are readable already", () => {
+    for (const color of ["#FF8800", "#58A6FF", "#FFFFFF"]) {
+      assert.strictEqual(contrast.readableColor(color), color);
+    }
+    // Uppercased, as COLOR_SET sends it
+    assert.strictEqual(contrast.readableColor("#ff8800"), "#FF8800");
+  });
+
+  it("lightens dark colors just enough, as COLOR_REJECTED sends them", () => {
+    for (const [color, want] of [
+      ["#000080", "#8080C0"],
+      ["#333333", "#858585"],
+      ["#0D1117", "#7A7C7F"],
+      ["#000000", "#808080"],
+    ]) {
+      const readable = contrast.readableColor(color);
+      assert.strictEqual(readable, want, color);
+      assert.ok(contrast.contrastRatio(readable, contrast.BACKGROUND) >= contrast.MIN_CONTRAST);
+    }
+  });
+});
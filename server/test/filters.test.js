@@ -0,0 +1,28 @@
+const { describe, it } = require("node:test");
+const assert = require("node:assert");
+const fs = require("fs");
+const os = require("os");
+const path = require("path");
+const { loadFilters, applyFilters } = require("../filters");
+
+describe("word filters", () => {
+  const file = path.join(fs.mkdtempSync(path.join(os.tmpdir(), "echo-filters-")), "filters.txt");
+  fs.writeFileSync(file, "# comment\ndarn*\nheck\n\n");
+  const filters = loadFilters(file);
+
+  it("reports the rules that matched", () => {
+    assert.deepStrictEqual(applyFilters(filters, "darned heck, HECK"), {
+      matched: true,
+      rules: ["darn*", "heck"],
+      cleaned: "*** ***, ***",
+    });
+  });
+
+  it("leaves clean text alone", () => {
+    assert.deepStrictEqual(applyFilters(filters, "all fine"), {
+      matched: false,
+      rules: [],
+      cleaned: "all fine",
+    });
+  });
+});
@@ -0,0 +1,116 @@
+const { test } = require("node:test");
+const assert = require("node:assert");
+const net = require("net");
+const { sendMail } = require("../mailer");
+
+// A local SMTP server that accepts everything and notes each command.
+// With silent set it greets and then never answers again.
+function mockServer({ silent = false } = {}) {
+  const commands = [];
+  const server = net.createServer((socket) => {
+    let buffer = "";
+    let inData = false;
+    socket.setEncoding("utf8");
+    socket.write("220 mock ESMTP\r\n");
+    socket.on("data", (chunk) => {
+      buffer += chunk;
+      let idx;
+      while ((idx = buffer.indexOf("\r\n")) !== -1) {
+        const line = buffer.slice(0, idx);
+        buffer = buffer.slice(idx + 2);
+        if (inData) {
+          if (line === ".") {
+            inData = false;
+            commands.push("<message>");
+            socket.write("250 queued\r\n");
+          }
+          continue;
+        }
+        commands.push(line);
+        if (silent) continue;
+        if (line.startsWith("EHLO")) {
+          socket.write("250-mock\r\n250 AUTH PLAIN\r\n");
+        } else if (line === "DATA") {
+          inData = true;
+          socket.write("354 go ahead\r\n");
+        } else if (line === "QUIT") {
+          socket.end("221 bye\r\n");
+        } else {
+          socket.write("250 ok\r\n");
+        }
+      }
+    });
+  });
+  return new Promise((resolve) => {
+    server.listen(0, "127.0.0.1", () => resolve({ server, commands }));
+  });
+}
+
+function smtpFor(server, extra) {
+  return {
+    host: "127.0.0.1",
+    port: server.address().port,
+    from: "echo@example.com",
+    ...extra,
+  };
+}
+
+const mail = { to: "alice@example.com", subject: "Hi", text: "Hello\n.dot" };
+
+test("sendMail goes through EHLO, MAIL, RCPT and DATA", async () => {
+  const { server, commands } = await mockServer();
+  try {
+    await sendMail(smtpFor(server), mail);
+    assert.deepStrictEqual(commands, [
+      "EHLO echo",
+      "MAIL FROM:<echo@example.com>",
+      "RCPT TO:<alice@example.com>",
+      "DATA",
+      "<message>",
+      "QUIT",
+    ]);
+  } finally {
+    server.close();
+  }
+});
+
+test("sendMail logs in with AUTH PLAIN when given a user", async () => {
+  const { server, commands } = await mockServer();
+  try {
+    await sendMail(smtpFor(server, { user: "u", pass: "p" }), mail);
+    const auth = Buffer.from("\0u\0p").toString("base64");
+    assert.strictEqual(commands[1], `AUTH PLAIN ${auth}`);
+  } finally {
+    server.close();
+  }
+});
+
+test("sendMail gives up on a server that stops answering", async () => {
+  const { server, commands } = await mockServer({ silent: true });
+  try {
+    await assert.rejects(
+      sendMail(smtpFor(server, { timeoutMs: 100 }), mail),
+      /SMTP timeout/
+    );
+    assert.deepStrictEqual(commands, ["EHLO echo"]);
+  } finally {
+    server.close();
+  }
+});
+
+test("sendMail refuses line breaks in addresses and the subject", async () => {
+  const { server, commands } = await mockServer();
+  try {
+    await assert.rejects(
+      sendMail(smtpFor(server), { ...mail, to: "a@b.c>\r\nRCPT TO:<x@y.z" }),
+      /line break/
+    );
+    await assert.rejects(
+      sendMail(smtpFor(server), { ...mail, subject: "Hi\nBcc: x@y.z" }),
+      /line break/
+    );
+    assert.deepStrictEqual(commands, []);
+  } finally {
+    server.close();
+  }
+});
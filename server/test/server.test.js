@@ -0,0 +1,421 @@
+// Starts the server against an in-memory MongoDB and talks to it over real
+// websockets. Needs mongodb-memory-server, which isn't a dependency yet:
+//
+//   npm install --no-save mongodb-memory-server && npm test
+//
+// or TEST_MONGODB_URI pointing at a database the tests may wipe.
+const { describe, it, before, after } = require("node:test");
+const assert = require("node:assert");
+const fs = require("fs");
+const os = require("os");
+const path = require("path");
+
+let MongoMemoryServer = null;
+try {
+  ({ MongoMemoryServer } = require("mongodb-memory-server"));
+} catch (error) {
+  // Skipped below, unless TEST_MONGODB_URI is set
+}
+const skip =
+  !MongoMemoryServer && !process.env.TEST_MONGODB_URI
+    ? "needs mongodb-memory-server or TEST_MONGODB_URI"
+    : false;
+
+const FRAME_TIMEOUT_MS = 2000;
+
+// A websocket client that keeps every frame it gets, for next to look through
+class TestClient {
+  constructor(WebSocket, url, protocols = "echo-v1") {
+    this.ws = new WebSocket(url, protocols);
+    this.frames = [];
+    this.waiting = [];
+    this.closed = new Promise((resolve) => this.ws.on("close", resolve));
+    this.ws.on("error", () => {}); // Seen by opened, or ends in close
+    this.ws.on("message", (data) => {
+      this.frames.push(data.toString());
+      this.waiting.forEach((check) => check());
+    });
+  }
+
+  opened() {
+    return new Promise((resolve, reject) => {
+      this.ws.once("open", resolve);
+      this.ws.once("error", reject);
+    });
+  }
+
+  send(text) {
+    this.ws.send(text);
+  }
+
+  // The first frame not yet looked at that matches, taking it and the
+  // frames before it
+  next(matches, timeoutMs = FRAME_TIMEOUT_MS) {
+    return new Promise((resolve, reject) => {
+      const check = () => {
+        const at = this.frames.findIndex(matches);
+        if (at === -1) return false;
+        const [frame] = this.frames.splice(0, at + 1).slice(-1);
+        done();
+        resolve(frame);
+        return true;
+      };
+      const timer = setTimeout(() => {
+        done();
+        reject(new Error(`no matching frame within ${timeoutMs}ms, got ${JSON.stringify(this.frames)}`));
+      }, timeoutMs);
+      const done = () => {
+        clearTimeout(timer);
+        this.waiting = this.waiting.filter((waiting) => waiting !== check);
+      };
+      if (!check()) this.waiting.push(check);
+    });
+  }
+
+  // Whether a matching frame turns up within timeoutMs
+  async gets(matches, timeoutMs) {
+    try {
+      await this.next(matches, timeoutMs);
+      return true;
+    } catch (error) {
+      return false;
+    }
+  }
+
+  close() {
+    this.ws.close();
+    return this.closed;
+  }
+}
+
+const chatFrom = (sender, content) => (frame) => {
+  try {
+    const message = JSON.parse(frame);
+    return message.type === "message" && message.sender === sender && message.content === content;
+  } catch (error) {
+    return false;
+  }
+};
+
+describe("server over websockets", { skip }, () => {
+  let mongod = null;
+  let mongoose;
+  let User;
+  let Message;
+  let WebSocket;
+  let running;
+  let url;
+  const motdFile = path.join(fs.mkdtempSync(path.join(os.tmpdir(), "echo-motd-")), "motd.txt");
+
+  // Log in, registering the user if they're new, and wait for the server
+  // to say they joined
+  const login = async (username, password = "secret") => {
+    const client = new TestClient(WebSocket, url);
+    await client.opened();
+    client.send(JSON.stringify({ username, password }));
+    const reply = await client.next((frame) => frame.startsWith("ERROR:") || frame === `${username} has joined`);
+    if (reply.startsWith("ERROR:")) {
+      await client.closed;
+      throw new Error(reply);
+    }
+    return client;
+  };
+
+  // Log out, waiting for the server to mark the user offline so they can
+  // log in again
+  const logout = async (client, username) => {
+    await client.close();
+    for (let i = 0; i < 50; i++) {
+      const user = await User.findOne({ username });
+      if (!user || !user.isOnline) return;
+      await new Promise((resolve) => setTimeout(resolve, 20));
+    }
+    throw new Error(`${username} still online`);
+  };
+
+  before(async () => {
+    let uri = process.env.TEST_MONGODB_URI;
+    if (!uri) {
+      mongod = await MongoMemoryServer.create();
+      uri = mongod.getUri("echo-test");
+    }
+    process.env.MONGODB_URI = uri;
+    process.env.BCRYPT_COST = "10"; // The lowest allowed, for speed
+    process.env.ALLOW_GUESTS = "true";
+    process.env.MOTD_FILE = motdFile;
+
+    mongoose = require("mongoose");
+    WebSocket = require("ws");
+    User = require("../models/User");
+    Message = require("../models/Message");
+    const { startServer } = require("../server");
+    running = await startServer(0);
+    url = `ws://127.0.0.1:${running.server.address().port}`;
+    await mongoose.connection.db.dropDatabase();
+  });
+
+  after(async () => {
+    if (running) {
+      running.wss.clients.forEach((client) => client.terminate());
+      running.wss.close();
+      running.server.close();
+    }
+    if (mongoose) await mongoose.disconnect();
+    if (mongod) await mongod.stop();
+  });
+
+  it("registers a new user and logs them back in", async () => {
+    await logout(await login("alice"), "alice");
+    assert.ok(await User.findOne({ username: "alice" }));
+
+    await logout(await login("alice"), "alice");
+  });
+
+  it("negotiates echo-v2 and announces joins and leaves as frames", async () => {
+    const bob = await login("v2_b");
+    const alice = new TestClient(WebSocket, url, ["echo-v1", "echo-v2"]);
+    try {
+      await alice.opened();
+      assert.strictEqual(alice.ws.protocol, "echo-v2");
+      alice.send(JSON.stringify({ username: "v2_a", password: "secret" }));
+      await alice.next((frame) => frame === "JOINED:v2_a");
+      await bob.next((frame) => frame === "v2_a has joined");
+
+      await logout(bob, "v2_b");
+      await alice.next((frame) => frame === "LEFT:v2_b");
+    } finally {
+      await alice.close();
+    }
+  });
+
+  it("sends the message of the day as the file says at login", async () => {
+    fs.writeFileSync(motdFile, "Welcome\n");
+    const first = await login("motd");
+    await first.next((frame) => frame === "MOTD:Welcome");
+    await logout(first, "motd");
+
+    // Edited without a reload, a second later as far as its mtime goes
+    fs.writeFileSync(motdFile, "Maintenance at noon\n");
+    const later = new Date(Date.now() + 1000);
+    fs.utimesSync(motdFile, later, later);
+    const second = await login("motd");
+    await second.next((frame) => frame === "MOTD:Maintenance at noon");
+    await logout(second, "motd");
+
+    fs.rmSync(motdFile);
+    const third = await login("motd");
+    assert.strictEqual(await third.gets((frame) => frame.startsWith("MOTD:"), 300), false);
+    await logout(third, "motd");
+  });
+
+  it("changes a password holding spaces and colons", async () => {
+    const client = await login("passwd_a", "old pass: one");
+    client.send(`PASSWD:${JSON.stringify({ old: "old pass: one", new: "new pass: two" })}`);
+    await client.next((frame) => frame === "PASSWD_OK");
+    await logout(client, "passwd_a");
+    await assert.rejects(login("passwd_a", "old pass: one"), /Wrong password/);
+    await logout(await login("passwd_a", "new pass: two"), "passwd_a");
+  });
+
+  it("refuses a wrong password", async () => {
+    await logout(await login("wrongpw"), "wrongpw");
+    await assert.rejects(login("wrongpw", "not the password"), /Wrong password/);
+  });
+
+  it("locks an account after wrong passwords sent side by side", async () => {
+    await logout(await login("lockout"), "lockout");
+    const attempts = Array.from({ length: 5 }, () => login("lockout", "not the password"));
+    const results = await Promise.allSettled(attempts);
+    assert.ok(results.every((result) => result.status === "rejected"));
+    await assert.rejects(login("lockout"), /Too many failed attempts/);
+  });
+
+  it("broadcasts messages to everyone within 200ms", async () => {
+    const alice = await login("bcast_a");
+    const bob = await login("bcast_b");
+    try {
+      const sent = Date.now();
+      alice.send("hello everyone");
+      await bob.next(chatFrom("bcast_a", "hello everyone"));
+      assert.ok(Date.now() - sent < 200, `took ${Date.now() - sent}ms`);
+    } finally {
+      await alice.close();
+      await bob.close();
+    }
+  });
+
+  it("delivers whispers to their target only", async () => {
+    const alice = await login("whisper_a");
+    const bob = await login("whisper_b");
+    const carol = await login("whisper_c");
+    try {
+      alice.send("/whisper whisper_b just for you");
+      assert.strictEqual(
+        await bob.next((frame) => frame.startsWith("WHISPER:")),
+        "WHISPER:whisper_a:just for you"
+      );
+      assert.strictEqual(await carol.gets((frame) => frame.includes("just for you"), 300), false);
+
+      alice.send("/whisper nobody_here are you there");
+      await alice.next((frame) => frame === "ERR:user_not_found");
+
+      // Sent with a clientID, whispers are acknowledged or refused by it
+      const whisper = (body, clientID) =>
+        alice.send(JSON.stringify({ type: "message", body, clientID }));
+      whisper("/whisper whisper_b again", "w1");
+      await alice.next((frame) => frame === "ACK:w1");
+      whisper("/whisper nobody_here hello?", "w2");
+      await alice.next((frame) => frame === "ERR:user_not_found:w2");
+    } finally {
+      await alice.close();
+      await bob.close();
+      await carol.close();
+    }
+  });
+
+  it("keeps guests from whispering and changing the account", async () => {
+    const bob = await login("guest_target");
+    const guest = new TestClient(WebSocket, url);
+    try {
+      await guest.opened();
+      guest.send(JSON.stringify({ username: "guest", password: "guest" }));
+      await guest.next((frame) => frame.startsWith("GUEST:"));
+
+      guest.send("/whisper guest_target psst");
+      await guest.next((frame) => frame === "ERR:guest_denied");
+      // Nor sent in the envelope the client uses
+      guest.send(JSON.stringify({ type: "message", body: "/w guest_target psst", clientID: "g1" }));
+      await guest.next((frame) => frame === "ERR:guest_denied");
+      assert.strictEqual(await bob.gets((frame) => frame.includes("psst"), 300), false);
+
+      for (const frame of ["PASSWD:a:b", "ENABLE2FA", "DISABLE2FA:a"]) {
+        guest.send(frame);
+        await guest.next((reply) => reply === "ERR:guest_denied");
+      }
+    } finally {
+      await guest.close();
+      await bob.close();
+    }
+  });
+
+  it("accepts readable colors and lightens dark ones", async () => {
+    const alice = await login("color_a");
+    try {
+      alice.send("SETCOLOR:#ff8800");
+      await alice.next((frame) => frame === "COLOR_SET:#FF8800");
+      alice.send("SETCOLOR:#000080");
+      await alice.next((frame) => frame === "COLOR_REJECTED:#8080C0");
+      await alice.next((frame) => frame === "COLOR:color_a:#8080C0");
+    } finally {
+      await alice.close();
+    }
+  });
+
+  it("rate limits the 11th message in a second", async () => {
+    const alice = await login("flood_a");
+    try {
+      for (let i = 1; i <= 10; i++) alice.send(`message ${i}`);
+      assert.strictEqual(await alice.gets((frame) => frame.startsWith("RATELIMIT:"), 300), false);
+      alice.send("message 11");
+      await alice.next((frame) => frame.startsWith("RATELIMIT:"));
+    } finally {
+      await alice.close();
+    }
+  });
+
+  it("backfills what came after since_id, or else the latest page", async () => {
+    const isBackfill = (frame) => frame.startsWith('{"type":"backfill"');
+    const contents = (frame) => JSON.parse(frame).messages.map((message) => message.content);
+    const filler = Array.from({ length: 250 }, (_, i) => ({
+      sender: "backfill_a",
+      content: `filler ${i + 1}`,
+      channel: "general",
+    }));
+    const stored = await Message.insertMany(filler);
+
+    const alice = await login("backfill_a");
+    try {
+      const since = stored[247]._id.toString();
+      alice.send(JSON.stringify({ type: "backfill_req", since_id: since }));
+      assert.deepStrictEqual(contents(await alice.next(isBackfill)), ["filler 249", "filler 250"]);
+
+      // Not the oldest 200, which would start with messages from before
+      for (const since_id of [undefined, "", "000000000000000000000000", "garbage"]) {
+        alice.send(JSON.stringify({ type: "backfill_req", since_id, channel: "general" }));
+        const page = contents(await alice.next(isBackfill));
+        assert.strictEqual(page.length, 200);
+        assert.strictEqual(page[0], "filler 51");
+        assert.strictEqual(page[199], "filler 250");
+      }
+
+      alice.send(JSON.stringify({ type: "backfill_req", since_id: since, channel: "nowhere" }));
+      await alice.next((frame) => frame === "ERR:channel_not_found");
+    } finally {
+      await alice.close();
+    }
+  });
+
+  it("keeps invite-only channels from those not let in", async () => {
+    await logout(await login("secret_mod"), "secret_mod");
+    await User.updateOne({ username: "secret_mod" }, { role: "mod" });
+    const mod = await login("secret_mod");
+    const outsider = await login("secret_out");
+    try {
+      mod.send("CREATECHANNEL:secret");
+      await mod.next((frame) => frame.startsWith("CHANNELADD:") && frame.includes('"secret"'));
+      mod.send("CHANNELMODE:secret:invite-only");
+      await mod.next((frame) => frame.startsWith("CHANNELADD:") && frame.includes("invite-only"));
+      mod.send("JOIN:secret");
+      await mod.next((frame) => frame.startsWith("HISTORY:secret:"));
+      mod.send("hidden plans @secret_out");
+      await mod.next(chatFrom("secret_mod", "hidden plans @secret_out"));
+
+      assert.strictEqual(
+        await outsider.gets((frame) => /^(ACTIVITY|MENTION):secret/.test(frame), 300),
+        false
+      );
+      for (const frame of ["SEARCH:secret:hidden:10", "TOPIC:secret:mine now", "EXPORT:secret:::json"]) {
+        outsider.send(frame);
+        await outsider.next((reply) => reply === "ERR:permission_denied");
+      }
+    } finally {
+      await mod.close();
+      await outsider.close();
+    }
+  });
+
+  it("kicks with a long reason cut between characters", async () => {
+    await logout(await login("kick_admin"), "kick_admin");
+    await User.updateOne({ username: "kick_admin" }, { role: "admin" });
+    const admin = await login("kick_admin");
+    const bob = await login("kick_b");
+    try {
+      const closed = new Promise((resolve) => bob.ws.once("close", (code, reason) => resolve({ code, reason })));
+      admin.send(`KICK:kick_b:${"é".repeat(100)}`);
+      const { code, reason } = await closed;
+      assert.strictEqual(code, 4000);
+      assert.ok(reason.length <= 123, `reason is ${reason.length} bytes`);
+      assert.match(reason.toString(), /^KICKED:é+$/);
+      // The server is still up
+      await logout(await login("kick_c"), "kick_c");
+    } finally {
+      await admin.close();
+    }
+  });
+
+  // Last, as the ban covers the address every test connects from
+  it("keeps a banned user from reconnecting", async () => {
+    await logout(await login("ban_admin"), "ban_admin");
+    await User.updateOne({ username: "ban_admin" }, { role: "admin" });
+    const admin = await login("ban_admin");
+    const bob = await login("ban_b");
+    try {
+      admin.send("BAN:ban_b:3600:testing");
+      await bob.closed;
+      // The ban takes the address too, so the upgrade itself is refused
+      await assert.rejects(login("ban_b"), /403/);
+    } finally {
+      await admin.close();
+    }
+  });
+});
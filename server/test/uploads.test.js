@@ -0,0 +1,62 @@
+const { describe, it } = require("node:test");
+const assert = require("node:assert");
+const uploads = require("../uploads");
+
+const text = (s) => Buffer.from(s).toString("base64");
+const chunk = (id, total, index, filename, data) =>
+  `${id}:${total}:${index}:${filename}:${data}`;
+
+describe("uploads", () => {
+  it("ignores chunks for an upload after it was rejected", async () => {
+    // Chunk 0 of a .png that isn't one fails the sniff
+    await assert.rejects(
+      uploads.addChunk("alice", chunk("rejected1", 3, 0, "a.png", text("not a png"))),
+      { code: "upload_type_denied" }
+    );
+    // Later chunks don't start it over, so they take no pending slot
+    assert.strictEqual(await uploads.addChunk("alice", chunk("rejected1", 3, 1, "a.png", text("x"))), null);
+    assert.strictEqual(uploads.dropUpload("rejected1", "alice"), false);
+    // Nor may anyone else take over the ID
+    await assert.rejects(
+      uploads.addChunk("bob", chunk("rejected1", 3, 1, "a.png", text("x"))),
+      { code: "upload_invalid" }
+    );
+  });
+
+  it("lets only the owner drop an upload", async () => {
+    assert.strictEqual(await uploads.addChunk("alice", chunk("mine1", 2, 0, "a.txt", text("hello"))), null);
+    assert.strictEqual(uploads.dropUpload("mine1", "bob"), false);
+    assert.strictEqual(uploads.dropUpload("mine1", "alice"), true);
+    // And what comes after the drop is ignored
+    assert.strictEqual(await uploads.addChunk("alice", chunk("mine1", 2, 1, "a.txt", text("again"))), null);
+    assert.strictEqual(uploads.dropUpload("mine1", "alice"), false);
+  });
+
+  it("doesn't count ignored chunks against the pending limit", async () => {
+    for (let i = 0; i < 3; i++) {
+      await assert.rejects(
+        uploads.addChunk("carol", chunk(`bad${i}`, 2, 0, "a.png", text("nope"))),
+        { code: "upload_type_denied" }
+      );
+      await uploads.addChunk("carol", chunk(`bad${i}`, 2, 1, "a.png", text("nope")));
+    }
+    assert.strictEqual(await uploads.addChunk("carol", chunk("good1", 2, 0, "a.txt", text("fine"))), null);
+    uploads.abandonUploads("carol");
+  });
+
+  it("applies the limits it was given", async () => {
+    uploads.setLimits(4096, ["text/plain"]);
+    try {
+      await assert.rejects(
+        uploads.addChunk("dave", chunk("typed1", 1, 0, "a.pdf", text("%PDF-1.4"))),
+        { code: "upload_type_denied" }
+      );
+      await assert.rejects(
+        uploads.addChunk("dave", chunk("big1", 3, 0, "a.txt", text("hello"))),
+        { code: "upload_too_large" }
+      );
+    } finally {
+      uploads.setLimits(10 * 1024 * 1024, ["image/png", "image/jpeg", "image/gif", "text/plain", "application/pdf"]);
+    }
+  });
+});
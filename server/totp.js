@@ -0,0 +1,107 @@
+const crypto = require("crypto");
+
+// RFC 6238 defaults, which authenticator apps assume
+const PERIOD_SECONDS = 30;
+const DIGITS = 6;
+// Codes from one period either side are accepted, for clock drift
+const DRIFT_STEPS = 1;
+const RECOVERY_CODE_COUNT = 8;
+const BASE32_ALPHABET = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567";
+
+function base32Encode(buffer) {
+  let bits = 0;
+  let value = 0;
+  let out = "";
+  for (const byte of buffer) {
+    value = (value << 8) | byte;
+    bits += 8;
+    while (bits >= 5) {
+      out += BASE32_ALPHABET[(value >>> (bits - 5)) & 31];
+      bits -= 5;
+    }
+  }
+  if (bits > 0) out += BASE32_ALPHABET[(value << (5 - bits)) & 31];
+  return out;
+}
+
+function base32Decode(text) {
+  let bits = 0;
+  let value = 0;
+  const bytes = [];
+  for (const char of text.replace(/=+$/, "").toUpperCase()) {
+    const index = BASE32_ALPHABET.indexOf(char);
+    if (index === -1) throw new Error("invalid base32 secret");
+    value = (value << 5) | index;
+    bits += 5;
+    if (bits >= 8) {
+      bytes.push((value >>> (bits - 8)) & 255);
+      bits -= 8;
+    }
+  }
+  return Buffer.from(bytes);
+}
+
+// A new random secret, base32 encoded as authenticator apps expect
+function generateSecret() {
+  return base32Encode(crypto.randomBytes(20));
+}
+
+// The code for one time step (RFC 4226 HOTP with HMAC-SHA1)
+function codeAt(secret, step) {
+  const counter = Buffer.alloc(8);
+  counter.writeBigUInt64BE(BigInt(step));
+  const hmac = crypto
+    .createHmac("sha1", base32Decode(secret))
+    .update(counter)
+    .digest();
+  const offset = hmac[hmac.length - 1] & 15;
+  const binary = hmac.readUInt32BE(offset) & 0x7fffffff;
+  return String(binary % 10 ** DIGITS).padStart(DIGITS, "0");
+}
+
+function verifyCode(secret, code, now = Date.now()) {
+  if (!/^\d{6}$/.test(code)) return false;
+  const step = Math.floor(now / 1000 / PERIOD_SECONDS);
+  for (let drift = -DRIFT_STEPS; drift <= DRIFT_STEPS; drift++) {
+    const expected = Buffer.from(codeAt(secret, step + drift));
+    if (crypto.timingSafeEqual(expected, Buffer.from(code))) return true;
+  }
+  return false;
+}
+
+// The otpauth:// URI authenticator apps read from a QR code
+function otpauthUri(secret, username, issuer) {
+  const label = encodeURIComponent(`${issuer}:${username}`);
+  const params = new URLSearchParams({
+    secret,
+    issuer,
+    digits: String(DIGITS),
+    period: String(PERIOD_SECONDS),
+  });
+  return `otpauth://totp/${label}?${params}`;
+}
+
+// Recovery codes are like "k3f9-x2mq"; only their hashes are stored
+function generateRecoveryCodes() {
+  const codes = [];
+  for (let i = 0; i < RECOVERY_CODE_COUNT; i++) {
+    const raw = base32Encode(crypto.randomBytes(5)).toLowerCase();
+    codes.push(`${raw.slice(0, 4)}-${raw.slice(4, 8)}`);
+  }
+  return codes;
+}
+
+function hashRecoveryCode(code) {
+  return crypto
+    .createHash("sha256")
+    .update(code.trim().toLowerCase())
+    .digest("hex");
+}
+
+module.exports = {
+  generateSecret,
+  verifyCode,
+  otpauthUri,
+  generateRecoveryCodes,
+  hashRecoveryCode,
+};
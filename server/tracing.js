@@ -0,0 +1,175 @@
+const crypto = require("crypto");
+const path = require("path");
+const { AsyncLocalStorage } = require("async_hooks");
+const { performance } = require("perf_hooks");
+const grpc = require("@grpc/grpc-js");
+const protoLoader = require("@grpc/proto-loader");
+const { version } = require("./package.json");
+
+// Minimal OpenTelemetry tracing: spans made here are batched and exported
+// to a collector over OTLP/gRPC (proto/otlp_trace.proto)
+const PROTO_PATH = path.join(__dirname, "proto", "otlp_trace.proto");
+const SCOPE_NAME = "echo-server";
+// Spans are exported this often, or sooner once this many are waiting.
+// Past MAX_QUEUED, say while the collector is down, new ones are dropped.
+const EXPORT_INTERVAL_MS = 5000;
+const EXPORT_BATCH_SIZE = 512;
+const MAX_QUEUED = 2048;
+const EXPORT_TIMEOUT_MS = 10000;
+
+const SPAN_KINDS = { internal: 1, server: 2 };
+const STATUS_CODE_ERROR = 2;
+
+// The span every call gets when tracing is off, which records nothing
+const noopSpan = {
+  setAttribute() {},
+  recordError() {},
+  end() {},
+};
+
+// Used when otel_enabled is off, so tracing costs nothing
+const noopTracer = {
+  enabled: false,
+  startSpan: () => noopSpan,
+  withSpan: (span, fn) => fn(),
+  shutdown: async () => {},
+};
+
+// The time now in nanoseconds since the epoch, as a string as it's past
+// what a number holds exactly
+function nowNanos() {
+  const micros = BigInt(Math.round((performance.timeOrigin + performance.now()) * 1000));
+  return (micros * 1000n).toString();
+}
+
+function anyValue(value) {
+  if (typeof value === "boolean") return { bool_value: value };
+  if (Number.isInteger(value)) return { int_value: value };
+  if (typeof value === "number") return { double_value: value };
+  return { string_value: String(value) };
+}
+
+function keyValues(attributes) {
+  return Object.entries(attributes).map(([key, value]) => ({ key, value: anyValue(value) }));
+}
+
+class Span {
+  constructor(tracer, name, kind, parent, attributes) {
+    this.tracer = tracer;
+    this.name = name;
+    this.kind = kind;
+    this.traceId = parent ? parent.traceId : crypto.randomBytes(16);
+    this.spanId = crypto.randomBytes(8);
+    this.parentSpanId = parent ? parent.spanId : null;
+    this.attributes = { ...attributes };
+    this.status = null;
+    this.start = nowNanos();
+    this.ended = false;
+  }
+
+  setAttribute(key, value) {
+    this.attributes[key] = value;
+  }
+
+  recordError(error) {
+    this.status = { code: STATUS_CODE_ERROR, message: error.message || String(error) };
+  }
+
+  end() {
+    if (this.ended) return;
+    this.ended = true;
+    this.tracer.finished({
+      trace_id: this.traceId,
+      span_id: this.spanId,
+      parent_span_id: this.parentSpanId || Buffer.alloc(0),
+      name: this.name,
+      kind: this.kind,
+      start_time_unix_nano: this.start,
+      end_time_unix_nano: nowNanos(),
+      attributes: keyValues(this.attributes),
+      status: this.status || {},
+    });
+  }
+}
+
+// The client for endpoint, like http://collector:4317; https:// dials
+// with TLS and a bare host:port without
+function traceClient(endpoint) {
+  const definition = protoLoader.loadSync(PROTO_PATH, { keepCase: true, longs: String });
+  const { TraceService } = grpc.loadPackageDefinition(definition).opentelemetry.proto.collector.trace.v1;
+  const secure = endpoint.startsWith("https://");
+  const address = endpoint.replace(/^https?:\/\//, "").replace(/\/+$/, "");
+  const credentials = secure ? grpc.credentials.createSsl() : grpc.credentials.createInsecure();
+  return new TraceService(address, credentials);
+}
+
+// A tracer exporting to settings.endpoint as settings.serviceName, or the
+// no-op tracer when settings.enabled is off. settings.log hears of failed
+// exports, once until one succeeds again.
+function createTracer(settings) {
+  if (!settings.enabled) return noopTracer;
+
+  const client = traceClient(settings.endpoint);
+  const resource = { attributes: keyValues({ "service.name": settings.serviceName }) };
+  const current = new AsyncLocalStorage();
+  let queue = [];
+  let failing = false;
+  let dropped = 0;
+
+  const exportBatch = (size = EXPORT_BATCH_SIZE) => {
+    if (queue.length === 0) return Promise.resolve();
+    const spans = queue.splice(0, size);
+    const request = {
+      resource_spans: [{ resource, scope_spans: [{ scope: { name: SCOPE_NAME, version }, spans }] }],
+    };
+    return new Promise((resolve) => {
+      const deadline = new Date(Date.now() + EXPORT_TIMEOUT_MS);
+      client.Export(request, { deadline }, (error) => {
+        if (error && !failing) {
+          settings.log(`Couldn't export traces to ${settings.endpoint}: ${error.details || error.message}`);
+        }
+        failing = !!error;
+        resolve();
+      });
+    });
+  };
+
+  const timer = setInterval(() => exportBatch(), EXPORT_INTERVAL_MS);
+  timer.unref();
+
+  const tracer = {
+    enabled: true,
+
+    // Start a span below the one running, or a new trace's root span.
+    // kind is "internal" or, for handling a client's request, "server".
+    startSpan(name, attributes = {}, kind = "internal") {
+      return new Span(tracer, name, SPAN_KINDS[kind], current.getStore(), attributes);
+    },
+
+    // Run fn with span as the parent of spans started in it, including
+    // after anything it awaits
+    withSpan(span, fn) {
+      return current.run(span, fn);
+    },
+
+    finished(span) {
+      if (queue.length >= MAX_QUEUED) {
+        if (dropped++ === 0) settings.log("Trace export queue full, dropping spans");
+        return;
+      }
+      dropped = 0;
+      queue.push(span);
+      if (queue.length >= EXPORT_BATCH_SIZE) exportBatch();
+    },
+
+    // Export what's left in one go, for shutting down
+    async shutdown() {
+      clearInterval(timer);
+      await exportBatch(queue.length);
+      client.close();
+    },
+  };
+  return tracer;
+}
+
+module.exports = { createTracer };
@@ -0,0 +1,297 @@
+const fs = require("fs");
+const path = require("path");
+
+const UPLOAD_DIR = path.resolve(process.env.UPLOAD_DIR || "uploads");
+
+// The largest file accepted and the types allowed, from max_upload_bytes
+// and allowed_mime_types
+let maxUploadBytes = 10 * 1024 * 1024;
+let allowedMimeTypes = ["image/png", "image/jpeg", "image/gif", "text/plain", "application/pdf"];
+
+// How many unfinished uploads a user may have at once, and how much of
+// their data the server holds on to meanwhile, by default twice
+// max_upload_bytes
+const MAX_PENDING_UPLOADS = parseInt(process.env.MAX_PENDING_UPLOADS, 10) || 3;
+const MAX_PENDING_BYTES = parseInt(process.env.MAX_PENDING_BYTES, 10) || 0;
+// Chunks each connection may send per second, with room for a burst
+const UPLOAD_CHUNKS_PER_SEC =
+  parseFloat(process.env.UPLOAD_CHUNKS_PER_SEC) || 100;
+const UPLOAD_CHUNK_BURST = 200;
+
+// Clients send 4 KB of file data per chunk
+const CHUNK_BYTES = 4096;
+// Uploads are dropped after STALE_UPLOAD_MS without a chunk, or once
+// UPLOAD_DEADLINE_MS has passed since they started however they're going
+const STALE_UPLOAD_MS = 5 * 60 * 1000;
+const UPLOAD_DEADLINE_MS = 30 * 60 * 1000;
+const SWEEP_INTERVAL_MS = 60 * 1000;
+
+const MIME_TYPES = {
+  ".png": "image/png",
+  ".jpg": "image/jpeg",
+  ".jpeg": "image/jpeg",
+  ".gif": "image/gif",
+  ".webp": "image/webp",
+  ".txt": "text/plain",
+  ".md": "text/markdown",
+  ".pdf": "application/pdf",
+  ".zip": "application/zip",
+};
+
+// uploadID -> chunks received so far
+const pending = new Map();
+// uploadID -> { owner, closedAt } for uploads that were finished, rejected
+// or dropped, kept as long as an upload could last so that chunks still on
+// their way don't start them over
+const closed = new Map();
+
+class UploadError extends Error {
+  constructor(code) {
+    super(code);
+    this.code = code;
+  }
+}
+
+function mimeType(filename) {
+  return MIME_TYPES[path.extname(filename).toLowerCase()] || "application/octet-stream";
+}
+
+// Leading bytes of each binary type, at the given offset
+const SIGNATURES = [
+  { type: "image/png", offset: 0, bytes: Buffer.from("89504e470d0a1a0a", "hex") },
+  { type: "image/jpeg", offset: 0, bytes: Buffer.from("ffd8ff", "hex") },
+  { type: "image/gif", offset: 0, bytes: Buffer.from("GIF87a") },
+  { type: "image/gif", offset: 0, bytes: Buffer.from("GIF89a") },
+  { type: "image/webp", offset: 8, bytes: Buffer.from("WEBP") },
+  { type: "application/pdf", offset: 0, bytes: Buffer.from("%PDF-") },
+  { type: "application/zip", offset: 0, bytes: Buffer.from("504b0304", "hex") },
+];
+
+// Whether data reads as UTF-8 text. A character cut in half at the end
+// is let through, as data may be just the first chunk.
+function looksLikeText(data) {
+  if (data.includes(0)) return false;
+  try {
+    new TextDecoder("utf-8", { fatal: true }).decode(data, { stream: true });
+    return true;
+  } catch (error) {
+    return false;
+  }
+}
+
+// The type of a file going by its first bytes, rather than its name.
+// Plain text has no signature; the name tells it from markdown.
+function sniffMimeType(data, filename) {
+  for (const { type, offset, bytes } of SIGNATURES) {
+    if (data.subarray(offset, offset + bytes.length).equals(bytes)) {
+      if (type === "image/webp" && !data.subarray(0, 4).equals(Buffer.from("RIFF"))) {
+        continue;
+      }
+      return type;
+    }
+  }
+  if (looksLikeText(data)) {
+    return mimeType(filename) === "text/markdown" ? "text/markdown" : "text/plain";
+  }
+  return "application/octet-stream";
+}
+
+// What owner's unfinished uploads add up to
+function pendingFor(owner) {
+  let count = 0;
+  let bytes = 0;
+  for (const upload of pending.values()) {
+    if (upload.owner === owner) {
+      count++;
+      bytes += upload.size;
+    }
+  }
+  return { count, bytes };
+}
+
+// Keep only the base name and drop characters that clash with the wire format
+function safeFilename(filename) {
+  return path.basename(filename).replace(/[:/\\\0]/g, "_").slice(0, 128);
+}
+
+// Parse FILECHUNK:<uploadID>:<total>:<index>:<filename>:<b64>. The filename
+// may contain anything, so the base64 data is split off from the right.
+function parseChunk(payload) {
+  const parts = payload.split(":");
+  if (parts.length < 5) return null;
+
+  const [uploadId, total, index] = parts;
+  const data = parts[parts.length - 1];
+  const filename = parts.slice(3, -1).join(":");
+  const chunk = {
+    uploadId,
+    total: parseInt(total, 10),
+    index: parseInt(index, 10),
+    filename: safeFilename(filename),
+    data: Buffer.from(data, "base64"),
+  };
+  if (
+    !/^[A-Za-z0-9_-]{1,64}$/.test(uploadId) ||
+    !(chunk.total > 0) ||
+    !(chunk.index >= 0 && chunk.index < chunk.total) ||
+    !chunk.filename
+  ) {
+    return null;
+  }
+  return chunk;
+}
+
+// Store one chunk from owner. Returns null while the upload is incomplete,
+// or { name, filename, size } once the file has been written to disk.
+// Throws an UploadError with an ERR: code when the upload is rejected.
+// The file's type is checked against its first bytes when chunk 0 comes.
+// Accept files of up to maxBytes, of mimeTypes, from now on
+function setLimits(maxBytes, mimeTypes) {
+  maxUploadBytes = maxBytes;
+  allowedMimeTypes = mimeTypes;
+}
+
+async function addChunk(owner, payload) {
+  const chunk = parseChunk(payload);
+  if (!chunk) throw new UploadError("upload_invalid");
+
+  const done = closed.get(chunk.uploadId);
+  if (done) {
+    // The owner was told why when it closed
+    if (done.owner === owner) return null;
+    throw new UploadError("upload_invalid");
+  }
+
+  let upload = pending.get(chunk.uploadId);
+  if (!upload) {
+    if (chunk.total * CHUNK_BYTES > maxUploadBytes + CHUNK_BYTES) {
+      reject(chunk.uploadId, owner, "upload_too_large");
+    }
+    if (!allowedMimeTypes.includes(mimeType(chunk.filename))) {
+      reject(chunk.uploadId, owner, "upload_type_denied");
+    }
+    if (pendingFor(owner).count >= MAX_PENDING_UPLOADS) {
+      reject(chunk.uploadId, owner, "upload_too_many");
+    }
+    upload = {
+      owner,
+      filename: chunk.filename,
+      total: chunk.total,
+      chunks: new Array(chunk.total),
+      received: 0,
+      size: 0,
+      startedAt: Date.now(),
+    };
+    pending.set(chunk.uploadId, upload);
+  }
+  if (upload.owner !== owner || upload.total !== chunk.total) {
+    throw new UploadError("upload_invalid");
+  }
+
+  upload.updatedAt = Date.now();
+  if (chunk.index === 0 && sniffMimeType(chunk.data, upload.filename) !== mimeType(upload.filename)) {
+    reject(chunk.uploadId, owner, "upload_type_denied");
+  }
+  if (!upload.chunks[chunk.index]) {
+    if (pendingFor(owner).bytes + chunk.data.length > (MAX_PENDING_BYTES || 2 * maxUploadBytes)) {
+      reject(chunk.uploadId, owner, "upload_too_large");
+    }
+    upload.chunks[chunk.index] = chunk.data;
+    upload.received++;
+    upload.size += chunk.data.length;
+  }
+  if (upload.size > maxUploadBytes) {
+    reject(chunk.uploadId, owner, "upload_too_large");
+  }
+  if (upload.received < upload.total) return null;
+
+  close(chunk.uploadId, owner);
+  const name = `${chunk.uploadId}-${upload.filename}`;
+  await fs.promises.mkdir(UPLOAD_DIR, { recursive: true });
+  await fs.promises.writeFile(
+    path.join(UPLOAD_DIR, name),
+    Buffer.concat(upload.chunks)
+  );
+  return { name, filename: upload.filename, size: upload.size };
+}
+
+// Forget the unfinished uploads of a user who disconnected
+function abandonUploads(owner) {
+  for (const [id, upload] of pending) {
+    if (upload.owner === owner) pending.delete(id);
+  }
+}
+
+// Stop an upload, remembering it so that later chunks are ignored
+function close(uploadId, owner) {
+  pending.delete(uploadId);
+  closed.set(uploadId, { owner, closedAt: Date.now() });
+}
+
+// Stop an upload and throw the UploadError with code
+function reject(uploadId, owner, code) {
+  close(uploadId, owner);
+  throw new UploadError(code);
+}
+
+// Drop one of owner's uploads, reporting whether it was still going
+function dropUpload(uploadId, owner) {
+  const upload = pending.get(uploadId);
+  if (!upload || upload.owner !== owner) return false;
+  close(uploadId, owner);
+  return true;
+}
+
+function sweepStaleUploads() {
+  const now = Date.now();
+  for (const [id, upload] of pending) {
+    if (
+      now - upload.updatedAt > STALE_UPLOAD_MS ||
+      now - upload.startedAt > UPLOAD_DEADLINE_MS
+    ) {
+      close(id, upload.owner);
+    }
+  }
+  for (const [id, done] of closed) {
+    if (now - done.closedAt > UPLOAD_DEADLINE_MS) closed.delete(id);
+  }
+}
+
+setInterval(sweepStaleUploads, SWEEP_INTERVAL_MS).unref();
+
+// Serve a finished upload for GET /files/<name>
+async function serveUpload(res, name) {
+  if (name !== path.basename(name)) {
+    res.writeHead(404, { "Content-Type": "text/plain" });
+    res.end("Not found\n");
+    return;
+  }
+
+  let data;
+  try {
+    data = await fs.promises.readFile(path.join(UPLOAD_DIR, name));
+  } catch (error) {
+    res.writeHead(404, { "Content-Type": "text/plain" });
+    res.end("Not found\n");
+    return;
+  }
+  res.writeHead(200, {
+    "Content-Type": mimeType(name),
+    "Content-Length": data.length,
+    "X-Content-Type-Options": "nosniff",
+    "Content-Disposition": `attachment; filename="${name.replace(/"/g, "")}"`,
+  });
+  res.end(data);
+}
+
+module.exports = {
+  UPLOAD_CHUNKS_PER_SEC,
+  UPLOAD_CHUNK_BURST,
+  UploadError,
+  setLimits,
+  addChunk,
+  dropUpload,
+  abandonUploads,
+  serveUpload,
+  sniffMimeType,
+};
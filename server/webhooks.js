@@ -0,0 +1,102 @@
+const crypto = require("crypto");
+const http = require("http");
+const https = require("https");
+
+const DELIVERY_TIMEOUT_MS = 5000;
+// Attempts after the first, waiting RETRY_BASE_MS, then twice that, ...
+const MAX_RETRIES = 3;
+const RETRY_BASE_MS = 1000;
+
+// Whether hook wants event in channel; "*" matches every channel
+function matches(hook, event, channel) {
+  return (
+    hook.events.includes(event) &&
+    (hook.channel === "*" || hook.channel === channel)
+  );
+}
+
+// The X-Echo-Signature header: an HMAC-SHA256 of the body with the hook's
+// secret, which receivers recompute to check the request came from us
+function sign(secret, body) {
+  return "sha256=" + crypto.createHmac("sha256", secret).update(body).digest("hex");
+}
+
+// POST body to hook.url once, resolving on a 2xx reply
+function post(hook, body) {
+  return new Promise((resolve, reject) => {
+    const url = new URL(hook.url);
+    const request = (url.protocol === "https:" ? https : http).request(url, {
+      method: "POST",
+      timeout: DELIVERY_TIMEOUT_MS,
+      headers: {
+        "Content-Type": "application/json",
+        "Content-Length": Buffer.byteLength(body),
+        "User-Agent": "Echo-Webhook",
+        "X-Echo-Signature": sign(hook.secret, body),
+      },
+    });
+    request.on("response", (response) => {
+      response.resume();
+      if (response.statusCode >= 200 && response.statusCode < 300) {
+        resolve();
+      } else {
+        reject(new Error(`HTTP ${response.statusCode}`));
+      }
+    });
+    request.on("timeout", () => request.destroy(new Error("timed out")));
+    request.on("error", reject);
+    request.end(body);
+  });
+}
+
+// Deliver to one hook, retrying with backoff. Resolves to null once
+// delivered, or the last error after the retries run out.
+async function deliver(hook, body) {
+  let lastError;
+  for (let attempt = 0; attempt <= MAX_RETRIES; attempt++) {
+    if (attempt > 0) {
+      await new Promise((resolve) =>
+        setTimeout(resolve, RETRY_BASE_MS * 2 ** (attempt - 1)).unref()
+      );
+    }
+    try {
+      await post(hook, body);
+      return null;
+    } catch (error) {
+      lastError = error;
+    }
+  }
+  return lastError;
+}
+
+// Send event to every hook that wants it, without waiting for delivery.
+// onFailure(hook, error) is called for each hook that couldn't be reached.
+function fire(hooks, event, { channel = null, username = null, body = "" }, onFailure) {
+  const payload = JSON.stringify({
+    event,
+    channel,
+    username,
+    body,
+    timestamp: new Date().toISOString(),
+  });
+  for (const hook of hooks) {
+    if (!matches(hook, event, channel)) continue;
+    deliver(hook, payload).then((error) => {
+      if (error) onFailure(hook, error);
+    });
+  }
+}
+
+// Send a ping to one hook, resolving to null once it answered or the error
+async function ping(hook, username) {
+  const payload = JSON.stringify({
+    event: "ping",
+    channel: null,
+    username,
+    body: "Webhook test from Echo",
+    timestamp: new Date().toISOString(),
+  });
+  return await deliver(hook, payload);
+}
+
+module.exports = { fire, ping };